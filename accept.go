@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Accepts returns the offered media type preferred by the client, according
+// to the "Accept" header of the request, or an empty string if the client
+// accepts none of them. The most specific media range in the header decides
+// the quality of each offer, so "text/html;q=0" excludes HTML even with "*/*".
+// Ties are resolved in favor of the first offer, and requests without the
+// header accept the first offer. Route.Produces uses the same negotiation.
+//
+// Example:
+//
+//	switch middleware.Accepts(r, "application/json", "text/html") {
+//	case "application/json":
+//	    json.NewEncoder(w).Encode(user)
+//	case "text/html":
+//	    tmpl.Execute(w, user)
+//	default:
+//	    http.Error(w, "Not Acceptable", http.StatusNotAcceptable)
+//	}
+func Accepts(r *http.Request, offers ...string) string {
+	return negotiate(r.Header.Values("Accept"), offers)
+}
+
+// AcceptsEncoding returns the offered content coding preferred by the client,
+// according to the "Accept-Encoding" header of the request, or an empty string
+// if the client accepts none of them. Ties are resolved in favor of the first
+// offer. The "*" entry matches the codings not listed in the header, and the
+// "identity" coding, which means no compression, is acceptable unless the
+// header excludes it with a zero quality. Requests without the header only
+// accept "identity", because many clients that omit the header do not support
+// compressed responses. The Compress middleware and the robots.txt and
+// sitemap handlers use the same negotiation.
+//
+// Example:
+//
+//	switch middleware.AcceptsEncoding(r, "br", "gzip", "identity") {
+//	case "br":
+//	    serveBrotli(w, r)
+//	case "gzip":
+//	    serveGzip(w, r)
+//	default:
+//	    serveRaw(w, r)
+//	}
+func AcceptsEncoding(r *http.Request, offers ...string) string {
+	accept := r.Header.Values("Accept-Encoding")
+
+	var best string
+	var bestQ float64
+
+	for _, offer := range offers {
+		q := encodingQuality(accept, offer)
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// encodingQuality returns the quality value of the content coding in the
+// values of the "Accept-Encoding" header, or zero if it is not acceptable.
+func encodingQuality(accept []string, coding string) float64 {
+	identity := strings.EqualFold(coding, "identity")
+	wildcard := -1.0
+
+	for _, value := range accept {
+		for _, part := range strings.Split(value, ",") {
+			params := strings.Split(part, ";")
+			name := strings.TrimSpace(params[0])
+
+			if name == "" {
+				continue
+			}
+
+			q := 1.0
+
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+
+				if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+					if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = f
+					}
+				}
+			}
+
+			if strings.EqualFold(name, coding) {
+				return q
+			}
+
+			if name == "*" {
+				wildcard = q
+			}
+		}
+	}
+
+	if wildcard >= 0 {
+		return wildcard
+	}
+
+	if identity {
+		return 1
+	}
+
+	return 0
+}
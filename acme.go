@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ACMEStore holds the key authorizations of the pending ACME HTTP-01
+// challenges, as defined in RFC 8555, section 8.3. Implement the interface to
+// share the challenges between multiple servers, for example, using a database.
+type ACMEStore interface {
+	// KeyAuthorization returns the key authorization for the token, if any.
+	KeyAuthorization(token string) (string, bool)
+}
+
+// ACMEChallenges is an in-memory ACMEStore safe for concurrent use. The zero
+// value is ready to use.
+type ACMEChallenges struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+// Set stores the key authorization of a challenge.
+func (c *ACMEChallenges) Set(token string, keyAuth string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tokens == nil {
+		c.tokens = map[string]string{}
+	}
+
+	c.tokens[token] = keyAuth
+}
+
+// Delete removes a challenge, usually after the certificate was issued.
+func (c *ACMEChallenges) Delete(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.tokens, token)
+}
+
+// KeyAuthorization implements the ACMEStore interface.
+func (c *ACMEChallenges) KeyAuthorization(token string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keyAuth, ok := c.tokens[token]
+
+	return keyAuth, ok
+}
+
+// ACMEChallenge registers the ACME HTTP-01 challenge endpoint for the default host.
+func (m *Middleware) ACMEChallenge(store ACMEStore) {
+	m.defaultRouter.ACMEChallenge(store)
+}
+
+// ACMEChallenge registers "/.well-known/acme-challenge/:token" to answer the
+// HTTP-01 challenges of a certificate authority, like Let's Encrypt, with the
+// key authorizations in the store. This allows external certificate managers,
+// like certbot or lego, to complete the challenges through the router while
+// the web server is listening on port 80. Unknown tokens receive a "404 Not
+// Found" response.
+//
+// Example:
+//
+//	challenges := &middleware.ACMEChallenges{}
+//	srv.ACMEChallenge(challenges)
+//	challenges.Set(token, keyAuth)
+func (r *router) ACMEChallenge(store ACMEStore) {
+	r.host().GET("/.well-known/acme-challenge/:token", func(w http.ResponseWriter, r *http.Request) {
+		token := Param(r, "token")
+
+		if !isACMEToken(token) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		keyAuth, ok := store.KeyAuthorization(token)
+
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write([]byte(keyAuth))
+	})
+}
+
+// isACMEToken reports whether the token only contains characters from the
+// base64url alphabet, which is the format required by RFC 8555.
+func isACMEToken(token string) bool {
+	if token == "" {
+		return false
+	}
+
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
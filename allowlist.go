@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// loopback is the list of networks allowed by AllowOnly when the list of
+// networks is empty, which restricts the access to the local machine.
+var loopback = []string{"127.0.0.0/8", "::1/128"}
+
+// AllowOnly returns a middleware that responds with "403 Forbidden" to every
+// request sent from an IP address outside the given networks. Each network is
+// either an IP address or an IP address range in CIDR notation. If the list is
+// empty, only requests from the local machine are allowed.
+//
+// The function panics if one of the networks is invalid, the same way the
+// router panics when a route is invalid, because it is a programming error.
+//
+// Example:
+//
+//	srv.Use(middleware.AllowOnly("10.0.0.0/8", "192.168.1.100"))
+func AllowOnly(networks ...string) func(http.Handler) http.Handler {
+	if len(networks) == 0 {
+		networks = loopback
+	}
+
+	allowed := make([]*net.IPNet, len(networks))
+
+	for i, network := range networks {
+		allowed[i] = mustParseNetwork(network)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := net.ParseIP(ClientIP(r))
+
+			for _, ipnet := range allowed {
+				if ip != nil && ipnet.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}
+}
+
+// mustParseNetwork converts an IP address or CIDR into an IP network, and
+// panics if the network is invalid.
+func mustParseNetwork(network string) *net.IPNet {
+	ipnet, err := parseNetwork(network)
+
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return ipnet
+}
+
+// parseNetwork converts an IP address or CIDR into an IP network.
+func parseNetwork(network string) (*net.IPNet, error) {
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+
+		if ip == nil {
+			return nil, errors.New("middleware: invalid IP address " + network)
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(network)
+
+	if err != nil {
+		return nil, errors.New("middleware: invalid network " + network)
+	}
+
+	return ipnet, nil
+}
+
+// ClientIP returns the IP address of the client that sent the request. The
+// address reported by a trusted proxy, if any, takes precedence over the
+// address of the peer connected to the web server. See TrustProxies.
+func ClientIP(r *http.Request) string {
+	if fwd, ok := r.Context().Value(forwardedKey).(*forwarded); ok && fwd.For != "" {
+		return fwd.For
+	}
+
+	return remoteIP(r)
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AuditLogger is an interface that allows users to store the audit records of
+// sensitive routes, separately from the access logs.
+type AuditLogger interface {
+	// Audit is called every time an audited route handles a request.
+	Audit(AuditRecord)
+}
+
+// AuditRecord represents a request to an audited route.
+//
+// The records are tamper-evident, every record contains the SHA-256 hash of
+// the previous record, and its own hash is computed over its content plus the
+// hash of the previous record. Modifying, removing, or reordering a record
+// breaks the chain, which can be verified with AuditRecord.Verify.
+type AuditRecord struct {
+	Time     time.Time         `json:"time"`
+	Actor    string            `json:"actor"`
+	ClientIP string            `json:"client_ip"`
+	Host     string            `json:"host"`
+	Method   string            `json:"method"`
+	Pattern  string            `json:"pattern"`
+	Path     string            `json:"path"`
+	Params   map[string]string `json:"params"`
+	Status   int               `json:"status"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// computeHash returns the SHA-256 hash of the record, excluding its own hash.
+func (a AuditRecord) computeHash() string {
+	a.Hash = ""
+	data, _ := json.Marshal(a)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify reports whether the record was not modified and follows the previous
+// record, which is the zero value for the first record.
+func (a AuditRecord) Verify(prev AuditRecord) bool {
+	return a.PrevHash == prev.Hash && a.Hash == a.computeHash()
+}
+
+// auditChain holds the hash of the latest audit record.
+type auditChain struct {
+	mu   sync.Mutex
+	last string
+}
+
+// Audit marks a route of the default host as audited, which means that every
+// request to the route produces a record that is delivered to AuditLogger.
+// The route must be registered before calling this function.
+func (m *Middleware) Audit(method string, endpoint string) {
+	m.defaultRouter.Audit(method, endpoint)
+}
+
+// Audit marks a route as audited, which means that every request to the route
+// produces a record that is delivered to Middleware.AuditLogger, including the
+// requests rejected by the middlewares attached with Middleware.Use. The
+// function panics if the route is not registered.
+func (r *router) Audit(method string, endpoint string) {
+	node := r.host().lookup(method, r.prefix+endpoint)
+
+	if node == nil {
+		panic("middleware: cannot audit unregistered route " + method + " " + endpoint)
+	}
+
+	node.audited = true
+}
+
+// lookup returns the trie node registered with the exact method and pattern.
+func (r *router) lookup(method string, endpoint string) *privTrieNode {
+	var found *privTrieNode
+
+	if t, ok := r.nodes[method]; ok {
+		t.root.walk(func(node *privTrieNode) {
+			if node.pattern == endpoint {
+				found = node
+			}
+		})
+	}
+
+	return found
+}
+
+// auditRequest is the state of a request to an audited route.
+type auditRequest struct {
+	start time.Time
+	mu    sync.Mutex
+	inner *http.Request
+}
+
+// wrap returns an HTTP handler that remembers the request received by the
+// route handler, whose context includes the authentication data added by the
+// middleware chain.
+func (a *auditRequest) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		a.inner = r
+		a.mu.Unlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAudit sends the audit record of a request to an audited route to the
+// audit logger. It runs after the middleware chain, so the requests rejected
+// by the chain, for example, with "401 Unauthorized" by an authentication
+// middleware, are recorded too. The actor is extracted from the request that
+// the route handler received, if any, or from the request before the chain.
+func (m *Middleware) writeAudit(a *auditRequest, pattern string, params map[string]string, rw *response, r *http.Request) {
+	if m.AuditLogger == nil {
+		return
+	}
+
+	a.mu.Lock()
+	if a.inner != nil {
+		r = a.inner
+	}
+	a.mu.Unlock()
+
+	record := AuditRecord{
+		Time:     a.start,
+		ClientIP: ClientIP(r),
+		Host:     r.Host,
+		Method:   r.Method,
+		Pattern:  pattern,
+		Path:     r.URL.Path,
+		Params:   params,
+		Status:   rw.status,
+	}
+
+	if m.AuditActor != nil {
+		record.Actor = m.AuditActor(r)
+	}
+
+	if record.Status == 0 {
+		// The handler did not write anything, so the client received "200 OK".
+		record.Status = http.StatusOK
+	}
+
+	m.audit.mu.Lock()
+	record.PrevHash = m.audit.last
+	record.Hash = record.computeHash()
+	m.audit.last = record.Hash
+	m.AuditLogger.Audit(record)
+	m.audit.mu.Unlock()
+}
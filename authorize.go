@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrUnauthenticated is the error returned by the authorizer, see Authorize,
+// when the request has no credentials, or they are invalid, in which case the
+// router responds with "401 Unauthorized" instead of "403 Forbidden".
+var ErrUnauthenticated = errors.New("middleware: unauthenticated")
+
+// Authorize sets the function that enforces the requirements of the routes,
+// like roles or scopes, declared with Route.Require. The function receives the
+// request, after the authentication middlewares attached with Use, and every
+// requirement of the matched route, and returns nil to allow the request,
+// ErrUnauthenticated, or an error that wraps it, to respond with "401
+// Unauthorized", or any other error to respond with "403 Forbidden". The
+// responses use http.Error, so they can be customized with ErrorPage.
+//
+// The requests to routes with requirements are denied with "403 Forbidden" if
+// there is no authorizer, so a missing configuration never exposes them.
+//
+// Example:
+//
+//	srv.Use(authenticate)
+//	srv.Authorize(func(r *http.Request, requirements []string) error {
+//	    user, ok := r.Context().Value(userKey).(*User)
+//	    if !ok {
+//	        return middleware.ErrUnauthenticated
+//	    }
+//	    for _, role := range requirements {
+//	        if !user.HasRole(role) {
+//	            return errors.New("missing role " + role)
+//	        }
+//	    }
+//	    return nil
+//	})
+//	srv.DELETE("/users/:id", deleteUser).Require("admin")
+func (m *Middleware) Authorize(fn func(*http.Request, []string) error) {
+	m.authorize = fn
+}
+
+// Require declares the requirements of the route, like roles or scopes, that
+// the authorizer set with Middleware.Authorize enforces before the handler
+// runs. Calls to Require accumulate, and the authorizer receives all of them,
+// which are also listed by Middleware.Routes, so the policy of the web server
+// can be reviewed in one place. The check runs in the position of the first
+// call among the options that wrap the handler, see Use.
+//
+// Example:
+//
+//	srv.GET("/invoices", listInvoices).Require("billing:read")
+//	srv.POST("/invoices", createInvoice).Require("billing:write", "admin")
+func (rt *Route) Require(requirements ...string) *Route {
+	rt.checkFrozen()
+
+	if len(requirements) == 0 {
+		return rt
+	}
+
+	if len(rt.requires) == 0 {
+		rt.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if authorized(w, r, rt.owner.authorize, rt.requires) {
+					next.ServeHTTP(w, r)
+				}
+			})
+		})
+	}
+
+	rt.requires = append(rt.requires, requirements...)
+
+	return rt
+}
+
+// Requirements returns a copy of the requirements declared with Require, or
+// nil if there are none.
+func (rt *Route) Requirements() []string {
+	if len(rt.requires) == 0 {
+		return nil
+	}
+
+	return append([]string(nil), rt.requires...)
+}
+
+// authorized checks the requirements with the authorizer, and responds with
+// "401 Unauthorized" or "403 Forbidden" if the request is denied.
+func authorized(w http.ResponseWriter, r *http.Request, authorize func(*http.Request, []string) error, requirements []string) bool {
+	if authorize == nil {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+
+	err := authorize(r, requirements)
+
+	if err == nil {
+		return true
+	}
+
+	LogNote(r, "authorization denied: %s", err)
+
+	if errors.Is(err, ErrUnauthenticated) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+
+	return false
+}
@@ -0,0 +1,12 @@
+// Package benchmarks compares the performance of the router against the
+// net/http ServeMux using static, parameterized, and glob routes.
+//
+// The package contains no code, only benchmarks, to keep the comparison out
+// of the main package and its dependencies. Run them with:
+//
+//	go test -bench . -benchmem ./benchmarks/
+//
+// The ServeMux does not support named parameters, so the parameterized routes
+// are emulated with a subtree pattern and a manual split of the URL path, which
+// is what most programs using the ServeMux do.
+package benchmarks
@@ -0,0 +1,91 @@
+package benchmarks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cixtor/middleware"
+)
+
+type discardResponseWriter struct {
+	head http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.head
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {}
+
+func noop(w http.ResponseWriter, r *http.Request) {}
+
+func newRouter() http.Handler {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/", noop)
+	srv.GET("/about/team", noop)
+	srv.GET("/users/:id/posts/:post", func(w http.ResponseWriter, r *http.Request) {
+		_ = middleware.Param(r, "id")
+		_ = middleware.Param(r, "post")
+	})
+	srv.GET("/static/*", noop)
+	return srv
+}
+
+func newServeMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", noop)
+	mux.HandleFunc("/about/team", noop)
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+		if len(parts) != 3 || parts[1] != "posts" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = parts[0], parts[2]
+	})
+	mux.HandleFunc("/static/", noop)
+	return mux
+}
+
+func benchmark(b *testing.B, h http.Handler, endpoint string) {
+	w := &discardResponseWriter{head: http.Header{}}
+	r := httptest.NewRequest(http.MethodGet, endpoint, nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		h.ServeHTTP(w, r)
+	}
+}
+
+func BenchmarkRouterStatic(b *testing.B) {
+	benchmark(b, newRouter(), "/about/team")
+}
+
+func BenchmarkServeMuxStatic(b *testing.B) {
+	benchmark(b, newServeMux(), "/about/team")
+}
+
+func BenchmarkRouterParam(b *testing.B) {
+	benchmark(b, newRouter(), "/users/12345/posts/67890")
+}
+
+func BenchmarkServeMuxParam(b *testing.B) {
+	benchmark(b, newServeMux(), "/users/12345/posts/67890")
+}
+
+func BenchmarkRouterGlob(b *testing.B) {
+	benchmark(b, newRouter(), "/static/css/bootstrap/bootstrap.min.css")
+}
+
+func BenchmarkServeMuxGlob(b *testing.B) {
+	benchmark(b, newServeMux(), "/static/css/bootstrap/bootstrap.min.css")
+}
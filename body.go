@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+// bodyKey is the key for the buffered request body in the request Context.
+var bodyKey = contextKey("MiddlewareBody")
+
+// BufferBody returns a middleware that reads the entire request body into
+// memory, so multiple middlewares, like signature verification, request
+// logging and data binding, can read it with BodyBytes without consuming it
+// for the handler. Requests with a body larger than maxSize bytes receive a
+// "413 Request Entity Too Large" response. If maxSize is zero or negative, the
+// limit is 10 MiB.
+//
+// Attach the middleware before the ones that read the body.
+//
+// Example:
+//
+//	srv.Use(middleware.BufferBody(1 << 20))
+//	srv.Use(func(next http.Handler) http.Handler {
+//	    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//	        log.Printf("payload: %s", middleware.BodyBytes(r))
+//	        next.ServeHTTP(w, r)
+//	    })
+//	})
+func BufferBody(maxSize int64) func(http.Handler) http.Handler {
+	if maxSize <= 0 {
+		maxSize = 10 << 20
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.ContentLength > maxSize {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			data, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+
+			if int64(len(data)) > maxSize {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			_ = r.Body.Close()
+
+			r = r.WithContext(context.WithValue(r.Context(), bodyKey, data))
+			r.Body = io.NopCloser(bytes.NewReader(data))
+			r.ContentLength = int64(len(data))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BodyBytes returns the request body buffered by BufferBody, or nil if the
+// body was not buffered. The function also rewinds the request body, so the
+// next middleware or handler that reads r.Body receives the entire data, even
+// if a previous middleware consumed it. The returned slice must not be
+// modified.
+func BodyBytes(r *http.Request) []byte {
+	data, ok := r.Context().Value(bodyKey).([]byte)
+
+	if !ok {
+		return nil
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(data))
+
+	return data
+}
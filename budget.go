@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// withBudget returns a shallow copy of the request whose context expires when
+// the time budget of the request runs out, which is Middleware.RequestBudget
+// or the timeout sent by the client if Middleware.RequestTimeoutHeaders is
+// enabled, whichever is shorter. The cancel function is nil if the request has
+// no budget.
+func (m *Middleware) withBudget(r *http.Request) (*http.Request, context.CancelFunc) {
+	budget := m.RequestBudget
+
+	if m.RequestTimeoutHeaders {
+		if d, ok := requestTimeout(r.Header); ok && (budget <= 0 || d < budget) {
+			budget = d
+		}
+	}
+
+	if budget <= 0 {
+		return r, nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), budget)
+
+	return r.WithContext(ctx), cancel
+}
+
+// requestTimeout returns the timeout sent by the client in the headers, either
+// "X-Request-Timeout" with a Go duration or a number of seconds, like "1.5s"
+// or "30", or "Grpc-Timeout" with a number and a unit, like "100m" for 100
+// milliseconds.
+func requestTimeout(h http.Header) (time.Duration, bool) {
+	if value := h.Get("X-Request-Timeout"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d, true
+		}
+
+		if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+			return time.Duration(secs * float64(time.Second)), true
+		}
+
+		return 0, false
+	}
+
+	return grpcTimeout(h.Get("Grpc-Timeout"))
+}
+
+// grpcTimeout parses the value of the "grpc-timeout" header, which is a
+// positive integer of at most 8 digits followed by one of the units: "H" for
+// hours, "M" for minutes, "S" for seconds, "m" for milliseconds, "u" for
+// microseconds, and "n" for nanoseconds.
+func grpcTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+
+	unit, ok := units[value[len(value)-1]]
+
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
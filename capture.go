@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// defaultCaptureSize is the maximum size of the bodies captured by CaptureBody
+// if the limit is zero or negative.
+const defaultCaptureSize = 4 << 10
+
+// CapturedBody is a response body captured by CaptureBody.
+type CapturedBody struct {
+	Time      time.Time
+	Duration  time.Duration
+	Method    string
+	Host      string
+	URL       string
+	Pattern   string
+	RequestID string
+	Status    int
+	Header    http.Header
+	Body      []byte
+	Truncated bool
+}
+
+// CaptureBody returns a middleware that captures the first bytes of the
+// response bodies, up to limit, or 4 KiB if the limit is zero or negative, and
+// passes them to the report function when the handler returns, which helps to
+// debug intermittent malformed responses in production.
+//
+// The match function decides which responses are captured, with the status
+// code and the headers of the response, before the body is written, so the
+// other responses are not buffered. If the match function is nil, the router
+// captures the responses with a status code of 500 or above. The Set-Cookie
+// header is never reported. The report function runs before the response is
+// logged, so it must not block.
+//
+// Example:
+//
+//	srv.Use(middleware.CaptureBody(8<<10, func(r *http.Request, status int, h http.Header) bool {
+//	    return status >= 500 || h.Get("X-Debug") != ""
+//	}, func(c middleware.CapturedBody) {
+//	    log.Printf("%s %s %d %q", c.Method, c.URL, c.Status, c.Body)
+//	}))
+func CaptureBody(limit int64, match func(*http.Request, int, http.Header) bool, report func(CapturedBody)) func(http.Handler) http.Handler {
+	if limit <= 0 {
+		limit = defaultCaptureSize
+	}
+
+	if match == nil {
+		match = func(r *http.Request, status int, h http.Header) bool {
+			return status >= http.StatusInternalServerError
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			cw := &captureResponse{ResponseWriter: rw, r: r, match: match, limit: limit}
+
+			next.ServeHTTP(cw, r)
+
+			if !cw.capturing {
+				return
+			}
+
+			c := CapturedBody{
+				Time:      start,
+				Duration:  time.Since(start),
+				Method:    r.Method,
+				Host:      r.Host,
+				URL:       r.URL.RequestURI(),
+				RequestID: RequestID(r),
+				Status:    cw.status,
+				Header:    redactHeader(rw.Header()),
+				Body:      cw.body.Bytes(),
+				Truncated: cw.truncated,
+			}
+
+			if w := findResponse(rw); w != nil {
+				c.RequestID = w.ensureRequestID(r)
+
+				if w.route != nil {
+					c.Pattern = w.route.pattern
+				}
+			}
+
+			report(c)
+		})
+	}
+}
+
+// captureResponse copies the beginning of the response body for CaptureBody,
+// if the response matches when the headers are written.
+type captureResponse struct {
+	http.ResponseWriter
+	r         *http.Request
+	match     func(*http.Request, int, http.Header) bool
+	limit     int64
+	status    int
+	capturing bool
+	body      bytes.Buffer
+	truncated bool
+}
+
+// WriteHeader implements the WriteHeader method for the http.ResponseWriter interface.
+func (c *captureResponse) WriteHeader(code int) {
+	if c.status == 0 && !isInformational(code) {
+		c.status = code
+		c.capturing = c.match(c.r, code, c.Header())
+	}
+
+	c.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the Write method for the http.ResponseWriter interface.
+func (c *captureResponse) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.capturing {
+		if room := c.limit - int64(c.body.Len()); int64(len(b)) > room {
+			c.body.Write(b[:room])
+			c.truncated = true
+		} else {
+			c.body.Write(b)
+		}
+	}
+
+	return c.ResponseWriter.Write(b)
+}
+
+// ReadFrom copies the data into the response, and delegates to the underlying
+// writer if the response is not captured, so STATIC can still use sendfile.
+func (c *captureResponse) ReadFrom(src io.Reader) (int64, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok && !c.capturing {
+		return rf.ReadFrom(src)
+	}
+
+	return io.Copy(writerOnly{c}, src)
+}
+
+// Flush sends the buffered data to the client.
+func (c *captureResponse) Flush() {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, without capturing.
+func (c *captureResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := c.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	return h.Hijack()
+}
+
+// Unwrap returns the original http.ResponseWriter.
+func (c *captureResponse) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"crypto/tls"
+)
+
+// Cert loads a certificate and its private key from a pair of PEM encoded
+// files, and associates them to the host. The certificate is presented to the
+// clients that request the host name via Server Name Indication (SNI), which
+// allows one TLS listener to serve many domains, each with its own
+// certificate. If the certificate is signed by a certificate authority, the
+// certFile should be the concatenation of the server's certificate, any
+// intermediates, and the CA's certificate.
+//
+// Example:
+//
+//	_ = srv.Host("a.example.com").Cert("a.crt", "a.key")
+//	_ = srv.Host("b.example.com").Cert("b.crt", "b.key")
+//	srv.ListenAndServeTLS(":443", "", "", nil)
+func (r *router) Cert(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	r.host().cert = &cert
+
+	return nil
+}
+
+// GetCertificate returns the certificate associated to the host name sent by
+// the client via SNI, or the certificate of the default host if there is no
+// such host. The method returns nil if neither has a certificate, in which
+// case the TLS server falls back to the certificates in tls.Config.
+//
+// ListenAndServeTLS uses it automatically when at least one host has a
+// certificate, unless the TLS configuration already has a GetCertificate
+// callback. Use it directly to configure a custom TLS listener.
+func (m *Middleware) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.hostsMu.RLock()
+	defer m.hostsMu.RUnlock()
+
+	if r, ok := m.hosts[normalizeHost(hello.ServerName)]; ok && r.cert != nil {
+		return r.cert, nil
+	}
+
+	return m.hosts[nohost].cert, nil
+}
+
+// hasCertificates reports whether at least one host has a certificate.
+func (m *Middleware) hasCertificates() bool {
+	m.hostsMu.RLock()
+	defer m.hostsMu.RUnlock()
+
+	for _, r := range m.hosts {
+		if r.cert != nil {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compress returns a middleware that compresses the responses with gzip when
+// the client accepts it, according to AcceptsEncoding, the response is not
+// already encoded, and the media type benefits from compression, like text,
+// JSON, JavaScript, XML or SVG.
+// Responses that declare a Content-Length smaller than 1 KiB are sent as they
+// are, because the compression overhead outweighs the savings, and so are the
+// partial responses, because the ranges refer to the uncompressed body.
+//
+// The access log records the size of the response before the compression in
+// AccessLog.BytesUncompressed, while AccessLog.BytesSent remains the number of
+// bytes sent to the client. The level is one of the gzip compression levels,
+// zero uses gzip.DefaultCompression.
+//
+// Example:
+//
+//	srv.Use(middleware.Compress(gzip.BestSpeed))
+func Compress(level int) func(http.Handler) http.Handler {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+		panic("middleware: invalid compression level " + strconv.Itoa(level))
+	}
+
+	pool := &sync.Pool{New: func() interface{} {
+		zw, _ := gzip.NewWriterLevel(nil, level)
+		return zw
+	}}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			if r.Method == http.MethodHead || AcceptsEncoding(r, "gzip") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressResponse{ResponseWriter: w, pool: pool, rw: findResponse(w)}
+
+			defer cw.close()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// compressResponse compresses the response body with gzip, if appropriate,
+// which is decided when the handler writes the response headers.
+type compressResponse struct {
+	http.ResponseWriter
+	pool    *sync.Pool
+	decided bool
+	zw      *gzip.Writer
+	rw      *response
+}
+
+// Unwrap returns the original http.ResponseWriter.
+func (c *compressResponse) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// WriteHeader decides whether to compress the response, then sends the status.
+func (c *compressResponse) WriteHeader(status int) {
+	if !c.decided && !isInformational(status) {
+		c.decide(status)
+	}
+
+	c.ResponseWriter.WriteHeader(status)
+}
+
+// decide enables the compression if the response is suitable for it.
+func (c *compressResponse) decide(status int) {
+	c.decided = true
+
+	h := c.Header()
+
+	if status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusSwitchingProtocols {
+		return
+	}
+
+	if status == http.StatusPartialContent || h.Get("Content-Range") != "" {
+		return
+	}
+
+	if h.Get("Content-Encoding") != "" || !compressible(h.Get("Content-Type")) {
+		return
+	}
+
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < 1024 {
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+
+	c.zw = c.pool.Get().(*gzip.Writer)
+	c.zw.Reset(c.ResponseWriter)
+
+	if c.rw != nil {
+		c.rw.compressed = true
+	}
+}
+
+// Write compresses the data, if necessary, and writes it into the response.
+func (c *compressResponse) Write(b []byte) (int, error) {
+	if !c.decided {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if c.zw == nil {
+		return c.ResponseWriter.Write(b)
+	}
+
+	n, err := c.zw.Write(b)
+
+	if c.rw != nil {
+		c.rw.uncompressed += n
+	}
+
+	return n, err
+}
+
+// Flush sends the compressed data buffered so far to the client.
+func (c *compressResponse) Flush() {
+	if c.zw != nil {
+		_ = c.zw.Flush()
+	}
+
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, without compression.
+func (c *compressResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := c.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	c.decided = true
+
+	return h.Hijack()
+}
+
+// close writes the gzip footer, if the response was compressed, and returns
+// the gzip writer to the pool.
+func (c *compressResponse) close() {
+	if c.zw != nil {
+		_ = c.zw.Close()
+		c.pool.Put(c.zw)
+		c.zw = nil
+	}
+}
+
+// compressible reports whether the media type benefits from compression.
+func compressible(contentType string) bool {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	if strings.HasPrefix(contentType, "text/") ||
+		strings.HasSuffix(contentType, "+json") ||
+		strings.HasSuffix(contentType, "+xml") {
+		return true
+	}
+
+	switch contentType {
+	case "application/json",
+		"application/javascript",
+		"application/xml",
+		"application/wasm",
+		"application/x-ndjson":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,275 @@
+package middleware
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RouteConflict describes a route that cannot match some, or all, of the
+// requests it was registered for, because of another route.
+type RouteConflict struct {
+	Host    string
+	Method  string
+	Pattern string
+	Reason  string
+}
+
+// String returns the conflict in a human-readable format.
+func (c RouteConflict) String() string {
+	host := ""
+
+	if c.Host != nohost {
+		host = c.Host
+	}
+
+	return c.Method + " " + host + c.Pattern + ": " + c.Reason
+}
+
+// RouteConflicts analyzes the routes of every host, and returns the routes that
+// are shadowed by other routes. The router prefers static segments over named
+// parameters, and named parameters over wildcards, one character at a time,
+// and never backtracks, so the following routes conflict:
+//
+//   - A named parameter, like "/users/:id", does not match the values that
+//     start with the same character as a static route in the same position,
+//     like "/users/new", because the request "/users/nick" follows "/users/n"
+//     and then fails.
+//   - A wildcard, like "/files/*", does not match anything if there is a named
+//     parameter without a constraint in the same position, like "/files/:name".
+//   - A named parameter shared with a route registered later with a different
+//     name or constraint, like "/users/:id" and "/users/:uid/posts", is
+//     received with the name and checked with the constraint of the latter.
+//   - A route registered twice is replaced by the second registration.
+//   - The same path registered under different methods with different names
+//     for the parameters, like "GET /u/:id" and "POST /u/:userID", makes the
+//     access logs grouped by pattern and the URL reversal ambiguous.
+//
+// The conflicts are written into ErrorLog when the web server starts, and the
+// server refuses to start if StrictRoutes is enabled.
+func (m *Middleware) RouteConflicts() []RouteConflict {
+	var out []RouteConflict
+
+	m.hostsMu.RLock()
+	defer m.hostsMu.RUnlock()
+
+	for host, router := range m.hosts {
+		for _, dup := range router.duplicates {
+			out = append(out, RouteConflict{
+				Host:    host,
+				Method:  dup.method,
+				Pattern: dup.pattern,
+				Reason:  "registered more than once, the last registration replaces the others",
+			})
+		}
+
+		shapes := map[string][]*Route{}
+
+		for method, t := range router.nodes {
+			t.root.walk(func(node *privTrieNode) {
+				shape := patternShape(node.pattern)
+				shapes[shape] = append(shapes[shape], node.route)
+			})
+
+			for _, c := range t.root.conflicts() {
+				c.Host, c.Method = host, method
+				out = append(out, c)
+			}
+
+			t.root.walk(func(node *privTrieNode) {
+				if reason := t.renamed(node.pattern); reason != "" {
+					out = append(out, RouteConflict{Host: host, Method: method, Pattern: node.pattern, Reason: reason})
+				}
+			})
+		}
+
+		for _, routes := range shapes {
+			for _, c := range paramNameConflicts(routes) {
+				c.Host = host
+				out = append(out, c)
+			}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Host != out[j].Host {
+			return out[i].Host < out[j].Host
+		}
+		if out[i].Pattern != out[j].Pattern {
+			return out[i].Pattern < out[j].Pattern
+		}
+		if out[i].Method != out[j].Method {
+			return out[i].Method < out[j].Method
+		}
+		return out[i].Reason < out[j].Reason
+	})
+
+	return out
+}
+
+// checkRouteConflicts writes the route conflicts into the error log, and
+// returns an error if there is any and StrictRoutes is enabled.
+func (m *Middleware) checkRouteConflicts() error {
+	conflicts := m.RouteConflicts()
+
+	for _, c := range conflicts {
+		m.logf("middleware: route conflict: %s", c)
+	}
+
+	if m.StrictRoutes && len(conflicts) > 0 {
+		return errors.New("middleware: refusing to start with " + strconv.Itoa(len(conflicts)) + " route conflicts")
+	}
+
+	return nil
+}
+
+// conflicts returns the routes shadowed by their siblings under this node and
+// its descendants. The host and method are set by the caller.
+func (n *privTrieNode) conflicts() []RouteConflict {
+	var out []RouteConflict
+
+	param := n.children[nps]
+	wildcard := n.children[all]
+
+	var chars []string
+	var examples []string
+
+	for char, child := range n.children {
+		if char == nps || char == all {
+			continue
+		}
+
+		chars = append(chars, strconv.Quote(string(char)))
+
+		child.walk(func(node *privTrieNode) {
+			examples = append(examples, node.pattern)
+		})
+	}
+
+	sort.Strings(chars)
+	sort.Strings(examples)
+
+	if len(examples) > 3 {
+		examples = append(examples[:3], "…")
+	}
+
+	if param != nil && len(chars) > 0 {
+		reason := "the parameter " + paramLabel(param.parameter, param.constraint) + " does not match values that start with " +
+			strings.Join(chars, ", ") + ", unless they match one of " + strings.Join(examples, ", ") +
+			", because the router prefers static segments and does not backtrack"
+
+		param.walk(func(node *privTrieNode) {
+			out = append(out, RouteConflict{Pattern: node.pattern, Reason: reason})
+		})
+	}
+
+	if wildcard != nil && wildcard.isTheEnd && param != nil && param.matcher == nil {
+		out = append(out, RouteConflict{
+			Pattern: wildcard.pattern,
+			Reason:  "unreachable, the parameter " + paramLabel(param.parameter, param.constraint) + " in the same position takes precedence and the router does not backtrack",
+		})
+	} else if wildcard != nil && wildcard.isTheEnd && len(chars) > 0 {
+		out = append(out, RouteConflict{
+			Pattern: wildcard.pattern,
+			Reason: "the wildcard does not match paths that start with " + strings.Join(chars, ", ") +
+				", unless they match one of " + strings.Join(examples, ", ") + ", because the router does not backtrack",
+		})
+	}
+
+	for _, child := range n.children {
+		out = append(out, child.conflicts()...)
+	}
+
+	return out
+}
+
+// renamed returns the reason why the named parameters of the pattern are
+// received with a different name, or an empty string if they are not.
+func (t *privTrie) renamed(pattern string) string {
+	node := t.root
+	total := len(pattern)
+
+	for i := 0; i < total && node != nil; i++ {
+		char := pattern[i]
+
+		if char == nps && pattern[i-1] == sep {
+			j := i + 1
+			for ; j < total && pattern[j] != sep; j++ {
+			}
+			name, constraint := splitParam(pattern[i+1 : j])
+			i = j - 1
+
+			node = node.children[nps]
+
+			if node != nil && (node.parameter != name || node.constraint != constraint) {
+				by := ""
+				label := paramLabel(node.parameter, node.constraint)
+
+				node.walk(func(other *privTrieNode) {
+					if by == "" && strings.Contains(other.pattern, label) {
+						by = other.pattern
+					}
+				})
+
+				return "the parameter " + paramLabel(name, constraint) + " is received as " + label + " because of " + by
+			}
+
+			continue
+		}
+
+		node = node.children[char]
+
+		if char == all && pattern[i-1] == sep {
+			break
+		}
+	}
+
+	return ""
+}
+
+// paramNameConflicts returns the routes registered for the same path under
+// different methods, with different names for the parameters.
+func paramNameConflicts(routes []*Route) []RouteConflict {
+	var out []RouteConflict
+
+	for _, rt := range routes {
+		var others []string
+
+		for _, other := range routes {
+			if stripConstraints(other.pattern) != stripConstraints(rt.pattern) {
+				others = append(others, other.method+" "+other.pattern)
+			}
+		}
+
+		if len(others) == 0 {
+			continue
+		}
+
+		sort.Strings(others)
+
+		out = append(out, RouteConflict{
+			Method:  rt.method,
+			Pattern: rt.pattern,
+			Reason:  "the parameters have different names in " + strings.Join(others, ", ") + ", which makes the logs and the URL reversal ambiguous",
+		})
+	}
+
+	return out
+}
+
+// patternShape returns the pattern without the names of the parameters, so
+// the patterns that match the same paths have the same shape.
+func patternShape(pattern string) string {
+	segments := strings.Split(pattern, "/")
+
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = ":"
+		} else if strings.HasPrefix(segment, "*") {
+			segments[i] = "*"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
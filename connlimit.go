@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LimitConnectionRate limits the number of new connections that each client
+// IP address can open per second, with bursts of up to the given number of
+// connections. The connections over the limit are closed as soon as they are
+// accepted, before the TLS handshake and before reading the request, so the
+// aggressive clients cannot make the web server spend resources parsing their
+// requests. This complements RateLimit, which counts requests instead of
+// connections, because a client can send many requests over the same
+// connection.
+//
+// The client is identified by the address of the TCP connection, so do not
+// use this behind a load balancer or a reverse proxy, which opens all the
+// connections from the same address.
+//
+// Example:
+//
+//	srv.LimitConnectionRate(10, 20)
+func (m *Middleware) LimitConnectionRate(perSecond float64, burst int) {
+	if perSecond <= 0 || burst <= 0 {
+		panic("middleware: invalid connection rate " + strconv.FormatFloat(perSecond, 'f', -1, 64) + " per second, with bursts of " + strconv.Itoa(burst))
+	}
+
+	m.connLimiter = &connLimiter{
+		rate:    perSecond,
+		burst:   float64(burst),
+		buckets: map[string]*connBucket{},
+	}
+}
+
+// allowConn reports whether the connection is within the limits of its IP.
+func (m *Middleware) allowConn(conn net.Conn) bool {
+	if m.connLimiter == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		// not an IP connection, like a Unix domain socket.
+		return true
+	}
+
+	return m.connLimiter.allow(host, m.now())
+}
+
+// connLimiter is a token bucket for each client IP address, which is refilled
+// at the rate of connections per second, up to the burst.
+type connLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*connBucket
+	sweep   int
+}
+
+// connBucket is the number of connections a client can still open.
+type connBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket of the IP address, if there is any.
+func (l *connLimiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[ip]
+
+	if !ok {
+		if len(l.buckets) >= l.sweep {
+			l.removeFull(now)
+		}
+
+		b = &connBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens = l.refill(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// refill returns the number of tokens in the bucket at the given time.
+func (l *connLimiter) refill(b *connBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+
+	if tokens > l.burst {
+		return l.burst
+	}
+
+	return tokens
+}
+
+// removeFull forgets the IP addresses that have not opened a connection for
+// burst/rate seconds, because their buckets refilled and a new bucket would
+// start with the same tokens. Without it, a scan from many addresses would
+// keep one bucket per address forever. The sweep runs again once the table
+// is twice as large as the addresses that survived this one.
+func (l *connLimiter) removeFull(now time.Time) {
+	for ip, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+
+	l.sweep = 2*len(l.buckets) + 64
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// paramConstraints is the list of named constraints for the parameters, which
+// are easier to read than the equivalent regular expressions.
+//
+// Example:
+//
+//	/posts/:id(int)
+//	/posts/:slug(slug)
+var paramConstraints = map[string]string{
+	"int":   `[0-9]+`,
+	"alpha": `[A-Za-z]+`,
+	"alnum": `[A-Za-z0-9]+`,
+	"hex":   `[0-9A-Fa-f]+`,
+	"slug":  `[a-z0-9]+(?:-[a-z0-9]+)*`,
+	"uuid":  `[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}`,
+}
+
+// splitParam separates the name and the constraint of a named parameter, like
+// "id" and "[0-9]+" in "id([0-9]+)". The constraint is empty if there is none.
+func splitParam(segment string) (string, string) {
+	i := strings.IndexByte(segment, '(')
+
+	if i < 0 || !strings.HasSuffix(segment, ")") {
+		return segment, ""
+	}
+
+	return segment[:i], segment[i+1 : len(segment)-1]
+}
+
+// paramLabel returns the named parameter as it is written in the pattern.
+func paramLabel(name string, constraint string) string {
+	if constraint == "" {
+		return ":" + name
+	}
+
+	return ":" + name + "(" + constraint + ")"
+}
+
+// compileConstraint returns the regular expression that matches the complete
+// value of a parameter, either a named constraint or a regular expression.
+func compileConstraint(constraint string) (*regexp.Regexp, error) {
+	if expr, ok := paramConstraints[constraint]; ok {
+		constraint = expr
+	}
+
+	// compile the expression alone first, so unbalanced parentheses cannot
+	// escape the anchors, like "a)|(b".
+	_, err := regexp.Compile(constraint)
+
+	if err != nil {
+		return nil, errors.New("middleware: invalid constraint (" + constraint + "): " + err.Error())
+	}
+
+	return regexp.MustCompile(`^(?:` + constraint + `)$`), nil
+}
+
+// stripConstraints returns the pattern without the constraints of the named
+// parameters, like "/users/:id" for "/users/:id(int)".
+func stripConstraints(pattern string) string {
+	if strings.IndexByte(pattern, '(') < 0 {
+		return pattern
+	}
+
+	segments := strings.Split(pattern, "/")
+
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name, _ := splitParam(segment[1:])
+			segments[i] = ":" + name
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures the Cross-Origin Resource Sharing headers, which allow
+// web browsers to send requests to the web server from other origins.
+type CORSConfig struct {
+	// AllowedOrigins is the list of origins allowed to send requests, e.g.
+	// "https://app.example.com". Use "*" to allow any origin.
+	AllowedOrigins []string
+	// AllowedHeaders is the list of request headers allowed in preflight
+	// requests. If empty, the headers requested by the browser are allowed.
+	AllowedHeaders []string
+	// ExposedHeaders is the list of response headers that the browser exposes
+	// to the JavaScript code, in addition to the CORS-safelisted headers.
+	ExposedHeaders []string
+	// AllowCredentials allows the requests to include cookies and the
+	// Authorization header. It cannot be combined with the "*" origin.
+	AllowCredentials bool
+	// MaxAge is the duration the browser caches the preflight response.
+	MaxAge time.Duration
+}
+
+// CORS enables Cross-Origin Resource Sharing. The router answers preflight
+// requests, which are OPTIONS requests with an "Access-Control-Request-Method"
+// header, with "204 No Content" and an "Access-Control-Allow-Methods" header
+// derived from the methods registered for the requested path, so the list
+// never drifts from the routes. Preflight requests for paths without routes
+// receive "404 Not Found". Other requests from an allowed origin receive the
+// "Access-Control-Allow-Origin" header.
+//
+// The function panics if AllowCredentials is combined with the "*" origin,
+// which would allow every website to send requests with the cookies of the
+// users.
+//
+// Example:
+//
+//	srv.CORS(middleware.CORSConfig{
+//	    AllowedOrigins: []string{"https://app.example.com"},
+//	    MaxAge:         time.Hour,
+//	})
+func (m *Middleware) CORS(cfg CORSConfig) {
+	if cfg.AllowCredentials && cfg.allowOrigin("*") {
+		panic("middleware: CORS credentials cannot be allowed for any origin")
+	}
+
+	m.cors = &cfg
+}
+
+// allowOrigin reports whether the origin can send requests.
+func (c *CORSConfig) allowOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleCORS adds the CORS headers to the response, and reports whether the
+// request was a preflight request, which is answered here.
+func (m *Middleware) handleCORS(router *router, w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if origin == "" {
+		return false
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+	if !m.cors.allowOrigin(origin) {
+		if preflight {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+		return preflight
+	}
+
+	if m.cors.allowOrigin("*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if m.cors.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !preflight {
+		if len(m.cors.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(m.cors.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	var methods []string
+
+	if urlPath := m.requestPath(r); urlPath != "" && urlPath[0] == '/' {
+		methods = router.allowedMethods(urlPath, !m.DisableAutoHead)
+	}
+
+	if len(methods) == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return true
+	}
+
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+	if len(m.cors.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(m.cors.AllowedHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	if m.cors.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(m.cors.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
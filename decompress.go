@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Decompress returns a middleware that decompresses the request body sent by
+// clients with the "Content-Encoding" header set to either "gzip" or
+// "deflate", so the handlers can read the original data. Requests using any
+// other encoding receive a "415 Unsupported Media Type" response, and requests
+// with a malformed compression header receive a "400 Bad Request" response.
+//
+// The decompressed body is limited to maxSize bytes, which protects the server
+// against decompression bombs, a small payload that expands into gigabytes of
+// data. Reading past the limit returns an error, like http.MaxBytesReader. If
+// maxSize is zero or negative, the limit is 10 MiB.
+//
+// Example:
+//
+//	srv.Use(middleware.Decompress(1 << 20))
+func Decompress(maxSize int64) func(http.Handler) http.Handler {
+	if maxSize <= 0 {
+		maxSize = 10 << 20
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+			var body io.ReadCloser
+
+			switch encoding {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case "gzip", "x-gzip":
+				zr, err := gzip.NewReader(r.Body)
+
+				if err != nil {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+
+				body = zr
+			case "deflate":
+				// HTTP calls "deflate" the zlib format defined in RFC 1950.
+				zr, err := zlib.NewReader(r.Body)
+
+				if err != nil {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+
+				body = zr
+			default:
+				http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+				return
+			}
+
+			defer body.Close()
+
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			r.Body = http.MaxBytesReader(w, body, maxSize)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
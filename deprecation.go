@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Deprecation describes a deprecated route. See Route.Deprecated.
+type Deprecation struct {
+	// Since is the date when the route was deprecated. If zero, the date when
+	// the route was marked as deprecated is used.
+	Since time.Time
+	// Sunset is the date when the route will stop working, if known.
+	Sunset time.Time
+	// Link is the URL of the route or the document that replaces this route.
+	Link string
+}
+
+// deprecation holds the pre-computed headers and the usage of a deprecated
+// route.
+type deprecation struct {
+	deprecation string
+	sunset      string
+	link        string
+	count       uint64
+	lastUsed    int64
+}
+
+// DeprecatedUsage is the number of requests received by a deprecated route.
+type DeprecatedUsage struct {
+	Host     string
+	Method   string
+	Pattern  string
+	Count    uint64
+	LastUsed time.Time
+}
+
+// Deprecated marks the route as deprecated. Every response of the route has
+// the "Deprecation" header defined in RFC 9745, the "Sunset" header defined in
+// RFC 8594 when the sunset date is known, and a "Link" header pointing to the
+// replacement, and the requests are counted, so Middleware.DeprecatedUsage can
+// tell which clients still have to migrate.
+//
+// Example:
+//
+//	srv.GET("/v1/users", listUsersV1).Deprecated(middleware.Deprecation{
+//	    Sunset: time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC),
+//	    Link:   "https://api.example.com/v2/users",
+//	})
+func (rt *Route) Deprecated(d Deprecation) *Route {
+	rt.checkFrozen()
+
+	if d.Since.IsZero() {
+		d.Since = time.Now()
+	}
+
+	dep := &deprecation{deprecation: "@" + strconv.FormatInt(d.Since.Unix(), 10)}
+
+	if !d.Sunset.IsZero() {
+		dep.sunset = d.Sunset.UTC().Format(http.TimeFormat)
+	}
+
+	if d.Link != "" {
+		dep.link = "<" + d.Link + ">; rel=\"successor-version\""
+	}
+
+	rt.deprecation = dep
+
+	return rt
+}
+
+// use adds the deprecation headers to the response and counts the request.
+func (d *deprecation) use(w http.ResponseWriter, now time.Time) {
+	h := w.Header()
+	h.Set("Deprecation", d.deprecation)
+
+	if d.sunset != "" {
+		h.Set("Sunset", d.sunset)
+	}
+
+	if d.link != "" {
+		h.Add("Link", d.link)
+	}
+
+	atomic.AddUint64(&d.count, 1)
+	atomic.StoreInt64(&d.lastUsed, now.UnixNano())
+}
+
+// DeprecatedUsage returns the number of requests received by each deprecated
+// route since the web server started, sorted by host, pattern and method,
+// which helps to track the migration of the clients to the replacements.
+func (m *Middleware) DeprecatedUsage() []DeprecatedUsage {
+	var out []DeprecatedUsage
+
+	m.hostsMu.RLock()
+	defer m.hostsMu.RUnlock()
+
+	for host, router := range m.hosts {
+		for method, trie := range router.nodes {
+			trie.root.walk(func(node *privTrieNode) {
+				if node.route == nil || node.route.deprecation == nil {
+					return
+				}
+
+				dep := node.route.deprecation
+				usage := DeprecatedUsage{
+					Host:    host,
+					Method:  method,
+					Pattern: node.pattern,
+					Count:   atomic.LoadUint64(&dep.count),
+				}
+
+				if last := atomic.LoadInt64(&dep.lastUsed); last > 0 {
+					usage.LastUsed = time.Unix(0, last)
+				}
+
+				out = append(out, usage)
+			})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Host != out[j].Host {
+			return out[i].Host < out[j].Host
+		}
+		if out[i].Pattern != out[j].Pattern {
+			return out[i].Pattern < out[j].Pattern
+		}
+		return out[i].Method < out[j].Method
+	})
+
+	return out
+}
@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Environment variables read by NewFromEnv.
+const (
+	EnvAddress           = "MIDDLEWARE_ADDRESS"
+	EnvReadTimeout       = "MIDDLEWARE_READ_TIMEOUT"
+	EnvReadHeaderTimeout = "MIDDLEWARE_READ_HEADER_TIMEOUT"
+	EnvWriteTimeout      = "MIDDLEWARE_WRITE_TIMEOUT"
+	EnvIdleTimeout       = "MIDDLEWARE_IDLE_TIMEOUT"
+	EnvShutdownTimeout   = "MIDDLEWARE_SHUTDOWN_TIMEOUT"
+	EnvTLSCert           = "MIDDLEWARE_TLS_CERT"
+	EnvTLSKey            = "MIDDLEWARE_TLS_KEY"
+	EnvTrustedProxies    = "MIDDLEWARE_TRUSTED_PROXIES"
+	EnvLogFormat         = "MIDDLEWARE_LOG_FORMAT"
+)
+
+// defaultEnvAddress is the address used by ListenAndServeFromEnv when neither
+// MIDDLEWARE_ADDRESS nor PORT are set.
+const defaultEnvAddress = ":8080"
+
+// NewFromEnv returns a new Middleware configured with environment variables,
+// for deployments that follow the twelve-factor methodology. Unset variables
+// keep the default values of New.
+//
+//   - MIDDLEWARE_ADDRESS: address for ListenAndServeFromEnv, e.g. ":3000".
+//     If empty, ":$PORT" is used when PORT is set, and ":8080" otherwise.
+//   - MIDDLEWARE_READ_TIMEOUT, MIDDLEWARE_READ_HEADER_TIMEOUT,
+//     MIDDLEWARE_WRITE_TIMEOUT, MIDDLEWARE_IDLE_TIMEOUT and
+//     MIDDLEWARE_SHUTDOWN_TIMEOUT: server timeouts, e.g. "5s" or "250ms".
+//   - MIDDLEWARE_TLS_CERT and MIDDLEWARE_TLS_KEY: certificate and private
+//     key files. When both are set, ListenAndServeFromEnv starts a TLS server.
+//   - MIDDLEWARE_TRUSTED_PROXIES: comma-separated list of networks passed to
+//     TrustProxies, e.g. "10.0.0.0/8,192.168.1.1".
+//   - MIDDLEWARE_LOG_FORMAT: format of the access logs, one of "basic" (the
+//     default), "common", "combined" or "none".
+//
+// The function returns an error naming the variable if one of the values is
+// invalid. The options, if any, are applied after the environment variables.
+//
+// Example:
+//
+//	srv, err := middleware.NewFromEnv()
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	srv.GET("/", index)
+//	srv.ListenAndServeFromEnv()
+func NewFromEnv(options ...Option) (*Middleware, error) {
+	m := New()
+
+	timeouts := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{EnvReadTimeout, &m.ReadTimeout},
+		{EnvReadHeaderTimeout, &m.ReadHeaderTimeout},
+		{EnvWriteTimeout, &m.WriteTimeout},
+		{EnvIdleTimeout, &m.IdleTimeout},
+		{EnvShutdownTimeout, &m.ShutdownTimeout},
+	}
+
+	for _, timeout := range timeouts {
+		value := os.Getenv(timeout.name)
+
+		if value == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+
+		if err != nil || d < 0 {
+			return nil, envError(timeout.name, value, "expecting a duration like \"5s\"")
+		}
+
+		*timeout.value = d
+	}
+
+	m.envAddress = os.Getenv(EnvAddress)
+
+	if m.envAddress == "" {
+		if port := os.Getenv("PORT"); port != "" {
+			m.envAddress = ":" + port
+		} else {
+			m.envAddress = defaultEnvAddress
+		}
+	}
+
+	m.envCertFile = os.Getenv(EnvTLSCert)
+	m.envKeyFile = os.Getenv(EnvTLSKey)
+
+	if (m.envCertFile == "") != (m.envKeyFile == "") {
+		return nil, errors.New("middleware: " + EnvTLSCert + " and " + EnvTLSKey + " must be set together")
+	}
+
+	for _, name := range []string{EnvTLSCert, EnvTLSKey} {
+		if filename := os.Getenv(name); filename != "" {
+			if _, err := os.Stat(filename); err != nil {
+				return nil, envError(name, filename, err.Error())
+			}
+		}
+	}
+
+	if value := os.Getenv(EnvTrustedProxies); value != "" {
+		for _, network := range strings.Split(value, ",") {
+			ipnet, err := parseNetwork(strings.TrimSpace(network))
+
+			if err != nil {
+				return nil, envError(EnvTrustedProxies, value, err.Error())
+			}
+
+			m.trustedProxies = append(m.trustedProxies, ipnet)
+		}
+	}
+
+	switch value := os.Getenv(EnvLogFormat); value {
+	case "", "basic":
+	case "common":
+		m.Logger = &BasicLogger{logger: log.New(os.Stdout, "", 0), format: AccessLog.CommonLog}
+	case "combined":
+		m.Logger = &BasicLogger{logger: log.New(os.Stdout, "", 0), format: AccessLog.CombinedLog}
+	case "none":
+		m.DiscardLogs()
+	default:
+		return nil, envError(EnvLogFormat, value, "expecting basic, common, combined or none")
+	}
+
+	for _, option := range options {
+		option(m)
+	}
+
+	return m, nil
+}
+
+// envError returns the error for an invalid environment variable.
+func envError(name string, value string, reason string) error {
+	return errors.New("middleware: invalid " + name + "=" + value + ": " + reason)
+}
+
+// ListenAndServeFromEnv starts the web server on the address configured with
+// the environment variables read by NewFromEnv, using TLS if the certificate
+// and private key were set.
+func (m *Middleware) ListenAndServeFromEnv() error {
+	address := m.envAddress
+
+	if address == "" {
+		address = defaultEnvAddress
+	}
+
+	if m.envCertFile != "" {
+		return m.ListenAndServeTLS(address, m.envCertFile, m.envKeyFile, nil)
+	}
+
+	return m.ListenAndServe(address)
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorPage sets the HTTP handler that renders the error responses with the
+// given status code, like "400 Bad Request", "403 Forbidden", "404 Not Found",
+// "405 Method Not Allowed", "413 Payload Too Large", "500 Internal Server
+// Error" or "503 Service Unavailable".
+//
+// The page replaces every error response written with http.Error, which is
+// what the router, STATIC, and the middlewares of this package use, as well as
+// handlers that call http.Error or http.NotFound themselves. Responses written
+// differently, for example, an API handler that returns a JSON error, are sent
+// as they are. The page is always sent with the original status code.
+//
+// Example:
+//
+//	srv.ErrorPage(http.StatusNotFound, notFoundPage)
+//	srv.ErrorPage(http.StatusInternalServerError, serverErrorPage)
+func (m *Middleware) ErrorPage(status int, handler http.Handler) {
+	if status < 400 || status > 599 {
+		panic("middleware: invalid error page status " + strconv.Itoa(status))
+	}
+
+	if m.errorPages == nil {
+		m.errorPages = map[int]http.Handler{}
+	}
+
+	m.errorPages[status] = handler
+}
+
+// isErrorText reports whether the response headers are the ones set by
+// http.Error, right before it writes the status code and the error message.
+func isErrorText(h http.Header) bool {
+	return h.Get("X-Content-Type-Options") == "nosniff" &&
+		strings.HasPrefix(h.Get("Content-Type"), "text/plain")
+}
+
+// serveErrorPage writes the error page instead of the error message that the
+// handler was about to write, which is then discarded. The page is written
+// directly into the response, bypassing the middlewares that wrap the writer,
+// like Compress, so the encoding of the error message does not apply to it.
+func (w *response) serveErrorPage(page http.Handler, status int) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("X-Content-Type-Options")
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	w.compressed = false
+
+	// prevent the error page from replacing its own response.
+	w.errorPages = nil
+
+	page.ServeHTTP(&errorPageWriter{response: w, status: status}, w.request)
+
+	if w.status == 0 {
+		w.WriteHeader(status)
+	}
+
+	w.replaced = true
+}
+
+// errorPageWriter forces the status code of the error page.
+type errorPageWriter struct {
+	*response
+	status int
+}
+
+// WriteHeader sends the status code of the original error.
+func (w *errorPageWriter) WriteHeader(int) {
+	w.response.WriteHeader(w.status)
+}
+
+// Write writes the error page, sending the status code first if necessary.
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if w.response.status == 0 {
+		w.response.WriteHeader(w.status)
+	}
+
+	return w.response.Write(b)
+}
+
+// ReadFrom writes the error page, sending the status code first if necessary.
+func (w *errorPageWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.response.status == 0 {
+		w.response.WriteHeader(w.status)
+	}
+
+	return w.response.ReadFrom(src)
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serverVars holds the runtime counters exposed by EnableExpvar.
+//
+// The variables are not published in the global expvar registry because the
+// registry panics when two variables share the same name, which would prevent
+// programs from running more than one server in the same process.
+type serverVars struct {
+	all         *expvar.Map
+	requests    *expvar.Map
+	connections *expvar.Int
+}
+
+// newServerVars returns a new set of runtime counters.
+func newServerVars() *serverVars {
+	start := time.Now()
+
+	v := &serverVars{
+		all:         new(expvar.Map).Init(),
+		requests:    new(expvar.Map).Init(),
+		connections: new(expvar.Int),
+	}
+
+	v.all.Set("requests", v.requests)
+	v.all.Set("active_connections", v.connections)
+	v.all.Set("uptime", expvar.Func(func() interface{} {
+		return time.Since(start).Seconds()
+	}))
+
+	return v
+}
+
+// countRequest increments the number of requests with the given status code.
+func (v *serverVars) countRequest(status int) {
+	if status == 0 {
+		// The handler did not write anything, so the client received "200 OK".
+		status = http.StatusOK
+	}
+
+	v.requests.Add(strconv.Itoa(status), 1)
+}
+
+// connState tracks the number of active client connections, and closes the
+// new connections over the limit set with LimitConnectionRate.
+func (m *Middleware) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateNew && !m.allowConn(conn) {
+		// the server notices the closed connection when it reads the request.
+		_ = conn.Close()
+	}
+
+	if m.vars == nil {
+		return
+	}
+
+	switch state {
+	case http.StateNew:
+		m.vars.connections.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		m.vars.connections.Add(-1)
+	}
+}
+
+// EnableExpvar registers an endpoint in the default host that exposes runtime
+// statistics in JSON format, the same way the expvar package does, including
+// the command line arguments, the memory allocator statistics, and any other
+// variable published by the program. Additionally, the "middleware" variable
+// contains the number of requests grouped by status code, the number of
+// active connections, and the uptime of the server in seconds.
+//
+// The endpoint is restricted to the given networks, which are passed to the
+// AllowOnly function. If the list is empty, only the local machine is allowed
+// to access the data.
+//
+// Example:
+//
+//	srv.EnableExpvar("/debug/vars", "10.0.0.0/8")
+func (m *Middleware) EnableExpvar(endpoint string, allowed ...string) {
+	if m.vars == nil {
+		m.vars = newServerVars()
+	}
+
+	handler := AllowOnly(allowed...)(http.HandlerFunc(m.expvarHandler))
+
+	m.GET(endpoint, handler.ServeHTTP)
+}
+
+// expvarHandler writes all the expvar variables plus the server statistics.
+func (m *Middleware) expvarHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	fmt.Fprintf(w, "{\n")
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+
+	fmt.Fprintf(w, "%q: %s\n}\n", "middleware", m.vars.all)
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// HostFallback is the behavior of the router for requests whose Host header
+// does not match any of the hosts registered with Middleware.Host.
+type HostFallback int
+
+const (
+	// FallbackDefaultHost handles the request with the router of the default
+	// host, or the host selected with Middleware.DefaultHost.
+	FallbackDefaultHost HostFallback = iota
+	// FallbackNotFound responds with "404 Not Found", or Middleware.NotFound.
+	FallbackNotFound
+	// FallbackMisdirected responds with "421 Misdirected Request", which tells
+	// the client that the server is not able to produce a response for the
+	// host, for example, because the TLS connection was reused for a different
+	// host name.
+	FallbackMisdirected
+	// FallbackRedirect redirects the client to the same URL in the host set in
+	// Middleware.CanonicalHost, or the host selected with DefaultHost.
+	FallbackRedirect
+)
+
+// DefaultHost promotes a host to be the fallback for requests whose Host
+// header does not match any of the registered hosts, instead of the router of
+// the default host, registering the host if necessary. The routes registered
+// directly with the Middleware are still available via the Host "_".
+//
+// Example:
+//
+//	srv.Host("www.example.com").GET("/", index)
+//	srv.DefaultHost("www.example.com")
+func (m *Middleware) DefaultHost(tld string) *router {
+	r := m.Host(tld)
+
+	m.hostsMu.Lock()
+	m.defaultHost = normalizeHost(tld)
+	m.hostsMu.Unlock()
+
+	return r
+}
+
+// fallback returns the router, and its host, or the HTTP handler that must
+// process a request for a host that is not registered.
+func (m *Middleware) fallback(r *http.Request) (string, *router, http.Handler) {
+	switch m.HostFallback {
+	case FallbackNotFound:
+		return nohost, nil, m.notFoundHandler(nil)
+	case FallbackMisdirected:
+		return nohost, nil, http.HandlerFunc(misdirectedRequest)
+	case FallbackRedirect:
+		canonical := m.CanonicalHost
+
+		if canonical == "" {
+			canonical = m.defaultHost
+		}
+
+		if canonical == "" {
+			return nohost, nil, http.HandlerFunc(misdirectedRequest)
+		}
+
+		return nohost, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status := http.StatusPermanentRedirect
+
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				status = http.StatusMovedPermanently
+			}
+
+			http.Redirect(w, r, Scheme(r)+"://"+canonical+r.URL.RequestURI(), status)
+		})
+	}
+
+	host := nohost
+
+	if m.defaultHost != "" {
+		host = m.defaultHost
+	}
+
+	return host, m.hosts[host], nil
+}
+
+// misdirectedRequest responds with "421 Misdirected Request".
+func misdirectedRequest(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+}
@@ -0,0 +1,279 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedKey is the key for the forwarded information in the request Context.
+var forwardedKey = contextKey("MiddlewareForwarded")
+
+// forwarded is the information about the original request, as reported by
+// the reverse proxies in front of the web server.
+type forwarded struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+// TrustProxies enables the parsing of the "Forwarded" header, as defined in
+// RFC 7239, and the "X-Forwarded-For", "X-Forwarded-Proto" and the header
+// "X-Forwarded-Host" for requests sent by a reverse proxy in the given list of
+// networks. Each network is either an IP address or an IP address range in
+// CIDR notation. The forwarded information is used by ClientIP, Scheme, the
+// access control middlewares, and the access logs.
+//
+// The headers are ignored for requests sent by any other IP address because
+// clients can send them with arbitrary values. The proxies are skipped from
+// right to left, and the first address that does not belong to a trusted
+// network is considered to be the client.
+//
+// Example:
+//
+//	srv.TrustProxies("10.0.0.0/8")
+func (m *Middleware) TrustProxies(networks ...string) {
+	for _, network := range networks {
+		m.trustedProxies = append(m.trustedProxies, mustParseNetwork(network))
+	}
+}
+
+// isTrustedProxy reports whether the IP address belongs to a trusted proxy.
+func (m *Middleware) isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range m.trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withForwarded attaches the forwarded information to the request context, if
+// the request was sent by a trusted proxy, and returns the updated request.
+func (m *Middleware) withForwarded(r *http.Request) (*http.Request, *forwarded) {
+	if len(m.trustedProxies) == 0 || !m.isTrustedProxy(remoteIP(r)) {
+		return r, nil
+	}
+
+	var fwd *forwarded
+
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		fwd = m.parseForwarded(values)
+	} else {
+		fwd = m.parseXForwarded(r.Header)
+	}
+
+	if fwd == nil {
+		return r, nil
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), forwardedKey, fwd)), fwd
+}
+
+// parseForwarded selects the element of the "Forwarded" header appended by the
+// proxy closest to the client, and returns its parameters.
+//
+// Example:
+//
+//	Forwarded: for=192.0.2.43;proto=https;host=example.com, for="[2001:db8::1]:4711"
+func (m *Middleware) parseForwarded(values []string) *forwarded {
+	elements := forwardedElements(strings.Join(values, ","))
+
+	var fwd *forwarded
+
+	for i := len(elements) - 1; i >= 0; i-- {
+		fwd = &forwarded{
+			For:   forwardedNode(elements[i]["for"]),
+			Proto: strings.ToLower(elements[i]["proto"]),
+			Host:  elements[i]["host"],
+		}
+
+		if !m.isTrustedProxy(fwd.For) {
+			break
+		}
+	}
+
+	return fwd
+}
+
+// forwardedElements splits the value of the "Forwarded" header into elements,
+// and each element into its parameters, with the names in lowercase and the
+// quoted values unescaped. Commas and semicolons inside a quoted string are
+// part of the value, as defined in RFC 7239, section 4.
+func forwardedElements(header string) []map[string]string {
+	var elements []map[string]string
+	var name, value strings.Builder
+	var inValue, quoted, escaped bool
+
+	element := map[string]string{}
+
+	endPair := func() {
+		if key := strings.ToLower(name.String()); inValue && key != "" {
+			element[key] = value.String()
+		}
+
+		name.Reset()
+		value.Reset()
+		inValue = false
+	}
+
+	for i := 0; i < len(header); i++ {
+		c := header[i]
+
+		switch {
+		case escaped:
+			value.WriteByte(c)
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case inValue && c == '"':
+			quoted = !quoted
+		case quoted:
+			value.WriteByte(c)
+		case c == ' ' || c == '\t':
+			// optional whitespace around the separators.
+		case c == ';':
+			endPair()
+		case c == ',':
+			endPair()
+			elements = append(elements, element)
+			element = map[string]string{}
+		case !inValue && c == '=':
+			inValue = true
+		case inValue:
+			value.WriteByte(c)
+		default:
+			name.WriteByte(c)
+		}
+	}
+
+	endPair()
+
+	return append(elements, element)
+}
+
+// parseXForwarded returns the information in the de-facto standard headers.
+func (m *Middleware) parseXForwarded(h http.Header) *forwarded {
+	fwd := &forwarded{
+		Proto: strings.ToLower(lastValue(h.Values("X-Forwarded-Proto"))),
+		Host:  lastValue(h.Values("X-Forwarded-Host")),
+	}
+
+	addrs := strings.Split(strings.Join(h.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(addrs) - 1; i >= 0; i-- {
+		fwd.For = strings.TrimSpace(addrs[i])
+
+		if !m.isTrustedProxy(fwd.For) {
+			break
+		}
+	}
+
+	if fwd.For == "" && fwd.Proto == "" && fwd.Host == "" {
+		return nil
+	}
+
+	return fwd
+}
+
+// forwardedNode returns the IP address in a "for" parameter, removing the
+// port and the brackets around IPv6 addresses. Obfuscated identifiers, like
+// "unknown" or "_hidden", are returned unchanged.
+func forwardedNode(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+// lastValue returns the last item in a list of comma-separated header values.
+func lastValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	last := values[len(values)-1]
+
+	if i := strings.LastIndexByte(last, ','); i >= 0 {
+		last = last[i+1:]
+	}
+
+	return strings.TrimSpace(last)
+}
+
+// remoteIP returns the IP address of the peer connected to the web server.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// Scheme returns the URL scheme, either "http" or "https", that the client
+// used to send the request. The scheme reported by a trusted proxy, if any,
+// takes precedence over the state of the connection with the web server.
+func Scheme(r *http.Request) string {
+	if fwd, ok := r.Context().Value(forwardedKey).(*forwarded); ok && fwd.Proto != "" {
+		return fwd.Proto
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// RequestHost returns the host, and optional port, that the client used to
+// send the request. The host reported by a trusted proxy, if any, takes
+// precedence over the Host header received by the web server. Use it with
+// Scheme to build absolute URLs.
+func RequestHost(r *http.Request) string {
+	if fwd, ok := r.Context().Value(forwardedKey).(*forwarded); ok && fwd.Host != "" {
+		return fwd.Host
+	}
+
+	return r.Host
+}
+
+// RedirectHTTPS returns a middleware that redirects the requests sent over
+// plain HTTP to the same URL with the HTTPS scheme, with "301 Moved
+// Permanently" for GET and HEAD requests, and "308 Permanent Redirect" for the
+// other methods, which keeps the method and the body. The scheme and host
+// reported by trusted proxies are respected, so a TLS-terminating load
+// balancer configured with TrustProxies does not cause a redirect loop.
+//
+// Example:
+//
+//	srv.TrustProxies("10.0.0.0/8")
+//	srv.Use(middleware.RedirectHTTPS())
+func RedirectHTTPS() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if Scheme(r) == "https" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			status := http.StatusPermanentRedirect
+
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				status = http.StatusMovedPermanently
+			}
+
+			http.Redirect(w, r, "https://"+RequestHost(r)+r.URL.RequestURI(), status)
+		})
+	}
+}
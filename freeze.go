@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"strings"
+)
+
+// Freeze finalizes the routes, which cannot change afterwards, and prepares
+// them for faster lookups. The routes without named parameters and wildcards
+// are indexed in a hash table, which finds them without traversing the trie,
+// and the middlewares attached with Use are composed once per route instead of
+// once per request.
+//
+// After Freeze, the functions that register routes, hosts and middlewares, and
+// the options of the routes, like Route.Use, panic, which protects web servers
+// with a fixed set of routes from changes made by mistake at runtime, for
+// example, from a request handler. Call it after all the routes were
+// registered, before starting the web server.
+//
+// Example:
+//
+//	srv.GET("/", index)
+//	srv.GET("/users/:id", showUser)
+//	srv.Freeze()
+//	srv.ListenAndServe(":3000")
+func (m *Middleware) Freeze() {
+	m.hostsMu.Lock()
+	defer m.hostsMu.Unlock()
+
+	m.frozen = true
+
+	for _, router := range m.hosts {
+		router.frozen = true
+
+		for _, t := range router.nodes {
+			t.static = map[string]*privTrieNode{}
+
+			t.root.walk(func(node *privTrieNode) {
+				if m.chain != nil {
+					node.composed = m.chain(m.withLogFields(node.handler))
+				}
+
+				if strings.IndexByte(node.pattern, nps) >= 0 || strings.IndexByte(node.pattern, all) >= 0 {
+					return
+				}
+
+				// keep the precedence rules of the trie, e.g. "/*" over "/".
+				if ok, found, _ := t.Search(node.pattern); ok && found == node {
+					t.static[node.pattern] = node
+				}
+			})
+		}
+	}
+}
+
+// Frozen reports whether the routes were finalized with Freeze.
+func (m *Middleware) Frozen() bool {
+	return m.frozen
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"strings"
+)
+
+// Group returns a router that registers the routes under the prefix, which
+// avoids repeating it in every route of a section of the website, like an API
+// version. The routes are inserted into the same tree as the routes of the
+// parent, so the group has no cost when the requests are handled. Groups can
+// be nested, in which case the prefixes are concatenated. The prefix can have
+// named parameters, but not a wildcard. The function panics if the prefix is
+// not a valid pattern.
+//
+// The settings of the host, like Cert, SetLimits and RedirectTo, apply to the
+// whole host, even if they are called on a group.
+//
+// Example:
+//
+//	api := srv.Group("/api/v1")
+//	api.GET("/users", listUsers)          // GET /api/v1/users
+//	api.GET("/users/:id", showUser)       // GET /api/v1/users/:id
+//	admin := api.Group("/admin")
+//	admin.DELETE("/users/:id", deleteUser) // DELETE /api/v1/admin/users/:id
+func (r *router) Group(prefix string) *router {
+	prefix = strings.TrimRight(prefix, "/")
+
+	if prefix == "" || strings.Contains(prefix, "/*") {
+		panic("middleware: invalid group prefix " + prefix)
+	}
+
+	if err := ValidatePattern(prefix); err != nil {
+		panic(err.Error())
+	}
+
+	return &router{root: r.host(), prefix: r.prefix + prefix}
+}
+
+// host returns the router of the host, which is the router itself, unless it
+// is a group.
+func (r *router) host() *router {
+	if r.root != nil {
+		return r.root
+	}
+
+	return r
+}
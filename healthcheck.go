@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck is a named probe that verifies the status of a dependency, like
+// a database or an external service, which the web server needs to work.
+type HealthCheck struct {
+	// Name is the unique identifier of the probe in the JSON response.
+	Name string
+	// Timeout is the maximum duration of the probe. Default: 1s
+	Timeout time.Duration
+	// Critical marks the web server as not ready when the probe fails. Non
+	// critical probes only change the status of the response to "degraded".
+	Critical bool
+	// Check returns a non-nil error if the dependency is not working. The
+	// context is cancelled when the timeout expires.
+	Check func(ctx context.Context) error
+}
+
+// healthResult is the result of a health check probe.
+type healthResult struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// healthReport is the JSON response of the health check endpoint.
+type healthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]healthResult `json:"checks"`
+}
+
+// AddHealthCheck registers a probe that is executed every time a client sends
+// a request to the health check endpoint.
+func (m *Middleware) AddHealthCheck(hc HealthCheck) {
+	if hc.Timeout <= 0 {
+		hc.Timeout = time.Second
+	}
+
+	m.healthChecks = append(m.healthChecks, hc)
+}
+
+// EnableHealthCheck registers an endpoint in the default host that executes all
+// the probes concurrently and responds with the result of each one in JSON
+// format. The status code is "200 OK" when all the critical probes succeed, or
+// "503 Service Unavailable" otherwise. The endpoint also fails as soon as the
+// server starts shutting down, so load balancers stop sending new requests.
+//
+// Example:
+//
+//	srv.AddHealthCheck(middleware.HealthCheck{
+//	    Name:     "database",
+//	    Critical: true,
+//	    Check:    db.PingContext,
+//	})
+//	srv.EnableHealthCheck("/readyz")
+func (m *Middleware) EnableHealthCheck(endpoint string) {
+	m.GET(endpoint, m.healthCheckHandler)
+}
+
+// healthCheckHandler executes the probes and writes the report.
+func (m *Middleware) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	report := healthReport{Status: "ok", Checks: map[string]healthResult{}}
+	status := http.StatusOK
+
+	for _, hc := range m.healthChecks {
+		wg.Add(1)
+
+		go func(hc HealthCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), hc.Timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := runHealthCheck(ctx, hc)
+			result := healthResult{Status: "ok", Critical: hc.Critical, Duration: time.Since(start).String()}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				result.Status = "failing"
+				result.Error = err.Error()
+
+				if hc.Critical {
+					report.Status = "failing"
+					status = http.StatusServiceUnavailable
+				} else if report.Status == "ok" {
+					report.Status = "degraded"
+				}
+			}
+
+			report.Checks[hc.Name] = result
+		}(hc)
+	}
+
+	wg.Wait()
+
+	if atomic.LoadInt32(&m.shuttingDown) == 1 {
+		report.Status = "shutting down"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = JSON(w, r, report)
+}
+
+// runHealthCheck executes the probe and returns early if the context expires,
+// even if the probe itself does not respect the context cancellation.
+func runHealthCheck(ctx context.Context, hc HealthCheck) error {
+	done := make(chan error, 1)
+
+	go func() { done <- hc.Check(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
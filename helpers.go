@@ -1,11 +1,18 @@
 package middleware
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
-// Param returns the value for a parameter in the URL.
+// Param returns the value for a parameter in the URL, or the rest of the path
+// matched by a named wildcard, like "filepath" in "/files/*filepath".
 func Param(r *http.Request, key string) string {
 	params, ok := r.Context().Value(paramsKey).(map[string]string)
 	if !ok {
@@ -14,6 +21,44 @@ func Param(r *http.Request, key string) string {
 	return params[key]
 }
 
+// RequestID returns the identifier of the request sent by the client or the
+// load balancer in the "X-Request-Id" header, or an empty string.
+func RequestID(r *http.Request) string {
+	return r.Header.Get("X-Request-Id")
+}
+
+// requestIDPrefix identifies the process in the request IDs generated by the
+// router, which avoids collisions between the instances of the web server.
+var requestIDPrefix = func() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}()
+
+// requestIDCounter is the sequence number of the generated request IDs.
+var requestIDCounter uint64
+
+// newRequestID returns a unique request ID for the requests without one.
+func newRequestID() string {
+	n := atomic.AddUint64(&requestIDCounter, 1)
+	return requestIDPrefix + "-" + strconv.FormatUint(n, 10)
+}
+
+// Params returns a copy of all the parameters in the URL, including the host
+// parameter captured by host patterns, which allows generic handlers to read
+// them without knowing their names in advance. The map is empty, but not nil,
+// if the route has no parameters.
+func Params(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(paramsKey).(map[string]string)
+	out := make(map[string]string, len(params))
+
+	for key, value := range params {
+		out[key] = value
+	}
+
+	return out
+}
+
 // Text responds to a request with a string in plain text.
 func Text(w http.ResponseWriter, r *http.Request, v string) (int, error) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -37,3 +82,142 @@ func Data(w http.ResponseWriter, r *http.Request, v []byte) (int, error) {
 	w.Header().Set("Content-Type", "application/octet-stream")
 	return w.Write(v)
 }
+
+// EarlyHints sends a "103 Early Hints" informational response with the given
+// Link headers, allowing the web browser to start preloading resources while
+// the server prepares the final response.
+//
+// The Link headers remain in the header map, so they are also included in the
+// final response, as recommended by RFC 8297. The router does not record the
+// informational response as the status code of the request.
+//
+// Example:
+//
+//	middleware.EarlyHints(w, "</style.css>; rel=preload; as=style")
+func EarlyHints(w http.ResponseWriter, links ...string) {
+	for _, link := range links {
+		w.Header().Add("Link", link)
+	}
+
+	w.WriteHeader(http.StatusEarlyHints)
+}
+
+// ExpectsContinue reports whether the client sent "Expect: 100-continue" and
+// is waiting for the server to accept the request before sending the body.
+//
+// By default, the server sends "100 Continue" the first time the handler reads
+// the request body, so handlers can reject a request, for example, because the
+// Content-Length is too large, by responding before reading the body.
+func ExpectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// Continue sends a "100 Continue" informational response immediately, instead
+// of waiting for the handler to read the request body. The function does
+// nothing if the client did not ask for it.
+func Continue(w http.ResponseWriter, r *http.Request) {
+	if ExpectsContinue(r) {
+		w.WriteHeader(http.StatusContinue)
+	}
+}
+
+// normalizeHost removes the port number, if any, from a hostname and converts
+// the remaining characters to lowercase, since hostnames are case-insensitive.
+//
+// The function is called for every request, so it only allocates memory when
+// the hostname contains uppercase letters, which is uncommon because most web
+// browsers and HTTP clients already send the hostname in lowercase.
+//
+// Example:
+//
+//	example.com      -> example.com
+//	Example.COM:8080 -> example.com
+//	[::1]:8080       -> [::1]
+//	[::1]            -> [::1]
+func normalizeHost(host string) string {
+	for i := len(host) - 1; i >= 0; i-- {
+		if host[i] == ']' {
+			// IPv6 address without a port number.
+			break
+		}
+
+		if host[i] == ':' {
+			host = host[:i]
+			break
+		}
+	}
+
+	for i := 0; i < len(host); i++ {
+		if 'A' <= host[i] && host[i] <= 'Z' {
+			return strings.ToLower(host)
+		}
+	}
+
+	return host
+}
+
+// validateHostname reports whether the value of the Host header is either
+// empty, which HTTP/1.0 clients are allowed to send, an IP address, or a
+// hostname made of labels with at most 63 letters, digits, hyphens or
+// underscores, that do not start or end with a hyphen, optionally followed
+// by a port number. Any other value is rejected before the routing to stop
+// malformed hosts from reaching the handlers, the redirects and the caches.
+//
+// Example:
+//
+//	example.com:8080      -> true
+//	[::1]:8080            -> true
+//	[::ffff:192.0.2.1]    -> true
+//	exa mple.com          -> false
+//	-example.com          -> false
+//	example.com:80:80     -> false
+func validateHostname(host string) bool {
+	if host == "" {
+		return true
+	}
+
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		port := host[i+1:]
+
+		if port == "" || len(port) > 5 {
+			return false
+		}
+
+		for j := 0; j < len(port); j++ {
+			if port[j] < '0' || port[j] > '9' {
+				return false
+			}
+		}
+
+		host = host[:i]
+	}
+
+	if strings.HasPrefix(host, "[") {
+		// any IPv6 address, including the IPv4-mapped addresses, but not
+		// an IPv4 address, which is never written between brackets.
+		addr := strings.TrimSuffix(host[1:], "]")
+		return strings.HasSuffix(host, "]") && strings.Contains(addr, ":") && net.ParseIP(addr) != nil
+	}
+
+	host = strings.TrimSuffix(host, ".")
+
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for j := 0; j < len(label); j++ {
+			c := label[j]
+
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// Before adds a hook that runs for every request before the router selects
+// the host and the route, outside the middleware chain attached with Use, so
+// it also runs for requests that end with "404 Not Found", "405 Method Not
+// Allowed" or a response from the access control middlewares. The hooks run in
+// the same order in which they are added.
+//
+// The hook returns the request that the router uses from then on, which allows
+// to normalize the request, for example, to rewrite the URL path. If the hook
+// returns nil, the router considers that the hook already sent the response,
+// skips the remaining hooks and the routing, but still writes the access log
+// and runs the After hooks.
+//
+// Example:
+//
+//	srv.Before(func(w http.ResponseWriter, r *http.Request) *http.Request {
+//	    r.URL.Path = strings.ToLower(r.URL.Path)
+//	    return r
+//	})
+func (m *Middleware) Before(hook func(http.ResponseWriter, *http.Request) *http.Request) {
+	m.beforeHooks = append(m.beforeHooks, hook)
+}
+
+// After adds a hook that runs for every request after the response was sent,
+// with the same information that the router sends to the access log. Unlike
+// the Logger, the hooks also run for the routes configured with Route.NoLog,
+// which makes them suitable for concerns like billing and quotas, which must
+// never skip a request. The hooks run in the same order in which they are
+// added, in the goroutine that served the request, so slow hooks delay the
+// release of the connection.
+//
+// Example:
+//
+//	srv.After(func(entry middleware.AccessLog) {
+//	    billing.Charge(entry.Host, entry.BytesSent)
+//	})
+func (m *Middleware) After(hook func(AccessLog)) {
+	m.afterHooks = append(m.afterHooks, hook)
+}
@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// HostConfig is the configuration of a virtual host, as loaded by LoadHosts.
+type HostConfig struct {
+	// Host is the domain name of the virtual host, or a host pattern.
+	Host string `json:"host"`
+	// Aliases are other domain names served by the same router.
+	Aliases []string `json:"aliases"`
+	// Static is the list of folders served by the virtual host.
+	Static []StaticConfig `json:"static"`
+	// Redirect, if set, redirects every request to another host.
+	Redirect *RedirectConfig `json:"redirect"`
+	// Allow restricts the access to the given networks, IP addresses or IP
+	// address ranges in CIDR notation. All the clients are allowed if empty.
+	Allow []string `json:"allow"`
+}
+
+// StaticConfig is a folder served by a virtual host, with the optional policy
+// of its HTML files, see StaticPolicy.
+type StaticConfig struct {
+	Root   string                 `json:"root"`
+	Prefix string                 `json:"prefix"`
+	CSP    *ContentSecurityPolicy `json:"csp"`
+}
+
+// RedirectConfig is the target of a virtual host that redirects all requests.
+type RedirectConfig struct {
+	To     string `json:"to"`
+	Status int    `json:"status"`
+}
+
+// hostsFile is the format of the file read by LoadHosts.
+type hostsFile struct {
+	Hosts []HostConfig `json:"hosts"`
+}
+
+// LoadHosts reads the configuration of the virtual hosts from a JSON file and
+// registers them, which allows to deploy the same binary with different sets
+// of domains. Routes with custom handlers can be added to the hosts afterwards
+// using Middleware.Host.
+//
+// The whole file is validated before registering any host, so a configuration
+// error never leaves the web server with half of the hosts. The function
+// returns an error after Freeze.
+//
+// Example:
+//
+//	{
+//	  "hosts": [
+//	    {
+//	      "host": "example.com",
+//	      "aliases": ["www.example.com"],
+//	      "static": [{"root": "/var/www/example", "prefix": "/assets", "csp": {"policy": "default-src 'self'"}}],
+//	      "allow": ["10.0.0.0/8"]
+//	    },
+//	    {
+//	      "host": "example.org",
+//	      "redirect": {"to": "https://example.com", "status": 301}
+//	    }
+//	  ]
+//	}
+func (m *Middleware) LoadHosts(filename string) error {
+	data, err := os.ReadFile(filename)
+
+	if err != nil {
+		return err
+	}
+
+	var file hostsFile
+
+	if err := json.Unmarshal(data, &file); err != nil {
+		return errors.New("middleware: invalid hosts file " + filename + ": " + err.Error())
+	}
+
+	return m.ConfigureHosts(file.Hosts)
+}
+
+// ConfigureHosts registers the virtual hosts described by the configuration.
+// See LoadHosts for more information.
+func (m *Middleware) ConfigureHosts(hosts []HostConfig) error {
+	if m.frozen {
+		return errors.New("middleware: cannot configure hosts after Freeze")
+	}
+
+	allowed := make([][]*net.IPNet, len(hosts))
+
+	for i, host := range hosts {
+		nets, err := host.validate()
+
+		if err != nil {
+			return err
+		}
+
+		allowed[i] = nets
+	}
+
+	for i, host := range hosts {
+		router := m.Host(host.Host)
+
+		for _, static := range host.Static {
+			router.STATIC(static.Root, static.Prefix)
+
+			if static.CSP != nil {
+				router.StaticPolicy(static.Prefix, *static.CSP)
+			}
+		}
+
+		if host.Redirect != nil {
+			router.RedirectTo(host.Redirect.To, host.Redirect.status())
+		}
+
+		router.allowed = allowed[i]
+
+		m.hostsMu.Lock()
+		for _, alias := range host.Aliases {
+			m.hosts[normalizeHost(alias)] = router
+		}
+		m.hostsMu.Unlock()
+	}
+
+	return nil
+}
+
+// validate checks the configuration of the virtual host, and returns the
+// parsed list of allowed networks.
+func (c HostConfig) validate() ([]*net.IPNet, error) {
+	if c.Host == "" || c.Host == nohost {
+		return nil, errors.New("middleware: invalid host " + strconv.Quote(c.Host))
+	}
+
+	if c.Host[0] == ':' {
+		if err := validateHostPattern(c.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, alias := range c.Aliases {
+		if alias == "" || alias == nohost || alias[0] == ':' {
+			return nil, errors.New("middleware: invalid alias " + strconv.Quote(alias) + " for host " + c.Host)
+		}
+	}
+
+	for _, static := range c.Static {
+		if static.Root == "" {
+			return nil, errors.New("middleware: static folder without root for host " + c.Host)
+		}
+
+		if err := ValidatePattern(static.Prefix + "/*"); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Redirect != nil {
+		if c.Redirect.To == "" {
+			return nil, errors.New("middleware: redirect without target for host " + c.Host)
+		}
+
+		if status := c.Redirect.status(); status < 300 || status > 399 {
+			return nil, errors.New("middleware: invalid redirect status " + strconv.Itoa(status))
+		}
+	}
+
+	nets := make([]*net.IPNet, 0, len(c.Allow))
+
+	for _, network := range c.Allow {
+		ipnet, err := parseNetwork(network)
+
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+// status returns the status code of the redirect, which defaults to "301 Moved
+// Permanently".
+func (c RedirectConfig) status() int {
+	if c.Status == 0 {
+		return http.StatusMovedPermanently
+	}
+
+	return c.Status
+}
+
+// isAllowed reports whether the router accepts requests from the client.
+func (r *router) isAllowed(req *http.Request) bool {
+	if len(r.allowed) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(ClientIP(req))
+
+	for _, ipnet := range r.allowed {
+		if ip != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// hostPattern is a host registered with a named parameter in the subdomain.
+type hostPattern struct {
+	key    string
+	param  string
+	suffix string
+}
+
+// addHostPattern registers a host pattern like ":tenant.example.com", where
+// the first label of the host name is captured as a named parameter.
+func (m *Middleware) addHostPattern(tld string) string {
+	if err := validateHostPattern(tld); err != nil {
+		panic(err.Error())
+	}
+
+	dot := strings.IndexByte(tld, '.')
+	key := hostPatternKey(tld)
+
+	for _, p := range m.hostPatterns {
+		if p.key == key {
+			return key
+		}
+	}
+
+	m.hostPatterns = append(m.hostPatterns, hostPattern{
+		key:    key,
+		param:  tld[1:dot],
+		suffix: strings.ToLower(tld[dot:]),
+	})
+
+	return key
+}
+
+// hostPatternKey returns the key of a valid host pattern in Middleware.hosts,
+// which has the parameter name as is and the domain name in lowercase.
+func hostPatternKey(tld string) string {
+	dot := strings.IndexByte(tld, '.')
+	return ":" + tld[1:dot] + strings.ToLower(tld[dot:])
+}
+
+// validateHostPattern checks that the host pattern has a parameter name and a
+// domain name after the first label.
+func validateHostPattern(tld string) error {
+	dot := strings.IndexByte(tld, '.')
+
+	if dot < 2 || dot == len(tld)-1 {
+		return errors.New("middleware: invalid host pattern " + tld)
+	}
+
+	return nil
+}
+
+// matchHostPattern returns the key of the host pattern that matches the host,
+// and the value of the subdomain parameter. The subdomain must be exactly one
+// label, so "a.b.example.com" does not match ":tenant.example.com".
+func (m *Middleware) matchHostPattern(host string) (hostPattern, string, bool) {
+	for _, p := range m.hostPatterns {
+		if !strings.HasSuffix(host, p.suffix) {
+			continue
+		}
+
+		label := host[:len(host)-len(p.suffix)]
+
+		if label != "" && strings.IndexByte(label, '.') == -1 {
+			return p, label, true
+		}
+	}
+
+	return hostPattern{}, "", false
+}
+
+// withHostParam attaches the subdomain parameter to the request context, where
+// handleRequest merges it with the parameters of the route.
+func withHostParam(r *http.Request, name string, value string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), paramsKey, map[string]string{name: value}))
+}
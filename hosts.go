@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Hosts returns the hosts registered with Middleware.Host, including the host
+// patterns, sorted alphabetically. The default host is not included.
+func (m *Middleware) Hosts() []string {
+	m.hostsMu.RLock()
+	defer m.hostsMu.RUnlock()
+
+	var out []string
+
+	for host := range m.hosts {
+		if host != nohost {
+			out = append(out, host)
+		}
+	}
+
+	sort.Strings(out)
+
+	return out
+}
+
+// RemoveHost removes a host registered with Middleware.Host, and reports
+// whether the host existed. Subsequent requests for the host are handled
+// according to Middleware.HostFallback, while requests in progress finish
+// normally. The default host cannot be removed. The aliases of the host, see
+// ConfigureHosts, are removed too, and removing an alias removes its host.
+//
+// It is safe to call RemoveHost and AddHost while the web server is running,
+// which allows control planes to add and remove tenant domains on a live
+// server. Middleware.Host is not, because the routes are registered while the
+// host is visible to the web server.
+func (m *Middleware) RemoveHost(tld string) bool {
+	m.hostsMu.Lock()
+	defer m.hostsMu.Unlock()
+
+	if strings.HasPrefix(tld, ":") {
+		for _, p := range m.hostPatterns {
+			if strings.EqualFold(p.key, tld) {
+				tld = p.key
+				break
+			}
+		}
+	} else {
+		tld = normalizeHost(tld)
+	}
+
+	removed, ok := m.hosts[tld]
+
+	if !ok || tld == nohost {
+		return false
+	}
+
+	for host, router := range m.hosts {
+		if router != removed {
+			continue
+		}
+
+		delete(m.hosts, host)
+
+		if m.defaultHost == host {
+			m.defaultHost = ""
+		}
+	}
+
+	patterns := m.hostPatterns[:0:0]
+
+	for _, p := range m.hostPatterns {
+		if _, ok := m.hosts[p.key]; ok {
+			patterns = append(patterns, p)
+		}
+	}
+
+	m.hostPatterns = patterns
+
+	return true
+}
+
+// NewRouter returns a router that is not attached to any host yet, for
+// AddHost.
+func (m *Middleware) NewRouter() *router {
+	return newRouter(m)
+}
+
+// AddHost attaches a router created with NewRouter, and its routes, to a new
+// host in a single step, so the web server never sees the host without its
+// routes. Unlike Middleware.Host, it is safe to call AddHost while the web
+// server is running. Do not register more routes on the router afterwards.
+// The function returns an error if the host already exists, or after Freeze.
+//
+// Example:
+//
+//	router := srv.NewRouter()
+//	router.GET("/", home)
+//	router.STATIC("/var/www/acme", "/assets")
+//	err := srv.AddHost("acme.example.com", router)
+func (m *Middleware) AddHost(tld string, router *router) error {
+	if router == nil || router.root != nil || router.owner != m {
+		return errors.New("middleware: AddHost requires a router from NewRouter")
+	}
+
+	key := normalizeHost(tld)
+
+	if strings.HasPrefix(tld, ":") {
+		if err := validateHostPattern(tld); err != nil {
+			return err
+		}
+
+		key = hostPatternKey(tld)
+	} else if key == "" || key == nohost {
+		return errors.New("middleware: invalid host " + strconv.Quote(tld))
+	}
+
+	m.hostsMu.Lock()
+	defer m.hostsMu.Unlock()
+
+	if m.frozen {
+		return errors.New("middleware: cannot add host " + tld + " after Freeze")
+	}
+
+	if _, ok := m.hosts[key]; ok {
+		return errors.New("middleware: host " + tld + " already exists")
+	}
+
+	for _, other := range m.hosts {
+		if other == router {
+			return errors.New("middleware: router of host " + tld + " already attached to another host")
+		}
+	}
+
+	if strings.HasPrefix(tld, ":") {
+		m.addHostPattern(tld)
+	}
+
+	m.hosts[key] = router
+
+	return nil
+}
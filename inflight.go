@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InFlightRequest describes a request that is currently being handled.
+type InFlightRequest struct {
+	Method    string
+	Host      string
+	Path      string
+	Pattern   string
+	ClientIP  string
+	RequestID string
+	StartTime time.Time
+}
+
+// inflight is a concurrent registry of the requests that are being handled.
+type inflight struct {
+	mu       sync.Mutex
+	requests map[*response]*InFlightRequest
+}
+
+// add registers a request in the in-flight registry.
+func (f *inflight) add(w *response, r *http.Request, start time.Time) {
+	req := &InFlightRequest{
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		ClientIP:  ClientIP(r),
+		RequestID: RequestID(r),
+		StartTime: start,
+	}
+
+	f.mu.Lock()
+	f.requests[w] = req
+	f.mu.Unlock()
+}
+
+// match updates the pattern of the route that is handling the request.
+func (f *inflight) match(w *response, pattern string) {
+	f.mu.Lock()
+	if req, ok := f.requests[w]; ok {
+		req.Pattern = pattern
+	}
+	f.mu.Unlock()
+}
+
+// remove deletes a request from the in-flight registry.
+func (f *inflight) remove(w *response) {
+	f.mu.Lock()
+	delete(f.requests, w)
+	f.mu.Unlock()
+}
+
+// EnableInFlight starts tracking the requests that are currently being handled,
+// which are available via Middleware.InFlight. When the server shutdown takes
+// longer than ShutdownTimeout, the requests that were still active are written
+// into the error log, which helps to diagnose slow handlers.
+func (m *Middleware) EnableInFlight() {
+	if m.inflight == nil {
+		m.inflight = &inflight{requests: map[*response]*InFlightRequest{}}
+	}
+}
+
+// InFlight returns a copy of the requests that are currently being handled,
+// sorted from the oldest to the newest. The list is empty unless the tracking
+// was enabled with EnableInFlight.
+func (m *Middleware) InFlight() []InFlightRequest {
+	if m.inflight == nil {
+		return nil
+	}
+
+	m.inflight.mu.Lock()
+
+	out := make([]InFlightRequest, 0, len(m.inflight.requests))
+
+	for _, req := range m.inflight.requests {
+		out = append(out, *req)
+	}
+
+	m.inflight.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].StartTime.Before(out[j].StartTime)
+	})
+
+	return out
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// jobs keeps track of the background goroutines started with Middleware.Go.
+type jobs struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	running int32
+}
+
+// Go runs the function in a background goroutine whose lifecycle is tied to
+// the web server, which is useful for periodic tasks, like refreshing a cache
+// or flushing metrics. The context is cancelled when Shutdown is called, and
+// Shutdown waits for the goroutines to return, up to ShutdownTimeout, before
+// it returns, so the tasks can finish their work gracefully.
+//
+// Example:
+//
+//	srv.Go(func(ctx context.Context) {
+//	    ticker := time.NewTicker(time.Minute)
+//	    defer ticker.Stop()
+//	    for {
+//	        select {
+//	        case <-ctx.Done():
+//	            return
+//	        case <-ticker.C:
+//	            refreshCache(ctx)
+//	        }
+//	    }
+//	})
+func (m *Middleware) Go(fn func(ctx context.Context)) {
+	j := &m.jobs
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.ctx == nil {
+		j.ctx, j.cancel = context.WithCancel(context.Background())
+	}
+
+	ctx := j.ctx
+
+	j.wg.Add(1)
+	atomic.AddInt32(&j.running, 1)
+
+	go func() {
+		defer j.wg.Done()
+		defer atomic.AddInt32(&j.running, -1)
+
+		fn(ctx)
+	}()
+}
+
+// stop cancels the context of the background goroutines, so the goroutines
+// started from now on belong to a new lifecycle.
+func (j *jobs) stop() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.cancel != nil {
+		j.cancel()
+	}
+
+	j.ctx, j.cancel = nil, nil
+}
+
+// wait waits for the background goroutines to return, or the context to
+// expire, in which case it returns the number of goroutines still running.
+func (j *jobs) wait(ctx context.Context) int {
+	if atomic.LoadInt32(&j.running) == 0 {
+		return 0
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		j.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return int(atomic.LoadInt32(&j.running))
+	}
+}
+
+// waitJobs waits for the background goroutines and reports the ones that did
+// not return before the deadline.
+func (m *Middleware) waitJobs(ctx context.Context, start time.Time) {
+	if n := m.jobs.wait(ctx); n > 0 {
+		m.logf("shutdown: %d background jobs still running after %s", n, time.Since(start))
+	}
+}
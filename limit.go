@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// ErrResponseTooLarge is returned by the Write method of the response writer
+// when the response exceeds the size limit set with Route.MaxResponseSize.
+var ErrResponseTooLarge = errors.New("middleware: response exceeds the size limit")
+
+// MaxResponseSize limits the size of the response body of the route, which
+// protects the clients and the network against accidental full table dumps.
+//
+// If the handler declares a larger Content-Length, or its first write exceeds
+// the limit, the client receives a "500 Internal Server Error" response
+// instead. If the limit trips after the response headers were sent, the rest
+// of the response is discarded and the connection is aborted, so the client
+// notices the truncated response. Either way, the writes return the error
+// ErrResponseTooLarge, which allows the handler to stop early, and the event
+// is written into Middleware.ErrorLog. The function panics if the limit is not
+// positive.
+//
+// Example:
+//
+//	srv.GET("/export", export).MaxResponseSize(50 << 20)
+func (rt *Route) MaxResponseSize(n int) *Route {
+	rt.checkFrozen()
+
+	if n <= 0 {
+		panic("middleware: invalid response size limit " + strconv.Itoa(n) + " for " + rt.method + " " + rt.pattern)
+	}
+
+	rt.maxResponseSize = n
+
+	return rt
+}
+
+// declaresTooLarge reports whether the Content-Length header exceeds the limit.
+func (w *response) declaresTooLarge() bool {
+	n, err := strconv.Atoi(w.Header().Get("Content-Length"))
+
+	return err == nil && n > w.maxBytes
+}
+
+// rejectTooLarge responds with "500 Internal Server Error" and discards the
+// rest of the response written by the handler.
+func (w *response) rejectTooLarge() {
+	w.tooLarge = true
+	w.maxBytes = 0
+
+	w.Header().Del("Content-Length")
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+
+	w.replaced = true
+}
+
+// exceedLimit handles a write that exceeds the size limit, either rejecting
+// the response, if nothing was sent yet, or aborting it.
+func (w *response) exceedLimit() error {
+	if w.status == 0 {
+		w.rejectTooLarge()
+		return ErrResponseTooLarge
+	}
+
+	w.tooLarge = true
+	w.aborted = true
+	w.replaced = true
+
+	return ErrResponseTooLarge
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+)
+
+// Limits overrides some of the server limits for the requests sent to a host.
+// A zero value leaves the corresponding server setting unchanged.
+type Limits struct {
+	// ReadTimeout is the maximum duration for reading the request body,
+	// measured from the moment the router receives the request.
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum duration for writing the response, measured
+	// from the moment the router receives the request.
+	WriteTimeout time.Duration
+	// MaxBodySize is the maximum size of the request body. Reading past the
+	// limit returns an error, and the server closes the connection after the
+	// response is sent.
+	MaxBodySize int64
+}
+
+// SetLimits overrides some of the server limits for the requests sent to the
+// host. All the hosts share the same http.Server, so the timeouts are applied
+// with per-request read and write deadlines on the underlying connection,
+// which requires Go 1.20 or later; older versions ignore the timeouts.
+//
+// Example:
+//
+//	srv.WriteTimeout = time.Second * 5
+//	srv.Host("upload.example.com").SetLimits(middleware.Limits{
+//	    ReadTimeout:  time.Minute * 10,
+//	    WriteTimeout: time.Minute * 10,
+//	    MaxBodySize:  1 << 30,
+//	})
+func (r *router) SetLimits(limits Limits) {
+	r.host().limits = &limits
+}
+
+// apply applies the limits of the host to the request.
+func (l *Limits) apply(w http.ResponseWriter, r *http.Request, now time.Time) {
+	if l.ReadTimeout > 0 {
+		if rw, ok := findDeadliner(w); ok {
+			_ = rw.SetReadDeadline(now.Add(l.ReadTimeout))
+		}
+	}
+
+	if l.WriteTimeout > 0 {
+		if rw, ok := findDeadliner(w); ok {
+			_ = rw.SetWriteDeadline(now.Add(l.WriteTimeout))
+		}
+	}
+
+	if l.MaxBodySize > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, l.MaxBodySize)
+	}
+}
+
+// deadliner is implemented by the response writers of the standard library
+// that allow to change the deadlines of the connection, which is the same
+// interface that http.ResponseController uses.
+type deadliner interface {
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+// findDeadliner follows the chain of writers that implement the Unwrap method
+// until it finds one that allows to change the deadlines of the connection.
+func findDeadliner(w http.ResponseWriter) (deadliner, bool) {
+	for {
+		if d, ok := w.(deadliner); ok {
+			return d, true
+		}
+
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+
+		if !ok {
+			return nil, false
+		}
+
+		w = u.Unwrap()
+	}
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ListenAndServeIPv4 acts identically to ListenAndServe, except that it only
+// accepts connections over IPv4, even if the address resolves to an IPv6
+// address, or has no host, in which case it listens on all IPv4 addresses.
+func (m *Middleware) ListenAndServeIPv4(address string) error {
+	return m.listenAndServe([]string{"tcp4"}, address)
+}
+
+// ListenAndServeIPv6 acts identically to ListenAndServe, except that it only
+// accepts connections over IPv6. If the address has no host, the server
+// listens on all IPv6 addresses, without the IPv4-mapped addresses that the
+// operating system may enable by default.
+func (m *Middleware) ListenAndServeIPv6(address string) error {
+	return m.listenAndServe([]string{"tcp6"}, address)
+}
+
+// ListenAndServeDualStack acts identically to ListenAndServe, except that it
+// accepts connections over both IPv4 and IPv6. If the address has no host, the
+// server uses a single dual-stack socket. Otherwise, it listens on the IPv4
+// and IPv6 addresses of the host, for example, both 127.0.0.1 and ::1 for
+// "localhost:3000", which ListenAndServe does not guarantee because it uses
+// the first address returned by the resolver. It fails only if the server
+// cannot listen on any of the two families.
+//
+// Example:
+//
+//	srv.ListenAndServeDualStack(":3000")
+func (m *Middleware) ListenAndServeDualStack(address string) error {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	if host == "" {
+		return m.listenAndServe([]string{"tcp"}, address)
+	}
+
+	return m.listenAndServe([]string{"tcp4", "tcp6"}, address)
+}
+
+// listenAndServe listens on the address for each network, stopping at the
+// first network that succeeds if there is only one, and serves the requests
+// received by all the listeners.
+func (m *Middleware) listenAndServe(networks []string, address string) error {
+	var listeners []net.Listener
+	var firstErr error
+
+	if err := m.checkRouteConflicts(); err != nil {
+		return err
+	}
+
+	for _, network := range networks {
+		l, err := net.Listen(network, address)
+
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		if len(listeners) == 0 {
+			// use the same port in the other networks, even if it was zero.
+			_, port, _ := net.SplitHostPort(l.Addr().String())
+			host, _, _ := net.SplitHostPort(address)
+			address = net.JoinHostPort(host, port)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return firstErr
+	}
+
+	info := m.startupInfo(listeners[0].Addr(), false)
+
+	switch {
+	case len(listeners) > 1:
+		info.Family = "dual-stack"
+	case networks[0] == "tcp4":
+		info.Family = "ipv4"
+	case networks[0] == "tcp6":
+		info.Family = "ipv6"
+	}
+
+	return m.serve(info, func() error {
+		errs := make(chan error, len(listeners))
+
+		for _, l := range listeners {
+			go func(l net.Listener) {
+				errs <- m.serverInstance.Serve(l)
+			}(l)
+		}
+
+		err := <-errs
+
+		if !errors.Is(err, http.ErrServerClosed) {
+			// stop serving the other listeners.
+			_ = m.serverInstance.Close()
+		}
+
+		return err
+	})
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LoadShedding is the policy that protects the web server during traffic
+// spikes by rejecting the requests that exceed its capacity, instead of
+// letting all of them become slower. See Middleware.ShedLoad.
+type LoadShedding struct {
+	// MaxInFlight is the maximum number of requests handled at the same time.
+	MaxInFlight int
+	// MaxQueueWait is the maximum duration a request waits for one of the
+	// in-flight requests to finish before it is rejected. If zero, the
+	// requests that exceed MaxInFlight are rejected immediately.
+	MaxQueueWait time.Duration
+	// RetryAfter is the value of the "Retry-After" header sent with the
+	// rejected requests, rounded up to seconds. Default: 1s.
+	RetryAfter time.Duration
+}
+
+// shedder implements the load shedding policy with a counting semaphore.
+type shedder struct {
+	slots      chan struct{}
+	wait       time.Duration
+	retryAfter string
+}
+
+// ShedLoad enables the load shedding policy. When the web server is already
+// handling MaxInFlight requests, new requests wait up to MaxQueueWait for a
+// free slot, and are answered with "503 Service Unavailable" and a
+// "Retry-After" header if none is released on time. Rejected requests skip the
+// routing and the middleware chain, so the response is immediate, and are
+// marked with AccessLog.Shed in the access log. The function panics if
+// MaxInFlight is not positive.
+//
+// Call the function before starting the web server.
+//
+// Example:
+//
+//	srv.ShedLoad(middleware.LoadShedding{
+//	    MaxInFlight:  500,
+//	    MaxQueueWait: 50 * time.Millisecond,
+//	})
+func (m *Middleware) ShedLoad(policy LoadShedding) {
+	if policy.MaxInFlight <= 0 {
+		panic("middleware: invalid MaxInFlight " + strconv.Itoa(policy.MaxInFlight))
+	}
+
+	if policy.RetryAfter <= 0 {
+		policy.RetryAfter = time.Second
+	}
+
+	seconds := int64((policy.RetryAfter + time.Second - 1) / time.Second)
+
+	m.shedder = &shedder{
+		slots:      make(chan struct{}, policy.MaxInFlight),
+		wait:       policy.MaxQueueWait,
+		retryAfter: strconv.FormatInt(seconds, 10),
+	}
+}
+
+// acquire reserves a slot for the request, and reports whether the request
+// can be handled. The caller must call release if the function returns true.
+func (s *shedder) acquire(r *http.Request) bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if s.wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(s.wait)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// release frees the slot reserved by acquire.
+func (s *shedder) release() {
+	<-s.slots
+}
+
+// reject answers the request with "503 Service Unavailable".
+func (s *shedder) reject(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", s.retryAfter)
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// logField extracts a value from the requests for the access logs.
+type logField struct {
+	name string
+	fn   func(*http.Request) string
+}
+
+// LogField registers a function that extracts a value from the requests, like
+// the ID of the user of the session, which is added to AccessLog.Fields with
+// the name, so the business identifiers appear in the access logs without a
+// custom Logger. Registering the same name again replaces the function.
+//
+// The function runs after the handler, with the request received by the
+// handler of the route, so it can read the values that the middlewares added
+// to the request Context, like the authenticated user. The requests that do
+// not match a route are passed as received by the router. Empty values are
+// not added to the access logs. The function panics after Freeze.
+//
+// Example:
+//
+//	srv.LogField("user_id", func(r *http.Request) string {
+//	    if user, ok := r.Context().Value(userKey).(*User); ok {
+//	        return user.ID
+//	    }
+//	    return ""
+//	})
+func (m *Middleware) LogField(name string, fn func(*http.Request) string) {
+	if m.frozen {
+		panic("middleware: cannot add log field " + name + " after Freeze")
+	}
+
+	for i, field := range m.logFields {
+		if field.name == name {
+			m.logFields[i].fn = fn
+			return
+		}
+	}
+
+	m.logFields = append(m.logFields, logField{name: name, fn: fn})
+}
+
+// withLogFields records the request received by the handler of the route, if
+// there are log fields, so they are extracted from it after the handler.
+func (m *Middleware) withLogFields(next http.Handler) http.Handler {
+	if len(m.logFields) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if res := findResponse(w); res != nil {
+			res.handlerRequest = r
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logFieldValues returns the non-empty values of the log fields for the
+// request, or nil if there are none.
+func (m *Middleware) logFieldValues(r *http.Request) map[string]string {
+	var out map[string]string
+
+	for _, field := range m.logFields {
+		value := field.fn(r)
+
+		if value == "" {
+			continue
+		}
+
+		if out == nil {
+			out = map[string]string{}
+		}
+
+		out[field.name] = value
+	}
+
+	return out
+}
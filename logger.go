@@ -5,6 +5,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"time"
 )
 
@@ -57,7 +59,8 @@ import (
 //	    l.parent.Log(data)
 //	}
 type Logger interface {
-	// ListeningOn is called once, just before the execution of ListenAndServe.
+	// ListeningOn is called once, just before the execution of ListenAndServe,
+	// unless the logger implements StartupLogger.
 	ListeningOn(net.Addr)
 	// Shutdown is called once, immediately after the graceful server shutdown.
 	Shutdown(error)
@@ -95,20 +98,56 @@ type Logger interface {
 // to determine this information unless IdentityCheck is set to "On".
 //
 // Source: https://en.wikipedia.org/wiki/Common_Log_Format
+//
+// BytesSent is zero for HEAD requests and for "204 No Content" and "304 Not
+// Modified" responses, because the body is never sent, while ContentLength
+// keeps the size that the body would have had, so the analytics can tell a
+// suppressed body apart from an empty one.
+//
+// BytesSent is the number of bytes on the wire, after the compression, if
+// any, while BytesUncompressed is the size of the response body before the
+// Compress middleware encoded it, with the encoding in ContentEncoding, so
+// the analytics can measure the bandwidth and the compression ratio.
+//
+// RequestID is the "X-Request-Id" sent by the client or, if the router wrote
+// an error about the request into Middleware.ErrorLog, the ID it generated
+// for the entry, which correlates both logs.
+//
+// Verbose is true if the request was flagged with VerboseLog, in which case
+// Header has all the request headers, ResponseHeader has the response headers,
+// Params has the route parameters, and Notes has the notes recorded with
+// LogNote. These fields are empty for the other requests.
+//
+// Fields has the non-empty values extracted with the functions registered with
+// Middleware.LogField, like the ID of the user, for every request.
 type AccessLog struct {
-	StartTime     time.Time
-	Host          string
-	RemoteAddr    string
-	RemoteUser    string
-	Method        string
-	Path          string
-	Query         url.Values
-	Protocol      string
-	StatusCode    int
-	BytesReceived int64
-	BytesSent     int
-	Header        http.Header
-	Duration      time.Duration
+	StartTime         time.Time
+	Host              string
+	RemoteAddr        string
+	RemoteUser        string
+	Scheme            string
+	Method            string
+	Path              string
+	Query             url.Values
+	Protocol          string
+	StatusCode        int
+	BytesReceived     int64
+	BytesSent         int
+	ContentLength     int64
+	BytesUncompressed int
+	ContentEncoding   string
+	Header            http.Header
+	Trailer           http.Header
+	Duration          time.Duration
+	Timings           []Timing
+	Variant           string
+	Shed              bool
+	RequestID         string
+	Verbose           bool
+	ResponseHeader    http.Header
+	Params            map[string]string
+	Notes             []string
+	Fields            map[string]string
 }
 
 // Request concatenates the request method, path, parameters and protocol.
@@ -149,9 +188,10 @@ func (a AccessLog) UserAgent() string {
 	return userAgent
 }
 
-// String returns the request metadata in Combined Log format.
+// String returns the request metadata in Combined Log format, followed by the
+// fields registered with Middleware.LogField, if any, sorted by name.
 func (a AccessLog) String() string {
-	return fmt.Sprintf(
+	out := fmt.Sprintf(
 		"%s %s %s %d %d %q %v",
 		a.Host,
 		a.RemoteAddr,
@@ -161,6 +201,25 @@ func (a AccessLog) String() string {
 		a.Header.Get("User-Agent"),
 		a.Duration,
 	)
+
+	for _, name := range a.fieldNames() {
+		out += " " + name + "=" + strconv.Quote(a.Fields[name])
+	}
+
+	return out
+}
+
+// fieldNames returns the names of the fields, sorted.
+func (a AccessLog) fieldNames() []string {
+	names := make([]string, 0, len(a.Fields))
+
+	for name := range a.Fields {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
 }
 
 // CommonLog returns the request metadata in Common Log format.
@@ -9,6 +9,7 @@ import (
 // BasicLogger implements the Logger interface and the NCSA_HTTPd log format.
 type BasicLogger struct {
 	logger *log.Logger
+	format func(AccessLog) string
 }
 
 // NewBasicLogger returns a new instance of a basic server access logger.
@@ -23,6 +24,11 @@ func (l BasicLogger) ListeningOn(addr net.Addr) {
 	l.logger.Println("listening on", addr)
 }
 
+// Startup implements the Startup method for the StartupLogger interface.
+func (l BasicLogger) Startup(info StartupInfo) {
+	l.logger.Println("listening on", info)
+}
+
 // Shutdown implements the Shutdown method for the Logger interface.
 func (l BasicLogger) Shutdown(err error) {
 	if err != nil {
@@ -35,5 +41,10 @@ func (l BasicLogger) Shutdown(err error) {
 
 // Log implements the Log method for the Logger interface.
 func (l BasicLogger) Log(data AccessLog) {
+	if l.format != nil {
+		l.logger.Println(l.format(data))
+		return
+	}
+
 	l.logger.Println(data)
 }
@@ -0,0 +1,285 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLPLogger implements the Logger interface and sends the access logs, in
+// batches, to an OpenTelemetry collector using the OTLP/HTTP protocol with
+// JSON encoding, so the logs reach the collector without a sidecar that tails
+// the standard output of the program.
+//
+// The logger sends a batch when it reaches BatchSize entries, or every
+// FlushInterval, whichever happens first. Failed requests are retried with an
+// exponential backoff when the collector responds with "429 Too Many Requests"
+// or a 5xx status code, or when the connection fails. The batch is discarded
+// after MaxRetries attempts, and the error is written into ErrorLog. While
+// the collector is unavailable, the queue keeps up to MaxQueue entries, and
+// the logger drops the new ones and writes the number of drops into ErrorLog.
+//
+// The background goroutine starts with the first entry, so the logger also
+// works with servers that never call ListeningOn, like httptest.Server or
+// Middleware.ServeCGI. Call Shutdown to send the remaining entries.
+//
+// Ref: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type OTLPLogger struct {
+	endpoint    string
+	serviceName string
+
+	// BatchSize is the maximum number of entries per request. Default: 100
+	BatchSize int
+	// FlushInterval is the maximum time an entry waits in the queue. Default: 1s
+	FlushInterval time.Duration
+	// MaxRetries is the number of attempts to send a batch. Default: 3
+	MaxRetries int
+	// MaxQueue is the maximum number of entries waiting to be sent. Default: 10000
+	MaxQueue int
+	// Backoff is the delay before the first retry, it doubles after every
+	// failed attempt. Default: 100ms
+	Backoff time.Duration
+	// Client is the HTTP client used to send the requests.
+	Client *http.Client
+	// ErrorLog specifies an optional logger for errors sending the requests.
+	ErrorLog *log.Logger
+
+	once    sync.Once
+	mu      sync.Mutex
+	closed  bool
+	queue   []AccessLog
+	dropped int
+	flush   chan struct{}
+	stopped chan struct{}
+}
+
+// NewOTLPLogger returns a new instance of an access logger that sends the logs
+// to an OTLP/HTTP endpoint, for example, "http://localhost:4318/v1/logs".
+func NewOTLPLogger(endpoint string, serviceName string) *OTLPLogger {
+	return &OTLPLogger{
+		endpoint:      endpoint,
+		serviceName:   serviceName,
+		BatchSize:     100,
+		FlushInterval: time.Second,
+		MaxRetries:    3,
+		MaxQueue:      10000,
+		Backoff:       time.Millisecond * 100,
+		Client:        &http.Client{Timeout: time.Second * 10},
+		ErrorLog:      log.New(os.Stderr, "", log.LstdFlags),
+		flush:         make(chan struct{}, 1),
+		stopped:       make(chan struct{}),
+	}
+}
+
+// ListeningOn implements the ListeningOn method for the Logger interface.
+func (l *OTLPLogger) ListeningOn(addr net.Addr) {
+	l.once.Do(func() { go l.run() })
+}
+
+// Shutdown implements the Shutdown method for the Logger interface. It sends
+// the remaining entries in the queue and stops the background goroutine.
+func (l *OTLPLogger) Shutdown(err error) {
+	l.once.Do(func() { go l.run() })
+
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.flush)
+	}
+	l.mu.Unlock()
+
+	<-l.stopped
+}
+
+// Log implements the Log method for the Logger interface.
+func (l *OTLPLogger) Log(data AccessLog) {
+	l.once.Do(func() { go l.run() })
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	if l.MaxQueue > 0 && len(l.queue) >= l.MaxQueue {
+		l.dropped++
+		return
+	}
+
+	l.queue = append(l.queue, data)
+
+	if len(l.queue) >= l.BatchSize {
+		select {
+		case l.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends the queued entries periodically until the logger is shut down.
+func (l *OTLPLogger) run() {
+	ticker := time.NewTicker(l.FlushInterval)
+
+	defer ticker.Stop()
+	defer close(l.stopped)
+
+	for {
+		select {
+		case <-ticker.C:
+			l.send()
+		case _, ok := <-l.flush:
+			l.send()
+
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// send removes all the entries from the queue and sends them in batches.
+func (l *OTLPLogger) send() {
+	l.mu.Lock()
+	queue := l.queue
+	dropped := l.dropped
+	l.queue = nil
+	l.dropped = 0
+	l.mu.Unlock()
+
+	if dropped > 0 {
+		l.ErrorLog.Printf("otlp: dropped %d access logs, the queue is full", dropped)
+	}
+
+	for len(queue) > 0 {
+		n := len(queue)
+
+		if n > l.BatchSize {
+			n = l.BatchSize
+		}
+
+		if err := l.post(queue[:n]); err != nil {
+			l.ErrorLog.Printf("otlp: discarded %d access logs: %s", n, err)
+		}
+
+		queue = queue[n:]
+	}
+}
+
+// post sends a batch of entries to the collector with retries.
+func (l *OTLPLogger) post(batch []AccessLog) error {
+	body, err := json.Marshal(l.encode(batch))
+
+	if err != nil {
+		return err
+	}
+
+	backoff := l.Backoff
+
+	for attempt := 1; ; attempt++ {
+		retry, err := l.postOnce(body)
+
+		if err == nil || !retry || attempt >= l.MaxRetries {
+			return err
+		}
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+	}
+}
+
+// postOnce sends the request body and reports whether it is worth retrying.
+func (l *OTLPLogger) postOnce(body []byte) (bool, error) {
+	res, err := l.Client.Post(l.endpoint, "application/json", bytes.NewReader(body))
+
+	if err != nil {
+		return true, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("unexpected status code %d", res.StatusCode)
+
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500, err
+}
+
+// otlpValue is the JSON representation of an OTLP AnyValue.
+type otlpValue map[string]interface{}
+
+// otlpAttribute is the JSON representation of an OTLP KeyValue.
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// stringAttr returns an OTLP attribute with a string value.
+func stringAttr(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{"stringValue": value}}
+}
+
+// intAttr returns an OTLP attribute with an integer value, which the JSON
+// encoding of the protocol represents as a string.
+func intAttr(key string, value int64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+// encode converts a batch of entries into an OTLP ExportLogsServiceRequest.
+func (l *OTLPLogger) encode(batch []AccessLog) interface{} {
+	records := make([]interface{}, len(batch))
+
+	for i, data := range batch {
+		attributes := []otlpAttribute{
+			stringAttr("server.address", data.Host),
+			stringAttr("client.address", data.RemoteAddr),
+			stringAttr("http.request.method", data.Method),
+			stringAttr("url.path", data.Path),
+			stringAttr("url.query", data.Query.Encode()),
+			stringAttr("network.protocol.name", data.Protocol),
+			intAttr("http.response.status_code", int64(data.StatusCode)),
+			intAttr("http.request.body.size", data.BytesReceived),
+			intAttr("http.response.body.size", int64(data.BytesSent)),
+			stringAttr("user_agent.original", data.Header.Get("User-Agent")),
+			intAttr("http.server.request.duration_ns", data.Duration.Nanoseconds()),
+		}
+
+		for _, name := range data.fieldNames() {
+			attributes = append(attributes, stringAttr(name, data.Fields[name]))
+		}
+
+		records[i] = map[string]interface{}{
+			"timeUnixNano":   strconv.FormatInt(data.StartTime.UnixNano(), 10),
+			"severityNumber": 9,
+			"severityText":   "INFO",
+			"body":           otlpValue{"stringValue": data.CombinedLog()},
+			"attributes":     attributes,
+		}
+	}
+
+	return map[string]interface{}{
+		"resourceLogs": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{stringAttr("service.name", l.serviceName)},
+				},
+				"scopeLogs": []interface{}{
+					map[string]interface{}{
+						"scope":      map[string]interface{}{"name": "github.com/cixtor/middleware"},
+						"logRecords": records,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Registry holds the handlers and middlewares that can be referenced by name
+// in a route manifest loaded with LoadRoutes.
+type Registry struct {
+	// Handlers maps the handler names to the functions that handle requests.
+	Handlers map[string]http.HandlerFunc
+	// Middlewares maps the middleware names to the functions that wrap the
+	// handlers, with the same signature as the middlewares attached with Use.
+	Middlewares map[string]func(http.Handler) http.Handler
+}
+
+// RouteConfig is a route in a manifest loaded with LoadRoutes.
+type RouteConfig struct {
+	// Host is the host of the route. The default host is used if empty.
+	Host string `json:"host"`
+	// Method is the HTTP method of the route, e.g. "GET".
+	Method string `json:"method"`
+	// Path is the pattern of the route, e.g. "/users/:id".
+	Path string `json:"path"`
+	// Handler is the name of the handler in the registry.
+	Handler string `json:"handler"`
+	// Middlewares are the names of the middlewares in the registry that wrap
+	// the handler, in the order in which they are executed.
+	Middlewares []string `json:"middlewares"`
+}
+
+// routeManifest is the format of the file read by LoadRoutes.
+type routeManifest struct {
+	Routes []RouteConfig `json:"routes"`
+}
+
+// LoadRoutes reads a route manifest from a JSON file and registers its routes
+// with the handlers and middlewares of the registry, which allows to build the
+// router from data, for example, for generated APIs and gateways driven by a
+// configuration file.
+//
+// The whole manifest is validated before registering any route, so a missing
+// handler or an invalid pattern never leaves the router with half the routes.
+// The function returns an error after Freeze.
+//
+// Example:
+//
+//	{
+//	  "routes": [
+//	    {"method": "GET", "path": "/users/:id", "handler": "getUser"},
+//	    {"method": "POST", "path": "/users", "handler": "createUser", "middlewares": ["auth"]}
+//	  ]
+//	}
+//
+//	err := srv.LoadRoutes("routes.json", middleware.Registry{
+//	    Handlers: map[string]http.HandlerFunc{
+//	        "getUser":    getUser,
+//	        "createUser": createUser,
+//	    },
+//	    Middlewares: map[string]func(http.Handler) http.Handler{
+//	        "auth": requireToken,
+//	    },
+//	})
+func (m *Middleware) LoadRoutes(filename string, registry Registry) error {
+	data, err := os.ReadFile(filename)
+
+	if err != nil {
+		return err
+	}
+
+	var manifest routeManifest
+
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return errors.New("middleware: invalid route manifest " + filename + ": " + err.Error())
+	}
+
+	return m.ConfigureRoutes(manifest.Routes, registry)
+}
+
+// ConfigureRoutes registers the routes described by the configuration. See
+// LoadRoutes for more information.
+func (m *Middleware) ConfigureRoutes(routes []RouteConfig, registry Registry) error {
+	if m.frozen {
+		return errors.New("middleware: cannot configure routes after Freeze")
+	}
+
+	handlers := make([]http.Handler, len(routes))
+
+	for i, route := range routes {
+		handler, err := route.build(registry)
+
+		if err != nil {
+			return err
+		}
+
+		handlers[i] = handler
+	}
+
+	for i, route := range routes {
+		router := m.defaultRouter
+
+		if route.Host != "" {
+			router = m.Host(route.Host)
+		}
+
+		router.register(strings.ToUpper(route.Method), route.Path, handlers[i])
+	}
+
+	return nil
+}
+
+// build validates the route and returns the handler wrapped by its middlewares.
+func (c RouteConfig) build(registry Registry) (http.Handler, error) {
+	if c.Method == "" {
+		return nil, errors.New("middleware: route without method " + c.Path)
+	}
+
+	if err := ValidatePattern(c.Path); err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(c.Host, ":") {
+		if err := validateHostPattern(c.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	fn, ok := registry.Handlers[c.Handler]
+
+	if !ok || fn == nil {
+		return nil, errors.New("middleware: unknown handler " + c.Handler + " for " + c.Method + " " + c.Path)
+	}
+
+	var handler http.Handler = fn
+
+	for i := len(c.Middlewares) - 1; i >= 0; i-- {
+		f, ok := registry.Middlewares[c.Middlewares[i]]
+
+		if !ok || f == nil {
+			return nil, errors.New("middleware: unknown middleware " + c.Middlewares[i] + " for " + c.Method + " " + c.Path)
+		}
+
+		handler = f(handler)
+	}
+
+	return handler, nil
+}
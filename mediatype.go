@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Consumes restricts the media types of the request body accepted by the
+// route. Requests with a different "Content-Type" receive a "415 Unsupported
+// Media Type" response, with the "Accept" header listing the supported types,
+// before the handler runs. Requests without a body are always accepted. The
+// media types may use a wildcard subtype, like "image/*".
+//
+// Example:
+//
+//	srv.POST("/users", createUser).Consumes("application/json")
+func (rt *Route) Consumes(mediaTypes ...string) *Route {
+	accept := strings.Join(mediaTypes, ", ")
+
+	return rt.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentType := r.Header.Get("Content-Type")
+
+			if contentType == "" && r.ContentLength == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mediaType, _, err := mime.ParseMediaType(contentType)
+
+			if err == nil {
+				for _, allowed := range mediaTypes {
+					if mediaTypeMatches(allowed, mediaType) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+
+			w.Header().Set("Accept", accept)
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		})
+	})
+}
+
+// Produces declares the media types of the responses of the route, in order
+// of preference. Requests whose "Accept" header excludes all of them receive
+// a "406 Not Acceptable" response before the handler runs. Otherwise, the
+// preferred type accepted by the client is set as the "Content-Type" of the
+// response, unless the handler sets a different one.
+//
+// Example:
+//
+//	srv.GET("/users/:id", showUser).Produces("application/json", "application/xml")
+func (rt *Route) Produces(mediaTypes ...string) *Route {
+	return rt.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mediaType := negotiate(r.Header.Values("Accept"), mediaTypes)
+
+			if mediaType == "" {
+				http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+				return
+			}
+
+			w.Header().Set("Content-Type", mediaType)
+			w.Header().Add("Vary", "Accept")
+
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// negotiate returns the offered media type with the highest quality in the
+// values of the "Accept" header, preferring the first offers on ties, or an
+// empty string if the client accepts none of them. An empty header accepts
+// any media type.
+func negotiate(accept []string, offers []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+
+	if len(accept) == 0 {
+		return offers[0]
+	}
+
+	var best string
+	var bestQ float64
+
+	for _, offer := range offers {
+		q := acceptQuality(accept, offer)
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best
+}
+
+// acceptQuality returns the quality value of the most specific range in the
+// values of the "Accept" header that matches the media type, or zero.
+func acceptQuality(accept []string, mediaType string) float64 {
+	var q float64
+	specificity := -1
+
+	for _, value := range accept {
+		for _, part := range strings.Split(value, ",") {
+			pattern, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+			if err != nil || !mediaTypeMatches(pattern, mediaType) {
+				continue
+			}
+
+			// "type/subtype" overrides "type/*", which overrides "*/*".
+			s := 2 - strings.Count(pattern, "*")
+
+			if s <= specificity {
+				continue
+			}
+
+			specificity = s
+			q = 1
+
+			if value, ok := params["q"]; ok {
+				if f, err := strconv.ParseFloat(value, 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+
+	return q
+}
+
+// mediaTypeMatches reports whether the media type matches the pattern, which
+// is either a media type, a type with a wildcard subtype, like "text/*", or
+// the "*/*" wildcard. The comparison is case-insensitive and ignores the
+// parameters of the pattern.
+func mediaTypeMatches(pattern string, mediaType string) bool {
+	if i := strings.IndexByte(pattern, ';'); i >= 0 {
+		pattern = pattern[:i]
+	}
+
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	mediaType = strings.ToLower(mediaType)
+
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, pattern[:len(pattern)-1])
+	}
+
+	return false
+}
@@ -3,8 +3,12 @@ package middleware
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,6 +39,85 @@ type Middleware struct {
 	// Ref: https://en.wikipedia.org/wiki/Server_log
 	Logger Logger
 
+	// AuditLogger receives the audit records of the routes marked as audited
+	// with Middleware.Audit. Audit records are separate from the access logs,
+	// and are meant to be stored in a secure location.
+	AuditLogger AuditLogger
+
+	// AuditActor returns the identity of the user that sent the request to an
+	// audited route, usually from the request context populated by one of the
+	// authentication middlewares attached with Middleware.Use.
+	AuditActor func(*http.Request) string
+
+	// LogHeaders is an optional list of request headers to copy into the
+	// access log. By default, AccessLog.Header holds a reference to the full
+	// request header map, which handlers and middlewares can modify, and that
+	// asynchronous loggers keep in memory until they process the entry. When
+	// the list is not empty, the access log receives a snapshot containing
+	// only these headers.
+	//
+	// Example:
+	//
+	//	srv.LogHeaders = []string{"Referer", "User-Agent"}
+	LogHeaders []string
+
+	// LogTrailers attaches the HTTP trailers set by the handler, if any, to the
+	// access log. Trailers are commonly used by gRPC-style services to send the
+	// status of the request and by file servers to send a checksum of the data
+	// after the response body.
+	LogTrailers bool
+
+	// HostFallback is the behavior of the router for requests whose Host header
+	// does not match any of the hosts registered with Middleware.Host. By
+	// default, the router of the default host handles such requests.
+	HostFallback HostFallback
+
+	// CanonicalHost is the host where FallbackRedirect sends the clients.
+	CanonicalHost string
+
+	// Now returns the current time, and is used to compute the start time and
+	// the duration of the requests recorded in the access and audit logs. If
+	// nil, the router uses time.Now. Replace it in tests of custom loggers and
+	// log formatters that need a deterministic output.
+	//
+	// Example:
+	//
+	//	tick := time.Date(2019, 12, 10, 13, 55, 36, 0, time.UTC)
+	//	srv.Now = func() time.Time { tick = tick.Add(time.Millisecond); return tick }
+	Now func() time.Time
+
+	// Debug writes the decisions of the router into ErrorLog for every request,
+	// including the cleaned path, the parameters captured, the static segments
+	// preferred over parameters, and the reason a request did not match any
+	// route. Do not enable it in production, because it logs every request.
+	Debug bool
+
+	// RawParams passes the named parameters to the handlers with the original
+	// percent-encoding, for example, "%40babel" instead of "@babel".
+	//
+	// By default, the router matches the routes against the decoded URL path,
+	// so the parameters are decoded too, and an encoded slash, "%2F", is a
+	// path separator, the same as "/". With RawParams, the router matches the
+	// routes against the escaped path instead, so an encoded slash remains in
+	// the parameter, for example, "a%2Fb" for "/files/:name", and the handler
+	// decides how to decode the value with url.PathUnescape. Routes with
+	// static segments that require escaping must be registered escaped.
+	RawParams bool
+
+	// StrictPaths rejects the requests whose URL path can be interpreted in
+	// more than one way with "400 Bad Request", instead of normalizing them.
+	// This includes the paths with dot segments, like "/a/../b", empty
+	// segments, like "/a//b", invalid UTF-8, control characters, and
+	// percent-encoded slashes, backslashes, dots and percent signs, which are
+	// commonly used to bypass the access rules enforced by other layers, like
+	// a reverse proxy or a web application firewall.
+	StrictPaths bool
+
+	// StrictRoutes prevents the web server from starting when some routes are
+	// shadowed by other routes. See RouteConflicts. By default, the conflicts
+	// are only written into ErrorLog.
+	StrictRoutes bool
+
 	// ErrorLog specifies an optional logger for errors accepting connections,
 	// unexpected behavior from handlers, and underlying FileSystem errors. If
 	// nil, logging is done via the log package's standard logger.
@@ -56,6 +139,51 @@ type Middleware struct {
 	// Wide Web.
 	NotFound http.Handler
 
+	// MethodNotAllowed handles the requests to endpoints that exist under
+	// other HTTP methods, for example, a DELETE request to a route that only
+	// accepts GET and POST. The router sets the "Allow" header with the list
+	// of methods of the route before the handler runs, as required by RFC
+	// 9110. Requests to endpoints that do not exist under any method are
+	// handled by NotFound. The default handler responds with "405 Method Not
+	// Allowed".
+	MethodNotAllowed http.Handler
+
+	// NotFoundSuggestions is the maximum number of registered paths, similar
+	// to the requested one, that the default NotFound handler suggests to the
+	// client, for example, "/users/42" for "/user/42", as JSON, HTML or plain
+	// text, depending on the "Accept" header, which helps the developers that
+	// integrate with an API. The suggestions reveal the routes of the host, so
+	// only enable them if the routes are not secret. Default: 0, disabled.
+	NotFoundSuggestions int
+
+	// DisableAutoHead stops the router from serving the HEAD requests to the
+	// routes that only have a GET handler. By default, the router executes the
+	// GET handler and discards the response body, so the clients receive the
+	// same status code and headers, including the Content-Length, if the
+	// handler sets it, like http.ServeContent does, without registering the
+	// routes twice. A HEAD handler registered for the same path takes
+	// precedence.
+	DisableAutoHead bool
+
+	// GRPC handles the gRPC requests, which are HTTP/2 requests with the
+	// "application/grpc" content type, allowing a grpc.Server to share the
+	// same port with the router. The requests skip the routes and middleware
+	// chain, but are still written into the access log. Notice that gRPC
+	// clients require HTTP/2, which Go only enables on TLS connections, so
+	// start the web server with ListenAndServeTLS.
+	//
+	// Example:
+	//
+	//	grpcServer := grpc.NewServer()
+	//	pb.RegisterGreeterServer(grpcServer, &greeter{})
+	//	srv.GRPC = grpcServer
+	GRPC http.Handler
+
+	// GRPCWeb handles the gRPC-Web requests, which are HTTP/1.1 or HTTP/2
+	// requests with the "application/grpc-web" content type, usually sent by
+	// web browsers, to a gRPC-Web proxy that wraps the grpc.Server.
+	GRPCWeb http.Handler
+
 	// ReadTimeout is the maximum duration for reading the entire request,
 	// including the body. Because ReadTimeout does not let Handlers make
 	// per-request decisions on each request body's acceptable deadline or
@@ -89,6 +217,20 @@ type Middleware struct {
 	// Default: 2s
 	IdleTimeout time.Duration
 
+	// RequestBudget is the maximum duration of each request. The context of
+	// the request expires when the budget runs out, so the operations that
+	// accept a context, like database queries and outgoing HTTP requests,
+	// give up instead of working on a response that nobody will read. The
+	// handlers can read the remaining time with r.Context().Deadline().
+	//
+	// Default: 0 (no deadline).
+	RequestBudget time.Duration
+
+	// RequestTimeoutHeaders enables the timeouts sent by the clients in the
+	// "X-Request-Timeout" and "Grpc-Timeout" headers, which shorten the
+	// deadline of the request, but never extend it beyond RequestBudget.
+	RequestTimeoutHeaders bool
+
 	// ShutdownTimeout is the maximum duration before cancelling the server
 	// shutdown context. This allows the developer to guarantee the termination
 	// of the server even if a client is keeping a connection idle.
@@ -105,10 +247,80 @@ type Middleware struct {
 	// shutdown, but should not wait for shutdown to complete.
 	OnShutdown func()
 
+	// ShutdownHandler responds to the requests received while the server is
+	// shutting down, which otherwise race against the closure of the listeners
+	// and the idle connections. The requests already in progress are not
+	// affected. Default: "503 Service Unavailable" with "Connection: close",
+	// so the load balancers retry the request on a different instance.
+	ShutdownHandler http.Handler
+
+	// ServeDuringShutdown routes the requests received while the server is
+	// shutting down as usual, instead of passing them to ShutdownHandler.
+	ServeDuringShutdown bool
+
 	chain func(http.Handler) http.Handler
 
+	chainNames []string
+
+	beforeHooks []func(http.ResponseWriter, *http.Request) *http.Request
+
+	afterHooks []func(AccessLog)
+
+	panicReport func(PanicEvent)
+
+	authorize func(*http.Request, []string) error
+
+	logFields []logField
+
+	jobs jobs
+
 	hosts map[string]*router
 
+	// defaultRouter is the router of the default host, which is never removed
+	// from hosts, so the methods that register routes without a host read it
+	// without holding hostsMu.
+	defaultRouter *router
+
+	vars *serverVars
+
+	routeStats *routeStats
+
+	healthChecks []HealthCheck
+
+	shuttingDown int32
+
+	startTime time.Time
+
+	inflight *inflight
+
+	shedder *shedder
+
+	connLimiter *connLimiter
+
+	cors *CORSConfig
+
+	errorPages map[int]http.Handler
+
+	frozen bool
+
+	shutdown chan struct{}
+
+	trustedProxies []*net.IPNet
+
+	defaultHost string
+
+	hostPatterns []hostPattern
+
+	hostsMu sync.RWMutex
+
+	envAddress string
+
+	envCertFile string
+
+	envKeyFile string
+
+	audit auditChain
+
 	serverInstance *http.Server
 }
 
@@ -128,6 +340,15 @@ var paramsKey = contextKey("MiddlewareParameter")
 // an instance of `middleware.New()`. You can also writes the logs to a buffer
 // or any other Go logger interface defined as `log.New()`.
 //
+// The options, if any, are applied after the default values are set.
+//
+// Example:
+//
+//	srv := middleware.New(
+//	    middleware.WithReadTimeout(5*time.Second),
+//	    middleware.WithLogger(logger),
+//	)
+//
 // Default timeout settings:
 //
 //   - ReadTimeout: 2s
@@ -155,11 +376,12 @@ var paramsKey = contextKey("MiddlewareParameter")
 //	│                                                                              │
 //	│                                      ├──http.TimeoutHandler──┤               │
 //	└──────────────────────────────────────────────────────────────────────────────┘
-func New() *Middleware {
+func New(options ...Option) *Middleware {
 	m := new(Middleware)
 
 	m.Logger = NewBasicLogger() /* basic access log */
-	m.hosts = map[string]*router{nohost: newRouter()}
+	m.defaultRouter = newRouter(m)
+	m.hosts = map[string]*router{nohost: m.defaultRouter}
 	m.OnShutdown = func() { /* shutting down... */ }
 
 	// Default timeout values.
@@ -169,9 +391,22 @@ func New() *Middleware {
 	m.IdleTimeout = time.Second * 2
 	m.ShutdownTimeout = time.Millisecond * 100
 
+	for _, option := range options {
+		option(m)
+	}
+
 	return m
 }
 
+// now returns the current time using the clock configured in Middleware.Now.
+func (m *Middleware) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+
+	return time.Now()
+}
+
 // compose follows the HTTP handler chain to execute additional middlewares.
 func compose(f, g func(http.Handler) http.Handler) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
@@ -209,6 +444,20 @@ func compose(f, g func(http.Handler) http.Handler) func(http.Handler) http.Handl
 //	    })
 //	}
 func (m *Middleware) Use(f func(http.Handler) http.Handler) {
+	m.UseNamed(funcName(f), f)
+}
+
+// UseNamed adds a middleware to the global middleware chain, like Use, with a
+// name that identifies the middleware in Middleware.Chain and the status page.
+// This is useful for middlewares created by other functions, which are named
+// after the enclosing function by the Go runtime, e.g. "AllowOnly.func1".
+func (m *Middleware) UseNamed(name string, f func(http.Handler) http.Handler) {
+	if m.frozen {
+		panic("middleware: cannot add middleware " + name + " after Freeze")
+	}
+
+	m.chainNames = append(m.chainNames, name)
+
 	if m.chain == nil {
 		m.chain = f
 		return
@@ -217,44 +466,241 @@ func (m *Middleware) Use(f func(http.Handler) http.Handler) {
 	m.chain = compose(f, m.chain)
 }
 
+// Chain returns the names of the middlewares attached with Middleware.Use, in
+// the same order in which they are executed.
+func (m *Middleware) Chain() []string {
+	return append([]string(nil), m.chainNames...)
+}
+
+// Wrap returns the handler wrapped by the middleware chain, the same way the
+// router wraps the handler of a route. Tests can use it to execute the chain
+// against a fake handler to assert the order and effect of the middlewares
+// without a web server.
+//
+// Example:
+//
+//	h := srv.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+//	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+func (m *Middleware) Wrap(handler http.Handler) http.Handler {
+	if m.chain == nil {
+		return handler
+	}
+
+	return m.chain(handler)
+}
+
 // ServeHTTP dispatches the request to the handler whose pattern most closely
 // matches the request URL. Additional to the standard functionality this also
 // logs every direct HTTP request into the standard output.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	myRouter := m.hosts[nohost]
+	r, fwd := m.withForwarded(r)
+	start := m.now()
+
+	r, cancel := m.withBudget(r)
+
+	if cancel != nil {
+		defer cancel()
+	}
+
+	writer := response{
+		ResponseWriter: w,
+		head:           r.Method == http.MethodHead,
+		errorPages:     m.errorPages,
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), responseKey, &writer))
+	writer.request = r
+
+	var handled bool
+
+	for _, hook := range m.beforeHooks {
+		next := hook(&writer, r)
+
+		if next == nil {
+			// the hook already sent a response, skip the routing.
+			handled = true
+			break
+		}
+
+		r = next
+	}
+
+	if !handled && !m.ServeDuringShutdown && atomic.LoadInt32(&m.shuttingDown) == 1 {
+		m.shutdownHandler().ServeHTTP(&writer, r)
+		handled = true
+	}
 
-	// Use the host specific router, if available.
-	if hostRouter, ok := m.hosts[r.Host]; ok && hostRouter != nil {
-		myRouter = hostRouter
+	if !handled && m.shedder != nil {
+		if m.shedder.acquire(r) {
+			defer m.shedder.release()
+		} else {
+			m.shedder.reject(&writer)
+			writer.shed = true
+			handled = true
+		}
 	}
 
-	if myRouter == nil {
+	if !handled && !validateHostname(r.Host) {
+		// reject malformed hosts before they reach the routing.
+		http.Error(&writer, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		handled = true
+	}
+
+	host := normalizeHost(r.Host)
+
+	m.hostsMu.RLock()
+	myRouter, ok := m.hosts[host]
+
+	var fallback http.Handler
+
+	if !ok && len(m.hostPatterns) > 0 {
+		if p, value, found := m.matchHostPattern(host); found {
+			host, myRouter, ok = p.key, m.hosts[p.key], true
+			r = withHostParam(r, p.param, value)
+		}
+	}
+
+	// Use the fallback behavior if there is no host specific router.
+	if !ok || myRouter == nil {
+		host, myRouter, fallback = m.fallback(r)
+	}
+
+	m.hostsMu.RUnlock()
+
+	if !handled && myRouter == nil && fallback == nil {
 		http.Error(w, "Unexpected host "+r.Host, http.StatusInternalServerError)
 		return
 	}
 
-	start := time.Now()
-	writer := response{w, 0, 0}
-	m.handleRequest(myRouter, &writer, r)
-	dur := time.Since(start)
-
-	m.Logger.Log(AccessLog{
-		StartTime:     start,
-		Host:          r.Host,
-		RemoteAddr:    r.RemoteAddr,
-		Method:        r.Method,
-		Path:          r.URL.Path,
-		Query:         r.URL.Query(),
-		Protocol:      r.Proto,
-		StatusCode:    writer.Status,
-		BytesReceived: r.ContentLength,
-		BytesSent:     writer.Length,
-		Header:        r.Header,
-		Duration:      dur,
-	})
+	if m.inflight != nil {
+		m.inflight.add(&writer, r, start)
+		defer m.inflight.remove(&writer)
+	}
+
+	if myRouter != nil && myRouter.limits != nil {
+		myRouter.limits.apply(w, r, start)
+	}
+
+	var pattern string
+
+	switch {
+	case handled:
+		// the response was sent by a before hook or the load shedder.
+	case fallback != nil:
+		fallback.ServeHTTP(&writer, r)
+	default:
+		pattern = m.handleRequest(myRouter, &writer, r)
+	}
+
+	if writer.tooLarge {
+		m.requestLogf(&writer, r, "middleware: response of %s %s%s exceeds %d bytes (route=%q)", r.Method, r.Host, r.URL.Path, writer.route.maxResponseSize, pattern)
+	}
+
+	dur := m.now().Sub(start)
+
+	if m.vars != nil {
+		m.vars.countRequest(writer.status)
+	}
+
+	if m.routeStats != nil && pattern != "" {
+		m.routeStats.record(host, r.Method, pattern, writer.status, dur)
+	}
+
+	if writer.route != nil && writer.route.slo != nil {
+		writer.route.slo.record(writer.route, dur, start)
+	}
+
+	var trailer http.Header
+
+	if m.LogTrailers {
+		trailer = writer.trailer()
+	}
+
+	entry := AccessLog{
+		StartTime:         start,
+		Host:              r.Host,
+		RemoteAddr:        r.RemoteAddr,
+		Scheme:            Scheme(r),
+		Method:            r.Method,
+		Path:              r.URL.Path,
+		Query:             r.URL.Query(),
+		Protocol:          r.Proto,
+		StatusCode:        writer.status,
+		BytesReceived:     r.ContentLength,
+		BytesSent:         writer.length,
+		ContentLength:     writer.contentLength(),
+		BytesUncompressed: writer.bytesUncompressed(),
+		ContentEncoding:   w.Header().Get("Content-Encoding"),
+		Header:            m.logHeader(r.Header),
+		Trailer:           trailer,
+		Duration:          dur,
+		Timings:           writer.timings,
+		Variant:           writer.variant,
+		Shed:              writer.shed,
+		RequestID:         writer.requestID,
+	}
+
+	if entry.RequestID == "" {
+		entry.RequestID = RequestID(r)
+	}
+
+	if writer.verbose {
+		entry.Verbose = true
+		entry.Header = r.Header.Clone()
+		entry.ResponseHeader = w.Header().Clone()
+		entry.Params = writer.params
+		entry.Notes = writer.notes
+	}
+
+	if len(m.logFields) > 0 {
+		if writer.handlerRequest != nil {
+			entry.Fields = m.logFieldValues(writer.handlerRequest)
+		} else {
+			entry.Fields = m.logFieldValues(r)
+		}
+	}
+
+	if fwd != nil && fwd.For != "" {
+		entry.RemoteAddr = fwd.For
+	}
+
+	if fwd != nil && fwd.Host != "" {
+		entry.Host = fwd.Host
+	}
+
+	if !writer.noLog {
+		m.Logger.Log(entry)
+	}
+
+	for _, hook := range m.afterHooks {
+		hook(entry)
+	}
+
+	if writer.aborted {
+		// the response was truncated, abort it so the client notices.
+		panic(http.ErrAbortHandler)
+	}
 }
 
-// handleRequest responds to an HTTP request.
+// logHeader returns the request headers that are attached to the access log.
+func (m *Middleware) logHeader(h http.Header) http.Header {
+	if len(m.LogHeaders) == 0 {
+		return h
+	}
+
+	snapshot := make(http.Header, len(m.LogHeaders))
+
+	for _, key := range m.LogHeaders {
+		if values := h.Values(key); len(values) > 0 {
+			snapshot[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+		}
+	}
+
+	return snapshot
+}
+
+// handleRequest responds to an HTTP request and returns the pattern of the
+// route that handled the request, or an empty string if there was no match.
 //
 // The function selects the HTTP handler by traversing a tree that contains a
 // list of all the defined URLs without the dynamic parameters (if any). If the
@@ -287,28 +733,183 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // the defined URL. This is because trailing slashes are ignored, so even the
 // first attempt (which is similar to what the HTTP handler is expecting) will
 // fail as there is not enough data to set the value for the "group" parameter.
-func (m *Middleware) handleRequest(router *router, w http.ResponseWriter, r *http.Request) {
+func (m *Middleware) handleRequest(router *router, w *response, r *http.Request) string {
+	if m.panicReport != nil {
+		defer m.recoverPanic(w, r)
+	}
+
+	if !router.isAllowed(r) {
+		// Client outside the allowed networks, return "403 Forbidden".
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return ""
+	}
+
+	if handler := m.grpcHandler(r); handler != nil {
+		handler.ServeHTTP(w, r)
+		return ""
+	}
+
+	if router.redirect != "" {
+		http.Redirect(w, r, router.redirect+r.URL.RequestURI(), router.redirectStatus)
+		return ""
+	}
+
+	if m.cors != nil && m.handleCORS(router, w, r) {
+		return ""
+	}
+
 	ends, ok := router.nodes[r.Method]
 
-	if !ok {
-		// HTTP method not allowed, return "405 Method Not Allowed".
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		return
+	if !ok && m.Debug {
+		m.logf("middleware: debug: %s %s: no routes for method %s on host %s", r.Method, r.URL.Path, r.Method, r.Host)
 	}
 
 	if r.URL.Path == "" || r.URL.Path[0] != '/' {
 		// URL prefix is invalid, return "400 Bad Request".
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+		return ""
+	}
+
+	if !isPrintablePath(r.URL.Path) {
+		// URL path has control characters or invalid UTF-8, return "400 Bad Request".
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return ""
 	}
 
-	handler, params := m.findHandler(r, ends)
+	if m.StrictPaths && !isCanonicalPath(r) {
+		// URL path is ambiguous, return "400 Bad Request".
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return ""
+	}
+
+	var node *privTrieNode
+	var params map[string]string
+
+	if ok {
+		node, params = m.findHandler(r, ends)
+	}
+
+	if node == nil && r.Method == http.MethodHead && !m.DisableAutoHead {
+		if get, exists := router.nodes[http.MethodGet]; exists {
+			// HEAD request to a route with only a GET handler, execute it
+			// without sending the response body.
+			if node, params = m.findHandler(r, get); node != nil {
+				w.discard = true
+			}
+		}
+	}
+
+	if node == nil {
+		if allowed := router.allowedMethods(m.requestPath(r), !m.DisableAutoHead); len(allowed) > 0 {
+			// HTTP route exists under other methods, return "405 Method Not Allowed".
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			m.serveHandler(m.methodNotAllowedHandler(), w, r)
+			return ""
+		}
+
+		// HTTP route not found, return "404 Not Found".
+		m.serveHandler(m.notFoundHandler(router), w, r)
+		return ""
+	}
+
+	if m.inflight != nil {
+		m.inflight.match(w, node.pattern)
+	}
+
+	w.route = node.route
+
+	if node.route != nil && node.route.noLog {
+		w.noLog = true
+	}
+
+	if node.route != nil && node.route.maxResponseSize > 0 {
+		w.maxBytes = node.route.maxResponseSize
+	}
+
+	if node.route != nil && node.route.headers != nil {
+		h := w.Header()
+
+		for key, values := range node.route.headers {
+			h[key] = append([]string(nil), values...)
+		}
+	}
+
+	if node.route != nil && node.route.deprecation != nil {
+		node.route.deprecation.use(w, m.now())
+	}
+
+	handler := node.handler
+
+	if node.audited {
+		audit := &auditRequest{start: m.now()}
+		handler = audit.wrap(handler)
+		defer func() { m.writeAudit(audit, node.pattern, params, w, r) }()
+	}
+
+	composed := !node.audited && node.composed != nil
+
+	if !composed {
+		handler = m.withLogFields(handler)
+	}
+
+	if len(m.hostPatterns) > 0 {
+		// merge the subdomain parameter, if any, with the route parameters.
+		hostParams, _ := r.Context().Value(paramsKey).(map[string]string)
+
+		if params == nil && len(hostParams) > 0 {
+			params = map[string]string{}
+		}
+
+		for key, value := range hostParams {
+			if _, exists := params[key]; !exists {
+				params[key] = value
+			}
+		}
+	}
 
 	if len(params) > 0 {
 		// insert request parameters into the request context.
+		w.params = params
 		r = r.WithContext(context.WithValue(r.Context(), paramsKey, params))
 	}
 
+	if composed {
+		// the middleware chain was composed by Freeze.
+		node.composed.ServeHTTP(w, r)
+		return node.pattern
+	}
+
+	m.serveHandler(handler, w, r)
+
+	return node.pattern
+}
+
+// grpcHandler returns the gRPC or gRPC-Web handler, if the request is meant
+// for one of them, or nil otherwise.
+func (m *Middleware) grpcHandler(r *http.Request) http.Handler {
+	if m.GRPC == nil && m.GRPCWeb == nil {
+		return nil
+	}
+
+	contentType := r.Header.Get("Content-Type")
+
+	if !strings.HasPrefix(contentType, "application/grpc") {
+		return nil
+	}
+
+	if strings.HasPrefix(contentType, "application/grpc-web") {
+		return m.GRPCWeb
+	}
+
+	if r.ProtoMajor == 2 {
+		return m.GRPC
+	}
+
+	return nil
+}
+
+// serveHandler executes the HTTP handler after the middleware chain, if any.
+func (m *Middleware) serveHandler(handler http.Handler, w http.ResponseWriter, r *http.Request) {
 	if m.chain != nil {
 		// pass request through other middlewares.
 		m.chain(handler).ServeHTTP(w, r)
@@ -320,134 +921,252 @@ func (m *Middleware) handleRequest(router *router, w http.ResponseWriter, r *htt
 
 // notFoundHandler returns a request handler that replies to each request with
 // a "404 page not found" message, either using custom code attached to the
-// router via Middleware.NotFound or with the default Go HTTP package.
-func (m *Middleware) notFoundHandler() http.Handler {
+// router via Middleware.NotFound or with the default Go HTTP package, plus the
+// similar paths of the router, if not nil, see NotFoundSuggestions.
+func (m *Middleware) notFoundHandler(router *router) http.Handler {
 	if m.NotFound != nil {
 		// custom 404 http handler.
 		return m.NotFound
 	}
 
+	if router != nil && m.NotFoundSuggestions > 0 {
+		// default 404 http handler with "did you mean" suggestions.
+		return m.suggestHandler(router)
+	}
+
 	// default 404 http handler.
 	return http.NotFoundHandler()
 }
 
-// findHandler returns a request handler that corresponds to the request URL.
-func (m *Middleware) findHandler(r *http.Request, t *privTrie) (http.Handler, map[string]string) {
+// methodNotAllowedHandler returns a request handler that replies to each
+// request with a "405 Method Not Allowed" message, either using custom code
+// attached to the router via Middleware.MethodNotAllowed or the default one.
+// The router sets the "Allow" header before the handler runs.
+func (m *Middleware) methodNotAllowedHandler() http.Handler {
+	if m.MethodNotAllowed != nil {
+		// custom 405 http handler.
+		return m.MethodNotAllowed
+	}
+
+	// default 405 http handler.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+}
+
+// shutdownHandler returns the handler for the requests received while the
+// server is shutting down, either Middleware.ShutdownHandler or the default.
+func (m *Middleware) shutdownHandler() http.Handler {
+	if m.ShutdownHandler != nil {
+		return m.ShutdownHandler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	})
+}
+
+// findHandler returns the trie node that corresponds to the request URL and
+// the values of the named parameters. The node is nil if there is no match.
+func (m *Middleware) findHandler(r *http.Request, t *privTrie) (*privTrieNode, map[string]string) {
+	urlPath := m.requestPath(r)
+
+	if t.Reject(urlPath) {
+		// Fast path for requests that cannot match any of the routes.
+		if m.Debug {
+			m.logf("middleware: debug: %s %s: no route starts with %q", r.Method, r.URL.Path, urlPath[:2])
+		}
+		return nil, nil
+	}
+
+	reqPath := cleanRequestPath(urlPath)
+
+	if !m.Debug {
+		if node, ok := t.static[reqPath]; ok {
+			return node, nil
+		}
+
+		ok, node, params := t.Search(reqPath)
+
+		if !ok {
+			return nil, nil
+		}
+
+		return node, params
+	}
+
+	prefix := "middleware: debug: " + r.Method + " " + r.URL.Path + ": "
+
+	if reqPath != urlPath {
+		m.logf(prefix+"path cleaned to %q", reqPath)
+	}
+
+	ok, node, params := t.search(reqPath, func(format string, v ...interface{}) {
+		m.logf(prefix+format, v...)
+	})
+
+	if !ok {
+		m.logf(prefix + "no match")
+		return nil, nil
+	}
+
+	m.logf(prefix+"matched %s", node.pattern)
+
+	return node, params
+}
+
+// requestPath returns the URL path used to find the route, which keeps the
+// escaped characters, other than the dot segments, if RawParams is enabled.
+func (m *Middleware) requestPath(r *http.Request) string {
+	if m.RawParams {
+		return decodeDotSegments(r.URL.EscapedPath())
+	}
+
+	return r.URL.Path
+}
+
+// cleanRequestPath returns the URL path without dot segments and duplicate
+// slashes, like path.Clean, but keeps the trailing slash, if any.
+func cleanRequestPath(urlPath string) string {
 	// TODO: optimize; this adds approximately 1100 ns/op.
-	reqPath := path.Clean(r.URL.Path)
+	reqPath := path.Clean(urlPath)
 
 	// If the original URL has a trailing slash, add it back after cleanup, but
 	// make sure it is only one. This way the web server can render blind index
 	// pages, even when the URLs are cleaned. Omit operation when the cleaned
 	// request path already points to a blind index page.
-	if reqPath != string(sep) && r.URL.Path[len(r.URL.Path)-1] == sep {
+	if reqPath != string(sep) && urlPath[len(urlPath)-1] == sep {
 		reqPath += string(sep)
 	}
 
-	ok, handler, params := t.Search(reqPath)
-
-	if !ok {
-		return m.notFoundHandler(), nil
-	}
-
-	return handler, params
+	return reqPath
 }
 
 // Host registers a new Top-Level Domain (TLD), if necessary, and then returns
 // a pointer to the associated router, which users can use to register an HTTP
 // handler of type GET, POST, PUT, PATCH, DELETE, HEAD or OPTIONS to handle
 // requests when req.Host == tld.
+//
+// The first label of the host name can be a named parameter, for example,
+// ":tenant.example.com" matches "acme.example.com", and the handlers can read
+// the value of the subdomain with middleware.Param(r, "tenant"). Hosts without
+// parameters take precedence over the patterns.
+//
+// Host is meant for the configuration of the web server before it starts.
+// The routes are registered while the host is visible to the web server, and
+// the router does not lock its routes, so use AddHost to add a host to a
+// running web server.
 func (m *Middleware) Host(tld string) *router {
+	m.hostsMu.Lock()
+	defer m.hostsMu.Unlock()
+
+	if strings.HasPrefix(tld, ":") {
+		tld = m.addHostPattern(tld)
+	} else {
+		tld = normalizeHost(tld)
+	}
+
 	if _, ok := m.hosts[tld]; !ok {
-		m.hosts[tld] = newRouter()
+		if m.frozen {
+			panic("middleware: cannot add host " + tld + " after Freeze")
+		}
+
+		m.hosts[tld] = newRouter(m)
 	}
 
 	return m.hosts[tld]
 }
 
+// Group returns a router that registers the routes under the prefix in the
+// default host. See the Group method of the host router.
+func (m *Middleware) Group(prefix string) *router {
+	return m.defaultRouter.Group(prefix)
+}
+
 // Handle registers the handler for the given pattern.
-func (m *Middleware) Handle(method string, path string, fn http.HandlerFunc) {
-	m.hosts[nohost].Handle(method, path, fn)
+func (m *Middleware) Handle(method string, path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.Handle(method, path, fn)
 }
 
 // GET registers a GET endpoint for the default host.
-func (m *Middleware) GET(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].GET(path, fn)
+func (m *Middleware) GET(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.GET(path, fn)
 }
 
 // POST registers a POST endpoint for the default host.
-func (m *Middleware) POST(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].POST(path, fn)
+func (m *Middleware) POST(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.POST(path, fn)
 }
 
 // PUT registers a PUT endpoint for the default host.
-func (m *Middleware) PUT(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].PUT(path, fn)
+func (m *Middleware) PUT(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.PUT(path, fn)
 }
 
 // PATCH registers a PATCH endpoint for the default host.
-func (m *Middleware) PATCH(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].PATCH(path, fn)
+func (m *Middleware) PATCH(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.PATCH(path, fn)
 }
 
 // DELETE registers a DELETE endpoint for the default host.
-func (m *Middleware) DELETE(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].DELETE(path, fn)
+func (m *Middleware) DELETE(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.DELETE(path, fn)
 }
 
 // HEAD registers a HEAD endpoint for the default host.
-func (m *Middleware) HEAD(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].HEAD(path, fn)
+func (m *Middleware) HEAD(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.HEAD(path, fn)
 }
 
 // OPTIONS registers an OPTIONS endpoint for the default host.
-func (m *Middleware) OPTIONS(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].OPTIONS(path, fn)
+func (m *Middleware) OPTIONS(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.OPTIONS(path, fn)
 }
 
 // CONNECT registers a CONNECT endpoint for the default host.
-func (m *Middleware) CONNECT(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].CONNECT(path, fn)
+func (m *Middleware) CONNECT(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.CONNECT(path, fn)
 }
 
 // TRACE registers a TRACE endpoint for the default host.
-func (m *Middleware) TRACE(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].TRACE(path, fn)
+func (m *Middleware) TRACE(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.TRACE(path, fn)
 }
 
 // COPY registers a WebDAV COPY endpoint for the default host.
-func (m *Middleware) COPY(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].COPY(path, fn)
+func (m *Middleware) COPY(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.COPY(path, fn)
 }
 
 // LOCK registers a WebDAV LOCK endpoint for the default host.
-func (m *Middleware) LOCK(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].LOCK(path, fn)
+func (m *Middleware) LOCK(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.LOCK(path, fn)
 }
 
 // MKCOL registers a WebDAV MKCOL endpoint for the default host.
-func (m *Middleware) MKCOL(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].MKCOL(path, fn)
+func (m *Middleware) MKCOL(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.MKCOL(path, fn)
 }
 
 // MOVE registers a WebDAV MOVE endpoint for the default host.
-func (m *Middleware) MOVE(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].MOVE(path, fn)
+func (m *Middleware) MOVE(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.MOVE(path, fn)
 }
 
 // PROPFIND registers a WebDAV PROPFIND endpoint for the default host.
-func (m *Middleware) PROPFIND(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].PROPFIND(path, fn)
+func (m *Middleware) PROPFIND(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.PROPFIND(path, fn)
 }
 
 // PROPPATCH registers a WebDAV PROPPATCH endpoint for the default host.
-func (m *Middleware) PROPPATCH(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].PROPPATCH(path, fn)
+func (m *Middleware) PROPPATCH(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.PROPPATCH(path, fn)
 }
 
 // UNLOCK registers a WebDAV UNLOCK endpoint for the default host.
-func (m *Middleware) UNLOCK(path string, fn http.HandlerFunc) {
-	m.hosts[nohost].UNLOCK(path, fn)
+func (m *Middleware) UNLOCK(path string, fn http.HandlerFunc) *Route {
+	return m.defaultRouter.UNLOCK(path, fn)
 }
 
 // STATIC registers an endpoint to handle GET and POST requests to static files
@@ -455,5 +1174,22 @@ func (m *Middleware) UNLOCK(path string, fn http.HandlerFunc) {
 // The function returns "404 Not Found" if the file does not exist or if the
 // client is trying to execute a directory listing attack.
 func (m *Middleware) STATIC(folder string, urlPrefix string) {
-	m.hosts[nohost].STATIC(folder, urlPrefix)
+	m.defaultRouter.STATIC(folder, urlPrefix)
+}
+
+// StaticPolicy sets the Content-Security-Policy of the HTML files served by
+// STATIC under the URL prefix for the default host.
+func (m *Middleware) StaticPolicy(urlPrefix string, policy ContentSecurityPolicy) {
+	m.defaultRouter.StaticPolicy(urlPrefix, policy)
+}
+
+// UPLOAD registers the endpoints to upload files into a folder for the default
+// host. See UploadConfig for the size limits and the overwrite policy.
+func (m *Middleware) UPLOAD(urlPrefix string, folder string, config UploadConfig) {
+	m.defaultRouter.UPLOAD(urlPrefix, folder, config)
+}
+
+// WEBDAV registers a WebDAV handler under the given prefix for the default host.
+func (m *Middleware) WEBDAV(urlPrefix string, handler http.Handler) {
+	m.defaultRouter.WEBDAV(urlPrefix, handler)
 }
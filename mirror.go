@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxMirrors is the maximum number of mirrored requests in progress. Requests
+// are not mirrored while the limit is reached, so a slow secondary backend
+// cannot exhaust the memory of the web server.
+const maxMirrors = 64
+
+// MirrorTraffic returns a middleware that replays a percentage of the requests,
+// from 0 to 100, to a secondary handler in the background, which is useful to
+// test a new backend with production traffic. The secondary handler receives a
+// copy of the method, URL, headers and body of the request, and its response
+// is discarded, so it never affects the response sent to the client.
+//
+// Requests with a body larger than maxBodySize are not mirrored. If maxBodySize
+// is zero or negative, the limit is 64 KiB. Use MirrorURL to replay the traffic
+// to a different web server.
+//
+// Example:
+//
+//	srv.Use(middleware.MirrorTraffic(middleware.MirrorURL("http://10.0.0.2:8080"), 5, 0))
+func MirrorTraffic(target http.Handler, percent float64, maxBodySize int64) func(http.Handler) http.Handler {
+	if maxBodySize <= 0 {
+		maxBodySize = 64 << 10
+	}
+
+	slots := make(chan struct{}, maxMirrors)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if percent <= 0 || rand.Float64()*100 >= percent {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			select {
+			case slots <- struct{}{}:
+			default:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+
+			// The primary handler reads the bytes consumed here, followed by
+			// the rest of the body, if any, as if nothing had happened.
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+			if err != nil || int64(len(body)) > maxBodySize {
+				<-slots
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			shadow := r.Clone(context.Background())
+			shadow.Body = io.NopCloser(bytes.NewReader(body))
+
+			go func() {
+				defer func() {
+					_ = recover()
+					<-slots
+				}()
+
+				target.ServeHTTP(&discardResponse{header: http.Header{}}, shadow)
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// MirrorURL returns an HTTP handler that sends the requests to the web server
+// at the base URL, keeping the original path and query, and discards the
+// responses. It is meant to be used as the target of MirrorTraffic.
+func MirrorURL(baseURL string) http.Handler {
+	baseURL = strings.TrimRight(baseURL, "/")
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequest(r.Method, baseURL+r.URL.RequestURI(), r.Body)
+
+		if err != nil {
+			return
+		}
+
+		req.Header = r.Header.Clone()
+		req.Host = r.Host
+
+		res, err := client.Do(req)
+
+		if err != nil {
+			return
+		}
+
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+	})
+}
+
+// readCloser combines a reader with the closer of the original request body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// discardResponse is an http.ResponseWriter that discards everything.
+type discardResponse struct {
+	header http.Header
+}
+
+// Header implements the Header method for the http.ResponseWriter interface.
+func (d *discardResponse) Header() http.Header {
+	return d.header
+}
+
+// Write implements the Write method for the http.ResponseWriter interface.
+func (d *discardResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// WriteHeader implements the WriteHeader method for the http.ResponseWriter interface.
+func (d *discardResponse) WriteHeader(int) {}
@@ -0,0 +1,665 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// identityKey is the key for the authenticated identity in the request Context.
+var identityKey = contextKey("MiddlewareIdentity")
+
+// OIDCConfig configures the OpenID Connect login implemented by OIDCLogin.
+type OIDCConfig struct {
+	// Issuer is the URL of the OpenID provider, e.g. "https://accounts.google.com".
+	// The endpoints are discovered from "/.well-known/openid-configuration".
+	Issuer string
+	// ClientID is the identifier of the application in the OpenID provider.
+	ClientID string
+	// ClientSecret is the secret of the application in the OpenID provider.
+	ClientSecret string
+	// RedirectURL is the absolute URL of the callback route, which must be
+	// registered in the OpenID provider, e.g. "https://example.com/auth/callback".
+	RedirectURL string
+	// Scopes are the requested scopes. Default: openid, email and profile.
+	Scopes []string
+	// SessionKey signs the session cookies, and must have at least 32 bytes.
+	// Use the same key in all the instances of the web server.
+	SessionKey []byte
+	// SessionTTL is the lifetime of the session. Default: 8h.
+	SessionTTL time.Duration
+	// CookieName is the name of the session cookie. Default: "oidc_session".
+	CookieName string
+	// Client sends the requests to the OpenID provider. Default: a client
+	// with a 10 seconds timeout.
+	Client *http.Client
+}
+
+// OIDCIdentity is the user authenticated by OIDCLogin.
+type OIDCIdentity struct {
+	Subject string `json:"sub"`
+	Issuer  string `json:"iss"`
+	Email   string `json:"email,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcLogin implements the OpenID Connect authorization code flow.
+type oidcLogin struct {
+	cfg          OIDCConfig
+	callbackPath string
+	now          func() time.Time
+
+	mu        sync.Mutex
+	provider  *oidcProvider
+	keys      map[string]crypto.PublicKey
+	keysFetch time.Time
+}
+
+// oidcProvider is the subset of the OpenID provider metadata used by the flow.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// The kinds of the signed cookies, which are part of the signature, so the
+// cookie of a login in progress cannot be used as a session, or vice versa.
+const (
+	oidcSessionCookie = "session"
+	oidcFlowCookie    = "flow"
+)
+
+// oidcFlow is the state of a login in progress, kept in a signed cookie.
+type oidcFlow struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Return   string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+// OIDCLogin returns a middleware that requires users to log in with an OpenID
+// Connect provider, using the authorization code flow with PKCE. The function
+// registers the callback route, the path of RedirectURL, in the default host.
+//
+// Requests without a valid session are redirected to the provider if they are
+// GET or HEAD requests, and receive a "401 Unauthorized" response otherwise.
+// After the login, the callback verifies the ID token, issues a session in a
+// signed cookie, and redirects the user to the original URL. Use Identity to
+// read the authenticated user in the handlers.
+//
+// The function panics if the configuration is invalid.
+//
+// Example:
+//
+//	srv.Use(srv.OIDCLogin(middleware.OIDCConfig{
+//	    Issuer:       "https://accounts.google.com",
+//	    ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+//	    ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+//	    RedirectURL:  "https://example.com/auth/callback",
+//	    SessionKey:   sessionKey,
+//	}))
+func (m *Middleware) OIDCLogin(cfg OIDCConfig) func(http.Handler) http.Handler {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		panic("middleware: OIDC login without issuer or client ID")
+	}
+
+	if len(cfg.SessionKey) < 32 {
+		panic("middleware: OIDC session key must have at least 32 bytes")
+	}
+
+	redirect, err := url.Parse(cfg.RedirectURL)
+
+	if err != nil || !redirect.IsAbs() || redirect.Path == "" {
+		panic("middleware: invalid OIDC redirect URL " + cfg.RedirectURL)
+	}
+
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = 8 * time.Hour
+	}
+
+	if cfg.CookieName == "" {
+		cfg.CookieName = "oidc_session"
+	}
+
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	login := &oidcLogin{cfg: cfg, callbackPath: redirect.Path, now: m.now}
+
+	m.defaultRouter.GET(login.callbackPath, login.callback)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == login.callbackPath {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var id OIDCIdentity
+
+			if cookie, err := r.Cookie(cfg.CookieName); err == nil && login.decode(oidcSessionCookie, cookie.Value, &id) && id.valid(login.now()) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, id)))
+				return
+			}
+
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			login.redirect(w, r)
+		})
+	}
+}
+
+// valid reports whether the session identifies a user and has not expired.
+func (id OIDCIdentity) valid(now time.Time) bool {
+	return id.Subject != "" && id.Issuer != "" && id.Expires > now.Unix()
+}
+
+// Identity returns the user authenticated by OIDCLogin, if any.
+func Identity(r *http.Request) (OIDCIdentity, bool) {
+	id, ok := r.Context().Value(identityKey).(OIDCIdentity)
+	return id, ok
+}
+
+// OIDCLogout returns a handler that deletes the session cookie created by
+// OIDCLogin and redirects the user to the given URL. Register it in a route
+// that is not protected by the login, or the user is asked to log in again.
+func OIDCLogout(cookieName string, redirect string) http.HandlerFunc {
+	if cookieName == "" {
+		cookieName = "oidc_session"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: cookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		http.Redirect(w, r, redirect, http.StatusFound)
+	}
+}
+
+// redirect starts the authorization code flow.
+func (o *oidcLogin) redirect(w http.ResponseWriter, r *http.Request) {
+	provider, err := o.discover()
+
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	flow := oidcFlow{
+		State:    randomToken(),
+		Verifier: randomToken() + randomToken(),
+		Nonce:    randomToken(),
+		Return:   r.URL.RequestURI(),
+		Expires:  o.now().Add(10 * time.Minute).Unix(),
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     o.cfg.CookieName + "_flow",
+		Value:    o.encode(oidcFlowCookie, flow),
+		Path:     o.callbackPath,
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(o.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.cfg.ClientID},
+		"redirect_uri":          {o.cfg.RedirectURL},
+		"scope":                 {strings.Join(o.cfg.Scopes, " ")},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	target := provider.AuthorizationEndpoint
+
+	if strings.Contains(target, "?") {
+		target += "&" + query.Encode()
+	} else {
+		target += "?" + query.Encode()
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// callback completes the authorization code flow.
+func (o *oidcLogin) callback(w http.ResponseWriter, r *http.Request) {
+	var flow oidcFlow
+
+	cookie, err := r.Cookie(o.cfg.CookieName + "_flow")
+
+	if err != nil || !o.decode(oidcFlowCookie, cookie.Value, &flow) || flow.Expires < o.now().Unix() {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+
+	if subtle.ConstantTimeCompare([]byte(state), []byte(flow.State)) != 1 {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("error") != "" {
+		http.Error(w, "login failed: "+r.URL.Query().Get("error"), http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := o.exchange(r.URL.Query().Get("code"), flow)
+
+	if err != nil {
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	expires := o.now().Add(o.cfg.SessionTTL)
+	id := OIDCIdentity{
+		Subject: claims.Subject,
+		Issuer:  claims.Issuer,
+		Email:   claims.Email,
+		Name:    claims.Name,
+		Expires: expires.Unix(),
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: o.cfg.CookieName + "_flow", Value: "", Path: o.callbackPath, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{
+		Name:     o.cfg.CookieName,
+		Value:    o.encode(oidcSessionCookie, id),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(o.cfg.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// only relative URLs, to prevent open redirects.
+	target := flow.Return
+
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/"
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// idTokenClaims are the claims of the ID token used by the flow.
+type idTokenClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+	Expires  int64           `json:"exp"`
+	Nonce    string          `json:"nonce"`
+	Email    string          `json:"email"`
+	Name     string          `json:"name"`
+}
+
+// exchange exchanges the authorization code for an ID token, and returns its
+// claims after the verification.
+func (o *oidcLogin) exchange(code string, flow oidcFlow) (idTokenClaims, error) {
+	var claims idTokenClaims
+
+	provider, err := o.discover()
+
+	if err != nil {
+		return claims, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"client_id":     {o.cfg.ClientID},
+		"code_verifier": {flow.Verifier},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return claims, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if o.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+
+	if err := o.fetchJSON(req, &token); err != nil {
+		return claims, err
+	}
+
+	if err := o.verify(token.IDToken, &claims); err != nil {
+		return claims, err
+	}
+
+	if claims.Issuer != provider.Issuer || !audienceContains(claims.Audience, o.cfg.ClientID) {
+		return claims, errors.New("middleware: ID token for another issuer or audience")
+	}
+
+	if claims.Expires+60 < o.now().Unix() {
+		return claims, errors.New("middleware: expired ID token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(flow.Nonce)) != 1 {
+		return claims, errors.New("middleware: invalid ID token nonce")
+	}
+
+	if claims.Subject == "" {
+		return claims, errors.New("middleware: ID token without subject")
+	}
+
+	return claims, nil
+}
+
+// audienceContains reports whether the "aud" claim, a string or an array of
+// strings, contains the client ID.
+func audienceContains(aud json.RawMessage, clientID string) bool {
+	var one string
+
+	if json.Unmarshal(aud, &one) == nil {
+		return one == clientID
+	}
+
+	var many []string
+
+	if json.Unmarshal(aud, &many) == nil {
+		for _, item := range many {
+			if item == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// verify checks the signature of a JWT and decodes its claims.
+func (o *oidcLogin) verify(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return errors.New("middleware: malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return err
+	}
+
+	key, err := o.publicKey(header.Kid)
+
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return errors.New("middleware: invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return errors.New("middleware: invalid ID token signature")
+		}
+
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return errors.New("middleware: invalid ID token signature")
+		}
+	default:
+		return errors.New("middleware: unsupported ID token key")
+	}
+
+	return decodeSegment(parts[1], claims)
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a JWT.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// discover returns the metadata of the OpenID provider, which is downloaded
+// once and then cached. The download happens without the lock, so a slow
+// provider does not block the requests that have a session.
+func (o *oidcLogin) discover() (*oidcProvider, error) {
+	o.mu.Lock()
+	provider := o.provider
+	o.mu.Unlock()
+
+	if provider != nil {
+		return provider, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(o.cfg.Issuer, "/")+"/.well-known/openid-configuration", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider = &oidcProvider{}
+
+	if err := o.fetchJSON(req, provider); err != nil {
+		return nil, err
+	}
+
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("middleware: incomplete OpenID provider metadata")
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.provider == nil {
+		o.provider = provider
+	}
+
+	return o.provider, nil
+}
+
+// publicKey returns the key used to sign the ID tokens. The keys are fetched
+// again when the key is unknown, which happens after a key rotation, at most
+// once per minute, and without the lock, like in discover.
+func (o *oidcLogin) publicKey(kid string) (crypto.PublicKey, error) {
+	provider, err := o.discover()
+
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+
+	if key, ok := o.keys[kid]; ok {
+		o.mu.Unlock()
+		return key, nil
+	}
+
+	if o.now().Sub(o.keysFetch) < time.Minute {
+		o.mu.Unlock()
+		return nil, errors.New("middleware: unknown ID token key " + kid)
+	}
+
+	o.keysFetch = o.now()
+	o.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, provider.JWKSURI, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+
+	if err := o.fetchJSON(req, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+
+			if err1 == nil && err2 == nil && len(e) <= 4 {
+				keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			}
+		case "EC":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+
+			if err1 == nil && err2 == nil && k.Crv == "P-256" {
+				key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+				if key.Curve.IsOnCurve(key.X, key.Y) {
+					keys[k.Kid] = key
+				}
+			}
+		}
+	}
+
+	o.mu.Lock()
+	o.keys = keys
+	o.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, errors.New("middleware: unknown ID token key " + kid)
+}
+
+// fetchJSON sends the request and decodes the JSON response.
+func (o *oidcLogin) fetchJSON(req *http.Request, v interface{}) error {
+	res, err := o.cfg.Client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("middleware: OpenID provider responded with " + res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// encode serializes and signs a value for a cookie of the given kind.
+func (o *oidcLogin) encode(kind string, v interface{}) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(o.sign(kind, payload))
+}
+
+// sign returns the signature of the payload of a cookie of the given kind.
+func (o *oidcLogin) sign(kind string, payload string) []byte {
+	mac := hmac.New(sha256.New, o.cfg.SessionKey)
+	_, _ = mac.Write([]byte(kind + "\x00" + payload))
+
+	return mac.Sum(nil)
+}
+
+// decode verifies and deserializes a value encoded by encode with the same
+// kind of cookie.
+func (o *oidcLogin) decode(kind string, value string, v interface{}) bool {
+	i := strings.LastIndexByte(value, '.')
+
+	if i < 0 {
+		return false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+
+	if err != nil {
+		return false
+	}
+
+	if !hmac.Equal(signature, o.sign(kind, value[:i])) {
+		return false
+	}
+
+	return decodeSegment(value[:i], v) == nil
+}
+
+// randomToken returns a random URL-safe string with 128 bits of entropy.
+func randomToken() string {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		panic("middleware: cannot read random bytes: " + err.Error())
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
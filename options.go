@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Option configures a Middleware created with New.
+//
+// Options are applied in order, after the default values are set, so they can
+// override the defaults and earlier options. Every option has an equivalent
+// exported field, which remains available to configure the router after it
+// was created.
+type Option func(*Middleware)
+
+// WithLogger sets Middleware.Logger. Use nil to disable the access logs.
+func WithLogger(logger Logger) Option {
+	return func(m *Middleware) {
+		m.Logger = logger
+	}
+}
+
+// WithErrorLog sets Middleware.ErrorLog.
+func WithErrorLog(logger *log.Logger) Option {
+	return func(m *Middleware) {
+		m.ErrorLog = logger
+	}
+}
+
+// WithReadTimeout sets Middleware.ReadTimeout.
+func WithReadTimeout(d time.Duration) Option {
+	return func(m *Middleware) {
+		m.ReadTimeout = d
+	}
+}
+
+// WithReadHeaderTimeout sets Middleware.ReadHeaderTimeout.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(m *Middleware) {
+		m.ReadHeaderTimeout = d
+	}
+}
+
+// WithWriteTimeout sets Middleware.WriteTimeout.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(m *Middleware) {
+		m.WriteTimeout = d
+	}
+}
+
+// WithIdleTimeout sets Middleware.IdleTimeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(m *Middleware) {
+		m.IdleTimeout = d
+	}
+}
+
+// WithShutdownTimeout sets Middleware.ShutdownTimeout.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(m *Middleware) {
+		m.ShutdownTimeout = d
+	}
+}
+
+// WithRequestBudget sets Middleware.RequestBudget and, to also accept the
+// timeouts sent by the clients, Middleware.RequestTimeoutHeaders.
+func WithRequestBudget(budget time.Duration, fromHeaders bool) Option {
+	return func(m *Middleware) {
+		m.RequestBudget = budget
+		m.RequestTimeoutHeaders = fromHeaders
+	}
+}
+
+// WithOnShutdown sets Middleware.OnShutdown.
+func WithOnShutdown(fn func()) Option {
+	return func(m *Middleware) {
+		m.OnShutdown = fn
+	}
+}
+
+// WithNotFound sets Middleware.NotFound.
+func WithNotFound(h http.Handler) Option {
+	return func(m *Middleware) {
+		m.NotFound = h
+	}
+}
+
+// WithHostFallback sets Middleware.HostFallback and, for FallbackRedirect,
+// Middleware.CanonicalHost.
+func WithHostFallback(fallback HostFallback, canonicalHost string) Option {
+	return func(m *Middleware) {
+		m.HostFallback = fallback
+		m.CanonicalHost = canonicalHost
+	}
+}
+
+// WithClock sets Middleware.Now.
+func WithClock(now func() time.Time) Option {
+	return func(m *Middleware) {
+		m.Now = now
+	}
+}
+
+// WithTrustedProxies calls Middleware.TrustProxies with the networks.
+func WithTrustedProxies(networks ...string) Option {
+	return func(m *Middleware) {
+		m.TrustProxies(networks...)
+	}
+}
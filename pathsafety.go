@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// isCanonicalPath reports whether the URL path of the request has only one
+// possible interpretation, which is what Middleware.StrictPaths requires. The
+// path must be valid UTF-8 without control characters, without dot segments
+// or empty segments, and without percent-encoded slashes, backslashes, dots,
+// percent signs or null bytes, which are the alternate encodings used to make
+// the router, the handlers and the file system disagree on the resource.
+func isCanonicalPath(r *http.Request) bool {
+	decoded := r.URL.Path
+
+	if !isPrintablePath(decoded) || strings.IndexByte(decoded, '\\') >= 0 {
+		return false
+	}
+
+	clean := path.Clean(decoded)
+
+	if clean != decoded && clean+"/" != decoded {
+		return false
+	}
+
+	escaped := r.URL.EscapedPath()
+
+	for i := strings.IndexByte(escaped, '%'); i >= 0; i = strings.IndexByte(escaped, '%') {
+		if i+2 >= len(escaped) {
+			return false
+		}
+
+		switch strings.ToUpper(escaped[i+1 : i+3]) {
+		case "2F", "5C", "2E", "25", "00":
+			return false
+		}
+
+		escaped = escaped[i+3:]
+	}
+
+	return true
+}
+
+// decodeDotSegments decodes the percent-encoded dot segments of an escaped URL
+// path, like "%2e%2E", so path.Clean removes them in the same way as the dot
+// segments of the decoded path, which the handlers and the file system see.
+func decodeDotSegments(escaped string) string {
+	if !strings.Contains(escaped, "%2") {
+		return escaped
+	}
+
+	segments := strings.Split(escaped, "/")
+
+	for i, segment := range segments {
+		switch strings.ToLower(segment) {
+		case "%2e", ".%2e", "%2e.", "%2e%2e":
+			segments[i] = strings.Repeat(".", len(segment)-2*strings.Count(segment, "%"))
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// isPrintablePath reports whether the path is valid UTF-8 without control
+// characters, like the null byte or a line break, which are never part of a
+// legitimate URL, and are often used to truncate or inject data into the logs
+// and the file system calls of the handlers.
+func isPrintablePath(p string) bool {
+	for i := 0; i < len(p); i++ {
+		if p[i] < 0x20 || p[i] == 0x7f {
+			return false
+		}
+	}
+
+	return utf8.ValidString(p)
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// EnablePprof registers the net/http/pprof handlers in the default host under
+// the given prefix, which allows the profiling of the program in production
+// without a second listener. The endpoints are restricted to the networks in
+// the list, which are passed to the AllowOnly function. If the list is empty,
+// only the local machine is allowed to access the data.
+//
+// Remember that Middleware.WriteTimeout limits the duration of the responses,
+// so CPU profiles and execution traces that take longer than the timeout will
+// fail. Use the "seconds" query parameter to collect shorter profiles or
+// increase the timeout accordingly.
+//
+// Note that the net/http/pprof package registers its handlers in the default
+// http.ServeMux when it is imported. The router does not use it, but programs
+// serving the http.DefaultServeMux in a different listener will expose them.
+//
+// Example:
+//
+//	srv.EnablePprof("/debug/pprof")
+//
+//	go tool pprof http://localhost:3000/debug/pprof/heap
+func (m *Middleware) EnablePprof(prefix string, allowed ...string) {
+	prefix = strings.TrimRight(prefix, "/")
+	handler := AllowOnly(allowed...)(pprofHandler(prefix)).ServeHTTP
+
+	m.GET(prefix, http.RedirectHandler(prefix+"/", http.StatusMovedPermanently).ServeHTTP)
+	m.GET(prefix+"/", handler)
+	m.GET(prefix+"/*", handler)
+	m.POST(prefix+"/*", handler)
+}
+
+// pprofHandler dispatches the request to the corresponding pprof handler.
+//
+// The pprof.Index function expects the profiles to be under "/debug/pprof/"
+// and the router does not support prefixes, so the function strips the prefix
+// itself to select the handler for the profile, which is also what allows the
+// profiles to be served under a different prefix.
+func pprofHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch name := strings.TrimPrefix(r.URL.Path, prefix+"/"); name {
+		case "":
+			pprof.Index(w, r)
+		case "cmdline":
+			pprof.Cmdline(w, r)
+		case "profile":
+			pprof.Profile(w, r)
+		case "symbol":
+			pprof.Symbol(w, r)
+		case "trace":
+			pprof.Trace(w, r)
+		default:
+			pprof.Handler(name).ServeHTTP(w, r)
+		}
+	})
+}
@@ -1,31 +1,73 @@
 package middleware_test
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/big"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/cixtor/middleware"
+	"github.com/cixtor/middleware/testlogger"
 )
 
-// newTestServer returns a server and an ephemeral port to listen.
-func newTestServer(t *testing.T) (*middleware.Middleware, net.Addr) {
-	srv := middleware.New()
+// newTestServer returns a server for the tests that send real requests.
+func newTestServer(t *testing.T) *middleware.Middleware {
+	return middleware.New()
+}
 
-	addr, err := srv.FreePort()
+// startTestServer starts the server on an ephemeral port, and returns its
+// address once it accepts connections.
+func startTestServer(t *testing.T, srv *middleware.Middleware) net.Addr {
+	ready := make(chan net.Addr, 1)
+	failed := make(chan error, 1)
 
-	if err != nil {
-		t.Fatal("shu", err)
+	go func() { failed <- srv.ListenAndServeReady("127.0.0.1:0", ready) }()
+
+	addr, ok := <-ready
+
+	if !ok {
+		t.Fatal("ListenAndServeReady", <-failed)
 	}
 
-	return srv, addr
+	return addr
 }
 
 func curl(t *testing.T, method string, host string, addr net.Addr, endpoint string, expected []byte) {
@@ -39,22 +81,6 @@ func curl(t *testing.T, method string, host string, addr net.Addr, endpoint stri
 
 	req.Host = host
 
-	// It looks like the TCP resolver that Middleware leverages to obtain a
-	// random free port delays the execution of the server listener long enough
-	// for this function to randomly fail 36.95% of the time when the tests run
-	// all at the same time.
-	//
-	// I managed to fix this by delaying the execution of the HTTP request a
-	// couple of milliseconds. A rudimentary benchmark with 10 iterations as a
-	// warmup returns the following results:
-	//
-	//   > Benchmark 1: go test
-	//   >   Time (mean ± σ):     949.3 ms ±  19.5 ms    [User: 722.2 ms, System: 467.7 ms]
-	//   >   Range (min … max):   904.9 ms … 968.8 ms    10 runs
-	//
-	// TODO: find a way to execute all the tests without the 2ms cURL delay.
-	time.Sleep(time.Millisecond * 2)
-
 	res, err := http.DefaultClient.Do(req)
 
 	if err != nil {
@@ -97,19 +123,19 @@ func shouldNotCurl(t *testing.T, method string, host string, addr net.Addr, endp
 }
 
 func TestIndex(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestUse(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 
 	lorem := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -143,13 +169,13 @@ func TestUse(t *testing.T) {
 		c := w.Header().Get("dolor")
 		w.Write([]byte(a + ":" + b + ":" + c))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/foobar", []byte("lorem:ipsum:dolor"))
 }
 
 func TestUse2(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 
 	lorem := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -180,62 +206,453 @@ func TestUse2(t *testing.T) {
 	srv.Use(lorem)
 	srv.Use(ipsum)
 	srv.Use(dolor)
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/foobar", []byte("<1:lorem><2:ipsum><3:dolor><4:foobar>"))
 }
 
+func TestFlush(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/events", func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+
+		if !ok {
+			t.Fatal("response writer does not implement http.Flusher")
+		}
+
+		w.Write([]byte("data: hello\n\n"))
+		f.Flush()
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/events", nil)
+	srv.ServeHTTP(w, r)
+
+	if !w.Flushed {
+		t.Fatal("response was not flushed")
+	}
+}
+
+func TestHijack(t *testing.T) {
+	srv := newTestServer(t)
+	srv.DiscardLogs()
+	defer srv.Shutdown()
+	srv.GET("/ws", func(w http.ResponseWriter, r *http.Request) {
+		h, ok := w.(http.Hijacker)
+
+		if !ok {
+			t.Fatal("response writer does not implement http.Hijacker")
+		}
+
+		conn, buf, err := h.Hijack()
+
+		if err != nil {
+			t.Fatalf("cannot hijack connection %s", err)
+		}
+
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 6\r\nConnection: close\r\n\r\nhijack")
+		buf.Flush()
+	})
+	addr := startTestServer(t, srv)
+
+	curl(t, "GET", "localhost", addr, "/ws", []byte("hijack"))
+}
+
+func TestResponseWriter(t *testing.T) {
+	var status, length int
+	var written bool
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw, ok := w.(middleware.ResponseWriter)
+
+			if !ok {
+				t.Fatal("response writer does not implement middleware.ResponseWriter")
+			}
+
+			if rw.Written() {
+				t.Fatal("response should not be written before the handler")
+			}
+
+			next.ServeHTTP(w, r)
+
+			status, length, written = rw.Status(), rw.BytesWritten(), rw.Written()
+		})
+	})
+	srv.GET("/teapot", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/teapot", nil)
+	srv.ServeHTTP(w, r)
+
+	if status != http.StatusTeapot || length != 15 || !written {
+		t.Fatalf("unexpected response metadata: %d %d %v", status, length, written)
+	}
+}
+
+func TestOnBeforeWriteHeader(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ok := middleware.OnBeforeWriteHeader(w, func(status int, h http.Header) {
+				h.Set("X-Status", strconv.Itoa(status))
+				h.Set("X-User", r.Header.Get("X-User"))
+			})
+
+			if !ok {
+				t.Fatal("cannot register the hook")
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	})
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("X-User", "alice")
+		w.Write([]byte("Hello World"))
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	srv.ServeHTTP(w, r)
+
+	if status := w.Header().Get("X-Status"); status != "200" {
+		t.Fatalf("unexpected value for X-Status: %s", status)
+	}
+
+	if user := w.Header().Get("X-User"); user != "alice" {
+		t.Fatalf("unexpected value for X-User: %s", user)
+	}
+
+	if middleware.OnBeforeWriteHeader(httptest.NewRecorder(), nil) {
+		t.Fatal("hook should not be registered on a foreign writer")
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	var status int
+	var hints []string
+
+	srv := newTestServer(t)
+	srv.DiscardLogs()
+	defer srv.Shutdown()
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		middleware.EarlyHints(w, "</style.css>; rel=preload; as=style")
+		w.Write([]byte("Hello World"))
+		status = w.(middleware.ResponseWriter).Status()
+	})
+	addr := startTestServer(t, srv)
+
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = header["Link"]
+			}
+			return nil
+		},
+	}
+
+	req, _ := http.NewRequest("GET", "http://"+addr.String()+"/", nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("http.DefaultClient %s", err)
+	}
+
+	res.Body.Close()
+
+	if len(hints) != 1 || hints[0] != "</style.css>; rel=preload; as=style" {
+		t.Fatalf("unexpected early hints: %#v", hints)
+	}
+
+	if res.StatusCode != http.StatusOK || status != http.StatusOK {
+		t.Fatalf("unexpected final status: %d %d", res.StatusCode, status)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	srv := middleware.New()
+	tracer := testlogger.New()
+	srv.Logger = tracer
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		middleware.AddTiming(w, "db", time.Millisecond*53, "users query")
+		middleware.AddTiming(w, "cache", time.Microsecond*1500, "")
+		w.Write([]byte("Hello World"))
+		middleware.AddTiming(w, "late", time.Millisecond, "")
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	expected := `db;dur=53;desc="users query", cache;dur=1.5`
+
+	if header := w.Header().Get("Server-Timing"); header != expected {
+		t.Fatalf("unexpected Server-Timing header:\n- %s\n+ %s", expected, header)
+	}
+
+	if len(lastLog(tracer).Timings) != 3 || lastLog(tracer).Timings[2].Name != "late" {
+		t.Fatalf("unexpected timings in access log: %#v", lastLog(tracer).Timings)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := newTestServer(t)
+	srv.DiscardLogs()
+	srv.WriteTimeout = time.Millisecond * 50
+	closed := make(chan bool, 1)
+	srv.WEBSOCKET("/echo", func(ws *middleware.WebSocket) {
+		for {
+			kind, data, err := ws.ReadMessage()
+			if err != nil {
+				closed <- true
+				return
+			}
+			ws.WriteMessage(kind, append([]byte("echo:"), data...))
+		}
+	})
+	addr := startTestServer(t, srv)
+
+	curl(t, "GET", "localhost", addr, "/echo", []byte("Bad Request\n"))
+
+	conn, err := net.Dial("tcp", addr.String())
+
+	if err != nil {
+		t.Fatalf("net.Dial %s", err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+
+	if err != nil {
+		t.Fatalf("http.ReadResponse %s", err)
+	}
+
+	if accept := res.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected value for Sec-WebSocket-Accept: %s", accept)
+	}
+
+	// Wait longer than WriteTimeout to verify that the connection is still open.
+	time.Sleep(time.Millisecond * 100)
+
+	mask := []byte{1, 2, 3, 4}
+	payload := []byte("hello")
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	conn.Write(append(append([]byte{0x81, 0x80 | 5}, mask...), payload...))
+
+	frame := make([]byte, 12)
+
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		t.Fatalf("cannot read websocket frame %s", err)
+	}
+
+	if !bytes.Equal(frame, append([]byte{0x81, 10}, []byte("echo:hello")...)) {
+		t.Fatalf("unexpected websocket frame: %q", frame)
+	}
+
+	// the unmasked frames are rejected with the close code 1002.
+	unmasked, err := net.Dial("tcp", addr.String())
+
+	if err != nil {
+		t.Fatalf("net.Dial %s", err)
+	}
+
+	defer unmasked.Close()
+
+	unmasked.Write([]byte("GET /echo HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+
+	unmaskedReader := bufio.NewReader(unmasked)
+
+	if _, err := http.ReadResponse(unmaskedReader, nil); err != nil {
+		t.Fatalf("http.ReadResponse %s", err)
+	}
+
+	unmasked.Write(append([]byte{0x81, 5}, []byte("hello")...))
+
+	if rest, _ := io.ReadAll(unmaskedReader); !bytes.Equal(rest, []byte{0x88, 2, 0x03, 0xea}) {
+		t.Fatalf("expecting close frame with protocol error, got %q", rest)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("websocket was not closed after an unmasked frame")
+	}
+
+	srv.Shutdown()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("websocket was not closed during shutdown")
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	srv := newTestServer(t)
+	srv.DiscardLogs()
+	defer srv.Shutdown()
+	errs := make(chan error, 1)
+	srv.WEBSOCKET("/echo", func(ws *middleware.WebSocket) {
+		ws.MaxMessageSize = 8
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	})
+	addr := startTestServer(t, srv)
+
+	frame := func(head byte, payload string) []byte {
+		mask := []byte{1, 2, 3, 4}
+		out := []byte{head}
+
+		if len(payload) < 126 {
+			out = append(out, 0x80|byte(len(payload)))
+		} else {
+			out = append(out, 0x80|126, byte(len(payload)>>8), byte(len(payload)))
+		}
+
+		out = append(out, mask...)
+
+		for i := 0; i < len(payload); i++ {
+			out = append(out, payload[i]^mask[i%4])
+		}
+
+		return out
+	}
+
+	protocolError := []byte{0x88, 2, 0x03, 0xea}
+	messageTooBig := []byte{0x88, 2, 0x03, 0xf1}
+
+	tests := []struct {
+		name     string
+		frames   [][]byte
+		expected []byte
+	}{
+		{"reserved opcode", [][]byte{frame(0x83, "x")}, protocolError},
+		{"reserved control opcode", [][]byte{frame(0x8b, "x")}, protocolError},
+		{"reserved bit", [][]byte{frame(0xc1, "x")}, protocolError},
+		{"continuation without message", [][]byte{frame(0x80, "x")}, protocolError},
+		{"new message inside fragmented message", [][]byte{frame(0x01, "a"), frame(0x81, "b")}, protocolError},
+		{"fragmented control frame", [][]byte{frame(0x09, "x")}, protocolError},
+		{"long control frame", [][]byte{frame(0x89, strings.Repeat("x", 126))}, protocolError},
+		{"large frame", [][]byte{frame(0x81, "0123456789")}, messageTooBig},
+		{"large fragmented message", [][]byte{frame(0x01, "01234"), frame(0x80, "56789")}, messageTooBig},
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", addr.String())
+
+		if err != nil {
+			t.Fatalf("net.Dial %s", err)
+		}
+
+		conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n" +
+			"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+			"Sec-WebSocket-Version: 13\r\n\r\n"))
+
+		reader := bufio.NewReader(conn)
+
+		if _, err := http.ReadResponse(reader, nil); err != nil {
+			t.Fatalf("%s: http.ReadResponse %s", test.name, err)
+		}
+
+		for _, f := range test.frames {
+			conn.Write(f)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		rest, _ := io.ReadAll(reader)
+		conn.Close()
+
+		if !bytes.Equal(rest, test.expected) {
+			t.Fatalf("%s: expecting close frame %q, got %q", test.name, test.expected, rest)
+		}
+
+		select {
+		case err := <-errs:
+			if tooBig := bytes.Equal(test.expected, messageTooBig); tooBig != (err == middleware.ErrMessageTooLarge) {
+				t.Fatalf("%s: unexpected error %v", test.name, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: websocket was not closed", test.name)
+		}
+	}
+}
+
 func TestPOST(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.POST("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World POST"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "POST", "localhost", addr, "/foobar", []byte("Hello World POST"))
 }
 
 func TestNotFound(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World GET"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/notfound", []byte("404 page not found\n"))
 }
 
 func TestNotFoundSimilar(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/lorem/ipsum/dolor", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World GET"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/lorem/ipsum/dolores", []byte("404 page not found\n"))
 }
 
 func TestNotFoundInvalid(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	srv.NotFound = nil
 	defer srv.Shutdown()
 	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World GET"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/test", []byte("404 page not found\n"))
 }
 
 func TestNotFoundCustom(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	srv.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("404 page does not exist"))
@@ -244,13 +661,13 @@ func TestNotFoundCustom(t *testing.T) {
 	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World GET"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/test", []byte("404 page does not exist"))
 }
 
 func TestNotFoundCustomWithInterceptor(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	srv.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("404 missing page\n"))
@@ -268,17 +685,17 @@ func TestNotFoundCustomWithInterceptor(t *testing.T) {
 	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World GET"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/test", []byte("hello interceptor\n404 missing page\n"))
 }
 
 func TestDirectoryListing(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.STATIC(".", "/assets")
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	inputs := [][]string{
 		{"test_0", "/assets", "404 page not found\n"},
@@ -296,20 +713,83 @@ func TestDirectoryListing(t *testing.T) {
 	}
 }
 
+func TestWebDAV(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.WEBDAV("/dav/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + r.Header.Get("Destination")))
+	}))
+
+	inputs := [][]string{
+		{"PROPFIND", "/dav", "", "PROPFIND /dav "},
+		{"PROPFIND", "/dav/", "", "PROPFIND /dav/ "},
+		{"MKCOL", "/dav/docs/", "", "MKCOL /dav/docs/ "},
+		{"MOVE", "/dav/a.txt", "http://localhost/dav/docs/b.txt", "MOVE /dav/a.txt http://localhost/dav/docs/b.txt"},
+		{"GET", "/dav/docs/b.txt", "", "GET /dav/docs/b.txt "},
+	}
+
+	for _, input := range inputs {
+		t.Run(input[0]+input[1], func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(input[0], input[1], nil)
+			r.Header.Set("Destination", input[2])
+			srv.ServeHTTP(w, r)
+
+			if body := w.Body.String(); body != input[3] {
+				t.Fatalf("unexpected response body: %q", body)
+			}
+		})
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GRPC = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("grpc")) })
+	srv.GRPCWeb = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("grpc-web")) })
+	srv.POST("/*", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("router")) })
+
+	inputs := []struct {
+		proto       int
+		contentType string
+		expected    string
+	}{
+		{proto: 2, contentType: "application/grpc", expected: "grpc"},
+		{proto: 2, contentType: "application/grpc+proto", expected: "grpc"},
+		{proto: 1, contentType: "application/grpc", expected: "router"},
+		{proto: 1, contentType: "application/grpc-web+proto", expected: "grpc-web"},
+		{proto: 2, contentType: "application/json", expected: "router"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.contentType, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/helloworld.Greeter/SayHello", nil)
+			r.ProtoMajor = input.proto
+			r.Header.Set("Content-Type", input.contentType)
+			srv.ServeHTTP(w, r)
+
+			if body := w.Body.String(); body != input.expected {
+				t.Fatalf("unexpected response body: %q", body)
+			}
+		})
+	}
+}
+
 func TestSingleParam(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.PUT("/hello/:name", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(middleware.Param(r, "name")))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "PUT", "localhost", addr, "/hello/john", []byte("john"))
 }
 
 func TestMultiParam(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.PATCH("/:group/:section", func(w http.ResponseWriter, r *http.Request) {
@@ -317,13 +797,13 @@ func TestMultiParam(t *testing.T) {
 		section := middleware.Param(r, "section")
 		w.Write([]byte("page /" + group + "/" + section))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "PATCH", "localhost", addr, "/account/info", []byte("page /account/info"))
 }
 
 func TestMultiParamPrefix(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.DELETE("/foo/:group/:section", func(w http.ResponseWriter, r *http.Request) {
@@ -331,29 +811,29 @@ func TestMultiParamPrefix(t *testing.T) {
 		section := middleware.Param(r, "section")
 		w.Write([]byte("page /foo/" + group + "/" + section))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "DELETE", "localhost", addr, "/foo/account/info", []byte("page /foo/account/info"))
 }
 
 func TestComplexParam(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.PUT("/account/:name/info", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(middleware.Param(r, "name")))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "PUT", "localhost", addr, "/account/alice/info", []byte("alice"))
 }
 
 func TestServeFiles(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.STATIC(".", "/cdn")
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	data, err := ioutil.ReadFile("LICENSE.md")
 
@@ -365,93 +845,119 @@ func TestServeFiles(t *testing.T) {
 	curl(t, "GET", "localhost", addr, "/cdn/LICENSE.md", data)
 }
 
+func TestServeFilesBytesSent(t *testing.T) {
+	srv := middleware.New()
+	tracer := testlogger.New()
+	srv.Logger = tracer
+	srv.STATIC(".", "/cdn")
+
+	data, err := ioutil.ReadFile("LICENSE.md")
+
+	if err != nil {
+		t.Fatalf("cannot read LICENSE.md %s", err)
+		return
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/cdn/LICENSE.md", nil)
+	srv.ServeHTTP(w, r)
+
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("unexpected response body: %q", w.Body.String())
+	}
+
+	if lastLog(tracer).BytesSent != len(data) {
+		t.Fatalf("unexpected value for BytesSent: %d", lastLog(tracer).BytesSent)
+	}
+}
+
 func TestServeFilesFake(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/updates/appcast.xml", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("<xml></xml>"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/updates/appcast.xml", []byte("<xml></xml>"))
 }
 
 func TestServeFilesFakeScript(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/tag/js/gpt.js", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("(function(E){})"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/tag/js/gpt.js", []byte("(function(E){})"))
 	curl(t, "GET", "localhost", addr, "/tag/js/foo.js", []byte("404 page not found\n"))
 }
 
 func TestRouteWithExtraSlash(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/hello/world", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("hello"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/hello///////world", []byte("hello"))
 }
 
 func TestRouteWithExtraSlash2(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/hello/world", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("hello"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "///////hello/world", []byte("hello"))
 }
 
 func TestTrailingSlash(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/hello/world/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/hello/world/", []byte("Hello World"))
 }
 
 func TestTrailingSlashDynamic(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.POST("/api/:id/store/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("store"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "POST", "localhost", addr, "/api/123/store/", []byte("store"))
 }
 
 func TestTrailingSlashDynamicMultiple(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.POST("/api/:id/store/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("dynamic"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "POST", "localhost", addr, "/api/123/////store/", []byte("dynamic"))
 }
 
 func TestMultipleRoutes(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/hello/world/", func(w http.ResponseWriter, r *http.Request) {
@@ -460,26 +966,63 @@ func TestMultipleRoutes(t *testing.T) {
 	srv.GET("/lorem/ipsum/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Lorem Ipsum"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/hello/world/", []byte("Hello World"))
 	curl(t, "GET", "localhost", addr, "/lorem/ipsum/", []byte("Lorem Ipsum"))
 }
 
 func TestRouteWithAsterisk(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
-	srv.GET("/home/users/*/ignored/sections", func(w http.ResponseWriter, r *http.Request) {
+	srv.GET("/home/users/*", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("robot"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/home/users/a/b/root", []byte("robot"))
 }
 
+func TestValidatePattern(t *testing.T) {
+	inputs := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"/", true},
+		{"/*", true},
+		{"/users/:id", true},
+		{"/users/:id/posts/:post", true},
+		{"/static/*", true},
+		{"/cookies/are*delicious", true},
+		{"", false},
+		{"users", false},
+		{"/users/:", false},
+		{"/users/:/posts", false},
+		{"/users/user:name", false},
+		{"/users/:id/posts/:id", false},
+		{"/home/users/*/ignored/sections", false},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.pattern, func(t *testing.T) {
+			if err := middleware.ValidatePattern(input.pattern); (err == nil) != input.valid {
+				t.Fatalf("unexpected validation result: %v", err)
+			}
+		})
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for malformed pattern")
+		}
+	}()
+
+	middleware.New().GET("/users/:id/posts/:id", func(w http.ResponseWriter, r *http.Request) {})
+}
+
 func TestMultipleDynamic(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/hello/:first/:last/info", func(w http.ResponseWriter, r *http.Request) {
@@ -487,13 +1030,13 @@ func TestMultipleDynamic(t *testing.T) {
 		last := middleware.Param(r, "last")
 		w.Write([]byte("Hello " + first + " " + last))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/hello/john/smith/info", []byte("Hello john smith"))
 }
 
 func TestMultipleHosts(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.Host("foo.test").GET("/hello/:name", func(w http.ResponseWriter, r *http.Request) {
@@ -502,14 +1045,28 @@ func TestMultipleHosts(t *testing.T) {
 	srv.Host("bar.test").GET("/hello/:name", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("@bar.test:" + middleware.Param(r, "name")))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "foo.test", addr, "/hello/john", []byte("@foo.test:john"))
 	curl(t, "GET", "bar.test", addr, "/hello/alice", []byte("@bar.test:alice"))
 }
 
+func TestMultipleHostsNormalized(t *testing.T) {
+	srv := newTestServer(t)
+	srv.DiscardLogs()
+	defer srv.Shutdown()
+	srv.Host("Foo.Test").GET("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("@foo.test"))
+	})
+	addr := startTestServer(t, srv)
+
+	curl(t, "GET", "foo.test", addr, "/hello", []byte("@foo.test"))
+	curl(t, "GET", "FOO.TEST", addr, "/hello", []byte("@foo.test"))
+	curl(t, "GET", "foo.test:8080", addr, "/hello", []byte("@foo.test"))
+}
+
 func TestDefaultHost(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/hello/:name", func(w http.ResponseWriter, r *http.Request) {
@@ -518,7 +1075,7 @@ func TestDefaultHost(t *testing.T) {
 	srv.Host("foo.test").GET("/world/:name", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("World " + middleware.Param(r, "name")))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/hello/john", []byte("Hello john"))
 	curl(t, "GET", "foo.test", addr, "/world/earth", []byte("World earth"))
@@ -526,127 +1083,127 @@ func TestDefaultHost(t *testing.T) {
 }
 
 func TestMethodHandle(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.Handle("HELLOWORLD", "/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "HELLOWORLD", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestMethodCONNECT(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.CONNECT("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "CONNECT", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestMethodTRACE(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.TRACE("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "TRACE", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestMethodCOPY(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.COPY("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "COPY", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestMethodLOCK(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.LOCK("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "LOCK", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestMethodMKCOL(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.MKCOL("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "MKCOL", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestMethodMOVE(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.MOVE("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "MOVE", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestMethodPROPFIND(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.PROPFIND("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "PROPFIND", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestMethodPROPPATCH(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.PROPPATCH("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "PROPPATCH", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestMethodUNLOCK(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.UNLOCK("/foobar", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "UNLOCK", "localhost", addr, "/foobar", []byte("Hello World"))
 }
 
 func TestEndpointOrder(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/*", func(w http.ResponseWriter, r *http.Request) {
@@ -670,7 +1227,7 @@ func TestEndpointOrder(t *testing.T) {
 	srv.GET("/help/:page/:group/comments", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("endpoint #1"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	inputs := [][]string{
 		{"test_0", "/help/viva/family/comments", "endpoint #1"},
@@ -693,7 +1250,7 @@ func TestEndpointOrder(t *testing.T) {
 }
 
 func TestAmbiguousPath(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/:package", func(w http.ResponseWriter, r *http.Request) {
@@ -702,14 +1259,14 @@ func TestAmbiguousPath(t *testing.T) {
 	srv.GET("/:package/-/:archive", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("package/archive"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/foobar", []byte("package"))
 	curl(t, "GET", "localhost", addr, "/foobar/-/foobar.tgz", []byte("package/archive"))
 }
 
 func TestAmbiguousPath2(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/:package", func(w http.ResponseWriter, r *http.Request) {
@@ -721,7 +1278,7 @@ func TestAmbiguousPath2(t *testing.T) {
 	srv.GET("/:package/-/:archive", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("package/archive"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/foobar", []byte("package"))
 	curl(t, "GET", "localhost", addr, "/@babel/core", []byte("module/package"))
@@ -729,7 +1286,7 @@ func TestAmbiguousPath2(t *testing.T) {
 }
 
 func TestAmbiguousPath3(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	srv.DiscardLogs()
 	defer srv.Shutdown()
 	srv.GET("/usr/local/:group/:user/*", func(w http.ResponseWriter, r *http.Request) {
@@ -737,7 +1294,7 @@ func TestAmbiguousPath3(t *testing.T) {
 		user := middleware.Param(r, "user")
 		w.Write([]byte(group + ":" + user))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	inputs := [][]string{
 		{"should not exist 1", "/usr/local", "404 page not found\n"},
@@ -753,103 +1310,672 @@ func TestAmbiguousPath3(t *testing.T) {
 	}
 }
 
-type telemetry struct {
-	called bool
-	latest middleware.AccessLog
-}
-
-func (t telemetry) ListeningOn(addr net.Addr) {}
-
-func (t telemetry) Shutdown(err error) {}
-
-func (t *telemetry) Log(data middleware.AccessLog) {
-	t.called = true
-	t.latest = data
+// lastLog returns the most recent access log recorded by the logger.
+func lastLog(logger *testlogger.Logger) middleware.AccessLog {
+	entry, _ := logger.Last()
+	return entry
 }
 
 func TestResponseCallback(t *testing.T) {
-	srv, addr := newTestServer(t)
-	tracer := &telemetry{}
+	srv := newTestServer(t)
+	tracer := testlogger.New()
 	srv.Logger = tracer
 	defer srv.Shutdown()
 	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Hello World"))
 	})
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/?hello=world&foo=bar", []byte("Hello World"))
 
-	if !tracer.called {
+	if _, err := tracer.Wait(1, time.Second); err != nil {
 		t.Fatal("http tracer was not called")
 	}
 
-	if tracer.latest.Host != "localhost" {
-		t.Fatalf("unexpected value for Host: %s", tracer.latest.Host)
+	if lastLog(tracer).Host != "localhost" {
+		t.Fatalf("unexpected value for Host: %s", lastLog(tracer).Host)
 	}
 
-	if tracer.latest.RemoteUser != "" {
-		t.Fatalf("unexpected value for RemoteUser: %s", tracer.latest.RemoteUser)
+	if lastLog(tracer).RemoteUser != "" {
+		t.Fatalf("unexpected value for RemoteUser: %s", lastLog(tracer).RemoteUser)
 	}
 
-	if tracer.latest.Method != "GET" {
-		t.Fatalf("unexpected value for Method: %s", tracer.latest.Method)
+	if lastLog(tracer).Method != "GET" {
+		t.Fatalf("unexpected value for Method: %s", lastLog(tracer).Method)
 	}
 
-	if tracer.latest.Path != "/" {
-		t.Fatalf("unexpected value for Path: %s", tracer.latest.Path)
+	if lastLog(tracer).Path != "/" {
+		t.Fatalf("unexpected value for Path: %s", lastLog(tracer).Path)
 	}
 
-	if params := tracer.latest.Query.Encode(); params != "foo=bar&hello=world" {
+	if params := lastLog(tracer).Query.Encode(); params != "foo=bar&hello=world" {
 		t.Fatalf("unexpected value for Query: %s", params)
 	}
 
-	if tracer.latest.Protocol != "HTTP/1.1" {
-		t.Fatalf("unexpected value for Protocol: %s", tracer.latest.Protocol)
+	if lastLog(tracer).Protocol != "HTTP/1.1" {
+		t.Fatalf("unexpected value for Protocol: %s", lastLog(tracer).Protocol)
 	}
 
-	if tracer.latest.StatusCode != 200 {
-		t.Fatalf("unexpected value for StatusCode: %d", tracer.latest.StatusCode)
+	if lastLog(tracer).StatusCode != 200 {
+		t.Fatalf("unexpected value for StatusCode: %d", lastLog(tracer).StatusCode)
 	}
 
-	if tracer.latest.BytesReceived != 0 {
-		t.Fatalf("unexpected value for BytesReceived: %d", tracer.latest.BytesReceived)
+	if lastLog(tracer).BytesReceived != 0 {
+		t.Fatalf("unexpected value for BytesReceived: %d", lastLog(tracer).BytesReceived)
 	}
 
-	if tracer.latest.BytesSent != 11 {
-		t.Fatalf("unexpected value for BytesSent: %d", tracer.latest.BytesSent)
+	if lastLog(tracer).BytesSent != 11 {
+		t.Fatalf("unexpected value for BytesSent: %d", lastLog(tracer).BytesSent)
 	}
 
-	if ua := tracer.latest.Header.Get("User-Agent"); ua != "Go-http-client/1.1" {
+	if ua := lastLog(tracer).Header.Get("User-Agent"); ua != "Go-http-client/1.1" {
 		t.Fatalf("unexpected value for BytesSent: %s", ua)
 	}
 
-	if tracer.latest.Duration <= 0 {
-		t.Fatalf("unexpected value for Duration: %v", tracer.latest.Duration)
+	if lastLog(tracer).Duration <= 0 {
+		t.Fatalf("unexpected value for Duration: %v", lastLog(tracer).Duration)
 	}
 }
 
-func TestShutdown(t *testing.T) {
-	srv, addr := newTestServer(t)
-	srv.DiscardLogs()
-	srv.GET("/s", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("xyz")) })
-
-	go srv.ListenAndServe(addr.String())
+func TestResponseCallbackLogHeaders(t *testing.T) {
+	srv := middleware.New()
+	tracer := testlogger.New()
+	srv.Logger = tracer
+	srv.LogHeaders = []string{"user-agent"}
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("User-Agent", "modified")
+		w.Write([]byte("Hello World"))
+	})
 
-	curl(t, "GET", "localhost", addr, "/s", []byte("xyz"))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Referer", "http://www.example.com/")
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+	srv.ServeHTTP(w, r)
 
-	srv.Shutdown()
+	if len(lastLog(tracer).Header) != 1 {
+		t.Fatalf("unexpected value for Header: %#v", lastLog(tracer).Header)
+	}
 
-	shouldNotCurl(t, "GET", "localhost", addr, "/s")
+	if ua := lastLog(tracer).Header.Get("User-Agent"); ua != "modified" {
+		t.Fatalf("unexpected value for User-Agent: %s", ua)
+	}
 }
 
-type CustomSignal int
+func TestResponseCallbackTrailers(t *testing.T) {
+	srv := middleware.New()
+	tracer := testlogger.New()
+	srv.Logger = tracer
+	srv.LogTrailers = true
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("Hello World"))
+		w.Header().Set("X-Checksum", "b10a8db1")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
 
-func (CustomSignal) Signal() {}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	srv.ServeHTTP(w, r)
+
+	if checksum := w.Result().Trailer.Get("X-Checksum"); checksum != "b10a8db1" {
+		t.Fatalf("unexpected value for X-Checksum trailer: %s", checksum)
+	}
+
+	if checksum := lastLog(tracer).Trailer.Get("X-Checksum"); checksum != "b10a8db1" {
+		t.Fatalf("unexpected value for X-Checksum in access log: %s", checksum)
+	}
+
+	if status := lastLog(tracer).Trailer.Get("Grpc-Status"); status != "0" {
+		t.Fatalf("unexpected value for Grpc-Status in access log: %s", status)
+	}
+}
+
+func TestAllowOnly(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(middleware.AllowOnly("10.0.0.0/8", "192.168.1.100"))
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World"))
+	})
+
+	inputs := [][]string{
+		{"10.1.2.3:4567", "Hello World"},
+		{"192.168.1.100:4567", "Hello World"},
+		{"192.168.1.101:4567", "Forbidden\n"},
+		{"[::1]:4567", "Forbidden\n"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input[0], func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = input[0]
+			srv.ServeHTTP(w, r)
+
+			if body := w.Body.String(); body != input[1] {
+				t.Fatalf("unexpected response body: %q", body)
+			}
+		})
+	}
+}
+
+func TestEnableExpvar(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.EnableExpvar("/debug/vars")
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+	srv.ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("remote clients should not have access: %d", w.Code)
+	}
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+	r.RemoteAddr = "127.0.0.1:4567"
+	srv.ServeHTTP(w, r)
+
+	var data struct {
+		Memstats   map[string]interface{} `json:"memstats"`
+		Middleware struct {
+			Requests map[string]int `json:"requests"`
+			Uptime   float64        `json:"uptime"`
+		} `json:"middleware"`
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatalf("cannot decode expvar response %s\n%s", err, w.Body.String())
+	}
+
+	if data.Memstats == nil {
+		t.Fatal("missing memstats")
+	}
+
+	if data.Middleware.Requests["200"] != 1 || data.Middleware.Requests["403"] != 1 {
+		t.Fatalf("unexpected request counters: %#v", data.Middleware.Requests)
+	}
+}
+
+func TestEnablePprof(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.EnablePprof("/_/pprof")
+
+	inputs := [][]string{
+		{"/_/pprof", "", "301"},
+		{"/_/pprof/", "127.0.0.1:4567", "200"},
+		{"/_/pprof/heap?debug=1", "127.0.0.1:4567", "200"},
+		{"/_/pprof/cmdline", "127.0.0.1:4567", "200"},
+		{"/_/pprof/symbol", "127.0.0.1:4567", "200"},
+		{"/_/pprof/heap?debug=1", "192.168.1.101:4567", "403"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input[0], func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, input[0], nil)
+			if input[1] != "" {
+				r.RemoteAddr = input[1]
+			}
+			srv.ServeHTTP(w, r)
+
+			if code := strconv.Itoa(w.Code); code != input[2] {
+				t.Fatalf("unexpected status code: %s\n%s", code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRouteStats(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.EnableRouteStats("/debug/routes")
+	srv.GET("/hello/:name", func(w http.ResponseWriter, r *http.Request) {
+		if middleware.Param(r, "name") == "error" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+
+	for _, endpoint := range []string{"/hello/alice", "/hello/bob", "/hello/error", "/notfound"} {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, endpoint, nil))
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/debug/routes", nil)
+	r.RemoteAddr = "127.0.0.1:4567"
+	srv.ServeHTTP(w, r)
+
+	var stats []middleware.RouteStats
+
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("cannot decode route stats %s\n%s", err, w.Body.String())
+	}
+
+	if len(stats) != 1 {
+		t.Fatalf("unexpected number of routes: %#v", stats)
+	}
+
+	s := stats[0]
+
+	if s.Host != "_" || s.Method != "GET" || s.Pattern != "/hello/:name" || s.Count != 3 {
+		t.Fatalf("unexpected route stats: %#v", s)
+	}
+
+	if s.Status[200] != 2 || s.Status[500] != 1 {
+		t.Fatalf("unexpected status distribution: %#v", s.Status)
+	}
+
+	if p := s.Percentile(99); p > s.Buckets[len(s.Buckets)-2].UpperBound {
+		t.Fatalf("unexpected percentile: %s", p)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.EnableHealthCheck("/readyz")
+	srv.AddHealthCheck(middleware.HealthCheck{
+		Name:     "database",
+		Critical: true,
+		Check:    func(ctx context.Context) error { return nil },
+	})
+	srv.AddHealthCheck(middleware.HealthCheck{
+		Name:    "cache",
+		Timeout: time.Millisecond,
+		Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var report struct {
+		Status string
+		Checks map[string]struct{ Status, Error string }
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("cannot decode health report %s\n%s", err, w.Body.String())
+	}
+
+	if w.Code != http.StatusOK || report.Status != "degraded" {
+		t.Fatalf("unexpected health status: %d %s", w.Code, report.Status)
+	}
+
+	if c := report.Checks["cache"]; c.Status != "failing" || c.Error != "context deadline exceeded" {
+		t.Fatalf("unexpected cache check: %#v", c)
+	}
+
+	srv.Shutdown()
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("health check should fail during shutdown: %d", w.Code)
+	}
+}
+
+func poweredBy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Powered-By", "middleware")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestEnableStatus(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(poweredBy)
+	srv.EnableStatus("/_server/status")
+	srv.POST("/hello/:name", func(w http.ResponseWriter, r *http.Request) {})
+	srv.Host("foo.test").GET("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/_server/status", nil)
+	r.RemoteAddr = "127.0.0.1:4567"
+	srv.ServeHTTP(w, r)
+
+	var status struct {
+		Hosts       []string
+		Routes      []middleware.RouteInfo
+		Middlewares []string
+		Config      map[string]string
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("cannot decode server status %s\n%s", err, w.Body.String())
+	}
+
+	if len(status.Hosts) != 2 || status.Hosts[0] != "_" || status.Hosts[1] != "foo.test" {
+		t.Fatalf("unexpected hosts: %#v", status.Hosts)
+	}
+
+	expected := []middleware.RouteInfo{
+		{Host: "_", Method: "GET", Pattern: "/_server/status"},
+		{Host: "_", Method: "POST", Pattern: "/hello/:name"},
+		{Host: "foo.test", Method: "GET", Pattern: "/"},
+	}
+
+	if !reflect.DeepEqual(status.Routes, expected) {
+		t.Fatalf("unexpected routes:\n- %#v\n+ %#v", expected, status.Routes)
+	}
+
+	if len(status.Middlewares) != 1 || !strings.HasSuffix(status.Middlewares[0], ".poweredBy") {
+		t.Fatalf("unexpected middlewares: %#v", status.Middlewares)
+	}
+
+	if status.Config["WriteTimeout"] != "2s" {
+		t.Fatalf("unexpected config: %#v", status.Config)
+	}
+}
+
+type auditLogger struct {
+	records []middleware.AuditRecord
+}
+
+func (l *auditLogger) Audit(record middleware.AuditRecord) {
+	l.records = append(l.records, record)
+}
+
+type actorKey struct{}
+
+func TestAudit(t *testing.T) {
+	logger := &auditLogger{}
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.AuditLogger = logger
+	srv.AuditActor = func(r *http.Request) string {
+		actor, _ := r.Context().Value(actorKey{}).(string)
+		return actor
+	}
+	srv.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := r.Header.Get("X-User")
+
+			if user == "" {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), actorKey{}, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+	srv.DELETE("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {})
+	srv.Audit("DELETE", "/users/:id")
+
+	requests := []struct {
+		method string
+		user   string
+	}{
+		{"GET", "alice"},
+		{"DELETE", "alice"},
+		{"DELETE", "alice"},
+		{"DELETE", ""},
+	}
+
+	for _, req := range requests {
+		r := httptest.NewRequest(req.method, "/users/123", nil)
+		r.Header.Set("X-User", req.user)
+		srv.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	if len(logger.records) != 3 {
+		t.Fatalf("unexpected number of audit records: %d", len(logger.records))
+	}
+
+	first, second, denied := logger.records[0], logger.records[1], logger.records[2]
+
+	// the request rejected by the middleware chain is recorded too.
+	if denied.Actor != "" || denied.Status != http.StatusUnauthorized || denied.Params["id"] != "123" || !denied.Verify(second) {
+		t.Fatalf("unexpected audit record for the rejected request: %#v", denied)
+	}
+
+	if first.Actor != "alice" || first.Pattern != "/users/:id" || first.Params["id"] != "123" || first.Status != http.StatusNoContent {
+		t.Fatalf("unexpected audit record: %#v", first)
+	}
+
+	if !first.Verify(middleware.AuditRecord{}) || !second.Verify(first) {
+		t.Fatal("audit records should form a valid chain")
+	}
+
+	second.Actor = "mallory"
+
+	if second.Verify(first) {
+		t.Fatal("modified audit record should not be valid")
+	}
+}
+
+func TestOTLPLogger(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	var records []string
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var data struct {
+			ResourceLogs []struct {
+				ScopeLogs []struct {
+					LogRecords []struct {
+						Body struct{ StringValue string }
+					}
+				}
+			}
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			t.Errorf("cannot decode OTLP request %s", err)
+		}
+
+		for _, record := range data.ResourceLogs[0].ScopeLogs[0].LogRecords {
+			records = append(records, record.Body.StringValue)
+		}
+	}))
+	defer collector.Close()
+
+	logger := middleware.NewOTLPLogger(collector.URL+"/v1/logs", "test")
+	logger.BatchSize = 2
+	logger.Backoff = time.Millisecond
+
+	srv := middleware.New()
+	srv.Logger = logger
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+
+	for i := 0; i < 3; i++ {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/?id="+strconv.Itoa(i), nil))
+	}
+
+	logger.Shutdown(nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(records) != 3 || !strings.Contains(records[2], `"GET /?id=2 HTTP/1.1" 200 2`) {
+		t.Fatalf("unexpected OTLP records: %#v", records)
+	}
+}
+
+func TestOTLPLoggerMaxQueue(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+
+	received := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			ResourceLogs []struct {
+				ScopeLogs []struct {
+					LogRecords []struct {
+						Attributes []struct {
+							Key   string
+							Value struct{ StringValue string }
+						}
+					}
+				}
+			}
+		}
+
+		json.NewDecoder(r.Body).Decode(&data)
+
+		mu.Lock()
+		for _, record := range data.ResourceLogs[0].ScopeLogs[0].LogRecords {
+			for _, attr := range record.Attributes {
+				if attr.Key == "url.path" {
+					paths = append(paths, attr.Value.StringValue)
+				}
+			}
+		}
+		mu.Unlock()
+
+		received <- struct{}{}
+		<-release
+	}))
+	defer collector.Close()
+
+	var errorLog bytes.Buffer
+
+	logger := middleware.NewOTLPLogger(collector.URL+"/v1/logs", "test")
+	logger.BatchSize = 1
+	logger.MaxQueue = 1
+	logger.ErrorLog = log.New(&errorLog, "", 0)
+
+	// the logger sends the entries without ListeningOn.
+	logger.Log(middleware.AccessLog{Path: "/1"})
+
+	select {
+	case <-received:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expecting the first entry without ListeningOn")
+	}
+
+	// the collector is busy, so the queue keeps one entry and drops the rest.
+	for i := 2; i <= 5; i++ {
+		logger.Log(middleware.AccessLog{Path: "/" + strconv.Itoa(i)})
+	}
+
+	close(release)
+	logger.Shutdown(nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !reflect.DeepEqual(paths, []string{"/1", "/2"}) {
+		t.Fatalf("unexpected OTLP records: %q", paths)
+	}
+
+	if errorLog.String() != "otlp: dropped 3 access logs, the queue is full\n" {
+		t.Fatalf("unexpected error log: %q", errorLog.String())
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv := newTestServer(t)
+	srv.DiscardLogs()
+	srv.GET("/s", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("xyz")) })
+
+	addr := startTestServer(t, srv)
+
+	curl(t, "GET", "localhost", addr, "/s", []byte("xyz"))
+
+	srv.Shutdown()
+
+	shouldNotCurl(t, "GET", "localhost", addr, "/s")
+}
+
+func TestInFlight(t *testing.T) {
+	var buf bytes.Buffer
+
+	srv := newTestServer(t)
+	srv.DiscardLogs()
+	srv.EnableInFlight()
+	srv.ErrorLog = log.New(&buf, "", 0)
+	srv.ShutdownTimeout = time.Millisecond * 10
+
+	started := make(chan bool)
+	release := make(chan bool)
+
+	srv.GET("/slow/:id", func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	})
+	addr := startTestServer(t, srv)
+
+	go http.Get("http://" + addr.String() + "/slow/123")
+
+	<-started
+
+	requests := srv.InFlight()
+
+	if len(requests) != 1 || requests[0].Pattern != "/slow/:id" || requests[0].Path != "/slow/123" {
+		t.Fatalf("unexpected in-flight requests: %#v", requests)
+	}
+
+	if err := srv.Shutdown(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown should time out: %v", err)
+	}
+
+	close(release)
+
+	if !strings.Contains(buf.String(), "GET 127.0.0.1:") || !strings.Contains(buf.String(), `route="/slow/:id"`) {
+		t.Fatalf("unexpected error log: %s", buf.String())
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	alerts := make(chan []string, 1)
+
+	srv := middleware.New()
+	stop := srv.StartWatchdog(middleware.Watchdog{
+		Interval:      time.Millisecond,
+		MaxGoroutines: 1,
+		MaxHeapBytes:  1 << 40,
+		OnAlert: func(s middleware.WatchdogSample, exceeded []string) {
+			select {
+			case alerts <- exceeded:
+			default:
+			}
+		},
+	})
+	defer stop()
+
+	select {
+	case exceeded := <-alerts:
+		if len(exceeded) != 1 || exceeded[0] != "goroutines>1" {
+			t.Fatalf("unexpected watchdog alert: %#v", exceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not raise an alert")
+	}
+}
+
+type CustomSignal int
+
+func (CustomSignal) Signal() {}
 
 func (CustomSignal) String() string { return "custom signal" }
 
 func TestShutdownWithChannel(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 
 	done := false
 	quit := make(chan os.Signal, 1)
@@ -865,7 +1991,7 @@ func TestShutdownWithChannel(t *testing.T) {
 		done = true
 	}()
 
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/swc", []byte("abc"))
 	quit <- CustomSignal(60310) // Call middleware.Shutdown to stop the server.
@@ -879,13 +2005,13 @@ func TestShutdownWithChannel(t *testing.T) {
 }
 
 func TestShutdownAddon(t *testing.T) {
-	srv, addr := newTestServer(t)
+	srv := newTestServer(t)
 	done := false
 	srv.DiscardLogs()
 	srv.OnShutdown = func() { done = true }
 	srv.GET("/s", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("XD")) })
 
-	go srv.ListenAndServe(addr.String())
+	addr := startTestServer(t, srv)
 
 	curl(t, "GET", "localhost", addr, "/s", []byte("XD"))
 	srv.Shutdown()
@@ -915,68 +2041,4389 @@ var sampleAccessLog = middleware.AccessLog{
 	Duration: time.Millisecond * 5420,
 }
 
-func TestLoggerString(t *testing.T) {
-	expected := `localhost 127.0.0.1 "POST /server-status HTTP/1.0" 200 2326 "Mozilla/5.0 (KHTML, like Gecko) Version/78.0.3904.108" 5.42s`
-
-	if str := sampleAccessLog.String(); str != expected {
-		t.Fatalf("incorrect access log format:\n- %s\n+ %s", expected, str)
+func TestWebhook(t *testing.T) {
+	sign := func(parts ...string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(strings.Join(parts, "")))
+		return hex.EncodeToString(mac.Sum(nil))
 	}
-}
 
-func TestLoggerCommonLog(t *testing.T) {
-	expected := `127.0.0.1 - - [10/12/2019:13:55:36 +00:00] "POST /server-status HTTP/1.0" 200 2326`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	body := `{"action":"opened"}`
 
-	if str := sampleAccessLog.CommonLog(); str != expected {
-		t.Fatalf("incorrect common log format:\n- %s\n+ %s", expected, str)
+	srv := middleware.New()
+	srv.DiscardLogs()
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}
+	srv.WEBHOOK("/github", middleware.GitHubWebhook("secret"), echo)
+	srv.WEBHOOK("/stripe", middleware.StripeWebhook("secret"), echo)
+	srv.WEBHOOK("/slack", middleware.SlackWebhook("secret"), echo)
+	srv.WEBHOOK("/small", &middleware.Webhook{MaxBodySize: 4}, echo)
+
+	inputs := []struct {
+		name     string
+		endpoint string
+		header   http.Header
+		status   int
+	}{
+		{"GitHubValid", "/github", http.Header{"X-Hub-Signature-256": {"sha256=" + sign(body)}}, http.StatusOK},
+		{"GitHubInvalid", "/github", http.Header{"X-Hub-Signature-256": {"sha256=" + sign("x")}}, http.StatusUnauthorized},
+		{"GitHubMissing", "/github", http.Header{}, http.StatusUnauthorized},
+		{"StripeValid", "/stripe", http.Header{"Stripe-Signature": {"t=" + now + ",v1=bad,v1=" + sign(now, ".", body)}}, http.StatusOK},
+		{"StripeExpired", "/stripe", http.Header{"Stripe-Signature": {"t=" + old + ",v1=" + sign(old, ".", body)}}, http.StatusUnauthorized},
+		{"SlackValid", "/slack", http.Header{"X-Slack-Request-Timestamp": {now}, "X-Slack-Signature": {"v0=" + sign("v0:", now, ":", body)}}, http.StatusOK},
+		{"SlackInvalid", "/slack", http.Header{"X-Slack-Request-Timestamp": {now}, "X-Slack-Signature": {"v0=" + sign(body)}}, http.StatusUnauthorized},
+		{"TooLarge", "/small", http.Header{}, http.StatusRequestEntityTooLarge},
 	}
-}
 
-func TestLoggerCombinedLog(t *testing.T) {
-	expected := `127.0.0.1 - - [10/12/2019:13:55:36 +00:00] "POST /server-status HTTP/1.0" 200 2326 "http://www.example.com/" "Mozilla/5.0 (KHTML, like Gecko) Version/78.0.3904.108"`
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, input.endpoint, strings.NewReader(body))
+			r.Header = input.header
+			srv.ServeHTTP(w, r)
+
+			if w.Code != input.status {
+				t.Fatalf("unexpected status code: %d", w.Code)
+			}
 
-	if str := sampleAccessLog.CombinedLog(); str != expected {
-		t.Fatalf("incorrect combined log format:\n- %s\n+ %s", expected, str)
+			if w.Code == http.StatusOK && w.Body.String() != body {
+				t.Fatalf("unexpected response body: %q", w.Body.String())
+			}
+		})
 	}
 }
 
-func TestLoggerCombinedLogWithHyphens(t *testing.T) {
-	localAccessLog := sampleAccessLog
-	localAccessLog.Header.Set("Referer", "")
-	localAccessLog.Header.Set("User-Agent", "")
+func TestTrustProxies(t *testing.T) {
+	inputs := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		clientIP   string
+		scheme     string
+		host       string
+	}{
+		{"Untrusted", "203.0.113.9:1234", http.Header{"Forwarded": {"for=192.0.2.43;proto=https"}}, "203.0.113.9", "http", "example.com"},
+		{"Forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {"for=192.0.2.43;proto=https;host=www.example.com"}}, "192.0.2.43", "https", "www.example.com"},
+		{"ForwardedIPv6", "10.0.0.1:1234", http.Header{"Forwarded": {`for="[2001:db8::1]:4711"`}}, "2001:db8::1", "http", "example.com"},
+		{"ForwardedChain", "10.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.7, for=192.0.2.43;proto=https", "for=10.0.0.2"}}, "192.0.2.43", "https", "example.com"},
+		{"ForwardedQuoted", "10.0.0.1:1234", http.Header{"Forwarded": {`for="[2001:db8::1]:4711";host="a,b";proto=https`}}, "2001:db8::1", "https", "a,b"},
+		{"ForwardedQuotedChain", "10.0.0.1:1234", http.Header{"Forwarded": {`for=192.0.2.43;host="x\"y;z", for="10.0.0.2";proto="https,http"`}}, "192.0.2.43", "http", `x"y;z`},
+		{"XForwarded", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7, 192.0.2.43, 10.0.0.2"}, "X-Forwarded-Proto": {"https"}}, "192.0.2.43", "https", "example.com"},
+	}
 
-	expected := `127.0.0.1 - - [10/12/2019:13:55:36 +00:00] "POST /server-status HTTP/1.0" 200 2326 "-" "-"`
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			var clientIP, scheme string
+			logger := testlogger.New()
+			srv := middleware.New()
+			srv.Logger = logger
+			srv.TrustProxies("10.0.0.0/8")
+			srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+				clientIP = middleware.ClientIP(r)
+				scheme = middleware.Scheme(r)
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = "example.com"
+			r.RemoteAddr = input.remoteAddr
+			r.Header = input.header
+			srv.ServeHTTP(w, r)
+
+			if clientIP != input.clientIP || !strings.HasPrefix(lastLog(logger).RemoteAddr, input.clientIP) {
+				t.Fatalf("unexpected client IP: %q and %q", clientIP, lastLog(logger).RemoteAddr)
+			}
 
-	str := sampleAccessLog.CombinedLog()
+			if scheme != input.scheme || lastLog(logger).Scheme != input.scheme {
+				t.Fatalf("unexpected scheme: %q and %q", scheme, lastLog(logger).Scheme)
+			}
+
+			if lastLog(logger).Host != input.host {
+				t.Fatalf("unexpected host: %q", lastLog(logger).Host)
+			}
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("hello world"))
+	zw.Close()
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(middleware.Decompress(8))
+	srv.POST("/", func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Write(b)
+	})
+
+	inputs := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+		expected string
+	}{
+		{"Identity", "", []byte("plain"), http.StatusOK, "plain"},
+		{"TooLarge", "gzip", compressed.Bytes(), http.StatusRequestEntityTooLarge, "http: request body too large\n"},
+		{"Malformed", "gzip", []byte("plain"), http.StatusBadRequest, "Bad Request\n"},
+		{"Unsupported", "br", []byte("plain"), http.StatusUnsupportedMediaType, "Unsupported Media Type\n"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(input.body))
+			r.Header.Set("Content-Encoding", input.encoding)
+			srv.ServeHTTP(w, r)
+
+			if w.Code != input.status || w.Body.String() != input.expected {
+				t.Fatalf("unexpected response: %d %q", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	srv = middleware.New()
+	srv.DiscardLogs()
+	srv.Use(middleware.Decompress(0))
+	srv.POST("/", func(w http.ResponseWriter, r *http.Request) { io.Copy(w, r.Body) })
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compressed.Bytes()))
+	r.Header.Set("Content-Encoding", "gzip")
+	srv.ServeHTTP(w, r)
+
+	if body := w.Body.String(); body != "hello world" {
+		t.Fatalf("unexpected response body: %q", body)
+	}
+}
+
+func TestRobotsAndSitemap(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/about", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/blog/:slug", func(w http.ResponseWriter, r *http.Request) {})
+	srv.POST("/contact", func(w http.ResponseWriter, r *http.Request) {})
+	srv.Robots([]middleware.RobotsRule{{UserAgent: []string{"*"}, Disallow: []string{"/admin/"}}})
+	srv.Sitemap(nil)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/robots.txt", nil)
+	srv.ServeHTTP(w, r)
+
+	if expected := "User-agent: *\nDisallow: /admin/\n\nSitemap: http://example.com/sitemap.xml\n"; w.Body.String() != expected {
+		t.Fatalf("unexpected robots.txt: %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/sitemap.xml", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	srv.ServeHTTP(w, r)
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip response, got %q", w.Header())
+	}
+
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := io.ReadAll(zr)
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url>
+    <loc>http://example.com/</loc>
+  </url>
+  <url>
+    <loc>http://example.com/about</loc>
+  </url>
+</urlset>
+`
+
+	if string(body) != expected {
+		t.Fatalf("unexpected sitemap.xml:\n%s", body)
+	}
+
+	etag := w.Header().Get("ETag")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/sitemap.xml", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-None-Match", etag)
+	srv.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 Not Modified, got %d", w.Code)
+	}
+}
+
+func TestACMEChallenge(t *testing.T) {
+	challenges := &middleware.ACMEChallenges{}
+	challenges.Set("LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0", "LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0.9jg46WB3rR_AHD-EBXdN7cBkH1WOu0tA3M9fm21mqTI")
+	challenges.Set("deleted", "deleted.thumbprint")
+	challenges.Delete("deleted")
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.ACMEChallenge(challenges)
+
+	inputs := []struct {
+		token    string
+		status   int
+		expected string
+	}{
+		{"LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0", http.StatusOK, "LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0.9jg46WB3rR_AHD-EBXdN7cBkH1WOu0tA3M9fm21mqTI"},
+		{"deleted", http.StatusNotFound, "Not Found\n"},
+		{"in%20valid", http.StatusNotFound, "Not Found\n"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.token, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/"+input.token, nil)
+			srv.ServeHTTP(w, r)
+
+			if w.Code != input.status || w.Body.String() != input.expected {
+				t.Fatalf("unexpected response: %d %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMirrorTraffic(t *testing.T) {
+	mirrored := make(chan string, 1)
+
+	shadow := middleware.New()
+	shadow.DiscardLogs()
+	shadow.POST("/users", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mirrored <- r.Header.Get("X-Test") + " " + string(b)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	shadowSrv := httptest.NewServer(shadow)
+	defer shadowSrv.Close()
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(middleware.MirrorTraffic(middleware.MirrorURL(shadowSrv.URL), 100, 8))
+	srv.POST("/users", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader("alice"))
+	r.Header.Set("X-Test", "mirror")
+	srv.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Fatalf("unexpected response: %d %q", w.Code, w.Body.String())
+	}
+
+	select {
+	case got := <-mirrored:
+		if got != "mirror alice" {
+			t.Fatalf("unexpected mirrored request: %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/users", strings.NewReader("a very long body"))
+	srv.ServeHTTP(w, r)
+
+	if w.Body.String() != "a very long body" {
+		t.Fatalf("unexpected response body: %q", w.Body.String())
+	}
+
+	select {
+	case got := <-mirrored:
+		t.Fatalf("unexpected mirrored request: %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	logger := testlogger.New()
+	srv := middleware.New()
+	srv.Logger = logger
+	srv.GET("/", middleware.Weighted(middleware.StickyHeader("X-User"),
+		middleware.Variant{Name: "stable", Weight: 90, Handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("stable")) }},
+		middleware.Variant{Name: "canary", Weight: 10, Handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("canary")) }},
+		middleware.Variant{Name: "disabled", Weight: 0, Handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("disabled")) }},
+	))
+
+	counts := map[string]int{}
+
+	for i := 0; i < 1000; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", strconv.Itoa(i))
+		srv.ServeHTTP(w, r)
+
+		if lastLog(logger).Variant != w.Body.String() {
+			t.Fatalf("unexpected variant in access log: %q != %q", lastLog(logger).Variant, w.Body.String())
+		}
+
+		counts[w.Body.String()]++
+
+		w2 := httptest.NewRecorder()
+		srv.ServeHTTP(w2, r)
+
+		if w2.Body.String() != w.Body.String() {
+			t.Fatalf("variant is not sticky for user %d", i)
+		}
+	}
+
+	if counts["canary"] < 50 || counts["canary"] > 150 || counts["disabled"] != 0 {
+		t.Fatalf("unexpected traffic split: %v", counts)
+	}
+}
+
+func TestListenAndServeReady(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	defer srv.Shutdown()
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ready")) })
+
+	ready := make(chan net.Addr, 1)
+	go srv.ListenAndServeReady("127.0.0.1:0", ready)
+	addr := <-ready
+
+	curl(t, "GET", "localhost", addr, "/", []byte("ready"))
+
+	// the port is in use, so the channel is closed without an address.
+	busy := make(chan net.Addr, 1)
+
+	if err := middleware.New().ListenAndServeReady(addr.String(), busy); err == nil {
+		t.Fatal("expecting error for a port in use")
+	}
+
+	if addr, ok := <-busy; ok {
+		t.Fatalf("expecting closed ready channel, got %v", addr)
+	}
+}
+
+// fcgiRequest sends a FastCGI request without body to the address, and returns
+// the CGI response written by the application.
+func fcgiRequest(t *testing.T, addr net.Addr, params map[string]string) string {
+	conn, err := net.Dial("tcp", addr.String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	record := func(kind byte, content []byte) {
+		header := []byte{1, kind, 0, 1, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+		conn.Write(append(header, content...))
+	}
+
+	var pairs []byte
+
+	for name, value := range params {
+		pairs = append(pairs, byte(len(name)), byte(len(value)))
+		pairs = append(pairs, name...)
+		pairs = append(pairs, value...)
+	}
+
+	record(1, []byte{0, 1, 0, 0, 0, 0, 0, 0}) /* FCGI_BEGIN_REQUEST, responder */
+	record(4, pairs)                          /* FCGI_PARAMS */
+	record(4, nil)
+	record(5, nil) /* FCGI_STDIN */
+
+	var stdout bytes.Buffer
+
+	for {
+		header := make([]byte, 8)
+
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.Fatalf("reading FastCGI record: %s", err)
+		}
+
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:]))+int(header[6]))
+
+		if _, err := io.ReadFull(conn, content); err != nil {
+			t.Fatalf("reading FastCGI record: %s", err)
+		}
+
+		switch header[1] {
+		case 6: /* FCGI_STDOUT */
+			stdout.Write(content[:binary.BigEndian.Uint16(header[4:])])
+		case 3: /* FCGI_END_REQUEST */
+			return stdout.String()
+		}
+	}
+}
+
+func TestServeFCGI(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.EnableStatus("/_status")
+	srv.GET("/hello/:name", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + middleware.Param(r, "name") + " at " + r.Host))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.ServeFCGI(l) }()
+
+	out := fcgiRequest(t, l.Addr(), map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"REQUEST_URI":     "/hello/world",
+		"HTTP_HOST":       "example.com",
+	})
+
+	if !strings.HasPrefix(out, "Status: 200 OK\r\n") || !strings.HasSuffix(out, "\r\n\r\nhello world at example.com") {
+		t.Fatalf("unexpected FastCGI response: %q", out)
+	}
+
+	status := fcgiRequest(t, l.Addr(), map[string]string{
+		"REQUEST_METHOD":  "GET",
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"REQUEST_URI":     "/_status",
+		"REMOTE_ADDR":     "127.0.0.1",
+		"REMOTE_PORT":     "40000",
+	})
+
+	if !strings.Contains(status, `"uptime":"`) || strings.Contains(status, `"uptime":""`) {
+		t.Fatalf("expecting the uptime of the FastCGI server: %q", status)
+	}
+
+	srv.Shutdown()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error after Shutdown: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeFCGI did not return after Shutdown")
+	}
+
+	srv.StrictRoutes = true
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	srv.GET("/hello/:other", func(w http.ResponseWriter, r *http.Request) {})
+
+	if err := srv.ServeFCGI(l); err == nil || !strings.Contains(err.Error(), "route conflicts") {
+		t.Fatalf("expecting FastCGI server to refuse to start, got %v", err)
+	}
+}
+
+func TestServeCGI(t *testing.T) {
+	if os.Getenv("MIDDLEWARE_TEST_CGI") == "1" {
+		// the child process, spawned below, handles one CGI request.
+		srv := middleware.New()
+		srv.DiscardLogs()
+		srv.GET("/hello/:name", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello " + middleware.Param(r, "name") + " at " + r.Host))
+		})
+
+		if err := srv.ServeCGI(); err != nil {
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServeCGI$")
+	cmd.Env = append(os.Environ(),
+		"MIDDLEWARE_TEST_CGI=1",
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"REQUEST_METHOD=GET",
+		"SERVER_PROTOCOL=HTTP/1.1",
+		"REQUEST_URI=/hello/world",
+		"HTTP_HOST=example.com",
+	)
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		t.Fatalf("CGI program failed: %s", err)
+	}
+
+	if !strings.HasPrefix(string(out), "Status: 200 OK\r\n") || !strings.HasSuffix(string(out), "\r\n\r\nhello world at example.com") {
+		t.Fatalf("unexpected CGI response: %q", out)
+	}
+}
+
+func TestDumpRoutes(t *testing.T) {
+	srv := middleware.New()
+	srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {})
+	srv.POST("/users", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {})
+	srv.Host("api.example.com").DELETE("/users/:id", func(w http.ResponseWriter, r *http.Request) {})
+
+	var buf bytes.Buffer
+
+	if err := srv.DumpRoutes(&buf, "text"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "_               GET    /\n" +
+		"_               POST   /users\n" +
+		"_               GET    /users/:id\n" +
+		"api.example.com DELETE /users/:id\n"
+
+	if buf.String() != expected {
+		t.Fatalf("unexpected text dump:\n%s", buf.String())
+	}
+
+	buf.Reset()
+
+	if err := srv.DumpRoutes(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	var routes []middleware.RouteInfo
+
+	if err := json.Unmarshal(buf.Bytes(), &routes); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(routes, srv.Routes()) {
+		t.Fatalf("unexpected json dump:\n%s", buf.String())
+	}
+
+	if err := srv.DumpRoutes(&buf, "yaml"); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestClock(t *testing.T) {
+	tick := time.Date(2019, 12, 10, 13, 55, 36, 0, time.UTC)
+	logger := testlogger.New()
+	srv := middleware.New()
+	srv.Logger = logger
+	srv.Now = func() time.Time {
+		tick = tick.Add(time.Millisecond * 5)
+		return tick
+	}
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	srv.ServeHTTP(w, r)
+
+	if expected := time.Date(2019, 12, 10, 13, 55, 36, 5000000, time.UTC); !lastLog(logger).StartTime.Equal(expected) {
+		t.Fatalf("unexpected start time: %s", lastLog(logger).StartTime)
+	}
+
+	if lastLog(logger).Duration != time.Millisecond*5 {
+		t.Fatalf("unexpected duration: %s", lastLog(logger).Duration)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+
+	mark := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	srv := middleware.New()
+	srv.UseNamed("headers", mark("headers"))
+	srv.UseNamed("session", mark("session"))
+	srv.Use(mark("filesys"))
+
+	chain := srv.Chain()
+
+	if len(chain) != 3 || chain[0] != "headers" || chain[1] != "session" || !strings.HasSuffix(chain[2], ".func1") {
+		t.Fatalf("unexpected middleware chain: %v", chain)
+	}
+
+	h := srv.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if expected := []string{"headers", "session", "filesys", "handler"}; !reflect.DeepEqual(order, expected) {
+		t.Fatalf("unexpected execution order: %v", order)
+	}
+}
+
+func TestRequestBuilder(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Host("api.example.com").POST("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write([]byte(middleware.Param(r, "id") + " " + r.URL.Query().Get("page") + " " + r.Header.Get("Content-Type") + " " + middleware.ClientIP(r) + " " + string(b)))
+	})
+
+	r := middleware.NewRequest(http.MethodPost, "/users/42?page=2").
+		Host("api.example.com").
+		Query("sort", "name").
+		RemoteAddr("203.0.113.9:5678").
+		JSON(map[string]string{"name": "alice"}).
+		Build()
+
+	if r.URL.RawQuery != "page=2&sort=name" || r.RequestURI != "/users/42?page=2&sort=name" {
+		t.Fatalf("unexpected query string: %q %q", r.URL.RawQuery, r.RequestURI)
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	if expected := `42 2 application/json 203.0.113.9 {"name":"alice"}`; w.Body.String() != expected {
+		t.Fatalf("unexpected response body: %q", w.Body.String())
+	}
+
+	r = middleware.NewRequest(http.MethodGet, "/").Param("id", "7").Header("X-Test", "a").Header("X-Test", "b").Build()
+
+	if middleware.Param(r, "id") != "7" || r.Host != "example.com" || len(r.Header.Values("X-Test")) != 2 {
+		t.Fatalf("unexpected request: %#v", r)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for the host name.
+func writeTestCertificate(t *testing.T, dir string, host string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, host+".crt")
+	keyFile := filepath.Join(dir, host+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestHostCertificate(t *testing.T) {
+	dir := t.TempDir()
+	srv := middleware.New()
+
+	if cert, _ := srv.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"}); cert != nil {
+		t.Fatal("unexpected certificate without hosts")
+	}
+
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		if err := srv.Host(host).Cert(writeTestCertificate(t, dir, host)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := srv.Host("c.example.com").Cert(filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key")); err == nil {
+		t.Fatal("expected error for missing certificate")
+	}
+
+	inputs := []struct {
+		serverName string
+		expected   string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"B.EXAMPLE.COM", "b.example.com"},
+		{"c.example.com", ""},
+		{"unknown.example.com", ""},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.serverName, func(t *testing.T) {
+			cert, err := srv.GetCertificate(&tls.ClientHelloInfo{ServerName: input.serverName})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if input.expected == "" {
+				if cert != nil {
+					t.Fatalf("unexpected certificate for %s", input.serverName)
+				}
+				return
+			}
+
+			leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+
+			if leaf.Subject.CommonName != input.expected {
+				t.Fatalf("unexpected certificate: %s", leaf.Subject.CommonName)
+			}
+		})
+	}
+}
+
+func TestHostFallback(t *testing.T) {
+	inputs := []struct {
+		name     string
+		fallback middleware.HostFallback
+		promote  bool
+		method   string
+		status   int
+		expected string
+	}{
+		{"Default", middleware.FallbackDefaultHost, false, http.MethodGet, http.StatusOK, "default"},
+		{"DefaultHost", middleware.FallbackDefaultHost, true, http.MethodGet, http.StatusOK, "www"},
+		{"NotFound", middleware.FallbackNotFound, false, http.MethodGet, http.StatusNotFound, "404 page not found\n"},
+		{"Misdirected", middleware.FallbackMisdirected, false, http.MethodGet, http.StatusMisdirectedRequest, "Misdirected Request\n"},
+		{"RedirectWithoutHost", middleware.FallbackRedirect, false, http.MethodGet, http.StatusMisdirectedRequest, "Misdirected Request\n"},
+		{"RedirectGET", middleware.FallbackRedirect, true, http.MethodGet, http.StatusMovedPermanently, ""},
+		{"RedirectPOST", middleware.FallbackRedirect, true, http.MethodPost, http.StatusPermanentRedirect, ""},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			srv := middleware.New()
+			srv.DiscardLogs()
+			srv.HostFallback = input.fallback
+			srv.Handle(input.method, "/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("default")) })
+			srv.Host("www.example.com").Handle(input.method, "/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("www")) })
+
+			if input.promote {
+				srv.DefaultHost("www.example.com")
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(input.method, "/?page=2", nil)
+			r.Host = "unknown.example.com"
+			srv.ServeHTTP(w, r)
+
+			if w.Code != input.status {
+				t.Fatalf("unexpected status code: %d", w.Code)
+			}
+
+			if input.expected != "" && w.Body.String() != input.expected {
+				t.Fatalf("unexpected response body: %q", w.Body.String())
+			}
+
+			if location := w.Header().Get("Location"); input.expected == "" && location != "http://www.example.com/?page=2" {
+				t.Fatalf("unexpected redirection: %q", location)
+			}
+		})
+	}
+}
+
+func TestHostRedirectTo(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Host("old.example.com").GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("old")) })
+	srv.Host("old.example.com").RedirectTo("https://new.example.com/", http.StatusMovedPermanently)
+	srv.Host("blog.example.com").RedirectTo("https://example.com/blog", http.StatusFound)
+
+	inputs := []struct {
+		host     string
+		target   string
+		status   int
+		location string
+	}{
+		{"old.example.com", "/", http.StatusMovedPermanently, "https://new.example.com/"},
+		{"old.example.com:8080", "/users/42?page=2", http.StatusMovedPermanently, "https://new.example.com/users/42?page=2"},
+		{"blog.example.com", "/posts/hello", http.StatusFound, "https://example.com/blog/posts/hello"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.host+input.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, input.target, nil)
+			r.Host = input.host
+			srv.ServeHTTP(w, r)
+
+			if w.Code != input.status || w.Header().Get("Location") != input.location {
+				t.Fatalf("unexpected redirection: %d %q", w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for invalid status code")
+		}
+	}()
+
+	srv.Host("example.org").RedirectTo("https://example.com", http.StatusOK)
+}
+
+func TestHostLimits(t *testing.T) {
+	srv := newTestServer(t)
+	srv.DiscardLogs()
+	srv.WriteTimeout = time.Millisecond * 50
+	defer srv.Shutdown()
+
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 100)
+		w.Write([]byte("done"))
+	}
+	upload := func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Write([]byte("uploaded"))
+	}
+
+	srv.GET("/", slow)
+	srv.POST("/", upload)
+	srv.Host("upload.example.com").GET("/", slow)
+	srv.Host("upload.example.com").POST("/", upload)
+	srv.Host("upload.example.com").SetLimits(middleware.Limits{WriteTimeout: time.Second, MaxBodySize: 4})
+	addr := startTestServer(t, srv)
+
+	if res, err := (&http.Client{Transport: &http.Transport{DisableKeepAlives: true}}).Get("http://" + addr.String() + "/"); err == nil {
+		res.Body.Close()
+		t.Fatal("expected write timeout for the default host")
+	}
+
+	curl(t, "GET", "upload.example.com", addr, "/", []byte("done"))
+
+	for host, expected := range map[string]string{"localhost": "uploaded", "upload.example.com": "too large\n"} {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+addr.String()+"/", strings.NewReader("hello world"))
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if string(body) != expected {
+			t.Fatalf("unexpected response body for %s: %q", host, body)
+		}
+	}
+}
+
+func TestHostPattern(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("default")) })
+	srv.Host("www.example.com").GET("/users/:id", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("www")) })
+	srv.Host(":tenant.Example.com").GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(middleware.Param(r, "tenant") + " " + middleware.Param(r, "id")))
+	})
+
+	inputs := []struct {
+		host     string
+		expected string
+	}{
+		{"acme.example.com", "acme 42"},
+		{"ACME.example.com:8080", "acme 42"},
+		{"www.example.com", "www"},
+		{"a.b.example.com", "default"},
+		{"example.com", "default"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.host, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+			r.Host = input.host
+			srv.ServeHTTP(w, r)
+
+			if w.Body.String() != input.expected {
+				t.Fatalf("unexpected response body: %q", w.Body.String())
+			}
+		})
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for invalid host pattern")
+		}
+	}()
+
+	srv.Host(":tenant")
+}
+
+func TestDefaultHostWhileAddingHosts(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			host := "tenant" + strconv.Itoa(i) + ".example.com"
+			srv.Host(host)
+			srv.RemoveHost(host)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		srv.GET("/page"+strconv.Itoa(i), func(w http.ResponseWriter, r *http.Request) {})
+	}
+
+	wg.Wait()
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/page99", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expecting 200, got %d", w.Code)
+	}
+}
+
+func TestAddHost(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("default")) })
+
+	get := func(host string, target string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Host = host
+		srv.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	var wg sync.WaitGroup
+
+	stop := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				get("acme.example.com", "/page42")
+				get("beta.example.org", "/")
+			}
+		}
+	}()
+
+	for _, host := range []string{"acme.example.com", ":tenant.example.org"} {
+		router := srv.NewRouter()
+
+		for i := 0; i < 100; i++ {
+			router.GET("/page"+strconv.Itoa(i), func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("page")) })
+		}
+
+		router.GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(middleware.Param(r, "tenant"))) })
+
+		if err := srv.AddHost(host, router); err != nil {
+			t.Fatalf("unexpected error adding %s: %s", host, err)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if body := get("ACME.example.com", "/page42") + get("beta.example.org", "/"); body != "pagebeta" {
+		t.Fatalf("unexpected response bodies: %q", body)
+	}
+
+	if hosts := srv.Hosts(); !reflect.DeepEqual(hosts, []string{":tenant.example.org", "acme.example.com"}) {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+
+	tests := []struct {
+		name string
+		add  func() error
+	}{
+		{"acme.example.com", func() error { return srv.AddHost("acme.example.com", srv.NewRouter()) }},
+		{":tenant.example.org", func() error { return srv.AddHost(":tenant.EXAMPLE.org", srv.NewRouter()) }},
+		{"", func() error { return srv.AddHost("", srv.NewRouter()) }},
+		{":.example.org", func() error { return srv.AddHost(":.example.org", srv.NewRouter()) }},
+		{"group", func() error { return srv.AddHost("group.example.com", srv.NewRouter().Group("/api")) }},
+		{"other server", func() error { return srv.AddHost("other.example.com", middleware.New().NewRouter()) }},
+	}
+
+	for _, test := range tests {
+		if err := test.add(); err == nil {
+			t.Fatalf("%s: expecting an error", test.name)
+		}
+	}
+
+	srv.Freeze()
+
+	if err := srv.AddHost("late.example.com", srv.NewRouter()); err == nil {
+		t.Fatal("expecting an error after Freeze")
+	}
+}
+
+func TestRemoveHost(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("default")) })
+	srv.Host("b.example.com").GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("b")) })
+	srv.Host("a.example.com").GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("a")) })
+	srv.Host(":tenant.example.org").GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("tenant")) })
+
+	if hosts := srv.Hosts(); !reflect.DeepEqual(hosts, []string{":tenant.example.org", "a.example.com", "b.example.com"}) {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+
+	get := func(host string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+		srv.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				get("a.example.com")
+			}
+		}()
+	}
+
+	if !srv.RemoveHost("A.example.com") || !srv.RemoveHost(":tenant.example.org") {
+		t.Fatal("expected hosts to be removed")
+	}
+
+	wg.Wait()
+
+	if srv.RemoveHost("a.example.com") || srv.RemoveHost("_") {
+		t.Fatal("unexpected removal of a missing host")
+	}
+
+	if hosts := srv.Hosts(); !reflect.DeepEqual(hosts, []string{"b.example.com"}) {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+
+	if body := get("a.example.com") + get("acme.example.org") + get("b.example.com"); body != "defaultdefaultb" {
+		t.Fatalf("unexpected response bodies: %q", body)
+	}
+}
+
+func TestLoggerString(t *testing.T) {
+	expected := `localhost 127.0.0.1 "POST /server-status HTTP/1.0" 200 2326 "Mozilla/5.0 (KHTML, like Gecko) Version/78.0.3904.108" 5.42s`
+
+	if str := sampleAccessLog.String(); str != expected {
+		t.Fatalf("incorrect access log format:\n- %s\n+ %s", expected, str)
+	}
+}
+
+func TestLoggerCommonLog(t *testing.T) {
+	expected := `127.0.0.1 - - [10/12/2019:13:55:36 +00:00] "POST /server-status HTTP/1.0" 200 2326`
+
+	if str := sampleAccessLog.CommonLog(); str != expected {
+		t.Fatalf("incorrect common log format:\n- %s\n+ %s", expected, str)
+	}
+}
+
+func TestLoggerCombinedLog(t *testing.T) {
+	expected := `127.0.0.1 - - [10/12/2019:13:55:36 +00:00] "POST /server-status HTTP/1.0" 200 2326 "http://www.example.com/" "Mozilla/5.0 (KHTML, like Gecko) Version/78.0.3904.108"`
+
+	if str := sampleAccessLog.CombinedLog(); str != expected {
+		t.Fatalf("incorrect combined log format:\n- %s\n+ %s", expected, str)
+	}
+}
+
+func TestLoggerCombinedLogWithHyphens(t *testing.T) {
+	localAccessLog := sampleAccessLog
+	localAccessLog.Header.Set("Referer", "")
+	localAccessLog.Header.Set("User-Agent", "")
+
+	expected := `127.0.0.1 - - [10/12/2019:13:55:36 +00:00] "POST /server-status HTTP/1.0" 200 2326 "-" "-"`
+
+	str := sampleAccessLog.CombinedLog()
+
+	if str != expected {
+		t.Fatalf("incorrect combined log format:\n- %s\n+ %s", expected, str)
+	}
+}
+
+type LoggerAndNewLines struct {
+	metadata middleware.AccessLog
+}
+
+func (l LoggerAndNewLines) ListeningOn(addr net.Addr) {}
+
+func (l LoggerAndNewLines) Shutdown(err error) {}
+
+func (l *LoggerAndNewLines) Log(data middleware.AccessLog) {
+	l.metadata = data
+}
+
+func TestLoggerAndNewLines(t *testing.T) {
+	srv := newTestServer(t)
+	logger := &LoggerAndNewLines{}
+	srv.Logger = logger
+	defer srv.Shutdown()
+	addr := startTestServer(t, srv)
+
+	// the server has no routes, which used to return "405 Method Not Allowed"
+	// before the URL path was checked. The router now returns 405 only if the
+	// path exists under other methods, so the invalid path is rejected first.
+	curl(t, "GET", "localhost", addr, "/foo%0abar", []byte("Bad Request\n"))
+
+	expected := `"GET /foo\nbar HTTP/1.1"`
+
+	if str := logger.metadata.Request(); str != expected {
+		t.Fatalf("incorrect request section in access log:\n- %s\n+ %s", expected, str)
+	}
+}
+
+func TestLoadHosts(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("Hello World"), 0644)
+	config := `{"hosts": [
+		{"host": "example.com", "aliases": ["www.example.com"], "static": [{"root": "` + dir + `", "prefix": "/assets"}]},
+		{"host": "example.org", "redirect": {"to": "https://example.com"}},
+		{"host": "admin.example.com", "static": [{"root": "` + dir + `", "prefix": "/assets"}], "allow": ["10.0.0.0/8"]}
+	]}`
+	filename := filepath.Join(dir, "hosts.json")
+	os.WriteFile(filename, []byte(config), 0644)
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+
+	if err := srv.LoadHosts(filename); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	inputs := []struct {
+		host     string
+		remote   string
+		target   string
+		status   int
+		location string
+	}{
+		{"example.com", "192.0.2.1:1234", "/assets/hello.txt", http.StatusOK, ""},
+		{"www.example.com", "192.0.2.1:1234", "/assets/hello.txt", http.StatusOK, ""},
+		{"example.org", "192.0.2.1:1234", "/users?page=2", http.StatusMovedPermanently, "https://example.com/users?page=2"},
+		{"admin.example.com", "10.1.2.3:1234", "/assets/hello.txt", http.StatusOK, ""},
+		{"admin.example.com", "192.0.2.1:1234", "/assets/hello.txt", http.StatusForbidden, ""},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		r := middleware.NewRequest(http.MethodGet, input.target).Host(input.host).RemoteAddr(input.remote).Build()
+		srv.ServeHTTP(w, r)
+
+		if w.Code != input.status {
+			t.Fatalf("%s%s from %s: expecting %d, got %d", input.host, input.target, input.remote, input.status, w.Code)
+		}
+
+		if location := w.Header().Get("Location"); location != input.location {
+			t.Fatalf("%s%s: expecting location %q, got %q", input.host, input.target, input.location, location)
+		}
+	}
+
+	if hosts := srv.Hosts(); !reflect.DeepEqual(hosts, []string{"admin.example.com", "example.com", "example.org", "www.example.com"}) {
+		t.Fatalf("unexpected hosts: %v", hosts)
+	}
+
+	// the aliases are removed with their host.
+	if !srv.RemoveHost("example.com") {
+		t.Fatal("expecting example.com to be removed")
+	}
+
+	if hosts := srv.Hosts(); !reflect.DeepEqual(hosts, []string{"admin.example.com", "example.org"}) {
+		t.Fatalf("unexpected hosts after RemoveHost: %v", hosts)
+	}
+}
+
+func TestLoadHostsInvalid(t *testing.T) {
+	inputs := []string{
+		`{"hosts": [{"host": ""}]}`,
+		`{"hosts": [{"host": "example.com", "allow": ["10.0.0.0/99"]}]}`,
+		`{"hosts": [{"host": "example.com", "static": [{"root": "/tmp", "prefix": "assets"}]}]}`,
+		`{"hosts": [{"host": "example.com", "redirect": {"to": "https://example.org", "status": 200}}]}`,
+		`{"hosts": [{"host": "example.com"}, {"host": "example.org", "allow": ["localhost"]}]}`,
+		`{"hosts": [{"host": "example.com"}, {"host": ":x"}]}`,
+		`{"hosts": [{"host": "example.com"}, {"host": ":tenant."}]}`,
+		`{"hosts": [`,
+	}
+
+	for _, input := range inputs {
+		filename := filepath.Join(t.TempDir(), "hosts.json")
+		os.WriteFile(filename, []byte(input), 0644)
+
+		srv := middleware.New()
+
+		if err := srv.LoadHosts(filename); err == nil {
+			t.Fatalf("expecting error for %s", input)
+		}
+
+		if hosts := srv.Hosts(); len(hosts) != 0 {
+			t.Fatalf("unexpected hosts after error: %v", hosts)
+		}
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	logger := testlogger.New()
+	notFound := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "custom not found", http.StatusNotFound)
+	})
+
+	srv := middleware.New(
+		middleware.WithReadTimeout(5*time.Second),
+		middleware.WithWriteTimeout(7*time.Second),
+		middleware.WithLogger(logger),
+		middleware.WithNotFound(notFound),
+		middleware.WithTrustedProxies("10.0.0.0/8"),
+	)
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	if srv.ReadTimeout != 5*time.Second || srv.WriteTimeout != 7*time.Second {
+		t.Fatalf("unexpected timeouts: %s, %s", srv.ReadTimeout, srv.WriteTimeout)
+	}
+
+	if srv.ReadHeaderTimeout != time.Second || srv.IdleTimeout != 2*time.Second {
+		t.Fatalf("default timeouts were modified: %s, %s", srv.ReadHeaderTimeout, srv.IdleTimeout)
+	}
+
+	if srv.Logger != logger {
+		t.Fatal("logger option was not applied")
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/missing").
+		RemoteAddr("10.0.0.1:1234").
+		Header("X-Forwarded-For", "198.51.100.7").
+		Build())
+
+	if entry, _ := logger.Last(); entry.RemoteAddr != "198.51.100.7" {
+		t.Fatalf("unexpected remote address: %q", entry.RemoteAddr)
+	}
+
+	if body := w.Body.String(); body != "custom not found\n" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func setenv(t *testing.T, env map[string]string) {
+	for key, value := range env {
+		key := key
+		old, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	setenv(t, map[string]string{
+		middleware.EnvReadTimeout:    "5s",
+		middleware.EnvIdleTimeout:    "250ms",
+		middleware.EnvTrustedProxies: "10.0.0.0/8, 192.168.1.1",
+		middleware.EnvLogFormat:      "none",
+	})
+
+	srv, err := middleware.NewFromEnv(middleware.WithWriteTimeout(3 * time.Second))
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if srv.ReadTimeout != 5*time.Second || srv.IdleTimeout != 250*time.Millisecond || srv.WriteTimeout != 3*time.Second {
+		t.Fatalf("unexpected timeouts: %s, %s, %s", srv.ReadTimeout, srv.IdleTimeout, srv.WriteTimeout)
+	}
+
+	if srv.ReadHeaderTimeout != time.Second {
+		t.Fatalf("default timeout was modified: %s", srv.ReadHeaderTimeout)
+	}
+
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(middleware.ClientIP(r)))
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/").
+		RemoteAddr("192.168.1.1:1234").
+		Header("X-Forwarded-For", "198.51.100.7").
+		Build())
+
+	if body := w.Body.String(); body != "198.51.100.7" {
+		t.Fatalf("unexpected client IP: %q", body)
+	}
+}
+
+func TestNewFromEnvInvalid(t *testing.T) {
+	inputs := []struct {
+		name  string
+		value string
+	}{
+		{middleware.EnvReadTimeout, "5"},
+		{middleware.EnvShutdownTimeout, "-1s"},
+		{middleware.EnvTLSCert, "/nonexistent/cert.pem"},
+		{middleware.EnvTrustedProxies, "10.0.0.0/8,localhost"},
+		{middleware.EnvLogFormat, "xml"},
+	}
+
+	for _, input := range inputs {
+		t.Run(input.name, func(t *testing.T) {
+			setenv(t, map[string]string{input.name: input.value})
+
+			if _, err := middleware.NewFromEnv(); err == nil || !strings.Contains(err.Error(), input.name) {
+				t.Fatalf("expecting error naming %s, got %v", input.name, err)
+			}
+		})
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	manifest := `{"routes": [
+		{"method": "GET", "path": "/users/:id", "handler": "getUser"},
+		{"method": "post", "path": "/users", "handler": "createUser", "middlewares": ["first", "second"]},
+		{"host": "admin.example.com", "method": "GET", "path": "/", "handler": "admin"}
+	]}`
+	filename := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(filename, []byte(manifest), 0644)
+
+	tag := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(name + ">"))
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	registry := middleware.Registry{
+		Handlers: map[string]http.HandlerFunc{
+			"getUser":    func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("user " + middleware.Param(r, "id"))) },
+			"createUser": func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("created")) },
+			"admin":      func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("admin")) },
+		},
+		Middlewares: map[string]func(http.Handler) http.Handler{
+			"first":  tag("first"),
+			"second": tag("second"),
+		},
+	}
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+
+	if err := srv.LoadRoutes(filename, registry); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	inputs := []struct {
+		method string
+		host   string
+		target string
+		body   string
+	}{
+		{http.MethodGet, "example.com", "/users/42", "user 42"},
+		{http.MethodPost, "example.com", "/users", "first>second>created"},
+		{http.MethodGet, "admin.example.com", "/", "admin"},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(input.method, input.target).Host(input.host).Build())
+
+		if body := w.Body.String(); body != input.body {
+			t.Fatalf("%s %s%s: expecting %q, got %q", input.method, input.host, input.target, input.body, body)
+		}
+	}
+}
+
+func TestLoadRoutesInvalid(t *testing.T) {
+	registry := middleware.Registry{
+		Handlers: map[string]http.HandlerFunc{
+			"index": func(w http.ResponseWriter, r *http.Request) {},
+		},
+	}
+
+	inputs := []string{
+		`{"routes": [{"method": "GET", "path": "/", "handler": "missing"}]}`,
+		`{"routes": [{"method": "GET", "path": "/", "handler": "index", "middlewares": ["missing"]}]}`,
+		`{"routes": [{"method": "GET", "path": "users", "handler": "index"}]}`,
+		`{"routes": [{"path": "/", "handler": "index"}]}`,
+		`{"routes": [{"method": "GET", "path": "/ok", "handler": "index"}, {"method": "GET", "path": "/:a/:a", "handler": "index"}]}`,
+		`{"routes": [{"method": "GET", "path": "/ok", "handler": "index"}, {"host": ":x", "method": "GET", "path": "/", "handler": "index"}]}`,
+		`{"routes": `,
+	}
+
+	for _, input := range inputs {
+		filename := filepath.Join(t.TempDir(), "routes.json")
+		os.WriteFile(filename, []byte(input), 0644)
+
+		srv := middleware.New()
+
+		if err := srv.LoadRoutes(filename, registry); err == nil {
+			t.Fatalf("expecting error for %s", input)
+		}
+
+		if routes := srv.Routes(); len(routes) != 0 {
+			t.Fatalf("unexpected routes after error: %v", routes)
+		}
+	}
+
+	srv := middleware.New()
+	srv.Freeze()
+
+	if err := srv.ConfigureRoutes([]middleware.RouteConfig{{Method: "GET", Path: "/", Handler: "index"}}, registry); err == nil {
+		t.Fatal("expecting error after Freeze")
+	}
+}
+
+func TestRouteOptions(t *testing.T) {
+	logger := testlogger.New()
+	srv := middleware.New(middleware.WithLogger(logger))
+
+	tag := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(name + ">"))
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	route := srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("user " + middleware.Param(r, "id")))
+	}).Name("users.show").Use(tag("first")).Use(tag("second"))
+
+	if route.Method() != http.MethodGet || route.Pattern() != "/users/:id" {
+		t.Fatalf("unexpected route: %s %s", route.Method(), route.Pattern())
+	}
+
+	srv.GET("/admin", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admin"))
+	}).AllowOnly("10.0.0.0/8")
+
+	srv.GET("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}).Timeout(10 * time.Millisecond)
+
+	srv.GET("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}).NoLog()
+
+	inputs := []struct {
+		target string
+		remote string
+		status int
+		body   string
+	}{
+		{"/users/42", "192.0.2.1:1234", http.StatusOK, "first>second>user 42"},
+		{"/admin", "10.1.2.3:1234", http.StatusOK, "admin"},
+		{"/admin", "192.0.2.1:1234", http.StatusForbidden, "Forbidden\n"},
+		{"/slow", "192.0.2.1:1234", http.StatusServiceUnavailable, "Service Unavailable"},
+		{"/healthz", "192.0.2.1:1234", http.StatusOK, "ok"},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, input.target).RemoteAddr(input.remote).Build())
+
+		if w.Code != input.status || w.Body.String() != input.body {
+			t.Fatalf("%s: expecting %d %q, got %d %q", input.target, input.status, input.body, w.Code, w.Body.String())
+		}
+	}
+
+	for _, entry := range logger.Entries() {
+		if entry.Path == "/healthz" {
+			t.Fatal("unexpected access log for route with NoLog")
+		}
+	}
+
+	if n := logger.Len(); n != 4 {
+		t.Fatalf("expecting 4 access logs, got %d", n)
+	}
+
+	for _, info := range srv.Routes() {
+		if info.Pattern == "/users/:id" && info.Name != "users.show" {
+			t.Fatalf("unexpected route name: %q", info.Name)
+		}
+	}
+}
+
+func TestDebugTracing(t *testing.T) {
+	var buf bytes.Buffer
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Debug = true
+	srv.ErrorLog = log.New(&buf, "", 0)
+	srv.GET("/foo/bar/x", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/foo/:a/:b", func(w http.ResponseWriter, r *http.Request) {})
+
+	inputs := []struct {
+		target   string
+		expected []string
+	}{
+		{"/foo/qux/y", []string{
+			`captured :a="qux"`,
+			`captured :b="y"`,
+			`matched /foo/:a/:b`,
+		}},
+		{"/foo/bar/y", []string{
+			`static segment preferred over :a at "/foo/"`,
+			`rejected at "/foo/bar/", next character 'y', candidates: "x"`,
+			`the router does not backtrack to :a`,
+			`no match`,
+		}},
+		{"/foo//qux/y", []string{
+			`path cleaned to "/foo/qux/y"`,
+		}},
+		{"/other", []string{
+			`no route starts with "/o"`,
+		}},
+	}
+
+	for _, input := range inputs {
+		buf.Reset()
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, input.target, nil))
+
+		for _, expected := range input.expected {
+			if !strings.Contains(buf.String(), expected) {
+				t.Fatalf("%s: expecting %q in debug log:\n%s", input.target, expected, buf.String())
+			}
+		}
+	}
+
+	buf.Reset()
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/foo", nil))
+
+	if !strings.Contains(buf.String(), "no routes for method POST") {
+		t.Fatalf("unexpected debug log: %s", buf.String())
+	}
+}
+
+func TestBeforeAfterHooks(t *testing.T) {
+	var mu sync.Mutex
+	var statuses []int
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(middleware.AllowOnly("10.0.0.0/8"))
+	srv.GET("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	srv.GET("/healthz", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }).NoLog()
+
+	srv.Before(func(w http.ResponseWriter, r *http.Request) *http.Request {
+		r.URL.Path = strings.ToLower(r.URL.Path)
+		return r
+	})
+	srv.Before(func(w http.ResponseWriter, r *http.Request) *http.Request {
+		if r.URL.Path == "/blocked" {
+			http.Error(w, "blocked", http.StatusTeapot)
+			return nil
+		}
+		return r
+	})
+	srv.After(func(entry middleware.AccessLog) {
+		mu.Lock()
+		statuses = append(statuses, entry.StatusCode)
+		mu.Unlock()
+	})
+
+	inputs := []struct {
+		method string
+		target string
+		remote string
+		status int
+	}{
+		{http.MethodGet, "/HELLO", "10.0.0.1:1234", http.StatusOK},
+		{http.MethodGet, "/missing", "10.0.0.1:1234", http.StatusNotFound},
+		{http.MethodPut, "/hello", "10.0.0.1:1234", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/hello", "192.0.2.1:1234", http.StatusForbidden},
+		{http.MethodGet, "/healthz", "10.0.0.1:1234", http.StatusOK},
+		{http.MethodGet, "/BLOCKED", "10.0.0.1:1234", http.StatusTeapot},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(input.method, input.target).RemoteAddr(input.remote).Build())
+
+		if w.Code != input.status {
+			t.Fatalf("%s %s: expecting %d, got %d", input.method, input.target, input.status, w.Code)
+		}
+	}
+
+	expected := []int{200, 404, 405, 403, 200, 418}
+
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Fatalf("unexpected statuses in after hooks: %v", statuses)
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(middleware.BufferBody(16))
+	srv.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// consume the body, like a naive middleware would do.
+			io.ReadAll(r.Body)
+			w.Header().Set("X-Signature", hex.EncodeToString(middleware.BodyBytes(r)))
+			next.ServeHTTP(w, r)
+		})
+	})
+	srv.POST("/echo", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		w.Write(data)
+	})
+
+	inputs := []struct {
+		body      string
+		status    int
+		signature string
+	}{
+		{"hello world", http.StatusOK, "68656c6c6f20776f726c64"},
+		{"this body is too large", http.StatusRequestEntityTooLarge, ""},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodPost, "/echo").Text(input.body).Build())
+
+		if w.Code != input.status {
+			t.Fatalf("%q: expecting %d, got %d", input.body, input.status, w.Code)
+		}
+
+		if input.status != http.StatusOK {
+			continue
+		}
+
+		if w.Body.String() != input.body || w.Header().Get("X-Signature") != input.signature {
+			t.Fatalf("%q: unexpected response %q, signature %q", input.body, w.Body.String(), w.Header().Get("X-Signature"))
+		}
+	}
+
+	if data := middleware.BodyBytes(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("x"))); data != nil {
+		t.Fatalf("expecting nil for unbuffered body, got %q", data)
+	}
+}
+
+func TestShedLoad(t *testing.T) {
+	logger := testlogger.New()
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+
+	srv := middleware.New(middleware.WithLogger(logger))
+	srv.ShedLoad(middleware.LoadShedding{
+		MaxInFlight:  2,
+		MaxQueueWait: 10 * time.Millisecond,
+		RetryAfter:   1500 * time.Millisecond,
+	})
+	srv.GET("/slow", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		}()
+	}
+
+	<-started
+	<-started
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expecting 503 with Retry-After 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if entry, _ := logger.Last(); !entry.Shed || entry.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expecting shed request in the access log, got %+v", entry)
+	}
+
+	close(release)
+	wg.Wait()
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expecting 200 after the load decreased, got %d", w.Code)
+	}
+}
+
+func TestRouteDeprecated(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/v1/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("v1"))
+	}).Deprecated(middleware.Deprecation{
+		Since:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Sunset: time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC),
+		Link:   "https://api.example.com/v2/users",
+	})
+	srv.GET("/v2/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("v2"))
+	})
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/users", nil))
+
+		if h := w.Header().Get("Deprecation"); h != "@1704067200" {
+			t.Fatalf("unexpected Deprecation header: %q", h)
+		}
+
+		if h := w.Header().Get("Sunset"); h != "Mon, 30 Jun 2025 00:00:00 GMT" {
+			t.Fatalf("unexpected Sunset header: %q", h)
+		}
+
+		if h := w.Header().Get("Link"); h != `<https://api.example.com/v2/users>; rel="successor-version"` {
+			t.Fatalf("unexpected Link header: %q", h)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/users", nil))
+
+	if h := w.Header().Get("Deprecation"); h != "" {
+		t.Fatalf("unexpected Deprecation header in active route: %q", h)
+	}
+
+	usage := srv.DeprecatedUsage()
+
+	if len(usage) != 1 || usage[0].Pattern != "/v1/users" || usage[0].Count != 3 || usage[0].LastUsed.IsZero() {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}
+
+func TestRouteHeaders(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Del("X-Remove")
+		w.Write([]byte("<rss/>"))
+	}).Headers(http.Header{
+		"content-type":  {"application/rss+xml"},
+		"Cache-Control": {"no-cache"},
+		"X-Remove":      {"yes"},
+	}).Headers(http.Header{
+		"Cache-Control": {"public, max-age=300"},
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/feed.xml", nil))
+
+	expected := http.Header{
+		"Content-Type":  {"application/rss+xml"},
+		"Cache-Control": {"public, max-age=300"},
+	}
+
+	if !reflect.DeepEqual(w.Header(), expected) {
+		t.Fatalf("unexpected headers: %v", w.Header())
+	}
+}
+
+func TestQuota(t *testing.T) {
+	now := time.Date(2024, 1, 31, 23, 59, 0, 0, time.UTC)
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(middleware.Quota(middleware.QuotaPolicy{
+		Key:     func(r *http.Request) string { return r.Header.Get("X-API-Key") },
+		Daily:   middleware.QuotaLimit{Requests: 2},
+		Monthly: middleware.QuotaLimit{Bytes: 12},
+		Now:     func() time.Time { return now },
+	}))
+	srv.GET("/data", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("12345"))
+	})
+
+	send := func(key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/data").Header("X-API-Key", key).Build())
+		return w
+	}
+
+	inputs := []struct {
+		key       string
+		status    int
+		remaining string
+		bytes     string
+	}{
+		{"alice", http.StatusOK, "1", "12"},
+		{"alice", http.StatusOK, "0", "7"},
+		{"alice", http.StatusTooManyRequests, "0", ""},
+		{"bob", http.StatusOK, "1", "12"},
+		{"", http.StatusOK, "", ""},
+	}
+
+	for i, input := range inputs {
+		w := send(input.key)
+
+		if w.Code != input.status {
+			t.Fatalf("#%d: expecting %d, got %d", i, input.status, w.Code)
+		}
+
+		if h := w.Header().Get("X-Quota-Remaining"); h != input.remaining {
+			t.Fatalf("#%d: expecting remaining %q, got %q", i, input.remaining, h)
+		}
+
+		if h := w.Header().Get("X-Quota-Remaining-Bytes"); h != input.bytes {
+			t.Fatalf("#%d: expecting remaining bytes %q, got %q", i, input.bytes, h)
+		}
+	}
+
+	if w := send("alice"); w.Header().Get("Retry-After") != "61" {
+		t.Fatalf("unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+	}
+
+	// new day and month, the quotas are reset.
+	now = now.Add(2 * time.Minute)
+
+	if w := send("alice"); w.Code != http.StatusOK || w.Header().Get("X-Quota-Remaining-Bytes") != "12" {
+		t.Fatalf("expecting 200 after the reset, got %d %q", w.Code, w.Header().Get("X-Quota-Remaining-Bytes"))
+	}
+
+	// the monthly byte quota survives the next day.
+	now = now.Add(24 * time.Hour)
+
+	if w := send("alice"); w.Header().Get("X-Quota-Remaining-Bytes") != "7" {
+		t.Fatalf("unexpected remaining bytes: %q", w.Header().Get("X-Quota-Remaining-Bytes"))
+	}
+
+	send("alice")
+	now = now.Add(24 * time.Hour)
+
+	if w := send("alice"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expecting 429 after the byte quota, got %d", w.Code)
+	}
+
+	// concurrent requests never exceed the request quota.
+	var allowed int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if send("carol").Code == http.StatusOK {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if allowed != 2 {
+		t.Fatalf("expecting 2 concurrent requests within the quota, got %d", allowed)
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nonce, challenge string
+	var issuer string
+
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/authorize",
+				"token_endpoint":         issuer + "/token",
+				"jwks_uri":               issuer + "/jwks",
+			})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "RSA",
+					"kid": "k1",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				}},
+			})
+		case "/token":
+			user, pass, _ := r.BasicAuth()
+			sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+
+			if user != "app" || pass != "secret" || r.FormValue("code") != "good-code" ||
+				base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+				http.Error(w, "invalid_grant", http.StatusBadRequest)
+				return
+			}
+
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"k1"}`))
+			claims, _ := json.Marshal(map[string]interface{}{
+				"iss":   issuer,
+				"sub":   "user-1",
+				"aud":   "app",
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"nonce": nonce,
+				"email": "alice@example.com",
+			})
+			payload := base64.RawURLEncoding.EncodeToString(claims)
+			digest := sha256.Sum256([]byte(header + "." + payload))
+			signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+
+			json.NewEncoder(w).Encode(map[string]string{
+				"id_token": header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(signature),
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+	issuer = idp.URL
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := middleware.Identity(r)
+		w.Write([]byte("hello " + id.Email))
+	})
+	srv.POST("/dashboard", func(w http.ResponseWriter, r *http.Request) {})
+	srv.Use(srv.OIDCLogin(middleware.OIDCConfig{
+		Issuer:       idp.URL,
+		ClientID:     "app",
+		ClientSecret: "secret",
+		RedirectURL:  "http://app.test/auth/callback",
+		SessionKey:   bytes.Repeat([]byte("k"), 32),
+	}))
+
+	serve := func(method string, target string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := middleware.NewRequest(method, target).Host("app.test").Build()
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(http.MethodGet, "/dashboard?tab=1")
+	location, _ := url.Parse(w.Header().Get("Location"))
+
+	if w.Code != http.StatusFound || !strings.HasPrefix(location.String(), idp.URL+"/authorize?") {
+		t.Fatalf("expecting redirect to the provider, got %d %s", w.Code, location)
+	}
+
+	query := location.Query()
+	nonce, challenge = query.Get("nonce"), query.Get("code_challenge")
+	flow := w.Result().Cookies()[0]
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("redirect_uri") != "http://app.test/auth/callback" {
+		t.Fatalf("unexpected authorization request: %s", location)
+	}
+
+	if w := serve(http.MethodGet, "/auth/callback?code=good-code&state=wrong", flow); w.Code != http.StatusBadRequest {
+		t.Fatalf("expecting 400 for invalid state, got %d", w.Code)
+	}
+
+	if w := serve(http.MethodGet, "/auth/callback?code=bad-code&state="+query.Get("state"), flow); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expecting 401 for invalid code, got %d", w.Code)
+	}
+
+	w = serve(http.MethodGet, "/auth/callback?code=good-code&state="+query.Get("state"), flow)
+
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/dashboard?tab=1" {
+		t.Fatalf("expecting redirect to the original URL, got %d %s: %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+
+	var session *http.Cookie
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "oidc_session" {
+			session = cookie
+		}
+	}
+
+	if session == nil {
+		t.Fatal("expecting session cookie")
+	}
+
+	if w := serve(http.MethodGet, "/dashboard", session); w.Body.String() != "hello alice@example.com" {
+		t.Fatalf("unexpected response with session: %d %q", w.Code, w.Body)
+	}
+
+	// the cookie of the login flow is signed with the same key, but it is not
+	// a session.
+	replayed := &http.Cookie{Name: session.Name, Value: flow.Value}
+
+	if w := serve(http.MethodGet, "/dashboard", replayed); w.Code != http.StatusFound {
+		t.Fatalf("expecting redirect with the flow cookie as session, got %d %q", w.Code, w.Body)
+	}
+
+	tampered := &http.Cookie{Name: session.Name, Value: "x" + session.Value}
+
+	if w := serve(http.MethodGet, "/dashboard", tampered); w.Code != http.StatusFound {
+		t.Fatalf("expecting redirect with tampered session, got %d", w.Code)
+	}
+
+	if w := serve(http.MethodPost, "/dashboard"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expecting 401 for POST without session, got %d", w.Code)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	var buf bytes.Buffer
+	var version int32 = 1
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(middleware.Record(&buf, 100, 0))
+	srv.POST("/echo", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(data)
+	})
+	srv.GET("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(int(atomic.LoadInt32(&version)))))
+	})
+	srv.GET("/stream", func(w http.ResponseWriter, r *http.Request) {
+		_, flusher := w.(http.Flusher)
+		_, hijacker := w.(http.Hijacker)
+		w.Write([]byte("flusher=" + strconv.FormatBool(flusher) + " hijacker=" + strconv.FormatBool(hijacker)))
+	})
+
+	srv.ServeHTTP(httptest.NewRecorder(), middleware.NewRequest(http.MethodPost, "/echo?x=1").
+		Header("Authorization", "Bearer secret").
+		Header("X-Trace", "abc").
+		Text("hello").
+		Build())
+	srv.ServeHTTP(httptest.NewRecorder(), middleware.NewRequest(http.MethodGet, "/version").Build())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("expecting 2 recorded requests, got %d", len(lines))
+	}
+
+	var recorded middleware.RecordedRequest
+	json.Unmarshal([]byte(lines[0]), &recorded)
+
+	if recorded.Method != http.MethodPost || recorded.URL != "/echo?x=1" || string(recorded.Body) != "hello" ||
+		recorded.Header.Get("X-Trace") != "abc" || recorded.Header.Get("Authorization") != "" {
+		t.Fatalf("unexpected recorded request: %+v", recorded)
+	}
+
+	if recorded.Response.Status != http.StatusCreated || string(recorded.Response.Body) != "hello" ||
+		recorded.Response.Header.Get("Set-Cookie") != "" {
+		t.Fatalf("unexpected recorded response: %+v", recorded.Response)
+	}
+
+	filename := filepath.Join(t.TempDir(), "requests.jsonl")
+	os.WriteFile(filename, buf.Bytes(), 0600)
+
+	target := httptest.NewServer(srv)
+	defer target.Close()
+
+	atomic.StoreInt32(&version, 2)
+	results, err := middleware.Replay(filename, target.URL)
+
+	if err != nil || len(results) != 2 {
+		t.Fatalf("unexpected replay: %d results, %v", len(results), err)
+	}
+
+	if !results[0].Matches() {
+		t.Fatalf("expecting same response for /echo, got %d %q", results[0].Status, results[0].Body)
+	}
+
+	if results[1].Matches() || string(results[1].Body) != "2" {
+		t.Fatalf("expecting different response for /version, got %q", results[1].Body)
+	}
+
+	// the recorded writer keeps the optional interfaces for streams and WEBSOCKET.
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/stream").Build())
+
+	if w.Body.String() != "flusher=true hijacker=true" {
+		t.Fatalf("unexpected interfaces for the recorded writer: %q", w.Body.String())
+	}
+}
+
+func TestCORSPreflightMethods(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.CORS(middleware.CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		ExposedHeaders:   []string{"X-Request-Id"},
+		MaxAge:           time.Hour,
+	})
+	handler := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+	srv.GET("/users/:id", handler)
+	srv.PUT("/users/:id", handler)
+	srv.DELETE("/users/:id", handler)
+	srv.POST("/users", handler)
+
+	preflight := func(origin string, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodOptions, target).
+			Header("Origin", origin).
+			Header("Access-Control-Request-Method", "PUT").
+			Header("Access-Control-Request-Headers", "Content-Type").
+			Build())
+		return w
+	}
+
+	w := preflight("https://app.example.com", "/users/42")
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expecting 204, got %d", w.Code)
+	}
+
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "DELETE, GET, HEAD, PUT",
+		"Access-Control-Allow-Headers":     "Content-Type",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "3600",
+	}
+
+	for key, value := range expected {
+		if h := w.Header().Get(key); h != value {
+			t.Fatalf("%s: expecting %q, got %q", key, value, h)
+		}
+	}
+
+	if h := preflight("https://app.example.com", "/users").Header().Get("Access-Control-Allow-Methods"); h != "POST" {
+		t.Fatalf("unexpected methods for /users: %q", h)
+	}
+
+	if w := preflight("https://app.example.com", "/missing"); w.Code != http.StatusNotFound {
+		t.Fatalf("expecting 404 for unknown path, got %d", w.Code)
+	}
+
+	if w := preflight("https://evil.example.com", "/users/42"); w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expecting 403 for unknown origin, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/users/42").Header("Origin", "https://app.example.com").Build())
+
+	if w.Body.String() != "ok" || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Expose-Headers") != "X-Request-Id" {
+		t.Fatalf("unexpected response for simple request: %q %v", w.Body, w.Header())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expecting panic for credentials with any origin")
+		}
+	}()
+
+	srv.CORS(middleware.CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+}
+
+func TestFreeze(t *testing.T) {
+	var calls int
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(func(next http.Handler) http.Handler {
+		calls++
+		return next
+	})
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("index")) })
+	srv.GET("/*", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("wildcard")) })
+	me := srv.GET("/users/me", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("me")) })
+	srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("user " + middleware.Param(r, "id"))) })
+	srv.Host("api.example.com").GET("/status", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("status")) })
+
+	serve := func(host string, target string) string {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, target).Host(host).Build())
+		return w.Body.String()
+	}
+
+	inputs := []struct {
+		host   string
+		target string
+		body   string
+	}{
+		{"example.com", "/", "wildcard"},
+		{"example.com", "/users/me", "me"},
+		{"example.com", "/users/42", "user 42"},
+		{"example.com", "/users//me", "me"},
+		{"api.example.com", "/status", "status"},
+	}
+
+	for _, input := range inputs {
+		if body := serve(input.host, input.target); body != input.body {
+			t.Fatalf("before Freeze %s%s: expecting %q, got %q", input.host, input.target, input.body, body)
+		}
+	}
+
+	srv.Freeze()
+	calls = 0
+
+	for _, input := range inputs {
+		if body := serve(input.host, input.target); body != input.body {
+			t.Fatalf("after Freeze %s%s: expecting %q, got %q", input.host, input.target, input.body, body)
+		}
+	}
+
+	if calls != 0 {
+		t.Fatalf("expecting the middleware chain to be composed by Freeze, composed %d times", calls)
+	}
+
+	if !srv.Frozen() {
+		t.Fatal("expecting frozen router")
+	}
+
+	mustPanic := func(name string, fn func()) {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%s: expecting panic after Freeze", name)
+			}
+		}()
+		fn()
+	}
+
+	mustPanic("GET", func() { srv.GET("/new", func(w http.ResponseWriter, r *http.Request) {}) })
+	mustPanic("Host", func() { srv.Host("new.example.com") })
+	mustPanic("Use", func() { srv.Use(func(next http.Handler) http.Handler { return next }) })
+	mustPanic("Route.Use", func() { me.Use(func(next http.Handler) http.Handler { return next }) })
+	mustPanic("Route.Require", func() { me.Require("admin") })
+	mustPanic("Route.Headers", func() { me.Headers(http.Header{"X-Test": {"1"}}) })
+
+	if err := srv.ConfigureHosts([]middleware.HostConfig{{Host: "api.example.com", Aliases: []string{"alias.example.com"}}}); err == nil {
+		t.Fatal("expecting error for ConfigureHosts after Freeze")
+	}
+
+	if body := serve("example.com", "/users/me"); body != "me" {
+		t.Fatalf("after the rejected changes: expecting %q, got %q", "me", body)
+	}
+}
+
+func TestParams(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/orgs/:org/repos/:repo", func(w http.ResponseWriter, r *http.Request) {
+		params := middleware.Params(r)
+		params["org"] = "modified"
+		json.NewEncoder(w).Encode(middleware.Params(r))
+	})
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		if params := middleware.Params(r); params == nil || len(params) != 0 {
+			t.Fatalf("expecting empty map, got %#v", params)
+		}
+	})
+	srv.Host(":tenant.example.com").GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(middleware.Params(r))
+	})
+
+	inputs := []struct {
+		host   string
+		target string
+		body   string
+	}{
+		{"example.com", "/orgs/cixtor/repos/middleware", `{"org":"cixtor","repo":"middleware"}` + "\n"},
+		{"acme.example.com", "/users/42", `{"id":"42","tenant":"acme"}` + "\n"},
+		{"example.com", "/", ""},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, input.target).Host(input.host).Build())
+
+		if w.Body.String() != input.body {
+			t.Fatalf("%s%s: expecting %q, got %q", input.host, input.target, input.body, w.Body)
+		}
+	}
+}
+
+func TestRedirectHTTPSBehindProxy(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.TrustProxies("10.0.0.0/8")
+	srv.Use(middleware.RedirectHTTPS())
+	srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		link, _ := srv.AbsoluteURL(r, "users.show", map[string]string{"id": "a b"})
+		w.Write([]byte(link))
+	}).Name("users.show")
+	srv.GET("/files/*", func(w http.ResponseWriter, r *http.Request) {}).Name("files")
+
+	inputs := []struct {
+		remote   string
+		header   string
+		status   int
+		location string
+		body     string
+	}{
+		{"10.0.0.1:1234", "proto=https;host=www.example.com", http.StatusOK, "", "https://www.example.com/users/a%20b"},
+		{"10.0.0.1:1234", "proto=http;host=www.example.com", http.StatusMovedPermanently, "https://www.example.com/users/1?x=y", ""},
+		{"192.0.2.1:1234", "proto=https;host=evil.example.com", http.StatusMovedPermanently, "https://example.com/users/1?x=y", ""},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/users/1?x=y").
+			RemoteAddr(input.remote).
+			Header("Forwarded", input.header).
+			Build())
+
+		if w.Code != input.status || w.Header().Get("Location") != input.location {
+			t.Fatalf("%s %s: expecting %d %q, got %d %q", input.remote, input.header, input.status, input.location, w.Code, w.Header().Get("Location"))
+		}
+
+		if input.body != "" && w.Body.String() != input.body {
+			t.Fatalf("expecting %q, got %q", input.body, w.Body)
+		}
+	}
+
+	if path, err := srv.URL("files", map[string]string{"*": "/docs/readme.md"}); err != nil || path != "/files/docs/readme.md" {
+		t.Fatalf("unexpected wildcard URL: %q, %v", path, err)
+	}
+
+	if _, err := srv.URL("users.show", nil); err == nil {
+		t.Fatal("expecting error for missing parameter")
+	}
+
+	if _, err := srv.URL("unknown", nil); err == nil {
+		t.Fatal("expecting error for unknown route")
+	}
+}
+
+func TestBodylessAccounting(t *testing.T) {
+	srv := middleware.New()
+	tracer := testlogger.New()
+	srv.Logger = tracer
+	srv.HEAD("/head", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World"))
+	})
+	srv.GET("/declared", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1234")
+		w.WriteHeader(http.StatusNotModified)
+	})
+	srv.GET("/empty", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	srv.GET("/full", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello World"))
+	})
+
+	inputs := []struct {
+		method        string
+		path          string
+		bytesSent     int
+		contentLength int64
+	}{
+		{http.MethodHead, "/head", 0, 11},
+		{http.MethodGet, "/declared", 0, 1234},
+		{http.MethodGet, "/empty", 0, 0},
+		{http.MethodGet, "/full", 11, 11},
+	}
+
+	for _, input := range inputs {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(input.method, input.path, nil))
+
+		entry := lastLog(tracer)
+
+		if entry.BytesSent != input.bytesSent || entry.ContentLength != input.contentLength {
+			t.Fatalf("%s %s: expecting %d/%d bytes, got %d/%d", input.method, input.path, input.bytesSent, input.contentLength, entry.BytesSent, entry.ContentLength)
+		}
+	}
+}
+
+func TestErrorPage(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.ErrorPage(http.StatusNotFound, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<h1>missing " + r.URL.Path + "</h1>"))
+	}))
+	srv.ErrorPage(http.StatusMethodNotAllowed, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<h1>wrong method</h1>"))
+	}))
+	srv.ErrorPage(http.StatusForbidden, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<h1>forbidden</h1>"))
+	}))
+	srv.STATIC(".", "/cdn")
+	srv.GET("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not found"}`))
+	})
+	srv.GET("/gone", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	inputs := []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{http.MethodGet, "/unknown", http.StatusNotFound, "<h1>missing /unknown</h1>"},
+		{http.MethodGet, "/gone", http.StatusNotFound, "<h1>missing /gone</h1>"},
+		{http.MethodGet, "/cdn/missing.txt", http.StatusNotFound, "<h1>missing /cdn/missing.txt</h1>"},
+		{http.MethodGet, "/cdn/testlogger", http.StatusForbidden, "<h1>forbidden</h1>"},
+		{http.MethodDelete, "/api", http.StatusMethodNotAllowed, "<h1>wrong method</h1>"},
+		{http.MethodGet, "/api", http.StatusNotFound, `{"error":"not found"}`},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(input.method, input.path, nil))
+
+		if w.Code != input.status || w.Body.String() != input.body {
+			t.Fatalf("%s %s: expecting %d %q, got %d %q", input.method, input.path, input.status, input.body, w.Code, w.Body.String())
+		}
+
+		if w.Header().Get("X-Content-Type-Options") != "" {
+			t.Fatalf("%s %s: unexpected headers %v", input.method, input.path, w.Header())
+		}
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	srv := middleware.New(middleware.WithRequestBudget(time.Second*10, true))
+	srv.DiscardLogs()
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		deadline, ok := r.Context().Deadline()
+
+		if !ok {
+			w.Write([]byte("none"))
+			return
+		}
+
+		w.Write([]byte(time.Until(deadline).Round(time.Second).String()))
+	})
+
+	inputs := []struct {
+		header string
+		value  string
+		body   string
+	}{
+		{"", "", "10s"},
+		{"X-Request-Timeout", "2s", "2s"},
+		{"X-Request-Timeout", "3", "3s"},
+		{"X-Request-Timeout", "1m", "10s"},
+		{"X-Request-Timeout", "invalid", "10s"},
+		{"Grpc-Timeout", "4000m", "4s"},
+		{"Grpc-Timeout", "5S", "5s"},
+		{"Grpc-Timeout", "5x", "10s"},
+	}
+
+	for _, input := range inputs {
+		req := middleware.NewRequest(http.MethodGet, "/")
+
+		if input.header != "" {
+			req.Header(input.header, input.value)
+		}
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req.Build())
+
+		if w.Body.String() != input.body {
+			t.Fatalf("%s: %s: expecting %q, got %q", input.header, input.value, input.body, w.Body.String())
+		}
+	}
+
+	srv.RequestBudget = 0
+	srv.RequestTimeoutHeaders = false
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/").Header("X-Request-Timeout", "2s").Build())
+
+	if w.Body.String() != "none" {
+		t.Fatalf("expecting no deadline, got %q", w.Body.String())
+	}
+}
+
+func TestMalformedHost(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	inputs := []struct {
+		host   string
+		status int
+	}{
+		{"example.com", http.StatusOK},
+		{"Example.COM:8080", http.StatusOK},
+		{"example.com.", http.StatusOK},
+		{"127.0.0.1:3000", http.StatusOK},
+		{"[::1]:8080", http.StatusOK},
+		{"[::1]", http.StatusOK},
+		{"[::ffff:192.0.2.1]", http.StatusOK},
+		{"[::ffff:192.0.2.1]:8080", http.StatusOK},
+		{"my_service.internal", http.StatusOK},
+		{"exa mple.com", http.StatusBadRequest},
+		{"-example.com", http.StatusBadRequest},
+		{"example..com", http.StatusBadRequest},
+		{"example.com:80:80", http.StatusBadRequest},
+		{"example.com:", http.StatusBadRequest},
+		{"example.com:http", http.StatusBadRequest},
+		{"[127.0.0.1]", http.StatusBadRequest},
+		{"[::1", http.StatusBadRequest},
+		{"evil.com/x", http.StatusBadRequest},
+		{strings.Repeat("a", 64) + ".com", http.StatusBadRequest},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = input.host
+		srv.ServeHTTP(w, r)
+
+		if w.Code != input.status {
+			t.Fatalf("%q: expecting %d, got %d", input.host, input.status, w.Code)
+		}
+	}
+}
+
+func TestRouteMeta(t *testing.T) {
+	var team string
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rt := middleware.MatchedRoute(w); rt != nil {
+				team = rt.Metadata()["team"]
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	srv.POST("/charges", func(w http.ResponseWriter, r *http.Request) {}).Meta("team", "payments").Meta("tier", "critical")
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/charges", nil))
+
+	if team != "payments" {
+		t.Fatalf("unexpected team: %q", team)
+	}
+
+	team = "none"
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if team != "" {
+		t.Fatalf("unexpected team: %q", team)
+	}
+
+	routes := srv.Routes()
+
+	if len(routes) != 2 || routes[1].Meta["tier"] != "critical" || routes[0].Meta != nil {
+		t.Fatalf("unexpected routes: %#v", routes)
+	}
+}
+
+func TestConsumesProduces(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.POST("/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("created"))
+	}).Consumes("application/json", "image/*")
+	srv.GET("/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}).Produces("application/json", "application/xml")
+
+	inputs := []struct {
+		request     *http.Request
+		status      int
+		contentType string
+	}{
+		{middleware.NewRequest(http.MethodPost, "/users").JSON(map[string]string{}).Build(), http.StatusOK, "text/plain; charset=utf-8"},
+		{middleware.NewRequest(http.MethodPost, "/users").Header("Content-Type", "image/png").Body(strings.NewReader("png")).Build(), http.StatusOK, "image/png"},
+		{middleware.NewRequest(http.MethodPost, "/users").Build(), http.StatusOK, "text/plain; charset=utf-8"},
+		{middleware.NewRequest(http.MethodPost, "/users").Text("hello").Build(), http.StatusUnsupportedMediaType, "text/plain; charset=utf-8"},
+		{middleware.NewRequest(http.MethodGet, "/users").Build(), http.StatusOK, "application/json"},
+		{middleware.NewRequest(http.MethodGet, "/users").Header("Accept", "text/html, application/xml;q=0.9, */*;q=0.1").Build(), http.StatusOK, "application/xml"},
+		{middleware.NewRequest(http.MethodGet, "/users").Header("Accept", "application/*, application/json;q=0").Build(), http.StatusOK, "application/xml"},
+		{middleware.NewRequest(http.MethodGet, "/users").Header("Accept", "text/html").Build(), http.StatusNotAcceptable, "text/plain; charset=utf-8"},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, input.request)
+
+		if w.Code != input.status {
+			t.Fatalf("%s %s %q: expecting %d, got %d", input.request.Method, input.request.URL, input.request.Header, input.status, w.Code)
+		}
+
+		if input.status == http.StatusUnsupportedMediaType && w.Header().Get("Accept") != "application/json, image/*" {
+			t.Fatalf("unexpected Accept header: %q", w.Header().Get("Accept"))
+		}
+
+		if input.request.Method == http.MethodGet && w.Header().Get("Content-Type") != input.contentType {
+			t.Fatalf("%q: expecting %q, got %q", input.request.Header, input.contentType, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var events []middleware.PanicEvent
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Recover(func(event middleware.PanicEvent) {
+		events = append(events, event)
+	})
+	srv.GET("/error/:id", func(w http.ResponseWriter, r *http.Request) {
+		panic(errors.New("database is down"))
+	}).Name("error")
+	srv.GET("/string", func(w http.ResponseWriter, r *http.Request) {
+		panic("unexpected state")
+	})
+	srv.GET("/other", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic(42)
+	})
+	srv.GET("/abort", func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	inputs := []struct {
+		path    string
+		status  int
+		kind    middleware.PanicKind
+		message string
+		pattern string
+	}{
+		{"/error/1", http.StatusInternalServerError, middleware.PanicError, "database is down", "/error/:id"},
+		{"/string", http.StatusInternalServerError, middleware.PanicString, "unexpected state", "/string"},
+		{"/other", http.StatusAccepted, middleware.PanicOther, "42", "/other"},
+	}
+
+	for i, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, input.path).Header("X-Request-Id", "req-1").Build())
+
+		if w.Code != input.status {
+			t.Fatalf("%s: expecting %d, got %d", input.path, input.status, w.Code)
+		}
+
+		event := events[i]
+
+		if event.Kind != input.kind || event.Message != input.message || event.Pattern != input.pattern || event.RequestID != "req-1" || len(event.Stack) == 0 {
+			t.Fatalf("%s: unexpected event: %+v", input.path, event)
+		}
+	}
+
+	if events[0].Route.Pattern() != "/error/:id" || !errors.Is(events[0].Err, events[0].Value.(error)) {
+		t.Fatalf("unexpected route or error: %+v", events[0])
+	}
+
+	func() {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Fatalf("expecting http.ErrAbortHandler, got %v", v)
+			}
+		}()
+
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort", nil))
+	}()
+
+	if len(events) != 4 || events[3].Kind != middleware.PanicAbort {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+}
+
+func TestCompressAccounting(t *testing.T) {
+	text := strings.Repeat("Hello World ", 1000)
+
+	srv := middleware.New()
+	tracer := testlogger.New()
+	srv.Logger = tracer
+	srv.Use(middleware.Compress(gzip.BestCompression))
+	srv.GET("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(text))
+	})
+	srv.GET("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte(text))
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/text").Header("Accept-Encoding", "gzip, br").Build())
+
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("unexpected headers: %v", w.Header())
+	}
+
+	zr, err := gzip.NewReader(w.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := io.ReadAll(zr)
+
+	if string(data) != text {
+		t.Fatalf("unexpected body: %q", data)
+	}
+
+	entry := lastLog(tracer)
+
+	if entry.BytesUncompressed != len(text) || entry.BytesSent >= len(text) || entry.BytesSent != int(entry.ContentLength) || entry.ContentEncoding != "gzip" {
+		t.Fatalf("unexpected accounting: sent=%d uncompressed=%d encoding=%q", entry.BytesSent, entry.BytesUncompressed, entry.ContentEncoding)
+	}
+
+	inputs := []struct {
+		path     string
+		encoding string
+	}{
+		{"/image", "gzip"},
+		{"/text", "gzip;q=0"},
+		{"/text", ""},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, input.path).Header("Accept-Encoding", input.encoding).Build())
+
+		entry := lastLog(tracer)
+
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != text || entry.BytesUncompressed != len(text) || entry.BytesSent != len(text) {
+			t.Fatalf("%s %q: unexpected compression %v", input.path, input.encoding, w.Header())
+		}
+	}
+
+	// the partial responses and the error pages are sent without compression.
+	srv.GET("/range", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Range", "bytes 0-"+strconv.Itoa(len(text)-1)+"/"+strconv.Itoa(len(text)*2))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(text))
+	})
+	srv.ErrorPage(http.StatusNotFound, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<h1>Not Found</h1>"))
+	}))
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/range").Header("Accept-Encoding", "gzip").Build())
+
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "" || w.Body.String() != text {
+		t.Fatalf("unexpected partial response: %d %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/missing").Header("Accept-Encoding", "gzip").Build())
+
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Encoding") != "" || w.Body.String() != "<h1>Not Found</h1>" {
+		t.Fatalf("unexpected error page: %d %v %q", w.Code, w.Header(), w.Body)
+	}
+
+	if entry := lastLog(tracer); entry.BytesUncompressed != entry.BytesSent {
+		t.Fatalf("unexpected accounting of the error page: sent=%d uncompressed=%d", entry.BytesSent, entry.BytesUncompressed)
+	}
+}
+
+func TestListenAndServeDualStack(t *testing.T) {
+	tracer := testlogger.New()
+
+	srv := middleware.New()
+	srv.Logger = tracer
+	defer srv.Shutdown()
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("dual")) })
+
+	go srv.ListenAndServeDualStack(":0")
+
+	deadline := time.Now().Add(time.Second)
+
+	for len(tracer.Addrs()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the server did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	port := tracer.Addrs()[0].(*net.TCPAddr).Port
+
+	curl(t, "GET", "localhost", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, "/", []byte("dual"))
+
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		l.Close()
+		curl(t, "GET", "localhost", &net.TCPAddr{IP: net.IPv6loopback, Port: port}, "/", []byte("dual"))
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	var buf bytes.Buffer
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.ErrorLog = log.New(&buf, "", 0)
+	srv.GET("/small", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}).MaxResponseSize(10)
+	srv.GET("/declared", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "20")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("01234567890123456789"))
+	}).MaxResponseSize(10)
+	srv.GET("/dump", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			if _, err := w.Write([]byte("0123456789")); err != nil {
+				if !errors.Is(err, middleware.ErrResponseTooLarge) {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+		}
+	}).MaxResponseSize(25)
+	srv.GET("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("01234567890123456789"))
+	}).MaxResponseSize(10)
+
+	inputs := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/small", http.StatusOK, "0123456789"},
+		{"/declared", http.StatusInternalServerError, "Internal Server Error\n"},
+		{"/big", http.StatusInternalServerError, "Internal Server Error\n"},
+	}
+
+	for _, input := range inputs {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, input.path, nil))
+
+		if w.Code != input.status || w.Body.String() != input.body {
+			t.Fatalf("%s: expecting %d %q, got %d %q", input.path, input.status, input.body, w.Code, w.Body.String())
+		}
+	}
+
+	func() {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Fatalf("expecting http.ErrAbortHandler, got %v", v)
+			}
+		}()
+
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dump", nil))
+	}()
+
+	if strings.Count(buf.String(), "exceeds") != 3 || !strings.Contains(buf.String(), `route="/dump"`) {
+		t.Fatalf("unexpected error log: %s", buf.String())
+	}
+}
+
+func TestRawParams(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/packages/:name", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("package=" + middleware.Param(r, "name")))
+	})
+	srv.GET("/scoped/:scope/:name", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("scope=" + middleware.Param(r, "scope") + " name=" + middleware.Param(r, "name")))
+	})
+
+	inputs := []struct {
+		raw    bool
+		target string
+		body   string
+	}{
+		{false, "/packages/%40babel", "package=@babel"},
+		{false, "/scoped/%40babel%2Fcore", "scope=@babel name=core"},
+		{true, "/packages/%40babel", "package=%40babel"},
+		{true, "/packages/%40babel%2Fcore", "package=%40babel%2Fcore"},
+		{true, "/scoped/%40babel/core", "scope=%40babel name=core"},
+	}
+
+	for _, input := range inputs {
+		srv.RawParams = input.raw
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, input.target, nil))
+
+		if w.Body.String() != input.body {
+			t.Fatalf("%s (raw=%v): expecting %q, got %q", input.target, input.raw, input.body, w.Body.String())
+		}
+	}
+}
+
+func TestAlternateEncodings(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.STATIC(".", "/cdn")
+	srv.GET("/admin/:page", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admin=" + middleware.Param(r, "page")))
+	})
+	srv.GET("/public/:page", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("public=" + middleware.Param(r, "page")))
+	})
+
+	license, err := os.ReadFile("LICENSE.md")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := []struct {
+		raw    bool
+		strict bool
+		target string
+		status int
+		body   string
+	}{
+		{false, false, "/cdn/testlogger/../LICENSE.md", http.StatusOK, string(license)},
+		{false, false, "/cdn/missing/../LICENSE.md", http.StatusOK, string(license)},
+		{false, false, "/cdn/testlogger%2F..%2FLICENSE.md", http.StatusOK, string(license)},
+		{false, false, "/cdn/%2e%2e/LICENSE.md", http.StatusNotFound, "404 page not found\n"},
+		{true, false, "/public/%2e%2e/admin/users", http.StatusOK, "admin=users"},
+		{true, false, "/public/%2E./admin/users", http.StatusOK, "admin=users"},
+		{false, true, "/public/users", http.StatusOK, "public=users"},
+		{false, true, "/public/caf%C3%A9", http.StatusOK, "public=café"},
+		{false, true, "/public/../admin/users", http.StatusBadRequest, "Bad Request\n"},
+		{false, true, "/public//users", http.StatusBadRequest, "Bad Request\n"},
+		{false, true, "/public/a%2Fb", http.StatusBadRequest, "Bad Request\n"},
+		{false, true, "/public/%252e", http.StatusBadRequest, "Bad Request\n"},
+		{false, true, "/public/%2e", http.StatusBadRequest, "Bad Request\n"},
+		{false, true, "/public/%FF", http.StatusBadRequest, "Bad Request\n"},
+		{false, true, "/public/a%5Cb", http.StatusBadRequest, "Bad Request\n"},
+		{false, true, "/cdn/testlogger/../LICENSE.md", http.StatusBadRequest, "Bad Request\n"},
+	}
+
+	for _, input := range inputs {
+		srv.RawParams = input.raw
+		srv.StrictPaths = input.strict
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, input.target, nil))
+
+		if w.Code != input.status || w.Body.String() != input.body {
+			t.Fatalf("%s (raw=%v, strict=%v): expecting %d %.40q, got %d %.40q", input.target, input.raw, input.strict, input.status, input.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/search", func(w http.ResponseWriter, r *http.Request) {
+		info, ok := middleware.RateLimitState(r)
+
+		if !ok {
+			t.Fatal("missing rate limit state")
+		}
+
+		w.Write([]byte(strconv.Itoa(info.Remaining)))
+	}).Use(middleware.RateLimit(middleware.RateLimitPolicy{
+		Limit:  2,
+		Window: time.Minute,
+		Now:    func() time.Time { return now },
+	}))
+
+	inputs := []struct {
+		advance   time.Duration
+		client    string
+		status    int
+		remaining string
+		reset     string
+	}{
+		{0, "192.0.2.1:1234", http.StatusOK, "1", "60"},
+		{time.Second * 20, "192.0.2.1:1234", http.StatusOK, "0", "40"},
+		{time.Second * 10, "192.0.2.1:1234", http.StatusTooManyRequests, "0", "30"},
+		{0, "192.0.2.2:1234", http.StatusOK, "1", "60"},
+		{time.Second * 30, "192.0.2.1:1234", http.StatusOK, "1", "60"},
+	}
+
+	for i, input := range inputs {
+		now = now.Add(input.advance)
+
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/search").RemoteAddr(input.client).Build())
+
+		h := w.Header()
+
+		if w.Code != input.status || h.Get("RateLimit-Remaining") != input.remaining || h.Get("RateLimit-Reset") != input.reset {
+			t.Fatalf("#%d: expecting %d remaining=%s reset=%s, got %d %v", i, input.status, input.remaining, input.reset, w.Code, h)
+		}
+
+		if h.Get("RateLimit-Limit") != "2" || h.Get("RateLimit-Policy") != "2;w=60" {
+			t.Fatalf("#%d: unexpected headers: %v", i, h)
+		}
+
+		if input.status == http.StatusOK && w.Body.String() != input.remaining {
+			t.Fatalf("#%d: unexpected state: %q", i, w.Body.String())
+		}
+
+		if input.status == http.StatusTooManyRequests && h.Get("Retry-After") != input.reset {
+			t.Fatalf("#%d: unexpected Retry-After: %q", i, h.Get("Retry-After"))
+		}
+	}
+
+	srv.GET("/export", func(w http.ResponseWriter, r *http.Request) {}).Use(middleware.RateLimit(middleware.RateLimitPolicy{
+		Limit:  1,
+		Window: time.Millisecond * 1500,
+	}))
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/export").Build())
+
+	if policy := w.Header().Get("RateLimit-Policy"); policy != "1;w=2" {
+		t.Fatalf("expecting the window rounded up, got %q", policy)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expecting a panic for a window under one second")
+		}
+	}()
+
+	middleware.RateLimit(middleware.RateLimitPolicy{Limit: 10, Window: time.Millisecond * 500})
+}
+
+func TestErrorLogRequestID(t *testing.T) {
+	var buf bytes.Buffer
+
+	tracer := testlogger.New()
+
+	srv := middleware.New()
+	srv.Logger = tracer
+	srv.ErrorLog = log.New(&buf, "", 0)
+	srv.Recover(nil)
+	srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		panic("broken")
+	})
+	srv.GET("/ok", func(w http.ResponseWriter, r *http.Request) {})
+
+	srv.ServeHTTP(httptest.NewRecorder(), middleware.NewRequest(http.MethodGet, "/users/1").Header("X-Request-Id", "abc-123").Build())
+
+	if !strings.HasPrefix(buf.String(), "[abc-123 /users/:id] panic: GET example.com/users/1: broken\n") {
+		t.Fatalf("unexpected error log: %s", buf.String())
+	}
+
+	if lastLog(tracer).RequestID != "abc-123" || lastLog(tracer).StatusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected access log: %+v", lastLog(tracer))
+	}
+
+	buf.Reset()
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/2", nil))
+
+	generated := lastLog(tracer).RequestID
+
+	if generated == "" || !strings.HasPrefix(buf.String(), "["+generated+" /users/:id] panic:") {
+		t.Fatalf("unexpected generated request ID %q: %s", generated, buf.String())
+	}
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ok", nil))
+
+	if lastLog(tracer).RequestID != "" {
+		t.Fatalf("unexpected request ID: %q", lastLog(tracer).RequestID)
+	}
+}
+
+func TestBackgroundJobs(t *testing.T) {
+	var buf bytes.Buffer
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.ErrorLog = log.New(&buf, "", 0)
+	srv.ShutdownTimeout = time.Millisecond * 200
+
+	var finished int32
+
+	for i := 0; i < 3; i++ {
+		srv.Go(func(ctx context.Context) {
+			<-ctx.Done()
+			time.Sleep(time.Millisecond * 10)
+			atomic.AddInt32(&finished, 1)
+		})
+	}
+
+	if err := srv.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&finished) != 3 || buf.Len() != 0 {
+		t.Fatalf("expecting 3 finished jobs, got %d: %s", finished, buf.String())
+	}
+
+	srv.ShutdownTimeout = time.Millisecond * 10
+
+	release := make(chan struct{})
+	defer close(release)
+
+	srv.Go(func(ctx context.Context) { <-release })
+
+	if err := srv.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "shutdown: 1 background jobs still running") {
+		t.Fatalf("unexpected error log: %s", buf.String())
+	}
+}
+
+func TestRouteConflicts(t *testing.T) {
+	var buf bytes.Buffer
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.ErrorLog = log.New(&buf, "", 0)
+	srv.GET("/users/new", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/users/:uid/posts", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/files/:name", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/files/*", func(w http.ResponseWriter, r *http.Request) {})
+	srv.POST("/users", func(w http.ResponseWriter, r *http.Request) {})
+	srv.POST("/users", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/about", func(w http.ResponseWriter, r *http.Request) {})
+
+	expected := []string{
+		"GET /files/*: unreachable, the parameter :name in the same position takes precedence and the router does not backtrack",
+		"POST /users: registered more than once, the last registration replaces the others",
+		"GET /users/:id: the parameter :id is received as :uid because of /users/:uid/posts",
+		"GET /users/:id: the parameter :uid does not match values that start with \"n\", unless they match one of /users/new, because the router prefers static segments and does not backtrack",
+		"GET /users/:uid/posts: the parameter :uid does not match values that start with \"n\", unless they match one of /users/new, because the router prefers static segments and does not backtrack",
+	}
+
+	conflicts := srv.RouteConflicts()
+
+	if len(conflicts) != len(expected) {
+		t.Fatalf("expecting %d conflicts, got %v", len(expected), conflicts)
+	}
+
+	for i, c := range conflicts {
+		if c.String() != expected[i] {
+			t.Fatalf("unexpected conflict #%d\n- %s\n+ %s", i, expected[i], c)
+		}
+	}
+
+	srv.StrictRoutes = true
+
+	if err := srv.ListenAndServe("127.0.0.1:0"); err == nil || !strings.Contains(err.Error(), "5 route conflicts") {
+		t.Fatalf("expecting server to refuse to start, got %v", err)
+	}
+
+	if err := srv.ListenAndServeIPv4("127.0.0.1:0"); err == nil || !strings.Contains(err.Error(), "5 route conflicts") {
+		t.Fatalf("expecting IPv4 server to refuse to start, got %v", err)
+	}
+
+	ready := make(chan net.Addr, 1)
+
+	if err := srv.ListenAndServeReady("127.0.0.1:0", ready); err == nil || !strings.Contains(err.Error(), "5 route conflicts") {
+		t.Fatalf("expecting ready server to refuse to start, got %v", err)
+	}
+
+	if addr, ok := <-ready; ok {
+		t.Fatalf("expecting closed ready channel, got %v", addr)
+	}
+
+	if !strings.Contains(buf.String(), "middleware: route conflict: GET /files/*: unreachable") {
+		t.Fatalf("unexpected error log: %s", buf.String())
+	}
+}
+
+func TestAcceptsNegotiation(t *testing.T) {
+	encodings := []struct {
+		header   string
+		offers   []string
+		expected string
+	}{
+		{"", []string{"br", "gzip"}, ""},
+		{"", []string{"gzip", "identity"}, "identity"},
+		{"gzip, br", []string{"br", "gzip"}, "br"},
+		{"gzip;q=1.0, br;q=0.5", []string{"br", "gzip"}, "gzip"},
+		{"GZIP", []string{"gzip"}, "gzip"},
+		{"*", []string{"br", "gzip"}, "br"},
+		{"br;q=0, *", []string{"br", "gzip"}, "gzip"},
+		{"gzip;q=0", []string{"gzip", "identity"}, "identity"},
+		{"gzip, identity;q=0", []string{"identity"}, ""},
+		{"gzip, *;q=0", []string{"identity"}, ""},
+		{"deflate", []string{"br", "gzip"}, ""},
+	}
+
+	for _, input := range encodings {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		if input.header != "" {
+			r.Header.Set("Accept-Encoding", input.header)
+		}
+
+		if output := middleware.AcceptsEncoding(r, input.offers...); output != input.expected {
+			t.Fatalf("AcceptsEncoding(%q, %v) = %q, expecting %q", input.header, input.offers, output, input.expected)
+		}
+	}
+
+	types := []struct {
+		header   string
+		offers   []string
+		expected string
+	}{
+		{"", []string{"application/json", "text/html"}, "application/json"},
+		{"text/html", []string{"application/json", "text/html"}, "text/html"},
+		{"text/*;q=0.5, application/json", []string{"text/plain", "application/json"}, "application/json"},
+		{"*/*, text/html;q=0", []string{"text/html", "text/plain"}, "text/plain"},
+		{"image/png", []string{"application/json"}, ""},
+	}
+
+	for _, input := range types {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		if input.header != "" {
+			r.Header.Set("Accept", input.header)
+		}
+
+		if output := middleware.Accepts(r, input.offers...); output != input.expected {
+			t.Fatalf("Accepts(%q, %v) = %q, expecting %q", input.header, input.offers, output, input.expected)
+		}
+	}
+}
+
+func TestVerboseLog(t *testing.T) {
+	tracer := testlogger.New()
+
+	srv := middleware.New()
+	srv.Logger = tracer
+	srv.LogHeaders = []string{"User-Agent"}
+	srv.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Debug") != "" {
+				middleware.VerboseLog(r)
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {
+		middleware.LogNote(r, "cache miss for user %s", middleware.Param(r, "id"))
+		w.Header().Set("X-Cache", "MISS")
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/users/42", nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.Header.Set("Authorization", "Bearer token")
+	srv.ServeHTTP(httptest.NewRecorder(), r)
+
+	entry := lastLog(tracer)
+
+	if entry.Verbose || entry.Params != nil || entry.Notes != nil || entry.ResponseHeader != nil || len(entry.Header) != 1 {
+		t.Fatalf("unexpected regular access log: %+v", entry)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/users/42", nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.Header.Set("X-Debug", "1")
+	srv.ServeHTTP(httptest.NewRecorder(), r)
+
+	entry = lastLog(tracer)
+
+	if !entry.Verbose {
+		t.Fatalf("expecting verbose access log: %+v", entry)
+	}
+
+	if entry.Header.Get("X-Debug") != "1" || entry.Header.Get("User-Agent") != "curl/8.0" {
+		t.Fatalf("unexpected request headers: %v", entry.Header)
+	}
+
+	if entry.ResponseHeader.Get("X-Cache") != "MISS" {
+		t.Fatalf("unexpected response headers: %v", entry.ResponseHeader)
+	}
+
+	if entry.Params["id"] != "42" {
+		t.Fatalf("unexpected params: %v", entry.Params)
+	}
+
+	if len(entry.Notes) != 1 || entry.Notes[0] != "cache miss for user 42" {
+		t.Fatalf("unexpected notes: %v", entry.Notes)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	dir := t.TempDir()
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.UPLOAD("/artifacts", dir, middleware.UploadConfig{MaxSize: 16})
+	srv.UPLOAD("/cache", filepath.Join(dir, "cache"), middleware.UploadConfig{MaxSize: 16, Overwrite: true, CreateDirs: true})
+
+	upload := func(method string, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	if w := upload(http.MethodPut, "/artifacts/app.tar", "v1"); w.Code != http.StatusCreated || w.Header().Get("Location") != "/artifacts/app.tar" {
+		t.Fatalf("unexpected response: %d %v", w.Code, w.Header())
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dir, "app.tar")); string(data) != "v1" {
+		t.Fatalf("unexpected file content: %q", data)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{http.MethodPut, "/artifacts/app.tar", "v2", http.StatusConflict},
+		{http.MethodPut, "/artifacts/big.tar", "0123456789abcdefg", http.StatusRequestEntityTooLarge},
+		{http.MethodPut, "/artifacts/missing/app.tar", "v1", http.StatusConflict},
+		{http.MethodPut, "/artifacts/.htaccess", "deny", http.StatusForbidden},
+		{http.MethodPut, "/artifacts/../escape.tar", "v1", http.StatusNotFound},
+		{http.MethodPut, "/artifacts/dir/", "v1", http.StatusBadRequest},
+		{http.MethodPut, "/cache/a/b/c.bin", "v1", http.StatusCreated},
+		{http.MethodPut, "/cache/a/b/c.bin", "v2", http.StatusNoContent},
+		{http.MethodPost, "/cache/d.bin", "v1", http.StatusCreated},
+	}
+
+	for _, test := range tests {
+		if w := upload(test.method, test.target, test.body); w.Code != test.status {
+			t.Fatalf("%s %s: expecting %d, got %d: %s", test.method, test.target, test.status, w.Code, w.Body.String())
+		}
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dir, "cache", "a", "b", "c.bin")); string(data) != "v2" {
+		t.Fatalf("unexpected overwritten content: %q", data)
+	}
+
+	for _, name := range []string{"big.tar", "escape.tar"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Fatalf("unexpected file %s", name)
+		}
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Fatalf("unexpected temporary files: %v", entries)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("comment", "nightly")
+	fw, _ := mw.CreateFormFile("file", `C:\builds\nightly.zip`)
+	fw.Write([]byte("zip"))
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/artifacts/", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+
+	if w.Code != http.StatusCreated || w.Body.String() != "/artifacts/nightly.zip\n" {
+		t.Fatalf("unexpected multipart response: %d %q", w.Code, w.Body.String())
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dir, "nightly.zip")); string(data) != "zip" {
+		t.Fatalf("unexpected uploaded file: %q", data)
+	}
+}
+
+func TestThrottledStreams(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789"), 200)
+
+	if err := os.WriteFile(filepath.Join(dir, "video.mp4"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/files/:name", func(w http.ResponseWriter, r *http.Request) {
+		middleware.StreamFile(w, r, filepath.Join(dir, filepath.Base(middleware.Param(r, "name"))), 10000)
+	})
+	srv.GET("/proxy/:name", func(w http.ResponseWriter, r *http.Request) {
+		_ = middleware.StreamURL(w, r, upstream.URL+"/"+middleware.Param(r, "name"), 10000)
+	})
+	srv.GET("/fast", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}).Use(middleware.Throttle(10000))
+
+	for _, target := range []string{"/files/video.mp4", "/proxy/video.mp4", "/fast"} {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if elapsed := time.Since(start); elapsed < time.Millisecond*150 {
+			t.Fatalf("%s: expecting a throttled response, took %s", target, elapsed)
+		}
+
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Fatalf("%s: unexpected response: %d, %d bytes", target, w.Code, w.Body.Len())
+		}
+	}
+
+	for _, target := range []string{"/files/video.mp4", "/proxy/video.mp4"} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, target).Header("Range", "bytes=10-19").Build())
+
+		if w.Code != http.StatusPartialContent || w.Body.String() != "0123456789" || w.Header().Get("Content-Range") != "bytes 10-19/2000" {
+			t.Fatalf("%s: unexpected range response: %d %v %q", target, w.Code, w.Header(), w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, middleware.NewRequest(http.MethodGet, "/proxy/video.mp4").Header("If-None-Match", `"v1"`).Build())
+
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expecting 304 from upstream, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/missing.mp4", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expecting 404 for a missing file, got %d", w.Code)
+	}
+}
+
+func TestShutdownHandler(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	srv.GET("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("done"))
+	})
+	srv.GET("/fast", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	slow := httptest.NewRecorder()
+	finished := make(chan struct{})
+
+	go func() {
+		srv.ServeHTTP(slow, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		close(finished)
+	}()
+
+	<-started
+
+	if err := srv.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fast", nil))
+
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Connection") != "close" {
+		t.Fatalf("expecting 503 with Connection: close, got %d %v", w.Code, w.Header())
+	}
+
+	close(release)
+	<-finished
+
+	if slow.Code != http.StatusOK || slow.Body.String() != "done" {
+		t.Fatalf("expecting in-flight request to finish, got %d %q", slow.Code, slow.Body.String())
+	}
+
+	srv.ShutdownHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fast", nil))
+
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" {
+		t.Fatalf("expecting custom shutdown response, got %d %v", w.Code, w.Header())
+	}
+
+	srv.ServeDuringShutdown = true
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fast", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("expecting regular response, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestLimitConnectionRate(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	srv.LimitConnectionRate(1, 2)
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	ready := make(chan net.Addr, 1)
+	go srv.ListenAndServeReady("127.0.0.1:0", ready)
+	defer srv.Shutdown()
+	addr := <-ready
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	get := func() error {
+		res, err := client.Get("http://" + addr.String() + "/")
+
+		if err != nil {
+			return err
+		}
+
+		defer res.Body.Close()
+
+		_, err = io.ReadAll(res.Body)
+
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := get(); err != nil {
+			t.Fatalf("connection #%d: %s", i, err)
+		}
+	}
+
+	if err := get(); err == nil {
+		t.Fatal("expecting the third connection to be closed")
+	}
+
+	mu.Lock()
+	now = now.Add(time.Second)
+	mu.Unlock()
+
+	if err := get(); err != nil {
+		t.Fatalf("expecting a new token after one second: %s", err)
+	}
+}
+
+func TestRouteSLO(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	latency := time.Millisecond * 10
+
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+
+	alerts := make(chan middleware.SLOAlert, 10)
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	srv.GET("/search", func(w http.ResponseWriter, r *http.Request) {
+		advance(latency)
+	}).SLO(middleware.SLO{
+		Percentile:  90,
+		Threshold:   time.Millisecond * 300,
+		Window:      time.Minute,
+		MinRequests: 10,
+		Alert:       func(alert middleware.SLOAlert) { alerts <- alert },
+	})
+
+	request := func(n int) {
+		for i := 0; i < n; i++ {
+			srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/search", nil))
+		}
+	}
+
+	request(9)
+	latency = time.Millisecond * 400
+	request(1)
+
+	select {
+	case alert := <-alerts:
+		t.Fatalf("unexpected alert with 10%% slow requests: %+v", alert)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	request(1)
+
+	select {
+	case alert := <-alerts:
+		if !alert.Violated || alert.Pattern != "/search" || alert.Requests != 11 || alert.Slow != 2 {
+			t.Fatalf("unexpected alert: %+v", alert)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expecting an SLO violation alert")
+	}
+
+	request(5)
+
+	select {
+	case alert := <-alerts:
+		t.Fatalf("unexpected repeated alert: %+v", alert)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// the slow requests leave the rolling window.
+	advance(time.Minute)
+	latency = time.Millisecond * 10
+	request(10)
+
+	select {
+	case alert := <-alerts:
+		if alert.Violated || alert.Requests != 10 || alert.Slow != 0 {
+			t.Fatalf("unexpected recovery alert: %+v", alert)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expecting an SLO recovery alert")
+	}
+}
+
+func TestRouteConflictsAcrossMethods(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/u/:id", func(w http.ResponseWriter, r *http.Request) {})
+	srv.POST("/u/:userID", func(w http.ResponseWriter, r *http.Request) {})
+	srv.DELETE("/u/:id", func(w http.ResponseWriter, r *http.Request) {})
+	srv.GET("/u/:id/posts/:post", func(w http.ResponseWriter, r *http.Request) {})
+	srv.PUT("/u/:id/posts/:post", func(w http.ResponseWriter, r *http.Request) {})
+
+	expected := []string{
+		"DELETE /u/:id: the parameters have different names in POST /u/:userID, which makes the logs and the URL reversal ambiguous",
+		"GET /u/:id: the parameters have different names in POST /u/:userID, which makes the logs and the URL reversal ambiguous",
+		"POST /u/:userID: the parameters have different names in DELETE /u/:id, GET /u/:id, which makes the logs and the URL reversal ambiguous",
+	}
+
+	conflicts := srv.RouteConflicts()
+
+	if len(conflicts) != len(expected) {
+		t.Fatalf("expecting %d conflicts, got %v", len(expected), conflicts)
+	}
+
+	for i, c := range conflicts {
+		if c.String() != expected[i] {
+			t.Fatalf("unexpected conflict #%d\n- %s\n+ %s", i, expected[i], c)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "app.js"), []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(middleware.MatchedRoute(w).Pattern() + " " + middleware.Param(r, "id")))
+	}
 
-	if str != expected {
-		t.Fatalf("incorrect combined log format:\n- %s\n+ %s", expected, str)
+	srv := middleware.New()
+	srv.DiscardLogs()
+
+	api := srv.Group("/api/v1/")
+	api.GET("/users", handler)
+	api.GET("/users/:id", handler)
+	api.STATIC(dir, "/assets")
+
+	admin := api.Group("/admin")
+	admin.DELETE("/users/:id", handler)
+
+	tenant := srv.Host("tenant.test").Group("/tenants/:id")
+	tenant.GET("/settings", handler)
+
+	orders := srv.Group("/orders/:id([0-9]*)")
+	orders.GET("/items", handler)
+
+	tests := []struct {
+		method   string
+		host     string
+		path     string
+		expected string
+	}{
+		{http.MethodGet, "", "/api/v1/users", "/api/v1/users "},
+		{http.MethodGet, "", "/api/v1/users/42", "/api/v1/users/:id 42"},
+		{http.MethodDelete, "", "/api/v1/admin/users/7", "/api/v1/admin/users/:id 7"},
+		{http.MethodGet, "", "/api/v1/assets/app.js", "app"},
+		{http.MethodGet, "tenant.test", "/tenants/acme/settings", "/tenants/:id/settings acme"},
+		{http.MethodGet, "", "/users", "404 page not found\n"},
+		{http.MethodGet, "", "/orders/123/items", "/orders/:id([0-9]*)/items 123"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, test.path, nil)
+
+		if test.host != "" {
+			r.Host = test.host
+		}
+
+		srv.ServeHTTP(w, r)
+
+		if w.Body.String() != test.expected {
+			t.Fatalf("%s %s%s: expecting %q, got %q", test.method, test.host, test.path, test.expected, w.Body.String())
+		}
 	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expecting a panic for a group with a wildcard")
+		}
+	}()
+
+	srv.Group("/files/*")
 }
 
-type LoggerAndNewLines struct {
-	metadata middleware.AccessLog
+func TestDotSegmentsAfterFirstSegment(t *testing.T) {
+	for _, raw := range []bool{false, true} {
+		srv := middleware.New()
+		srv.DiscardLogs()
+		srv.RawParams = raw
+		srv.GET("/api", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("api")) })
+
+		for _, target := range []string{"/x/../api", "/x/%2e%2e/api", "/x//../api"} {
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+			if w.Code != http.StatusOK || w.Body.String() != "api" {
+				t.Fatalf("RawParams=%v %s: expecting 200 api, got %d %q", raw, target, w.Code, w.Body.String())
+			}
+		}
+	}
 }
 
-func (l LoggerAndNewLines) ListeningOn(addr net.Addr) {}
+func TestControlCharactersInPath(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/files/:name", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(middleware.Param(r, "name")))
+	})
 
-func (l LoggerAndNewLines) Shutdown(err error) {}
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/files/report.pdf", http.StatusOK},
+		{"/files/r%C3%A9sum%C3%A9.pdf", http.StatusOK},
+		{"/files/report.pdf%00.txt", http.StatusBadRequest},
+		{"/files/report%0D%0ASet-Cookie:%20a=b", http.StatusBadRequest},
+		{"/files/%FF%FE", http.StatusBadRequest},
+		{"/missing%00", http.StatusBadRequest},
+	}
 
-func (l *LoggerAndNewLines) Log(data middleware.AccessLog) {
-	l.metadata = data
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+
+		if w.Code != test.status {
+			t.Fatalf("%s: expecting %d, got %d", test.target, test.status, w.Code)
+		}
+	}
 }
 
-func TestLoggerAndNewLines(t *testing.T) {
-	srv, addr := newTestServer(t)
-	logger := &LoggerAndNewLines{}
+type startupRecorder struct {
+	infos chan middleware.StartupInfo
+	addrs int32
+}
+
+func (l *startupRecorder) ListeningOn(addr net.Addr) { atomic.AddInt32(&l.addrs, 1) }
+
+func (l *startupRecorder) Startup(info middleware.StartupInfo) { l.infos <- info }
+
+func (l *startupRecorder) Shutdown(err error) {}
+
+func (l *startupRecorder) Log(data middleware.AccessLog) {}
+
+func TestStartupInfo(t *testing.T) {
+	logger := &startupRecorder{infos: make(chan middleware.StartupInfo, 1)}
+
+	srv := middleware.New()
 	srv.Logger = logger
+	srv.ReadTimeout = time.Second * 7
+
+	go srv.ListenAndServeIPv4("127.0.0.1:0")
 	defer srv.Shutdown()
-	go srv.ListenAndServe(addr.String())
 
-	curl(t, "GET", "localhost", addr, "/foo%0abar", []byte("Method Not Allowed\n"))
+	var info middleware.StartupInfo
 
-	expected := `"GET /foo\nbar HTTP/1.1"`
+	select {
+	case info = <-logger.infos:
+	case <-time.After(time.Second):
+		t.Fatal("expecting startup information")
+	}
 
-	if str := logger.metadata.Request(); str != expected {
-		t.Fatalf("incorrect request section in access log:\n- %s\n+ %s", expected, str)
+	if info.Family != "ipv4" || info.Scheme != "http" || info.TLS || info.ReadTimeout != time.Second*7 || info.ShutdownTimeout != srv.ShutdownTimeout {
+		t.Fatalf("unexpected startup information: %+v", info)
+	}
+
+	if !strings.HasPrefix(info.String(), info.Addr.String()+" (scheme=http family=ipv4 read_timeout=7s ") {
+		t.Fatalf("unexpected startup information: %s", info)
+	}
+
+	if atomic.LoadInt32(&logger.addrs) != 0 {
+		t.Fatal("expecting Startup instead of ListeningOn")
+	}
+}
+
+func TestParamConstraints(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(middleware.MatchedRoute(w).Pattern()))
+	}
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/users/:id(int)", handler).Name("users.show")
+	srv.GET("/users/new", handler)
+	srv.GET("/docs/:page(alpha)", handler)
+	srv.GET("/docs/*", handler)
+
+	testCases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{path: "/users/42", status: http.StatusOK, body: "/users/:id(int)"},
+		{path: "/users/new", status: http.StatusOK, body: "/users/new"},
+		{path: "/users/me", status: http.StatusNotFound},
+		{path: "/docs/intro", status: http.StatusOK, body: "/docs/:page(alpha)"},
+		{path: "/docs/v2", status: http.StatusOK, body: "/docs/*"},
+		{path: "/docs/v2/intro", status: http.StatusOK, body: "/docs/*"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("expecting status %d, got %d", tc.status, w.Code)
+			}
+
+			if tc.body != "" && w.Body.String() != tc.body {
+				t.Fatalf("expecting body %q, got %q", tc.body, w.Body.String())
+			}
+		})
+	}
+
+	if path, err := srv.URL("users.show", map[string]string{"id": "42"}); err != nil || path != "/users/42" {
+		t.Fatalf("expecting /users/42, got %q %v", path, err)
+	}
+
+	for _, c := range srv.RouteConflicts() {
+		if c.Pattern == "/docs/*" {
+			t.Fatalf("unexpected conflict %s", c)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expecting a panic for an invalid constraint")
+		}
+	}()
+
+	srv.GET("/posts/:id([0-9+)", handler)
+}
+
+func TestNamedWildcard(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/files/*filepath", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(middleware.Param(r, "filepath")))
+	}).Name("files")
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/docs/report.pdf", nil))
+
+	if w.Code != http.StatusOK || w.Body.String() != "docs/report.pdf" {
+		t.Fatalf("expecting docs/report.pdf, got %d %q", w.Code, w.Body.String())
+	}
+
+	if path, err := srv.URL("files", map[string]string{"filepath": "docs/report.pdf"}); err != nil || path != "/files/docs/report.pdf" {
+		t.Fatalf("expecting /files/docs/report.pdf, got %q %v", path, err)
+	}
+}
+
+func TestCaptureBody(t *testing.T) {
+	var captured []middleware.CapturedBody
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.Use(middleware.CaptureBody(8, nil, func(c middleware.CapturedBody) {
+		captured = append(captured, c)
+	}))
+	srv.GET("/ok", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("everything is fine"))
+	})
+	srv.GET("/fail/:id", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("<html>"))
+		_, _ = w.Write([]byte("truncated"))
+	})
+
+	for _, path := range []string{"/ok", "/fail/1"} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if path == "/fail/1" && w.Body.String() != "<html>truncated" {
+			t.Fatalf("unexpected response body %q", w.Body.String())
+		}
+	}
+
+	if len(captured) != 1 {
+		t.Fatalf("expecting one captured body, got %d", len(captured))
+	}
+
+	c := captured[0]
+
+	if c.Status != http.StatusBadGateway || c.URL != "/fail/1" || c.Pattern != "/fail/:id" {
+		t.Fatalf("unexpected capture %d %s %s", c.Status, c.URL, c.Pattern)
+	}
+
+	if string(c.Body) != "<html>tr" || !c.Truncated {
+		t.Fatalf("expecting truncated body, got %q %v", c.Body, c.Truncated)
+	}
+
+	if c.Header.Get("Set-Cookie") != "" {
+		t.Fatal("expecting Set-Cookie to be redacted")
+	}
+
+	if c.RequestID == "" {
+		t.Fatal("expecting a request ID")
+	}
+
+	// the writer keeps the optional interfaces for WEBSOCKET and STATIC.
+	var hijacker, readerFrom bool
+
+	srv.GET("/copy", func(w http.ResponseWriter, r *http.Request) {
+		_, hijacker = w.(http.Hijacker)
+		_, readerFrom = w.(io.ReaderFrom)
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.Copy(w, strings.NewReader("copied body"))
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/copy", nil))
+
+	if !hijacker || !readerFrom {
+		t.Fatalf("expecting http.Hijacker and io.ReaderFrom, got %v %v", hijacker, readerFrom)
+	}
+
+	if w.Body.String() != "copied body" || len(captured) != 2 || string(captured[1].Body) != "copied b" {
+		t.Fatalf("unexpected capture with io.Copy: %q", w.Body.String())
+	}
+}
+
+func TestRouteRequire(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/public", handler)
+	srv.GET("/admin", handler).Require("admin")
+	srv.GET("/billing", handler).Require("billing:read").Require("admin")
+	// http.TimeoutHandler hides the writer of the router from the check.
+	srv.GET("/reports", handler).Timeout(time.Second).Require("admin")
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin", nil))
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expecting 403 without an authorizer, got %d", w.Code)
+	}
+
+	var received []string
+
+	srv.Authorize(func(r *http.Request, requirements []string) error {
+		received = requirements
+		roles := r.Header.Get("X-Roles")
+
+		if roles == "" {
+			return middleware.ErrUnauthenticated
+		}
+
+		for _, role := range requirements {
+			if !strings.Contains(","+roles+",", ","+role+",") {
+				return errors.New("missing role " + role)
+			}
+		}
+
+		return nil
+	})
+
+	testCases := []struct {
+		path   string
+		roles  string
+		status int
+	}{
+		{path: "/public", status: http.StatusOK},
+		{path: "/admin", status: http.StatusUnauthorized},
+		{path: "/admin", roles: "user", status: http.StatusForbidden},
+		{path: "/admin", roles: "user,admin", status: http.StatusOK},
+		{path: "/reports", roles: "user", status: http.StatusForbidden},
+		{path: "/reports", roles: "admin", status: http.StatusOK},
+		{path: "/billing", roles: "admin", status: http.StatusForbidden},
+		{path: "/billing", roles: "admin,billing:read", status: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path+" "+tc.roles, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+
+			if tc.roles != "" {
+				req.Header.Set("X-Roles", tc.roles)
+			}
+
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("expecting status %d, got %d", tc.status, w.Code)
+			}
+		})
+	}
+
+	if !reflect.DeepEqual(received, []string{"billing:read", "admin"}) {
+		t.Fatalf("unexpected requirements %v", received)
+	}
+
+	var buf bytes.Buffer
+
+	if err := srv.DumpRoutes(&buf, "text"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "_ GET /admin   admin\n" +
+		"_ GET /billing billing:read,admin\n" +
+		"_ GET /public\n" +
+		"_ GET /reports admin\n"
+
+	if buf.String() != expected {
+		t.Fatalf("unexpected text dump:\n%s", buf.String())
+	}
+
+	for _, info := range srv.Routes() {
+		if info.Pattern == "/admin" && !reflect.DeepEqual(info.Require, []string{"admin"}) {
+			t.Fatalf("unexpected requirements in Routes %v", info.Require)
+		}
+	}
+}
+
+func TestLogField(t *testing.T) {
+	type userKey struct{}
+
+	var entries []middleware.AccessLog
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.After(func(entry middleware.AccessLog) {
+		entries = append(entries, entry)
+	})
+	srv.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if user := r.Header.Get("X-User"); user != "" {
+				r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	srv.LogField("user_id", func(r *http.Request) string {
+		user, _ := r.Context().Value(userKey{}).(string)
+		return user
+	})
+	srv.LogField("tenant", func(r *http.Request) string {
+		return r.Header.Get("X-Tenant")
+	})
+	srv.GET("/profile", func(w http.ResponseWriter, r *http.Request) {})
+	srv.Freeze()
+
+	for _, path := range []string{"/profile", "/missing"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-User", "u-42")
+		req.Header.Set("X-Tenant", "acme")
+		srv.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/profile", nil))
+
+	if len(entries) != 3 {
+		t.Fatalf("expecting 3 entries, got %d", len(entries))
+	}
+
+	if !reflect.DeepEqual(entries[0].Fields, map[string]string{"user_id": "u-42", "tenant": "acme"}) {
+		t.Fatalf("unexpected fields %v", entries[0].Fields)
+	}
+
+	if !strings.HasSuffix(entries[0].String(), ` tenant="acme" user_id="u-42"`) {
+		t.Fatalf("expecting the fields in the log line, got %s", entries[0])
+	}
+
+	// the request did not match a route, the fields use the request received
+	// by the router, without the values added by the middlewares.
+	if !reflect.DeepEqual(entries[1].Fields, map[string]string{"tenant": "acme"}) {
+		t.Fatalf("unexpected fields for 404 %v", entries[1].Fields)
+	}
+
+	if entries[2].Fields != nil {
+		t.Fatalf("expecting no fields, got %v", entries[2].Fields)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/users/:id", func(w http.ResponseWriter, r *http.Request) {})
+	srv.PUT("/users/:id", func(w http.ResponseWriter, r *http.Request) {})
+	srv.DELETE("/users/:id/sessions", func(w http.ResponseWriter, r *http.Request) {})
+
+	testCases := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{method: http.MethodGet, path: "/users/42", status: http.StatusOK},
+		{method: http.MethodPost, path: "/users/42", status: http.StatusMethodNotAllowed, allow: "GET, HEAD, PUT"},
+		{method: http.MethodDelete, path: "/users/42", status: http.StatusMethodNotAllowed, allow: "GET, HEAD, PUT"},
+		{method: http.MethodGet, path: "/users/42/sessions", status: http.StatusMethodNotAllowed, allow: "DELETE"},
+		{method: http.MethodPost, path: "/missing", status: http.StatusNotFound},
+		{method: http.MethodGet, path: "/missing", status: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+
+			if w.Code != tc.status {
+				t.Fatalf("expecting status %d, got %d", tc.status, w.Code)
+			}
+
+			if allow := w.Header().Get("Allow"); allow != tc.allow {
+				t.Fatalf("expecting Allow %q, got %q", tc.allow, allow)
+			}
+		})
+	}
+
+	srv.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = w.Write([]byte("use " + w.Header().Get("Allow")))
+	})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/users/42", nil))
+
+	if w.Code != http.StatusMethodNotAllowed || w.Body.String() != "use GET, HEAD, PUT" {
+		t.Fatalf("unexpected custom response %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestNotFoundSuggestions(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.NotFoundSuggestions = 2
+	srv.GET("/users/:id", handler)
+	srv.POST("/users", handler)
+	srv.GET("/orders/:id/items", handler)
+	srv.GET("/files/*path", handler)
+
+	testCases := []struct {
+		path   string
+		accept string
+		body   string
+	}{
+		{path: "/user/42", body: "404 page not found\n\nDid you mean:\n/users/42\n"},
+		{path: "/order/7/item", accept: "application/json", body: `{"error":"404 page not found","suggestions":["/orders/7/items"]}` + "\n"},
+		{path: "/file/a/b.txt", accept: "text/html,*/*;q=0.8", body: "<!DOCTYPE html>\n<title>404 page not found</title>\n<h1>404 page not found</h1>\n<p>Did you mean:</p>\n<ul>\n<li><a href=\"/files/a/b.txt\">/files/a/b.txt</a></li>\n</ul>\n"},
+		{path: "/completely/unrelated/path", body: "404 page not found\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+
+			w := httptest.NewRecorder()
+			srv.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("expecting status 404, got %d", w.Code)
+			}
+
+			if w.Body.String() != tc.body {
+				t.Fatalf("unexpected body\n- %q\n+ %q", tc.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStaticPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"index.html":       `<html><SCRIPT src="/app.js"></SCRIPT><style>p{}</style><scripts></scripts></html>`,
+		"app.js":           `console.log("app")`,
+		"legacy/page.html": `<script>alert(1)</script>`,
+	}
+
+	for name, content := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.STATIC(dir, "/site")
+	srv.StaticPolicy("/site", middleware.ContentSecurityPolicy{Policy: "script-src 'self' {nonce}; style-src {nonce}"})
+	srv.StaticPolicy("/site/legacy", middleware.ContentSecurityPolicy{Policy: "default-src 'self'", ReportOnly: true})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/site/index.html", nil))
+
+	policy := w.Header().Get("Content-Security-Policy")
+	nonce := strings.TrimPrefix(strings.Fields(policy)[2], "'nonce-")
+	nonce = strings.TrimSuffix(nonce, "';")
+
+	if w.Code != http.StatusOK || nonce == "" || policy != "script-src 'self' 'nonce-"+nonce+"'; style-src 'nonce-"+nonce+"'" {
+		t.Fatalf("unexpected policy %d %q", w.Code, policy)
+	}
+
+	expected := `<html><SCRIPT nonce="` + nonce + `" src="/app.js"></SCRIPT><style nonce="` + nonce + `">p{}</style><scripts></scripts></html>`
+
+	if w.Body.String() != expected {
+		t.Fatalf("unexpected body\n- %s\n+ %s", expected, w.Body.String())
+	}
+
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("expecting Cache-Control no-store, got %q", w.Header().Get("Cache-Control"))
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/site/index.html", nil))
+
+	if w.Header().Get("Content-Security-Policy") == policy {
+		t.Fatal("expecting a different nonce for each response")
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/site/legacy/page.html", nil))
+
+	if w.Header().Get("Content-Security-Policy-Report-Only") != "default-src 'self'" || w.Header().Get("Content-Security-Policy") != "" {
+		t.Fatalf("expecting the report-only policy of the nested prefix, got %v", w.Header())
+	}
+
+	if w.Body.String() != files["legacy/page.html"] {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/site/app.js", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Security-Policy") != "" {
+		t.Fatalf("expecting no policy for scripts, got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestAutoHead(t *testing.T) {
+	srv := middleware.New()
+	srv.DiscardLogs()
+	srv.GET("/report", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Header().Set("X-Method", r.Method)
+		_, _ = w.Write([]byte("hello"))
+	})
+	srv.GET("/custom", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("get"))
+	})
+	srv.HEAD("/custom", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handler", "head")
+	})
+	srv.POST("/submit", func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/report", nil))
+
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("expecting 200 without body, got %d %q", w.Code, w.Body.String())
+	}
+
+	if w.Header().Get("Content-Length") != "5" || w.Header().Get("X-Method") != http.MethodHead {
+		t.Fatalf("expecting the headers of the GET handler, got %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/custom", nil))
+
+	if w.Header().Get("X-Handler") != "head" {
+		t.Fatalf("expecting the HEAD handler to take precedence, got %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/submit", nil))
+
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST" {
+		t.Fatalf("expecting 405 with Allow POST, got %d %q", w.Code, w.Header().Get("Allow"))
+	}
+
+	srv.DisableAutoHead = true
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/report", nil))
+
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Fatalf("expecting 405 with Allow GET, got %d %q", w.Code, w.Header().Get("Allow"))
 	}
 }
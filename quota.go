@@ -0,0 +1,279 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaLimit is the maximum usage of an API key in a period of time. Zero
+// values mean unlimited.
+type QuotaLimit struct {
+	// Requests is the maximum number of requests.
+	Requests int64
+	// Bytes is the maximum number of bytes sent in the response bodies.
+	Bytes int64
+}
+
+// QuotaUsage is the usage of an API key in a period of time.
+type QuotaUsage struct {
+	Requests int64
+	Bytes    int64
+}
+
+// QuotaStore stores the usage of the API keys. The window identifies the
+// period of time, e.g. "day:2006-01-02" or "month:2006-01", so the store can
+// discard the usage of previous windows. Implementations must be safe for
+// concurrent use. Use a shared store, like a database, when the web server
+// runs in more than one machine.
+type QuotaStore interface {
+	// Add increments the usage of the key in the window, which can also be
+	// decremented with negative values, and returns the usage after the
+	// change. The operation must be atomic, like "UPDATE ... RETURNING" in
+	// SQL or INCRBY in Redis, so concurrent requests cannot exceed the quota.
+	Add(key string, window string, requests int64, bytes int64) (QuotaUsage, error)
+}
+
+// QuotaPolicy configures the quotas enforced by the Quota middleware.
+type QuotaPolicy struct {
+	// Key returns the API key of the request. Requests with an empty key are
+	// not subject to the quotas, so combine the middleware with one that
+	// rejects unauthenticated requests.
+	Key func(*http.Request) string
+	// Daily is the quota of each API key per calendar day, in UTC.
+	Daily QuotaLimit
+	// Monthly is the quota of each API key per calendar month, in UTC.
+	Monthly QuotaLimit
+	// Store keeps the usage of the API keys. Default: NewMemoryQuotaStore().
+	Store QuotaStore
+	// Now returns the current time. Default: time.Now.
+	Now func() time.Time
+}
+
+// quotaWindow is a period of time with its own quota.
+type quotaWindow struct {
+	id    string
+	limit QuotaLimit
+	reset time.Time
+}
+
+// Quota returns a middleware that enforces daily and monthly quotas of
+// requests and response bytes per API key. Every response includes the
+// "X-Quota-Remaining" header with the number of requests left in the most
+// restrictive window, and "X-Quota-Remaining-Bytes" if there is a byte quota.
+// Requests from a key that exhausted one of its quotas receive a "429 Too Many
+// Requests" response with a "Retry-After" header pointing to the end of the
+// window, and do not count towards the quotas.
+//
+// The response bytes are only known after the handler finishes, so the last
+// request before the byte quota is exhausted can exceed it.
+//
+// If the store returns an error, the request is allowed, because an outage of
+// the store should not become an outage of the API.
+//
+// Example:
+//
+//	srv.Use(middleware.Quota(middleware.QuotaPolicy{
+//	    Key:     func(r *http.Request) string { return r.Header.Get("X-API-Key") },
+//	    Daily:   middleware.QuotaLimit{Requests: 10000},
+//	    Monthly: middleware.QuotaLimit{Bytes: 10 << 30},
+//	}))
+func Quota(policy QuotaPolicy) func(http.Handler) http.Handler {
+	if policy.Key == nil {
+		panic("middleware: quota without key function")
+	}
+
+	if policy.Store == nil {
+		policy.Store = NewMemoryQuotaStore()
+	}
+
+	if policy.Now == nil {
+		policy.Now = time.Now
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := policy.Key(r)
+
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			windows := policy.windows(policy.Now().UTC())
+			remaining, remainingBytes := int64(-1), int64(-1)
+
+			var counted []quotaWindow
+			var denied *quotaWindow
+
+			// count the request first, so the decision is based on the usage
+			// returned by the atomic increment, even with concurrent requests.
+			for i, window := range windows {
+				usage, err := policy.Store.Add(key, window.id, 1, 0)
+
+				if err != nil {
+					continue
+				}
+
+				counted = append(counted, window)
+
+				if exceeded(usage.Requests-1, window.limit.Requests) || exceeded(usage.Bytes, window.limit.Bytes) {
+					if denied == nil {
+						denied = &windows[i]
+					}
+					continue
+				}
+
+				if window.limit.Requests > 0 {
+					remaining = minRemaining(remaining, window.limit.Requests-usage.Requests)
+				}
+
+				if window.limit.Bytes > 0 {
+					remainingBytes = minRemaining(remainingBytes, window.limit.Bytes-usage.Bytes)
+				}
+			}
+
+			if denied != nil {
+				for _, window := range counted {
+					_, _ = policy.Store.Add(key, window.id, -1, 0)
+				}
+
+				retry := int64(denied.reset.Sub(policy.Now()).Seconds()) + 1
+				w.Header().Set("X-Quota-Remaining", "0")
+				w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+
+			if remaining >= 0 {
+				w.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+			}
+
+			if remainingBytes >= 0 {
+				w.Header().Set("X-Quota-Remaining-Bytes", strconv.FormatInt(remainingBytes, 10))
+			}
+
+			next.ServeHTTP(w, r)
+
+			var sent int64
+
+			if rw := findResponse(w); rw != nil {
+				sent = int64(rw.length)
+			}
+
+			if sent > 0 {
+				for _, window := range windows {
+					if window.limit.Bytes > 0 {
+						_, _ = policy.Store.Add(key, window.id, 0, sent)
+					}
+				}
+			}
+		})
+	}
+}
+
+// windows returns the quota windows that contain the current time.
+func (p QuotaPolicy) windows(now time.Time) []quotaWindow {
+	var out []quotaWindow
+
+	if p.Daily != (QuotaLimit{}) {
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		out = append(out, quotaWindow{id: "day:" + day.Format("2006-01-02"), limit: p.Daily, reset: day.AddDate(0, 0, 1)})
+	}
+
+	if p.Monthly != (QuotaLimit{}) {
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		out = append(out, quotaWindow{id: "month:" + month.Format("2006-01"), limit: p.Monthly, reset: month.AddDate(0, 1, 0)})
+	}
+
+	return out
+}
+
+// exceeded reports whether the usage reached the limit, if any.
+func exceeded(usage int64, limit int64) bool {
+	return limit > 0 && usage >= limit
+}
+
+// minRemaining returns the smallest of two remaining values, where -1 means
+// that there is no value yet.
+func minRemaining(current int64, value int64) int64 {
+	if value < 0 {
+		value = 0
+	}
+
+	if current < 0 || value < current {
+		return value
+	}
+
+	return current
+}
+
+// MemoryQuotaStore is a QuotaStore that keeps the usage in memory, which is
+// lost when the program stops. Only the current window of each kind is kept
+// for every key.
+type MemoryQuotaStore struct {
+	mu    sync.Mutex
+	usage map[string]map[string]*QuotaUsage
+}
+
+// NewMemoryQuotaStore returns a new in-memory quota store.
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{usage: map[string]map[string]*QuotaUsage{}}
+}
+
+// Usage returns the usage of the key in the window.
+func (s *MemoryQuotaStore) Usage(key string, window string) (QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if usage, ok := s.usage[key][window]; ok {
+		return *usage, nil
+	}
+
+	return QuotaUsage{}, nil
+}
+
+// Add implements the Add method for the QuotaStore interface.
+func (s *MemoryQuotaStore) Add(key string, window string, requests int64, bytes int64) (QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	windows, ok := s.usage[key]
+
+	if !ok {
+		windows = map[string]*QuotaUsage{}
+		s.usage[key] = windows
+	}
+
+	usage, ok := windows[window]
+
+	if !ok {
+		// discard the previous window of the same kind, e.g. yesterday.
+		kind := windowKind(window)
+
+		for id := range windows {
+			if windowKind(id) == kind {
+				delete(windows, id)
+			}
+		}
+
+		usage = &QuotaUsage{}
+		windows[window] = usage
+	}
+
+	usage.Requests += requests
+	usage.Bytes += bytes
+
+	return *usage, nil
+}
+
+// windowKind returns the kind of a window, which is the text before the colon.
+func windowKind(window string) string {
+	if i := strings.IndexByte(window, ':'); i >= 0 {
+		return window[:i]
+	}
+
+	return window
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitKey is the key for the state of the rate limiter in the request
+// Context.
+var rateLimitKey = contextKey("MiddlewareRateLimit")
+
+// RateLimitPolicy configures the limits enforced by the RateLimit middleware.
+type RateLimitPolicy struct {
+	// Limit is the maximum number of requests per client in each window.
+	Limit int
+	// Window is the duration of each window, e.g. time.Minute, and must be at
+	// least one second, because the "RateLimit-Policy" header has seconds.
+	Window time.Duration
+	// Key returns the identifier of the client. Requests with an empty key
+	// are not limited. Default: ClientIP.
+	Key func(*http.Request) string
+	// Now returns the current time. Default: time.Now.
+	Now func() time.Time
+}
+
+// RateLimitInfo is the state of the rate limiter for the client of a request,
+// after counting the request.
+type RateLimitInfo struct {
+	// Limit is the maximum number of requests in the window.
+	Limit int
+	// Remaining is the number of requests left in the window.
+	Remaining int
+	// Reset is the time when the window ends and the counter starts over.
+	Reset time.Time
+}
+
+// RateLimit returns a middleware that limits the number of requests of each
+// client in fixed windows of time. Every response includes the headers of the
+// IETF draft "RateLimit header fields for HTTP": "RateLimit-Limit",
+// "RateLimit-Remaining", "RateLimit-Reset", with the seconds until the end of
+// the window, and "RateLimit-Policy", so the clients can slow down before they
+// reach the limit. Requests over the limit receive a "429 Too Many Requests"
+// response with a "Retry-After" header.
+//
+// The handlers read the state of the limiter with RateLimitState, for example,
+// to skip expensive optional work for clients close to the limit. The counters
+// are kept in memory, so each instance of the web server has its own limits.
+//
+// Example:
+//
+//	srv.POST("/login", login).Use(middleware.RateLimit(middleware.RateLimitPolicy{
+//	    Limit:  5,
+//	    Window: time.Minute,
+//	}))
+func RateLimit(policy RateLimitPolicy) func(http.Handler) http.Handler {
+	if policy.Limit <= 0 || policy.Window < time.Second {
+		panic("middleware: invalid rate limit " + strconv.Itoa(policy.Limit) + " per " + policy.Window.String())
+	}
+
+	if policy.Key == nil {
+		policy.Key = ClientIP
+	}
+
+	if policy.Now == nil {
+		policy.Now = time.Now
+	}
+
+	limiter := &rateLimiter{policy: policy, windows: map[string]*rateWindow{}}
+	// windows with a fraction of a second are rounded up, e.g. 1.5s is "w=2".
+	seconds := (policy.Window + time.Second - 1) / time.Second
+	rules := strconv.Itoa(policy.Limit) + ";w=" + strconv.FormatInt(int64(seconds), 10)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := policy.Key(r)
+
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			now := policy.Now()
+			info, allowed := limiter.take(key, now)
+			reset := int64(info.Reset.Sub(now)+time.Second-1) / int64(time.Second)
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(info.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(info.Remaining))
+			h.Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+			h.Set("RateLimit-Policy", rules)
+
+			if !allowed {
+				h.Set("Retry-After", strconv.FormatInt(reset, 10))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateLimitKey, info)))
+		})
+	}
+}
+
+// RateLimitState returns the state of the rate limiter for the client of the
+// request, and false if the request did not pass through RateLimit. If there
+// is more than one rate limiter, the state is the one of the innermost.
+func RateLimitState(r *http.Request) (RateLimitInfo, bool) {
+	info, ok := r.Context().Value(rateLimitKey).(RateLimitInfo)
+	return info, ok
+}
+
+// rateLimiter counts the requests of each client in the current window.
+type rateLimiter struct {
+	policy  RateLimitPolicy
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+	sweep   int
+}
+
+// rateWindow is the number of requests of a client in a window.
+type rateWindow struct {
+	reset time.Time
+	count int
+}
+
+// take counts a request of the client, and reports whether it is allowed.
+func (l *rateLimiter) take(key string, now time.Time) (RateLimitInfo, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	win, ok := l.windows[key]
+
+	if !ok || !now.Before(win.reset) {
+		if !ok && len(l.windows) >= l.sweep {
+			l.removeExpired(now)
+		}
+
+		win = &rateWindow{reset: now.Add(l.policy.Window)}
+		l.windows[key] = win
+	}
+
+	info := RateLimitInfo{Limit: l.policy.Limit, Reset: win.reset}
+
+	if win.count >= l.policy.Limit {
+		return info, false
+	}
+
+	win.count++
+	info.Remaining = l.policy.Limit - win.count
+
+	return info, true
+}
+
+// removeExpired deletes the windows that already ended, which keeps the memory
+// proportional to the number of active clients. The next sweep happens when
+// the number of clients doubles, so the cost is amortized across requests.
+func (l *rateLimiter) removeExpired(now time.Time) {
+	for key, win := range l.windows {
+		if !now.Before(win.reset) {
+			delete(l.windows, key)
+		}
+	}
+
+	l.sweep = 2*len(l.windows) + 64
+}
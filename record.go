@@ -0,0 +1,291 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redactedHeaders are the headers that Record never writes, because they
+// contain credentials.
+var redactedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie"}
+
+// RecordedRequest is a request captured by Record, with its response.
+type RecordedRequest struct {
+	Time     time.Time        `json:"time"`
+	Method   string           `json:"method"`
+	Host     string           `json:"host"`
+	URL      string           `json:"url"`
+	Header   http.Header      `json:"header"`
+	Body     []byte           `json:"body,omitempty"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedResponse is the response of a request captured by Record.
+type RecordedResponse struct {
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// ReplayResult is the result of a request sent by Replay.
+type ReplayResult struct {
+	// Recorded is the original request and response.
+	Recorded RecordedRequest
+	// Status is the status code of the new response, or zero on error.
+	Status int
+	// Body is the body of the new response.
+	Body []byte
+	// Err is the error sending the request, if any.
+	Err error
+}
+
+// Matches reports whether the new response has the same status code and body
+// as the recorded one.
+func (r ReplayResult) Matches() bool {
+	return r.Err == nil && r.Status == r.Recorded.Response.Status &&
+		(r.Recorded.Response.Truncated || bytes.Equal(r.Body, r.Recorded.Response.Body))
+}
+
+// Record returns a middleware that writes a percentage of the requests, from 0
+// to 100, and their responses into w, one JSON document per line, which can be
+// sent again to a web server with Replay. This is useful to debug problems
+// that are hard to reproduce outside of production.
+//
+// Requests with a body larger than maxBodySize are not recorded, and response
+// bodies are truncated to maxBodySize. If maxBodySize is zero or negative, the
+// limit is 64 KiB. The Authorization, Cookie, Proxy-Authorization and
+// Set-Cookie headers are never recorded, but the bodies may still contain
+// personal data, so protect the file accordingly.
+//
+// Example:
+//
+//	f, _ := os.OpenFile("requests.jsonl", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+//	srv.Use(middleware.Record(f, 1, 0))
+func Record(w io.Writer, percent float64, maxBodySize int64) func(http.Handler) http.Handler {
+	if maxBodySize <= 0 {
+		maxBodySize = 64 << 10
+	}
+
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if percent <= 0 || rand.Float64()*100 >= percent {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			var body []byte
+
+			if r.Body != nil {
+				data, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+				r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+
+				if err != nil || int64(len(data)) > maxBodySize {
+					next.ServeHTTP(rw, r)
+					return
+				}
+
+				body = data
+			}
+
+			entry := RecordedRequest{
+				Time:   time.Now().UTC(),
+				Method: r.Method,
+				Host:   r.Host,
+				URL:    r.URL.RequestURI(),
+				Header: redactHeader(r.Header),
+				Body:   body,
+			}
+
+			tee := &teeResponse{ResponseWriter: rw, limit: maxBodySize}
+
+			next.ServeHTTP(tee, r)
+
+			entry.Response = RecordedResponse{
+				Status:    tee.status,
+				Header:    redactHeader(rw.Header()),
+				Body:      tee.body.Bytes(),
+				Truncated: tee.truncated,
+			}
+
+			if entry.Response.Status == 0 {
+				entry.Response.Status = http.StatusOK
+			}
+
+			mu.Lock()
+			_ = enc.Encode(entry)
+			mu.Unlock()
+		})
+	}
+}
+
+// redactHeader returns a copy of the headers without the credentials.
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+
+	for _, key := range redactedHeaders {
+		out.Del(key)
+	}
+
+	return out
+}
+
+// teeResponse copies the response status and body for Record.
+type teeResponse struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+// WriteHeader implements the WriteHeader method for the http.ResponseWriter interface.
+func (t *teeResponse) WriteHeader(code int) {
+	if t.status == 0 {
+		t.status = code
+	}
+
+	t.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the Write method for the http.ResponseWriter interface.
+func (t *teeResponse) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+
+	if room := t.limit - int64(t.body.Len()); room > 0 {
+		if int64(len(b)) > room {
+			t.body.Write(b[:room])
+			t.truncated = true
+		} else {
+			t.body.Write(b)
+		}
+	} else if len(b) > 0 {
+		t.truncated = true
+	}
+
+	return t.ResponseWriter.Write(b)
+}
+
+// Flush sends the buffered data to the client.
+func (t *teeResponse) Flush() {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection, without recording.
+func (t *teeResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := t.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	return h.Hijack()
+}
+
+// Unwrap returns the original http.ResponseWriter.
+func (t *teeResponse) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Replay sends the requests recorded by Record in the file to the web server
+// at the target base URL, e.g. "http://localhost:8080", one at a time and in
+// the same order, keeping the original method, path, query, Host header,
+// headers and body. The function returns the new responses, so they can be
+// compared with the recorded ones using ReplayResult.Matches, or an error if
+// the file cannot be read.
+//
+// Example:
+//
+//	results, err := middleware.Replay("requests.jsonl", "http://localhost:8080")
+//	for _, result := range results {
+//	    if !result.Matches() {
+//	        fmt.Println("different response for", result.Recorded.URL)
+//	    }
+//	}
+func Replay(filename string, target string) ([]ReplayResult, error) {
+	f, err := os.Open(filename)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	target = strings.TrimRight(target, "/")
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var out []ReplayResult
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+
+	for scanner.Scan() {
+		var recorded RecordedRequest
+
+		if err := json.Unmarshal(scanner.Bytes(), &recorded); err != nil {
+			return out, err
+		}
+
+		out = append(out, replay(client, target, recorded))
+	}
+
+	return out, scanner.Err()
+}
+
+// replay sends one recorded request to the target.
+func replay(client *http.Client, target string, recorded RecordedRequest) ReplayResult {
+	result := ReplayResult{Recorded: recorded}
+
+	req, err := http.NewRequest(recorded.Method, target+recorded.URL, bytes.NewReader(recorded.Body))
+
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	req.Header = recorded.Header.Clone()
+	req.Host = recorded.Host
+
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	defer res.Body.Close()
+
+	result.Status = res.StatusCode
+	result.Body, result.Err = io.ReadAll(res.Body)
+
+	return result
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// PanicKind classifies the value passed to panic by a handler.
+type PanicKind string
+
+const (
+	// PanicError is a panic with an error value.
+	PanicError PanicKind = "error"
+	// PanicString is a panic with a string value.
+	PanicString PanicKind = "string"
+	// PanicAbort is a panic with http.ErrAbortHandler, which handlers use to
+	// abort the response on purpose, for example, when a reverse proxy loses
+	// the connection with the backend.
+	PanicAbort PanicKind = "abort"
+	// PanicOther is a panic with any other value.
+	PanicOther PanicKind = "other"
+)
+
+// PanicEvent describes a panic recovered by the router. See Recover.
+type PanicEvent struct {
+	Time      time.Time
+	Kind      PanicKind
+	Value     interface{}
+	Err       error
+	Message   string
+	Stack     []byte
+	Method    string
+	Host      string
+	Path      string
+	Pattern   string
+	Route     *Route
+	RequestID string
+}
+
+// Recover enables the recovery of the panics raised by the middlewares and the
+// handlers of the routes. The router responds with "500 Internal Server Error",
+// unless the handler already wrote the response headers, and passes the panic
+// to the report function, with the matched route and the request ID, so it can
+// be sent to an error tracking service. If the report function is nil, the
+// panic and the stack trace are written into Middleware.ErrorLog.
+//
+// Panics with http.ErrAbortHandler are reported, but not recovered, so the Go
+// HTTP server aborts the response, as expected by the handler.
+//
+// Example:
+//
+//	srv.Recover(func(event middleware.PanicEvent) {
+//	    sentry.CaptureException(event.Err)
+//	})
+func (m *Middleware) Recover(report func(PanicEvent)) {
+	if report == nil {
+		report = func(event PanicEvent) {
+			m.logf(logPrefix(event.RequestID, event.Pattern)+"panic: %s %s%s: %s\n%s", event.Method, event.Host, event.Path, event.Message, event.Stack)
+		}
+	}
+
+	m.panicReport = report
+}
+
+// recoverPanic recovers from a panic in the handler and reports it.
+func (m *Middleware) recoverPanic(w *response, r *http.Request) {
+	value := recover()
+
+	if value == nil {
+		return
+	}
+
+	event := PanicEvent{
+		Time:      m.now(),
+		Value:     value,
+		Stack:     debug.Stack(),
+		Method:    r.Method,
+		Host:      r.Host,
+		Path:      r.URL.Path,
+		Route:     w.route,
+		RequestID: w.ensureRequestID(r),
+	}
+
+	if w.route != nil {
+		event.Pattern = w.route.pattern
+	}
+
+	switch v := value.(type) {
+	case error:
+		event.Kind = PanicError
+		event.Err = v
+
+		if errors.Is(v, http.ErrAbortHandler) {
+			event.Kind = PanicAbort
+		}
+	case string:
+		event.Kind = PanicString
+		event.Err = errors.New(v)
+	default:
+		event.Kind = PanicOther
+		event.Err = fmt.Errorf("%v", v)
+	}
+
+	event.Message = event.Err.Error()
+
+	m.panicReport(event)
+
+	if event.Kind == PanicAbort {
+		panic(value)
+	}
+
+	if !w.Written() {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RequestBuilder builds HTTP requests for tests, configured the same way the
+// web server configures the requests it passes to the router. Use NewRequest
+// to create one.
+type RequestBuilder struct {
+	method     string
+	target     string
+	host       string
+	header     http.Header
+	query      url.Values
+	body       io.Reader
+	params     map[string]string
+	remoteAddr string
+	ctx        context.Context
+}
+
+// NewRequest returns a builder for an HTTP request with the method and target,
+// which is either a path, like "/users?page=2", or an absolute URL.
+//
+// Example:
+//
+//	r := middleware.NewRequest("POST", "/users").
+//	    Host("api.example.com").
+//	    Header("Authorization", "Bearer token").
+//	    JSON(map[string]string{"name": "alice"}).
+//	    Build()
+//	srv.ServeHTTP(w, r)
+func NewRequest(method string, target string) *RequestBuilder {
+	return &RequestBuilder{
+		method: method,
+		target: target,
+		header: http.Header{},
+		query:  url.Values{},
+	}
+}
+
+// Host sets the value of the Host header, which selects the router of the host.
+func (b *RequestBuilder) Host(host string) *RequestBuilder {
+	b.host = host
+	return b
+}
+
+// Header adds a value to a request header.
+func (b *RequestBuilder) Header(key string, value string) *RequestBuilder {
+	b.header.Add(key, value)
+	return b
+}
+
+// Query adds a value to a query string parameter.
+func (b *RequestBuilder) Query(key string, value string) *RequestBuilder {
+	b.query.Add(key, value)
+	return b
+}
+
+// Body sets the request body.
+func (b *RequestBuilder) Body(body io.Reader) *RequestBuilder {
+	b.body = body
+	return b
+}
+
+// Text sets the request body to the string, as plain text.
+func (b *RequestBuilder) Text(body string) *RequestBuilder {
+	b.header.Set("Content-Type", "text/plain; charset=utf-8")
+	b.body = strings.NewReader(body)
+	return b
+}
+
+// JSON sets the request body to the JSON encoding of v. The function panics if
+// v cannot be encoded, because it is a programming error in the test.
+func (b *RequestBuilder) JSON(v interface{}) *RequestBuilder {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		panic("middleware: invalid JSON request body: " + err.Error())
+	}
+
+	b.header.Set("Content-Type", "application/json")
+	b.body = bytes.NewReader(data)
+	return b
+}
+
+// Form sets the request body to the URL encoding of the values, as a form.
+func (b *RequestBuilder) Form(values url.Values) *RequestBuilder {
+	b.header.Set("Content-Type", "application/x-www-form-urlencoded")
+	b.body = strings.NewReader(values.Encode())
+	return b
+}
+
+// Param sets the value of a named parameter, which allows tests to call route
+// handlers directly, without the router, and still use middleware.Param.
+func (b *RequestBuilder) Param(key string, value string) *RequestBuilder {
+	if b.params == nil {
+		b.params = map[string]string{}
+	}
+
+	b.params[key] = value
+	return b
+}
+
+// RemoteAddr sets the network address of the client, e.g. "192.0.2.1:1234".
+func (b *RequestBuilder) RemoteAddr(addr string) *RequestBuilder {
+	b.remoteAddr = addr
+	return b
+}
+
+// Context sets the context of the request.
+func (b *RequestBuilder) Context(ctx context.Context) *RequestBuilder {
+	b.ctx = ctx
+	return b
+}
+
+// Build returns the request. Like the requests received by the web server, the
+// request has a RequestURI and a RemoteAddr, and the Host is "example.com" by
+// default. The function panics if the target is invalid.
+func (b *RequestBuilder) Build() *http.Request {
+	r, err := http.NewRequest(b.method, b.target, b.body)
+
+	if err != nil {
+		panic("middleware: invalid request: " + err.Error())
+	}
+
+	r.RequestURI = r.URL.RequestURI()
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	if r.Host == "" {
+		r.Host = "example.com"
+	}
+
+	for key, values := range b.header {
+		r.Header[key] = append([]string(nil), values...)
+	}
+
+	if len(b.query) > 0 {
+		q := r.URL.Query()
+
+		for key, values := range b.query {
+			q[key] = append(q[key], values...)
+		}
+
+		r.URL.RawQuery = q.Encode()
+		r.RequestURI = r.URL.RequestURI()
+	}
+
+	if b.host != "" {
+		r.Host = b.host
+	}
+
+	if b.remoteAddr != "" {
+		r.RemoteAddr = b.remoteAddr
+	}
+
+	if b.ctx != nil {
+		r = r.WithContext(b.ctx)
+	}
+
+	if b.params != nil {
+		r = r.WithContext(context.WithValue(r.Context(), paramsKey, b.params))
+	}
+
+	return r
+}
@@ -1,9 +1,40 @@
 package middleware
 
 import (
+	"bufio"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+// ResponseWriter is the interface implemented by the http.ResponseWriter that
+// the router passes to every middleware and HTTP handler. Use it to read the
+// status code and the size of the response written by the next handler in the
+// chain, which is otherwise impossible without a custom wrapper.
+//
+// Example:
+//
+//	func foobar(next http.Handler) http.Handler {
+//	    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//	        next.ServeHTTP(w, r)
+//	        if rw, ok := w.(middleware.ResponseWriter); ok && rw.Status() >= 500 {
+//	            […]
+//	        }
+//	    })
+//	}
+type ResponseWriter interface {
+	http.ResponseWriter
+	// Status returns the HTTP status code of the response, or zero if the
+	// handler has not written the response headers yet.
+	Status() int
+	// BytesWritten returns the number of bytes written in the response body.
+	BytesWritten() int
+	// Written reports whether the response headers were already written.
+	Written() bool
+}
+
 // response is an interface used by an HTTP handler to construct an HTTP
 // response. ResponseWriter may not be used after the Handler.ServeHTTP method
 // has returned. Here it’s being used to include additional data for the logger
@@ -11,8 +42,215 @@ import (
 // bytes of the response.
 type response struct {
 	http.ResponseWriter
-	Status int
-	Length int
+	status int
+	length int
+	hooks  []func(int, http.Header)
+
+	timings []Timing
+
+	variant string
+
+	noLog bool
+
+	shed bool
+
+	head       bool
+	suppressed int
+	discard    bool
+
+	request    *http.Request
+	errorPages map[int]http.Handler
+	replaced   bool
+
+	route *Route
+
+	compressed   bool
+	uncompressed int
+
+	maxBytes int
+	tooLarge bool
+	aborted  bool
+
+	requestID string
+
+	verbose bool
+	params  map[string]string
+	notes   []string
+
+	handlerRequest *http.Request
+}
+
+// OnBeforeWriteHeader registers a function that runs right before the router
+// writes the response headers, which happens either when the handler calls
+// WriteHeader or the first time it writes data into the response body. This
+// allows middlewares to inject headers, like cookies or timing information,
+// that depend on work done by the handler after the middleware called next.
+//
+// The functions run once, in the same order they were registered, and receive
+// the HTTP status code and the response headers, which are still modifiable.
+// The function returns false if the http.ResponseWriter is not, and does not
+// wrap, the writer created by the router, in which case fn is never executed.
+//
+// Example:
+//
+//	func timing(next http.Handler) http.Handler {
+//	    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//	        start := time.Now()
+//	        middleware.OnBeforeWriteHeader(w, func(status int, h http.Header) {
+//	            h.Set("X-Response-Time", time.Since(start).String())
+//	        })
+//	        next.ServeHTTP(w, r)
+//	    })
+//	}
+func OnBeforeWriteHeader(w http.ResponseWriter, fn func(status int, h http.Header)) bool {
+	rw := findResponse(w)
+
+	if rw == nil {
+		return false
+	}
+
+	rw.hooks = append(rw.hooks, fn)
+
+	return true
+}
+
+// findResponse returns the writer created by the router, following the chain
+// of writers that implement the Unwrap method, or nil if there is none.
+func findResponse(w http.ResponseWriter) *response {
+	for {
+		if rw, ok := w.(*response); ok {
+			return rw
+		}
+
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+
+		if !ok {
+			return nil
+		}
+
+		w = u.Unwrap()
+	}
+}
+
+// Unwrap returns the original http.ResponseWriter, which allows the use of
+// http.ResponseController to access features not exposed by the wrapper.
+func (w *response) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// beforeWriteHeader executes the functions registered with OnBeforeWriteHeader.
+func (w *response) beforeWriteHeader(status int) {
+	hooks := w.hooks
+	w.hooks = nil
+
+	for _, fn := range hooks {
+		fn(status, w.Header())
+	}
+}
+
+// Status implements the Status method for the ResponseWriter interface.
+func (w *response) Status() int {
+	return w.status
+}
+
+// BytesWritten implements the BytesWritten method for the ResponseWriter interface.
+func (w *response) BytesWritten() int {
+	return w.length
+}
+
+// trailer returns the HTTP trailers set by the handler, if any.
+//
+// Handlers can declare trailers in two different ways, both of which work
+// through the wrapper because it shares the header map with the underlying
+// writer. The first one is to list the trailer keys in the "Trailer" header
+// before writing the response, then set their values after writing the body.
+// The second one is to set the trailers, at any time, using a header key with
+// the http.TrailerPrefix.
+func (w *response) trailer() http.Header {
+	var out http.Header
+
+	h := w.Header()
+
+	for _, declared := range h.Values("Trailer") {
+		for _, key := range strings.Split(declared, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+
+			if values, ok := h[key]; ok {
+				if out == nil {
+					out = http.Header{}
+				}
+				out[key] = append([]string(nil), values...)
+			}
+		}
+	}
+
+	for key, values := range h {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			if out == nil {
+				out = http.Header{}
+			}
+			out[http.CanonicalHeaderKey(key[len(http.TrailerPrefix):])] = append([]string(nil), values...)
+		}
+	}
+
+	return out
+}
+
+// bodyless reports whether the response body is suppressed, which is the case
+// for HEAD requests and for "204 No Content" and "304 Not Modified" responses.
+func (w *response) bodyless() bool {
+	return w.head || w.status == http.StatusNoContent || w.status == http.StatusNotModified
+}
+
+// count records the number of bytes written by the handler, either as sent or
+// as suppressed when the response is not allowed to have a body.
+func (w *response) count(n int) {
+	if w.bodyless() {
+		w.suppressed += n
+		return
+	}
+
+	w.length += n
+}
+
+// contentLength returns the size of the body that the response declared with
+// the Content-Length header or, if missing, the number of bytes written by the
+// handler, including those suppressed because the response has no body.
+func (w *response) contentLength() int64 {
+	if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil && n >= 0 {
+		return n
+	}
+
+	return int64(w.length + w.suppressed)
+}
+
+// bytesUncompressed returns the size of the response body before compression,
+// which is the number of bytes sent when the response is not compressed.
+func (w *response) bytesUncompressed() int {
+	if w.compressed {
+		return w.uncompressed
+	}
+
+	return w.length
+}
+
+// ensureRequestID returns the ID of the request, either the one sent by the
+// client, or a new one, which is kept for the access log.
+func (w *response) ensureRequestID(r *http.Request) string {
+	if w.requestID == "" {
+		w.requestID = RequestID(r)
+	}
+
+	if w.requestID == "" {
+		w.requestID = newRequestID()
+	}
+
+	return w.requestID
+}
+
+// Written implements the Written method for the ResponseWriter interface.
+func (w *response) Written() bool {
+	return w.status != 0
 }
 
 // WriteHeader sends an HTTP response header with status code.
@@ -21,10 +259,44 @@ type response struct {
 // trigger an implicit WriteHeader(http.StatusOK). Thus explicit calls to
 // WriteHeader are mainly used to send error codes.
 func (w *response) WriteHeader(status int) {
-	w.Status = status
+	if isInformational(status) {
+		// Informational responses, like "103 Early Hints", are sent before the
+		// final response, so they are not recorded as the final status code.
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if w.replaced {
+		return
+	}
+
+	if w.status == 0 && w.maxBytes > 0 && w.declaresTooLarge() {
+		w.rejectTooLarge()
+		return
+	}
+
+	if w.status == 0 && w.errorPages != nil && isErrorText(w.Header()) {
+		if page, ok := w.errorPages[status]; ok {
+			w.serveErrorPage(page, status)
+			return
+		}
+	}
+
+	if w.status == 0 {
+		w.beforeWriteHeader(status)
+	}
+
+	w.status = status
 	w.ResponseWriter.WriteHeader(status)
 }
 
+// isInformational reports whether the status code belongs to an informational
+// response (1xx) that precedes the final response. "101 Switching Protocols"
+// is excluded because no other response follows it on the same connection.
+func isInformational(status int) bool {
+	return status >= 100 && status < 200 && status != http.StatusSwitchingProtocols
+}
+
 // Write writes the data to the connection as part of an HTTP reply.
 //
 // If WriteHeader hasn’t been called, Write calls WriteHeader(http.StatusOK)
@@ -42,11 +314,127 @@ func (w *response) WriteHeader(status int) {
 // response. However, such behavior may not be supported by all HTTP/2 clients.
 // Handlers should read before writing if possible to maximize compatibility.
 func (w *response) Write(b []byte) (int, error) {
-	if w.Status == 0 {
-		w.Status = http.StatusOK
+	if w.replaced {
+		// discard the error message replaced by the error page.
+		return len(b), nil
+	}
+
+	if w.maxBytes > 0 && w.length+len(b) > w.maxBytes {
+		return 0, w.exceedLimit()
+	}
+
+	if w.status == 0 {
+		w.beforeWriteHeader(http.StatusOK)
+		w.status = http.StatusOK
+	}
+
+	if w.discard {
+		// HEAD request served by a GET handler, never send the body.
+		w.count(len(b))
+		return len(b), nil
 	}
 
-	w.Length = len(b)
+	n, err := w.ResponseWriter.Write(b)
+
+	w.count(n)
+
+	return n, err
+}
+
+// ReadFrom reads data from src until EOF or error and writes it to the
+// connection as part of an HTTP reply.
+//
+// The standard library uses io.ReaderFrom to detect when a response can be
+// copied using the sendfile(2) system call, which is what http.ServeContent
+// and http.FileServer rely on to serve static files without copying the data
+// into user space. Wrapping the original writer hides the interface, so the
+// method delegates to the underlying writer when possible, otherwise, it falls
+// back to a regular copy. Either way, the number of bytes is counted.
+func (w *response) ReadFrom(src io.Reader) (int64, error) {
+	if w.replaced {
+		return io.Copy(io.Discard, src)
+	}
+
+	if w.maxBytes > 0 || w.discard {
+		// copy the data with Write to enforce the size limit or to discard it.
+		return io.Copy(writerOnly{w}, src)
+	}
+
+	if w.status == 0 {
+		w.beforeWriteHeader(http.StatusOK)
+		w.status = http.StatusOK
+	}
+
+	var n int64
+	var err error
+
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(writerOnly{w.ResponseWriter}, src)
+	}
+
+	w.count(int(n))
+
+	return n, err
+}
+
+// writerOnly hides any optional interfaces implemented by the io.Writer, like
+// io.ReaderFrom, to prevent io.Copy from calling them recursively.
+type writerOnly struct {
+	io.Writer
+}
+
+// Flush sends any buffered data to the client.
+//
+// The method delegates to the underlying http.ResponseWriter if it implements
+// the http.Flusher interface, which is the case for the default HTTP/1.x and
+// HTTP/2 writers. This allows handlers to implement Server-Sent Events (SSE),
+// long-polling, and streamed downloads. Flushing without writing a status code
+// sends "200 OK" to the client, so the same status is recorded in the logs.
+//
+// Keep in mind that Middleware.WriteTimeout limits the duration of the entire
+// response, not the time between flushes, so the server will close streamed
+// responses that take longer than the timeout. Set WriteTimeout to zero when
+// the server is expected to keep connections open for an extended period.
+func (w *response) Flush() {
+	f, ok := w.ResponseWriter.(http.Flusher)
+
+	if !ok {
+		return
+	}
+
+	if w.status == 0 {
+		w.beforeWriteHeader(http.StatusOK)
+		w.status = http.StatusOK
+	}
+
+	f.Flush()
+}
+
+// Hijack lets the caller take over the connection.
+//
+// The method delegates to the underlying http.ResponseWriter if it implements
+// the http.Hijacker interface, which allows WebSocket libraries and other raw
+// TCP protocol upgrades to work through the router. HTTP/2 connections do not
+// support hijacking, in which case the method returns http.ErrNotSupported.
+//
+// After a call to Hijack, the HTTP server library will not do anything else
+// with the connection, so the caller is responsible for managing and closing
+// it. The status code is recorded as "101 Switching Protocols", unless the
+// handler already wrote a different one, because the response is no longer
+// visible to the logger.
+func (w *response) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	if w.status == 0 {
+		w.hooks = nil
+		w.status = http.StatusSwitchingProtocols
+	}
 
-	return w.ResponseWriter.Write(b)
+	return h.Hijack()
 }
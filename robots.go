@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RobotsRule is a group of directives in the robots.txt file, as defined in
+// RFC 9309, that apply to one or more web crawlers.
+type RobotsRule struct {
+	// UserAgent is the list of crawlers, "*" matches all of them.
+	UserAgent []string
+	// Allow is the list of URL paths the crawlers are allowed to access.
+	Allow []string
+	// Disallow is the list of URL paths the crawlers are not allowed to access.
+	Disallow []string
+}
+
+// URLEntry is a URL in the sitemap.xml file, as defined by sitemaps.org.
+type URLEntry struct {
+	// Loc is the URL of the page, either absolute or relative to the host.
+	Loc string
+	// LastMod is the date of the last modification of the page, if known.
+	LastMod time.Time
+	// ChangeFreq is how frequently the page is likely to change, for example,
+	// "always", "hourly", "daily", "weekly", "monthly", "yearly" or "never".
+	ChangeFreq string
+	// Priority is the priority of the URL relative to other URLs in the site,
+	// from 0.0 to 1.0, or zero to omit the element.
+	Priority float64
+}
+
+// Robots registers "/robots.txt" with the given rules, plus a reference to the
+// sitemap if one is registered with Middleware.Sitemap. If the list of rules
+// is empty, all crawlers are allowed to access the entire website.
+//
+// Example:
+//
+//	srv.Robots([]middleware.RobotsRule{
+//	    {UserAgent: []string{"*"}, Disallow: []string{"/admin/"}},
+//	})
+func (m *Middleware) Robots(rules []RobotsRule) {
+	if len(rules) == 0 {
+		rules = []RobotsRule{{UserAgent: []string{"*"}, Allow: []string{"/"}}}
+	}
+
+	var buf bytes.Buffer
+
+	for i, rule := range rules {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		for _, agent := range rule.UserAgent {
+			buf.WriteString("User-agent: " + agent + "\n")
+		}
+		for _, allow := range rule.Allow {
+			buf.WriteString("Allow: " + allow + "\n")
+		}
+		for _, disallow := range rule.Disallow {
+			buf.WriteString("Disallow: " + disallow + "\n")
+		}
+	}
+
+	text := buf.String()
+
+	m.GET("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		body := text
+
+		if m.defaultRouter.lookup(http.MethodGet, "/sitemap.xml") != nil {
+			body += "\nSitemap: " + Scheme(r) + "://" + RequestHost(r) + "/sitemap.xml\n"
+		}
+
+		serveCached(w, r, "text/plain; charset=utf-8", []byte(body))
+	})
+}
+
+// Sitemap registers "/sitemap.xml" with the URLs returned by the function,
+// which is called on every request, so the list can change over time. If the
+// function is nil, the sitemap lists every GET route of the default host that
+// has neither named parameters nor wildcards, which are the only ones whose
+// URL is known in advance. Relative URLs are resolved against the scheme and
+// host of the request.
+//
+// The response is compressed when the client supports gzip, and includes an
+// ETag so crawlers can skip the download when the sitemap has not changed.
+//
+// Example:
+//
+//	srv.Sitemap(func() []middleware.URLEntry {
+//	    return []middleware.URLEntry{{Loc: "/", ChangeFreq: "daily", Priority: 1.0}}
+//	})
+func (m *Middleware) Sitemap(fn func() []URLEntry) {
+	if fn == nil {
+		fn = m.sitemapRoutes
+	}
+
+	m.GET("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		base := Scheme(r) + "://" + RequestHost(r)
+
+		var buf bytes.Buffer
+
+		buf.WriteString(xml.Header)
+		buf.WriteString(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">` + "\n")
+
+		for _, entry := range fn() {
+			loc := entry.Loc
+
+			if strings.HasPrefix(loc, "/") {
+				loc = base + loc
+			}
+
+			buf.WriteString("  <url>\n    <loc>")
+			_ = xml.EscapeText(&buf, []byte(loc))
+			buf.WriteString("</loc>\n")
+
+			if !entry.LastMod.IsZero() {
+				buf.WriteString("    <lastmod>" + entry.LastMod.UTC().Format(time.RFC3339) + "</lastmod>\n")
+			}
+
+			if entry.ChangeFreq != "" {
+				buf.WriteString("    <changefreq>")
+				_ = xml.EscapeText(&buf, []byte(entry.ChangeFreq))
+				buf.WriteString("</changefreq>\n")
+			}
+
+			if entry.Priority > 0 {
+				buf.WriteString("    <priority>" + strconv.FormatFloat(entry.Priority, 'f', 1, 64) + "</priority>\n")
+			}
+
+			buf.WriteString("  </url>\n")
+		}
+
+		buf.WriteString("</urlset>\n")
+
+		serveCached(w, r, "application/xml; charset=utf-8", buf.Bytes())
+	})
+}
+
+// sitemapRoutes returns the static GET routes of the default host.
+func (m *Middleware) sitemapRoutes() []URLEntry {
+	var out []URLEntry
+
+	for _, route := range m.Routes() {
+		if route.Host != nohost || route.Method != http.MethodGet {
+			continue
+		}
+
+		if route.Pattern == "/robots.txt" || route.Pattern == "/sitemap.xml" {
+			continue
+		}
+
+		if strings.Contains(route.Pattern, "/:") || strings.Contains(route.Pattern, "/*") {
+			continue
+		}
+
+		out = append(out, URLEntry{Loc: route.Pattern})
+	}
+
+	return out
+}
+
+// serveCached writes a response that clients and intermediate caches can store
+// for an hour and revalidate with the ETag, compressed with gzip if possible.
+func serveCached(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := hex.EncodeToString(sum[:8])
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Cache-Control", "public, max-age=3600")
+	h.Add("Vary", "Accept-Encoding")
+
+	if AcceptsEncoding(r, "gzip") != "" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(body)
+		_ = zw.Close()
+		body = buf.Bytes()
+		etag += "-gzip"
+		h.Set("Content-Encoding", "gzip")
+	}
+
+	h.Set("ETag", `"`+etag+`"`)
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
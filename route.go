@@ -0,0 +1,204 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+)
+
+// Route is a handle to a registered route, returned by the registration
+// methods, which allows to configure the route with chainable calls.
+//
+// Example:
+//
+//	srv.GET("/admin/users", listUsers).
+//	    Name("admin.users").
+//	    AllowOnly("10.0.0.0/8").
+//	    Timeout(5 * time.Second)
+//
+// The options that wrap the handler, Use, Timeout, AllowOnly and Require, are
+// executed in the same order in which they are added to the route, after the
+// global middlewares attached with Middleware.Use. The options panic after
+// Middleware.Freeze.
+type Route struct {
+	method  string
+	pattern string
+	name    string
+	noLog   bool
+
+	handler  http.Handler
+	wrappers []func(http.Handler) http.Handler
+	node     *privTrieNode
+
+	deprecation *deprecation
+
+	headers http.Header
+
+	meta map[string]string
+
+	maxResponseSize int
+
+	slo *sloTracker
+
+	requires []string
+
+	owner *Middleware
+}
+
+// Method returns the HTTP method of the route.
+func (rt *Route) Method() string {
+	return rt.method
+}
+
+// Pattern returns the URL path used to register the route.
+func (rt *Route) Pattern() string {
+	return rt.pattern
+}
+
+// Name sets the name of the route, which is included in Middleware.Routes.
+func (rt *Route) Name(name string) *Route {
+	rt.checkFrozen()
+	rt.name = name
+	return rt
+}
+
+// Use adds a middleware to the route. The middleware only runs for requests
+// that match the route.
+func (rt *Route) Use(f func(http.Handler) http.Handler) *Route {
+	rt.checkFrozen()
+	rt.wrappers = append(rt.wrappers, f)
+	rt.rebuild()
+	return rt
+}
+
+// Timeout limits the duration of the handler using http.TimeoutHandler, which
+// responds with "503 Service Unavailable" if the handler does not finish on
+// time. The function panics if the duration is not positive.
+func (rt *Route) Timeout(d time.Duration) *Route {
+	if d <= 0 {
+		panic("middleware: invalid timeout " + d.String() + " for " + rt.method + " " + rt.pattern)
+	}
+
+	return rt.Use(func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, d, http.StatusText(http.StatusServiceUnavailable))
+	})
+}
+
+// AllowOnly restricts the access to the route to the given networks, the same
+// way the AllowOnly middleware does for the whole router.
+func (rt *Route) AllowOnly(networks ...string) *Route {
+	return rt.Use(AllowOnly(networks...))
+}
+
+// NoLog excludes the requests to the route from the access logs, which is
+// useful for health checks and other endpoints polled by machines.
+func (rt *Route) NoLog() *Route {
+	rt.checkFrozen()
+	rt.noLog = true
+	return rt
+}
+
+// Headers sets static response headers, like the cache policy or the content
+// type, before the handler runs, which can still modify or delete them. Calls
+// to Headers accumulate, and the values of the same header replace the
+// previous ones.
+//
+// Example:
+//
+//	srv.GET("/feed.xml", feed).Headers(http.Header{
+//	    "Content-Type":  {"application/rss+xml"},
+//	    "Cache-Control": {"public, max-age=300"},
+//	})
+func (rt *Route) Headers(h http.Header) *Route {
+	rt.checkFrozen()
+
+	if rt.headers == nil {
+		rt.headers = http.Header{}
+	}
+
+	for key, values := range h {
+		rt.headers[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+
+	return rt
+}
+
+// Meta attaches metadata to the route, like the team that owns it or the
+// feature it belongs to, which the middlewares read from MatchedRoute and the
+// tooling from Middleware.Routes. The values of the same key replace the
+// previous ones.
+//
+// Example:
+//
+//	srv.POST("/charges", createCharge).Meta("team", "payments").Meta("tier", "critical")
+func (rt *Route) Meta(key string, value string) *Route {
+	rt.checkFrozen()
+
+	if rt.meta == nil {
+		rt.meta = map[string]string{}
+	}
+
+	rt.meta[key] = value
+
+	return rt
+}
+
+// Metadata returns a copy of the metadata attached with Meta, or nil if there
+// is none.
+func (rt *Route) Metadata() map[string]string {
+	if len(rt.meta) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(rt.meta))
+
+	for key, value := range rt.meta {
+		out[key] = value
+	}
+
+	return out
+}
+
+// MatchedRoute returns the route that matched the request, or nil if there is
+// none, for example, when the router responds with "404 Not Found", or if the
+// http.ResponseWriter is not, and does not wrap, the writer created by the
+// router. The route is available to the middlewares attached with Use.
+//
+// Example:
+//
+//	func ownership(next http.Handler) http.Handler {
+//	    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//	        if rt := middleware.MatchedRoute(w); rt != nil {
+//	            requestsByTeam.WithLabelValues(rt.Metadata()["team"]).Inc()
+//	        }
+//	        next.ServeHTTP(w, r)
+//	    })
+//	}
+func MatchedRoute(w http.ResponseWriter) *Route {
+	rw := findResponse(w)
+
+	if rw == nil {
+		return nil
+	}
+
+	return rw.route
+}
+
+// checkFrozen panics if the route belongs to a web server finalized with
+// Freeze, because the composed handlers would ignore the change.
+func (rt *Route) checkFrozen() {
+	if rt.owner != nil && rt.owner.frozen {
+		panic("middleware: cannot modify " + rt.method + " " + rt.pattern + " after Freeze")
+	}
+}
+
+// rebuild wraps the original handler with the middlewares of the route.
+func (rt *Route) rebuild() {
+	handler := rt.handler
+
+	for i := len(rt.wrappers) - 1; i >= 0; i-- {
+		handler = rt.wrappers[i](handler)
+	}
+
+	rt.node.handler = handler
+	rt.node.composed = nil
+}
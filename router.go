@@ -1,8 +1,16 @@
 package middleware
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // router is an HTTP routing machine. The default host automatically creates a
@@ -12,12 +20,35 @@ import (
 // a new routing machine.
 type router struct {
 	nodes map[string]*privTrie
+	cert  *tls.Certificate
+
+	redirect       string
+	redirectStatus int
+
+	limits *Limits
+
+	allowed []*net.IPNet
+
+	frozen bool
+
+	duplicates []*Route
+
+	policies map[string]ContentSecurityPolicy
+
+	// owner is the web server that dispatches the requests to the router.
+	owner *Middleware
+
+	// root is the router of the host, and prefix is the path prepended to the
+	// routes, if the router is a group. See Group.
+	root   *router
+	prefix string
 }
 
 // newRouter creates a new instance of the routing machine.
-func newRouter() *router {
+func newRouter(owner *Middleware) *router {
 	return &router{
 		nodes: map[string]*privTrie{},
+		owner: owner,
 	}
 }
 
@@ -26,16 +57,34 @@ func newRouter() *router {
 // This function is intended for bulk loading and to allow the usage of less
 // frequently used, non-standardized or custom methods (e.g. for internal
 // communication with a proxy).
-func (r *router) register(method string, endpoint string, fn http.Handler) {
+func (r *router) register(method string, endpoint string, fn http.Handler) *Route {
+	if r.root != nil {
+		return r.root.register(method, r.prefix+endpoint, fn)
+	}
+
+	if r.frozen {
+		panic("middleware: cannot register " + method + " " + endpoint + " after Freeze")
+	}
+
+	if err := ValidatePattern(endpoint); err != nil {
+		panic(err.Error())
+	}
+
 	if _, ok := r.nodes[method]; !ok {
 		r.nodes[method] = newPrivTrie()
 	}
-	r.nodes[method].Insert(endpoint, fn)
+	node := r.nodes[method].Insert(endpoint, fn)
+	if node.route != nil {
+		// the previous route is no longer reachable, see RouteConflicts.
+		r.duplicates = append(r.duplicates, node.route)
+	}
+	node.route = &Route{method: method, pattern: endpoint, handler: fn, node: node, owner: r.owner}
+	return node.route
 }
 
 // Handle registers the handler for the given pattern.
-func (r *router) Handle(method string, endpoint string, fn http.HandlerFunc) {
-	r.register(method, endpoint, fn)
+func (r *router) Handle(method string, endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(method, endpoint, fn)
 }
 
 // GET requests a representation of the specified resource.
@@ -44,8 +93,8 @@ func (r *router) Handle(method string, endpoint string, fn http.HandlerFunc) {
 // such as using it for taking actions in web applications. One reason for this
 // is that GET may be used arbitrarily by robots or crawlers, which should not
 // need to consider the side effects that a request should cause.
-func (r *router) GET(endpoint string, fn http.HandlerFunc) {
-	r.register(http.MethodGet, endpoint, fn)
+func (r *router) GET(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(http.MethodGet, endpoint, fn)
 }
 
 // POST submits data to be processed to the identified resource.
@@ -58,78 +107,78 @@ func (r *router) GET(endpoint string, fn http.HandlerFunc) {
 // data to be encoded in the Request-URI. Many existing servers, proxies, and
 // user agents will log the request URI in some place where it might be visible
 // to third parties. Servers can use POST-based form submission instead.
-func (r *router) POST(endpoint string, fn http.HandlerFunc) {
-	r.register(http.MethodPost, endpoint, fn)
+func (r *router) POST(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(http.MethodPost, endpoint, fn)
 }
 
 // PUT is a shortcut for middleware.handle("PUT", endpoint, handle).
-func (r *router) PUT(endpoint string, fn http.HandlerFunc) {
-	r.register(http.MethodPut, endpoint, fn)
+func (r *router) PUT(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(http.MethodPut, endpoint, fn)
 }
 
 // PATCH is a shortcut for middleware.handle("PATCH", endpoint, handle).
-func (r *router) PATCH(endpoint string, fn http.HandlerFunc) {
-	r.register(http.MethodPatch, endpoint, fn)
+func (r *router) PATCH(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(http.MethodPatch, endpoint, fn)
 }
 
 // DELETE is a shortcut for middleware.handle("DELETE", endpoint, handle).
-func (r *router) DELETE(endpoint string, fn http.HandlerFunc) {
-	r.register(http.MethodDelete, endpoint, fn)
+func (r *router) DELETE(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(http.MethodDelete, endpoint, fn)
 }
 
 // HEAD is a shortcut for middleware.handle("HEAD", endpoint, handle).
-func (r *router) HEAD(endpoint string, fn http.HandlerFunc) {
-	r.register(http.MethodHead, endpoint, fn)
+func (r *router) HEAD(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(http.MethodHead, endpoint, fn)
 }
 
 // OPTIONS is a shortcut for middleware.handle("OPTIONS", endpoint, handle).
-func (r *router) OPTIONS(endpoint string, fn http.HandlerFunc) {
-	r.register(http.MethodOptions, endpoint, fn)
+func (r *router) OPTIONS(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(http.MethodOptions, endpoint, fn)
 }
 
 // CONNECT is a shortcut for middleware.handle("CONNECT", endpoint, handle).
-func (r *router) CONNECT(endpoint string, fn http.HandlerFunc) {
-	r.register(http.MethodConnect, endpoint, fn)
+func (r *router) CONNECT(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(http.MethodConnect, endpoint, fn)
 }
 
 // TRACE is a shortcut for middleware.handle("TRACE", endpoint, handle).
-func (r *router) TRACE(endpoint string, fn http.HandlerFunc) {
-	r.register(http.MethodTrace, endpoint, fn)
+func (r *router) TRACE(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register(http.MethodTrace, endpoint, fn)
 }
 
 // COPY is a shortcut for middleware.handle("WebDAV.COPY", endpoint, handle).
-func (r *router) COPY(endpoint string, fn http.HandlerFunc) {
-	r.register("COPY", endpoint, fn)
+func (r *router) COPY(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register("COPY", endpoint, fn)
 }
 
 // LOCK is a shortcut for middleware.handle("WebDAV.LOCK", endpoint, handle).
-func (r *router) LOCK(endpoint string, fn http.HandlerFunc) {
-	r.register("LOCK", endpoint, fn)
+func (r *router) LOCK(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register("LOCK", endpoint, fn)
 }
 
 // MKCOL is a shortcut for middleware.handle("WebDAV.MKCOL", endpoint, handle).
-func (r *router) MKCOL(endpoint string, fn http.HandlerFunc) {
-	r.register("MKCOL", endpoint, fn)
+func (r *router) MKCOL(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register("MKCOL", endpoint, fn)
 }
 
 // MOVE is a shortcut for middleware.handle("WebDAV.MOVE", endpoint, handle).
-func (r *router) MOVE(endpoint string, fn http.HandlerFunc) {
-	r.register("MOVE", endpoint, fn)
+func (r *router) MOVE(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register("MOVE", endpoint, fn)
 }
 
 // PROPFIND is a shortcut for middleware.handle("WebDAV.PROPFIND", endpoint, handle).
-func (r *router) PROPFIND(endpoint string, fn http.HandlerFunc) {
-	r.register("PROPFIND", endpoint, fn)
+func (r *router) PROPFIND(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register("PROPFIND", endpoint, fn)
 }
 
 // PROPPATCH is a shortcut for middleware.handle("WebDAV.PROPPATCH", endpoint, handle).
-func (r *router) PROPPATCH(endpoint string, fn http.HandlerFunc) {
-	r.register("PROPPATCH", endpoint, fn)
+func (r *router) PROPPATCH(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register("PROPPATCH", endpoint, fn)
 }
 
 // UNLOCK is a shortcut for middleware.handle("WebDAV.UNLOCK", endpoint, handle).
-func (r *router) UNLOCK(endpoint string, fn http.HandlerFunc) {
-	r.register("UNLOCK", endpoint, fn)
+func (r *router) UNLOCK(endpoint string, fn http.HandlerFunc) *Route {
+	return r.register("UNLOCK", endpoint, fn)
 }
 
 // STATIC refers to the static assets folder, a place where people can store
@@ -139,20 +188,104 @@ func (r *router) UNLOCK(endpoint string, fn http.HandlerFunc) {
 // put one in the middle of your requests as easy as you attach normal HTTP
 // handlers.
 func (r *router) STATIC(folder string, urlPrefix string) {
-	fn := r.serveFiles(folder, urlPrefix)
+	fn := r.serveFiles(folder, r.prefix+urlPrefix)
 
 	r.HEAD(urlPrefix+"/*", fn)
 	r.GET(urlPrefix+"/*", fn)
 	r.POST(urlPrefix+"/*", fn)
 }
 
+// webdavMethods is the list of HTTP methods used by WebDAV clients.
+var webdavMethods = []string{
+	http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPost,
+	http.MethodPut, http.MethodDelete, "COPY", "LOCK", "MKCOL", "MOVE",
+	"PROPFIND", "PROPPATCH", "UNLOCK",
+}
+
+// WEBDAV registers a WebDAV handler, like the one implemented by the package
+// golang.org/x/net/webdav, for every WebDAV method under the given prefix,
+// including the prefix itself and the collection at the root of the prefix.
+//
+// The handler receives the original URL path, instead of the cleaned version
+// the router uses to select the route, so collections keep their trailing
+// slash, and the paths in the Destination header of COPY and MOVE requests
+// match the request URL. Configure the same prefix in the handler, including
+// the prefix of the group, if any.
+//
+// Example:
+//
+//	srv.WEBDAV("/dav", &webdav.Handler{
+//	    Prefix:     "/dav",
+//	    FileSystem: webdav.Dir("/var/www/dav"),
+//	    LockSystem: webdav.NewMemLS(),
+//	})
+func (r *router) WEBDAV(urlPrefix string, handler http.Handler) {
+	urlPrefix = strings.TrimRight(urlPrefix, "/")
+
+	for _, method := range webdavMethods {
+		if r.prefix+urlPrefix != "" {
+			r.register(method, urlPrefix, handler)
+		}
+
+		r.register(method, urlPrefix+"/", handler)
+		r.register(method, urlPrefix+"/*", handler)
+	}
+}
+
+// RedirectTo redirects every request sent to the host to the same path and
+// query in the target URL, which is useful to migrate a website to a different
+// domain without a handler for each route. The target URL can include a path,
+// in which case the request path is appended to it. The routes registered in
+// the host are ignored while the redirection is active.
+//
+// The function panics if the status code is not a redirection (3xx).
+//
+// Example:
+//
+//	srv.Host("old.example.com").RedirectTo("https://new.example.com", http.StatusMovedPermanently)
+func (r *router) RedirectTo(target string, status int) {
+	r = r.host()
+
+	if status < 300 || status > 399 {
+		panic("middleware: invalid redirect status " + strconv.Itoa(status))
+	}
+
+	r.redirect = strings.TrimRight(target, "/")
+	r.redirectStatus = status
+}
+
 // serveFiles serves files from the root of the given file system.
+//
+// The URL path is cleaned the same way the router does before the matching, so
+// the file checked for existence, the file served, and the route that matched
+// the request are always the same, regardless of the dot segments and encoded
+// slashes in the original URL.
 func (r *router) serveFiles(root string, prefix string) http.HandlerFunc {
 	fs := http.FileServer(http.Dir(root))
 	handler := http.StripPrefix(prefix, fs)
+	host := r.host()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fifo, err := os.Stat(root + r.URL.Path[len(prefix):])
+		clean := path.Clean("/" + r.URL.Path)
+
+		if !strings.HasPrefix(clean, prefix+"/") {
+			// cleaned path outside the folder; return 404 Not Found
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		if clean != r.URL.Path {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = clean
+			r2.URL.RawPath = ""
+			r = r2
+		}
+
+		filename := filepath.Join(root, filepath.FromSlash(clean[len(prefix):]))
+		fifo, err := os.Stat(filename)
 
 		if err != nil {
 			// requested resource does not exists; return 404 Not Found
@@ -166,6 +299,43 @@ func (r *router) serveFiles(root string, prefix string) http.HandlerFunc {
 			return
 		}
 
+		if policy, ok := host.staticPolicy(clean); ok {
+			if strings.Contains(policy.Policy, nonceMarker) {
+				serveWithNonce(w, filename, policy)
+				return
+			}
+
+			w.Header().Set(policy.header(), policy.Policy)
+		}
+
 		handler.ServeHTTP(w, r)
 	})
 }
+
+// allowedMethods returns the sorted list of methods with a route that matches
+// the URL path, which the router sends in the "Allow" header of the "405
+// Method Not Allowed" responses, including HEAD if the GET handler serves it.
+func (r *router) allowedMethods(urlPath string, autoHead bool) []string {
+	var out []string
+
+	reqPath := cleanRequestPath(urlPath)
+
+	get, head := false, false
+
+	for method, t := range r.nodes {
+		if ok, _, _ := t.Search(reqPath); ok {
+			out = append(out, method)
+			get = get || method == http.MethodGet
+			head = head || method == http.MethodHead
+		}
+	}
+
+	if get && !head && autoHead {
+		// the GET handler also serves the HEAD requests.
+		out = append(out, http.MethodHead)
+	}
+
+	sort.Strings(out)
+
+	return out
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// RouteInfo describes an endpoint registered in the router.
+type RouteInfo struct {
+	// Host is the hostname associated to the route, or "_" for the default host.
+	Host string `json:"host"`
+	// Method is the HTTP method associated to the route.
+	Method string `json:"method"`
+	// Pattern is the URL path used to register the route.
+	Pattern string `json:"pattern"`
+	// Name is the name of the route, set with Route.Name, if any.
+	Name string `json:"name,omitempty"`
+	// Meta is the metadata attached with Route.Meta, if any.
+	Meta map[string]string `json:"meta,omitempty"`
+	// Require is the list of requirements declared with Route.Require, if any.
+	Require []string `json:"require,omitempty"`
+}
+
+// Routes returns all the registered routes, sorted by host, pattern and method.
+func (m *Middleware) Routes() []RouteInfo {
+	var out []RouteInfo
+
+	m.hostsMu.RLock()
+	defer m.hostsMu.RUnlock()
+
+	for host, router := range m.hosts {
+		for method, trie := range router.nodes {
+			trie.root.walk(func(node *privTrieNode) {
+				info := RouteInfo{Host: host, Method: method, Pattern: node.pattern}
+
+				if node.route != nil {
+					info.Name = node.route.name
+					info.Meta = node.route.Metadata()
+					info.Require = node.route.Requirements()
+				}
+
+				out = append(out, info)
+			})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Host != out[j].Host {
+			return out[i].Host < out[j].Host
+		}
+		if out[i].Pattern != out[j].Pattern {
+			return out[i].Pattern < out[j].Pattern
+		}
+		return out[i].Method < out[j].Method
+	})
+
+	return out
+}
+
+// DumpRoutes writes the route table into w, either as an aligned plain text
+// table when the format is "text", with the requirements of the routes, if
+// any, in the last column, or as a JSON array when the format is "json". The
+// output is sorted by host, pattern and method, so it is stable across
+// executions, and can be compared against a golden file to detect accidental
+// changes in the public routes after a refactor.
+//
+// Example:
+//
+//	var buf bytes.Buffer
+//	_ = srv.DumpRoutes(&buf, "text")
+//	golden, _ := os.ReadFile("testdata/routes.golden")
+//	if !bytes.Equal(buf.Bytes(), golden) {
+//	    t.Fatalf("routes changed:\n%s", buf.String())
+//	}
+func (m *Middleware) DumpRoutes(w io.Writer, format string) error {
+	routes := m.Routes()
+
+	switch format {
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+
+		for _, route := range routes {
+			line := route.Host + "\t" + route.Method + "\t" + route.Pattern
+
+			if len(route.Require) > 0 {
+				line += "\t" + strings.Join(route.Require, ",")
+			}
+
+			if _, err := io.WriteString(tw, line+"\n"); err != nil {
+				return err
+			}
+		}
+
+		return tw.Flush()
+	case "json":
+		if routes == nil {
+			routes = []RouteInfo{}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(routes)
+	}
+
+	return errors.New("middleware: unknown route dump format " + format)
+}
+
+// walk executes the function for every node marked as the end of an endpoint.
+func (n *privTrieNode) walk(fn func(*privTrieNode)) {
+	if n.isTheEnd {
+		fn(n)
+	}
+
+	for _, child := range n.children {
+		child.walk(fn)
+	}
+}
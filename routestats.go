@@ -0,0 +1,207 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram of each route.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 25,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 5,
+	time.Second * 10,
+}
+
+// RouteStats represents the latency and status code distributions of a route.
+type RouteStats struct {
+	Host    string         `json:"host"`
+	Method  string         `json:"method"`
+	Pattern string         `json:"pattern"`
+	Count   uint64         `json:"count"`
+	Total   time.Duration  `json:"total"`
+	Min     time.Duration  `json:"min"`
+	Max     time.Duration  `json:"max"`
+	Buckets []Bucket       `json:"buckets"`
+	Status  map[int]uint64 `json:"status"`
+}
+
+// Bucket is a latency histogram bucket. The last bucket of every histogram has
+// no upper bound, represented as zero, and counts all the slower requests.
+type Bucket struct {
+	UpperBound time.Duration `json:"upper_bound"`
+	Count      uint64        `json:"count"`
+}
+
+// Mean returns the average duration of the requests handled by the route.
+func (s RouteStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+
+	return s.Total / time.Duration(s.Count)
+}
+
+// Percentile returns an estimate of the given percentile, between 0 and 100,
+// which is the upper bound of the bucket that contains it. The function
+// returns the maximum duration if the percentile falls into the last bucket.
+func (s RouteStats) Percentile(p float64) time.Duration {
+	target := uint64(math.Ceil(float64(s.Count) * p / 100))
+
+	if target == 0 {
+		target = 1
+	}
+
+	var seen uint64
+
+	for _, b := range s.Buckets {
+		seen += b.Count
+
+		if seen >= target && b.UpperBound > 0 {
+			return b.UpperBound
+		}
+	}
+
+	return s.Max
+}
+
+// routeKey is the unique identifier of a route across all the hosts.
+type routeKey struct {
+	host    string
+	method  string
+	pattern string
+}
+
+// routeStats holds the statistics of every route that handled a request.
+type routeStats struct {
+	mu     sync.Mutex
+	routes map[routeKey]*RouteStats
+}
+
+// record adds the status code and the duration of a request to the stats.
+func (rs *routeStats) record(host string, method string, pattern string, status int, dur time.Duration) {
+	if status == 0 {
+		// The handler did not write anything, so the client received "200 OK".
+		status = http.StatusOK
+	}
+
+	key := routeKey{host: host, method: method, pattern: pattern}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	s, ok := rs.routes[key]
+
+	if !ok {
+		s = &RouteStats{
+			Host:    host,
+			Method:  method,
+			Pattern: pattern,
+			Min:     dur,
+			Buckets: make([]Bucket, len(latencyBuckets)+1),
+			Status:  map[int]uint64{},
+		}
+
+		for i, bound := range latencyBuckets {
+			s.Buckets[i].UpperBound = bound
+		}
+
+		rs.routes[key] = s
+	}
+
+	s.Count++
+	s.Total += dur
+	s.Status[status]++
+
+	if dur < s.Min {
+		s.Min = dur
+	}
+
+	if dur > s.Max {
+		s.Max = dur
+	}
+
+	i := sort.Search(len(latencyBuckets), func(i int) bool {
+		return dur <= latencyBuckets[i]
+	})
+
+	s.Buckets[i].Count++
+}
+
+// EnableRouteStats starts collecting the latency and status code distribution
+// of every route, which can be used to diagnose slow endpoints without a full
+// metrics stack. If the endpoint is not empty, the function also registers a
+// route in the default host that responds with the statistics in JSON format.
+// The endpoint is restricted to the given networks, which are passed to the
+// AllowOnly function. If the list is empty, only the local machine is allowed
+// to access the data.
+//
+// Requests that do not match any route are not included in the statistics.
+//
+// Example:
+//
+//	srv.EnableRouteStats("/debug/routes")
+func (m *Middleware) EnableRouteStats(endpoint string, allowed ...string) {
+	if m.routeStats == nil {
+		m.routeStats = &routeStats{routes: map[routeKey]*RouteStats{}}
+	}
+
+	if endpoint == "" {
+		return
+	}
+
+	handler := AllowOnly(allowed...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = JSON(w, r, m.RouteStats())
+	}))
+
+	m.GET(endpoint, handler.ServeHTTP)
+}
+
+// RouteStats returns a copy of the statistics collected for every route, sorted
+// by host, method and pattern. The list is empty unless EnableRouteStats was
+// called before the server started.
+func (m *Middleware) RouteStats() []RouteStats {
+	if m.routeStats == nil {
+		return nil
+	}
+
+	m.routeStats.mu.Lock()
+
+	out := make([]RouteStats, 0, len(m.routeStats.routes))
+
+	for _, s := range m.routeStats.routes {
+		c := *s
+		c.Buckets = append([]Bucket(nil), s.Buckets...)
+		c.Status = make(map[int]uint64, len(s.Status))
+
+		for status, count := range s.Status {
+			c.Status[status] = count
+		}
+
+		out = append(out, c)
+	}
+
+	m.routeStats.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Host != out[j].Host {
+			return out[i].Host < out[j].Host
+		}
+		if out[i].Method != out[j].Method {
+			return out[i].Method < out[j].Method
+		}
+		return out[i].Pattern < out[j].Pattern
+	})
+
+	return out
+}
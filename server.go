@@ -4,18 +4,44 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"log"
 	"net"
 	"net/http"
+	"net/http/cgi"
+	"net/http/fcgi"
+	"os"
+	"sync/atomic"
+	"time"
 )
 
 // startServer setups and starts the web server.
-func (m *Middleware) startServer(address string, f func() error) error {
+func (m *Middleware) startServer(address string, secure bool, f func() error) error {
+	if err := m.checkRouteConflicts(); err != nil {
+		return err
+	}
+
 	addr, err := m.resolveTCPAddr(address)
 
 	if err != nil {
 		return err
 	}
 
+	return m.serve(m.startupInfo(addr, secure), f)
+}
+
+// serve configures the web server for the address and then calls f. The
+// callers check the route conflicts before they open the listeners, so the
+// listeners are not leaked if StrictRoutes refuses to start the web server.
+func (m *Middleware) serve(info StartupInfo, f func() error) error {
+	addr := info.Addr
+
+	atomic.StoreInt32(&m.shuttingDown, 0)
+
+	shutdown := make(chan struct{})
+	m.shutdown = shutdown
+
+	m.startTime = time.Now()
+
 	m.serverInstance = &http.Server{
 		Addr:              addr.String(),
 		Handler:           m,
@@ -24,14 +50,18 @@ func (m *Middleware) startServer(address string, f func() error) error {
 		WriteTimeout:      m.WriteTimeout,
 		IdleTimeout:       m.IdleTimeout,
 		ErrorLog:          m.ErrorLog,
+		ConnState:         m.connState,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), shutdownKey, shutdown)
+		},
 	}
 
 	// Configure additional shutdown operations.
 	m.serverInstance.RegisterOnShutdown(m.OnShutdown)
 
-	m.Logger.ListeningOn(addr)
+	m.listeningOn(info)
 
-	err = f() /* ListenAndServe OR ListenAndServeTLS */
+	err := f() /* ListenAndServe OR ListenAndServeTLS */
 
 	// Ignore "http: Server closed" errors as benign.
 	if err != nil && errors.Is(err, http.ErrServerClosed) {
@@ -92,23 +122,130 @@ func (m *Middleware) FreePort() (net.Addr, error) {
 // configured to enable TCP keep-alives. If the hostname is blank, ":http" is
 // used. The method always returns a non-nil error.
 func (m *Middleware) ListenAndServe(address string) error {
-	return m.startServer(address, func() error {
+	return m.startServer(address, false, func() error {
 		return m.serverInstance.ListenAndServe()
 	})
 }
 
+// ListenAndServeReady acts identically to ListenAndServe, except that it sends
+// the address of the listener to the channel once the web server is ready to
+// accept connections, which is useful when the address uses port zero to
+// obtain an ephemeral port, and for tests that need to send requests right
+// after the server starts. The channel must be able to receive the value
+// without blocking the web server, so use a buffered channel. If the web
+// server cannot start, for example, because the port is in use, the function
+// closes the channel without sending the address and returns the error.
+//
+// Example:
+//
+//	ready := make(chan net.Addr, 1)
+//	errs := make(chan error, 1)
+//	go func() { errs <- srv.ListenAndServeReady("127.0.0.1:0", ready) }()
+//	addr, ok := <-ready
+//	if !ok {
+//	    log.Fatal(<-errs)
+//	}
+func (m *Middleware) ListenAndServeReady(address string, ready chan<- net.Addr) error {
+	if err := m.checkRouteConflicts(); err != nil {
+		close(ready)
+		return err
+	}
+
+	l, err := net.Listen("tcp", address)
+
+	if err != nil {
+		close(ready)
+		return err
+	}
+
+	return m.serve(m.startupInfo(l.Addr(), false), func() error {
+		ready <- l.Addr()
+		return m.serverInstance.Serve(l)
+	})
+}
+
 // ListenAndServeTLS acts identically to ListenAndServe, except that it
 // expects HTTPS connections. Additionally, files containing a certificate and
 // matching private key for the server must be provided. If the certificate
 // is signed by a certificate authority, the certFile should be the concatenation
 // of the server's certificate, any intermediates, and the CA's certificate.
+//
+// The files can be empty when the hosts have their own certificates, loaded
+// with the Cert method of the host router, which are selected using SNI.
 func (m *Middleware) ListenAndServeTLS(address string, certFile string, keyFile string, cfg *tls.Config) error {
-	return m.startServer(address, func() error {
+	if m.hasCertificates() {
+		if cfg == nil {
+			cfg = &tls.Config{}
+		} else {
+			cfg = cfg.Clone()
+		}
+
+		if cfg.GetCertificate == nil {
+			cfg.GetCertificate = m.GetCertificate
+		}
+	}
+
+	return m.startServer(address, true, func() error {
 		m.serverInstance.TLSConfig = cfg /* TLS configuration */
 		return m.serverInstance.ListenAndServeTLS(certFile, keyFile)
 	})
 }
 
+// ServeFCGI accepts incoming FastCGI connections on the listener and handles
+// the requests with the router, which allows the web server to run behind a
+// classic web server like Apache httpd or Nginx. If the listener is nil, the
+// function accepts connections on os.Stdin, which is the case when the web
+// server is spawned by the classic web server itself.
+//
+// The web server starts like in ListenAndServe, so StrictRoutes, Shutdown and
+// OnShutdown apply, but the server timeouts have no effect in this mode, and
+// Shutdown stops accepting connections without waiting for the requests in
+// progress.
+//
+// Example:
+//
+//	l, _ := net.Listen("tcp", "127.0.0.1:9000")
+//	srv.ServeFCGI(l)
+func (m *Middleware) ServeFCGI(l net.Listener) error {
+	if err := m.checkRouteConflicts(); err != nil {
+		return err
+	}
+
+	if l == nil {
+		// the same listener that fcgi.Serve creates, so Shutdown can close it.
+		stdin, err := net.FileListener(os.Stdin)
+
+		if err != nil {
+			return err
+		}
+
+		l = stdin
+	}
+
+	return m.serve(m.startupInfo(l.Addr(), false), func() error {
+		// http.Server does not know the listener, so Shutdown closes it.
+		m.serverInstance.RegisterOnShutdown(func() { _ = l.Close() })
+
+		err := fcgi.Serve(l, m)
+
+		if atomic.LoadInt32(&m.shuttingDown) == 1 {
+			return http.ErrServerClosed
+		}
+
+		return err
+	})
+}
+
+// ServeCGI handles the current CGI request with the router, reading the request
+// from the environment variables and standard input, and writing the response
+// to the standard output, which is useful in constrained hosting environments
+// that only support CGI programs. The Logger must not write into the standard
+// output, like the default one does, because it would corrupt the response, so
+// use DiscardLogs or a Logger that writes into the standard error.
+func (m *Middleware) ServeCGI() error {
+	return cgi.Serve(m)
+}
+
 // Shutdown gracefully shuts down the server without interrupting any active
 // connections. Shutdown works by first closing all open listeners, then
 // closing all idle connections, and then waiting indefinitely for connections
@@ -118,14 +255,79 @@ func (m *Middleware) ListenAndServeTLS(address string, certFile string, keyFile
 // returns the context's error, otherwise it returns any error returned from
 // closing the Server's underlying Listener(s).
 func (m *Middleware) Shutdown() error {
+	if atomic.CompareAndSwapInt32(&m.shuttingDown, 0, 1) && m.shutdown != nil {
+		// Notify hijacked connections, like WebSockets, that the server is
+		// shutting down, since http.Server does not keep track of them.
+		close(m.shutdown)
+	}
+
+	start := time.Now()
+
+	// Notify the background goroutines started with Go.
+	m.jobs.stop()
+
 	ctx, cancel := context.WithTimeout(context.Background(), m.ShutdownTimeout)
 
 	defer cancel()
 
 	if m.serverInstance == nil {
-		// Nothing to stop.
+		// Nothing to stop, except the background goroutines.
+		m.waitJobs(ctx, start)
 		return nil
 	}
 
-	return m.serverInstance.Shutdown(ctx)
+	err := m.serverInstance.Shutdown(ctx)
+
+	m.waitJobs(ctx, start)
+
+	if err != nil {
+		for _, req := range m.InFlight() {
+			m.logf(logPrefix(req.RequestID, req.Pattern)+"shutdown: request still active after %s: %s %s%s (route=%q, client=%s)",
+				time.Since(req.StartTime), req.Method, req.Host, req.Path, req.Pattern, req.ClientIP)
+		}
+	}
+
+	return err
+}
+
+// requestLogf writes a message about the request being processed into the
+// error log, prefixed with the request ID and the pattern of the matched route,
+// so it can be correlated with the access log. If the client did not send a
+// request ID, the router generates one, which is also sent to the Logger.
+//
+// Example:
+//
+//	[5f2b9c1e4d3a7b60-42 /users/:id] middleware: response of GET ...
+func (m *Middleware) requestLogf(w *response, r *http.Request, format string, v ...interface{}) {
+	pattern := ""
+
+	if w.route != nil {
+		pattern = w.route.pattern
+	}
+
+	m.logf(logPrefix(w.ensureRequestID(r), pattern)+format, v...)
+}
+
+// logPrefix returns the prefix of the error log entries about a request, with
+// hyphens in place of the missing values.
+func logPrefix(requestID string, pattern string) string {
+	if requestID == "" {
+		requestID = "-"
+	}
+
+	if pattern == "" {
+		pattern = "-"
+	}
+
+	return "[" + requestID + " " + pattern + "] "
+}
+
+// logf writes a message into the error log, or the standard logger if nil.
+func (m *Middleware) logf(format string, v ...interface{}) {
+	if m.ErrorLog != nil {
+		m.ErrorLog.Printf(format, v...)
+		return
+	}
+
+	log.Printf(format, v...)
 }
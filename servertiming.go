@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timing is a named span of time spent handling a request, like a database
+// query or a call to an external service, which is sent to the web browser via
+// the Server-Timing header and attached to the access log.
+//
+// Ref: https://www.w3.org/TR/server-timing/
+type Timing struct {
+	Name        string
+	Duration    time.Duration
+	Description string
+}
+
+// String returns the timing in the Server-Timing header format.
+func (t Timing) String() string {
+	out := t.Name + ";dur=" + strconv.FormatFloat(float64(t.Duration)/float64(time.Millisecond), 'f', -1, 64)
+
+	if t.Description != "" {
+		out += ";desc=" + strconv.Quote(t.Description)
+	}
+
+	return out
+}
+
+// AddTiming records a named span of time for the current request. The spans
+// recorded before the response headers are written are sent to the client in
+// the Server-Timing header, and all of them are attached to the access log.
+//
+// The function does nothing if the http.ResponseWriter is not, and does not
+// wrap, the writer created by the router.
+//
+// Example:
+//
+//	start := time.Now()
+//	rows, err := db.QueryContext(r.Context(), "SELECT …")
+//	middleware.AddTiming(w, "db", time.Since(start), "users query")
+func AddTiming(w http.ResponseWriter, name string, dur time.Duration, desc string) {
+	rw := findResponse(w)
+
+	if rw == nil {
+		return
+	}
+
+	if len(rw.timings) == 0 && rw.status == 0 {
+		rw.hooks = append(rw.hooks, func(status int, h http.Header) {
+			h.Set("Server-Timing", serverTiming(rw.timings))
+		})
+	}
+
+	rw.timings = append(rw.timings, Timing{Name: name, Duration: dur, Description: desc})
+}
+
+// StartTiming starts a named span of time for the current request and returns
+// a function that stops it and records the span with AddTiming.
+//
+// Example:
+//
+//	defer middleware.StartTiming(w, "render")()
+func StartTiming(w http.ResponseWriter, name string) func() {
+	start := time.Now()
+
+	return func() {
+		AddTiming(w, name, time.Since(start), "")
+	}
+}
+
+// serverTiming returns the value of the Server-Timing header.
+func serverTiming(timings []Timing) string {
+	parts := make([]string, len(timings))
+
+	for i, t := range timings {
+		parts[i] = t.String()
+	}
+
+	return strings.Join(parts, ", ")
+}
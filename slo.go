@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sloSlots is the number of slots of the rolling window of an SLO. The oldest
+// slot is discarded at once, so the window slides in steps of 1/10 of its
+// duration.
+const sloSlots = 10
+
+// SLO is a service level objective for the latency of a route, like "99% of
+// the requests finish in less than 300ms over the last 5 minutes".
+type SLO struct {
+	// Percentile is the percentage of requests, between 0 and 100, that must
+	// finish in less than Threshold, e.g. 99 for the p99 latency.
+	Percentile float64
+	// Threshold is the maximum duration of the requests in the percentile.
+	Threshold time.Duration
+	// Window is the duration of the rolling window, e.g. 5 minutes.
+	Window time.Duration
+	// MinRequests is the minimum number of requests in the window before the
+	// objective is evaluated, which prevents alerts caused by a few slow
+	// requests during periods of low traffic. Default: 100.
+	MinRequests int
+	// Alert is called, in a new goroutine, when the route starts violating the
+	// objective, and when it meets the objective again.
+	Alert func(SLOAlert)
+}
+
+// SLOAlert describes a change in the state of the SLO of a route.
+type SLOAlert struct {
+	Time       time.Time
+	Route      *Route
+	Method     string
+	Pattern    string
+	Violated   bool
+	Percentile float64
+	Threshold  time.Duration
+	Window     time.Duration
+	Requests   int
+	Slow       int
+}
+
+// SLO tracks the latency of the route in a rolling window, and calls the alert
+// function of the objective when the route starts violating it, and when the
+// route meets it again. The latency is the same duration sent to the Logger,
+// which includes the global middlewares.
+//
+// The objective is evaluated after every request, so a route that stops
+// receiving requests keeps its last state until the next request. The function
+// panics if the objective is invalid.
+//
+// Example:
+//
+//	srv.GET("/search", search).SLO(middleware.SLO{
+//	    Percentile: 99,
+//	    Threshold:  time.Millisecond * 300,
+//	    Window:     time.Minute * 5,
+//	    Alert: func(alert middleware.SLOAlert) {
+//	        pager.Notify(alert.Method+" "+alert.Pattern, alert.Violated)
+//	    },
+//	})
+func (rt *Route) SLO(slo SLO) *Route {
+	rt.checkFrozen()
+
+	if slo.Percentile <= 0 || slo.Percentile >= 100 || slo.Threshold <= 0 || slo.Window < sloSlots || slo.Alert == nil {
+		panic("middleware: invalid SLO p" + strconv.FormatFloat(slo.Percentile, 'f', -1, 64) + " < " + slo.Threshold.String() +
+			" over " + slo.Window.String() + " for " + rt.method + " " + rt.pattern)
+	}
+
+	if slo.MinRequests <= 0 {
+		slo.MinRequests = 100
+	}
+
+	rt.slo = &sloTracker{slo: slo, slot: slo.Window / sloSlots}
+
+	return rt
+}
+
+// sloTracker counts the requests, and the ones slower than the threshold, in
+// each slot of the rolling window.
+type sloTracker struct {
+	slo      SLO
+	slot     time.Duration
+	mu       sync.Mutex
+	slots    [sloSlots]sloSlot
+	violated bool
+}
+
+// sloSlot is the number of requests that started in a fraction of the window.
+type sloSlot struct {
+	start time.Time
+	total int
+	slow  int
+}
+
+// record adds the duration of a request to the window, and calls the alert
+// function if the state of the objective changed.
+func (t *sloTracker) record(rt *Route, dur time.Duration, now time.Time) {
+	start := now.Truncate(t.slot)
+	i := int(start.UnixNano()/int64(t.slot)) % sloSlots
+
+	t.mu.Lock()
+
+	if !t.slots[i].start.Equal(start) {
+		// the slot belongs to a previous window, start over.
+		t.slots[i] = sloSlot{start: start}
+	}
+
+	t.slots[i].total++
+
+	if dur > t.slo.Threshold {
+		t.slots[i].slow++
+	}
+
+	var total, slow int
+
+	for _, s := range t.slots {
+		if now.Sub(s.start) < t.slo.Window {
+			total += s.total
+			slow += s.slow
+		}
+	}
+
+	violated := t.violated
+
+	if total >= t.slo.MinRequests {
+		violated = float64(slow) > float64(total)*(100-t.slo.Percentile)/100
+	}
+
+	changed := violated != t.violated
+	t.violated = violated
+
+	t.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	go t.slo.Alert(SLOAlert{
+		Time:       now,
+		Route:      rt,
+		Method:     rt.method,
+		Pattern:    rt.pattern,
+		Violated:   violated,
+		Percentile: t.slo.Percentile,
+		Threshold:  t.slo.Threshold,
+		Window:     t.slo.Window,
+		Requests:   total,
+		Slow:       slow,
+	})
+}
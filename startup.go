@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"net"
+	"time"
+)
+
+// StartupLogger is an optional interface for the loggers that want to record
+// the effective configuration of the web server when it starts. If the Logger
+// implements it, the router calls Startup instead of ListeningOn.
+type StartupLogger interface {
+	// Startup is called once, just before the web server accepts connections.
+	Startup(StartupInfo)
+}
+
+// StartupInfo describes the effective configuration of the web server when it
+// starts, so the operational logs can tell how each instance was configured.
+//
+// Family is "ipv4", "ipv6", "dual-stack" if the server accepts connections
+// over both families, or the network of the address, like "unix", if it is not
+// a TCP address.
+type StartupInfo struct {
+	Addr              net.Addr
+	Family            string
+	Scheme            string
+	TLS               bool
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+}
+
+// String returns the startup information in a human-readable format.
+func (s StartupInfo) String() string {
+	return s.Addr.String() + " (scheme=" + s.Scheme +
+		" family=" + s.Family +
+		" read_timeout=" + s.ReadTimeout.String() +
+		" read_header_timeout=" + s.ReadHeaderTimeout.String() +
+		" write_timeout=" + s.WriteTimeout.String() +
+		" idle_timeout=" + s.IdleTimeout.String() +
+		" shutdown_timeout=" + s.ShutdownTimeout.String() + ")"
+}
+
+// startupInfo returns the startup information for the address, with the
+// timeouts configured in the router.
+func (m *Middleware) startupInfo(addr net.Addr, secure bool) StartupInfo {
+	info := StartupInfo{
+		Addr:              addr,
+		Family:            addrFamily(addr),
+		Scheme:            "http",
+		TLS:               secure,
+		ReadTimeout:       m.ReadTimeout,
+		ReadHeaderTimeout: m.ReadHeaderTimeout,
+		WriteTimeout:      m.WriteTimeout,
+		IdleTimeout:       m.IdleTimeout,
+		ShutdownTimeout:   m.ShutdownTimeout,
+	}
+
+	if secure {
+		info.Scheme = "https"
+	}
+
+	return info
+}
+
+// listeningOn sends the startup information to the Logger.
+func (m *Middleware) listeningOn(info StartupInfo) {
+	if l, ok := m.Logger.(StartupLogger); ok {
+		l.Startup(info)
+		return
+	}
+
+	m.Logger.ListeningOn(info.Addr)
+}
+
+// addrFamily returns the address family of the listener address. A TCP
+// listener without a host, like ":3000", accepts connections over both
+// families on the systems that support it.
+func addrFamily(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+
+	if !ok {
+		return addr.Network()
+	}
+
+	if tcp.IP.To4() != nil {
+		return "ipv4"
+	}
+
+	if tcp.IP == nil || tcp.IP.IsUnspecified() {
+		return "dual-stack"
+	}
+
+	return "ipv6"
+}
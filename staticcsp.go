@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// nonceMarker is the placeholder for the nonce in a ContentSecurityPolicy.
+const nonceMarker = "{nonce}"
+
+// nonceTags are the HTML elements that receive the nonce of the policy.
+var nonceTags = []string{"script", "style"}
+
+// ContentSecurityPolicy is the policy sent with the HTML files served by
+// STATIC, see StaticPolicy.
+type ContentSecurityPolicy struct {
+	// Policy is the value of the header, like "default-src 'self'". The
+	// "{nonce}" placeholder, if any, is replaced with a random nonce, like
+	// 'nonce-4AEemGb0xJptoIGFP3Nd', different for each response, which is
+	// also added to the <script> and <style> elements of the file.
+	Policy string `json:"policy"`
+	// ReportOnly sends the policy in "Content-Security-Policy-Report-Only"
+	// instead of "Content-Security-Policy", so the browsers report the
+	// violations without blocking the resources, which allows to test a new
+	// policy before enforcing it.
+	ReportOnly bool `json:"report_only"`
+}
+
+// header returns the name of the header for the policy.
+func (p ContentSecurityPolicy) header() string {
+	if p.ReportOnly {
+		return "Content-Security-Policy-Report-Only"
+	}
+
+	return "Content-Security-Policy"
+}
+
+// StaticPolicy sets the Content-Security-Policy of the HTML files served by
+// STATIC under the URL prefix, so the static landing pages get the same
+// protection as the pages rendered by the handlers. The policy replaces the
+// header set by the middlewares, if any. The longest prefix applies if there
+// are policies for nested prefixes.
+//
+// If the policy has the "{nonce}" placeholder, the router reads the HTML files
+// into memory to add the nonce to their <script> and <style> elements, and
+// sends them with "Cache-Control: no-store", because a nonce must never be
+// reused. The range and conditional requests do not apply to these files.
+//
+// Example:
+//
+//	srv.STATIC("/var/www/landing", "/welcome")
+//	srv.StaticPolicy("/welcome", middleware.ContentSecurityPolicy{
+//	    Policy: "default-src 'self'; script-src 'self' {nonce}; style-src 'self' {nonce}",
+//	})
+func (r *router) StaticPolicy(urlPrefix string, policy ContentSecurityPolicy) {
+	host := r.host()
+
+	if host.policies == nil {
+		host.policies = map[string]ContentSecurityPolicy{}
+	}
+
+	host.policies[strings.TrimRight(r.prefix+urlPrefix, "/")] = policy
+}
+
+// staticPolicy returns the policy of the HTML file at the URL path, if any.
+func (r *router) staticPolicy(urlPath string) (ContentSecurityPolicy, bool) {
+	if len(r.policies) == 0 {
+		return ContentSecurityPolicy{}, false
+	}
+
+	if ext := strings.ToLower(path.Ext(urlPath)); ext != ".html" && ext != ".htm" {
+		return ContentSecurityPolicy{}, false
+	}
+
+	for prefix := urlPath; prefix != ""; prefix = prefix[:strings.LastIndexByte(prefix, '/')] {
+		if policy, ok := r.policies[prefix]; ok {
+			return policy, true
+		}
+	}
+
+	policy, ok := r.policies[""]
+
+	return policy, ok
+}
+
+// serveWithNonce sends the HTML file with a new nonce in the policy and in the
+// <script> and <style> elements.
+func serveWithNonce(w http.ResponseWriter, filename string, policy ContentSecurityPolicy) {
+	body, err := os.ReadFile(filename)
+
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var b [16]byte
+
+	if _, err := rand.Read(b[:]); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	nonce := base64.RawStdEncoding.EncodeToString(b[:])
+	body = addNonce(body, nonce)
+
+	h := w.Header()
+	h.Set(policy.header(), strings.ReplaceAll(policy.Policy, nonceMarker, "'nonce-"+nonce+"'"))
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// addNonce adds the nonce attribute to the opening tags of the elements that
+// support it in the HTML document.
+func addNonce(body []byte, nonce string) []byte {
+	var out bytes.Buffer
+
+	out.Grow(len(body) + 64)
+
+	for len(body) > 0 {
+		i := bytes.IndexByte(body, '<')
+
+		if i < 0 {
+			out.Write(body)
+			break
+		}
+
+		out.Write(body[:i+1])
+		body = body[i+1:]
+
+		for _, tag := range nonceTags {
+			n := len(tag)
+
+			if len(body) > n && strings.EqualFold(string(body[:n]), tag) && isTagEnd(body[n]) {
+				out.Write(body[:n])
+				out.WriteString(` nonce="` + nonce + `"`)
+				body = body[n:]
+				break
+			}
+		}
+	}
+
+	return out.Bytes()
+}
+
+// isTagEnd reports whether the character ends the name of an HTML tag.
+func isTagEnd(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '/' || c == '>'
+}
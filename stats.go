@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"sort"
+	"unsafe"
+)
+
+// Stats describes the size of the trie associated to an HTTP method of a host.
+//
+// Servers with tens of thousands of generated routes can use this information
+// to understand the memory footprint of the router. The memory estimate counts
+// the nodes, the parameter names and the maps that link every node with its
+// children. It does not include the memory used by the HTTP handlers.
+type Stats struct {
+	// Host is the hostname associated to the trie, or "_" for the default host.
+	Host string
+	// Method is the HTTP method associated to the trie.
+	Method string
+	// Nodes is the number of nodes in the trie, including the root node.
+	Nodes int
+	// Routes is the number of nodes marked as the end of an endpoint.
+	Routes int
+	// MaxDepth is the number of nodes in the longest branch of the trie.
+	MaxDepth int
+	// Bytes is an approximation of the memory used by the trie.
+	Bytes int
+}
+
+// mapEntrySize is an approximation of the memory used by every entry in the
+// children map of a trie node, which is the key, the pointer to the node, and
+// the proportional cost of the bucket metadata.
+const mapEntrySize = 1 + 8 + 7
+
+// mapHeaderSize is an approximation of the memory used by an empty map.
+const mapHeaderSize = 48
+
+// Stats returns node counts, memory estimates and the maximum depth of every
+// trie in the router, sorted by host and HTTP method.
+func (m *Middleware) Stats() []Stats {
+	var out []Stats
+
+	m.hostsMu.RLock()
+	defer m.hostsMu.RUnlock()
+
+	for host, router := range m.hosts {
+		for method, trie := range router.nodes {
+			s := Stats{Host: host, Method: method}
+			s.MaxDepth = trie.root.stats(&s)
+			out = append(out, s)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Host != out[j].Host {
+			return out[i].Host < out[j].Host
+		}
+		return out[i].Method < out[j].Method
+	})
+
+	return out
+}
+
+// stats accumulates the node statistics and returns the depth of the branch.
+func (n *privTrieNode) stats(s *Stats) int {
+	s.Nodes++
+	s.Bytes += int(unsafe.Sizeof(*n)) + len(n.parameter) + len(n.constraint)
+	s.Bytes += mapHeaderSize + len(n.children)*mapEntrySize
+
+	if n.isTheEnd {
+		s.Routes++
+	}
+
+	depth := 0
+
+	for _, child := range n.children {
+		if d := child.stats(s); d > depth {
+			depth = d
+		}
+	}
+
+	return depth + 1
+}
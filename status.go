@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// serverStatus is the JSON response of the status endpoint.
+type serverStatus struct {
+	Hosts       []string          `json:"hosts"`
+	Routes      []RouteInfo       `json:"routes"`
+	Middlewares []string          `json:"middlewares"`
+	Build       buildStatus       `json:"build"`
+	Uptime      string            `json:"uptime"`
+	Config      map[string]string `json:"config"`
+}
+
+// buildStatus is the build information embedded in the binary.
+type buildStatus struct {
+	GoVersion string `json:"go_version"`
+	Path      string `json:"path"`
+	Version   string `json:"version"`
+}
+
+// EnableStatus registers an endpoint in the default host that responds with the
+// route table, virtual hosts, middleware chain, build information, uptime and
+// timeouts of the web server in JSON format, which is useful to debug servers
+// with multiple hosts. The endpoint is restricted to the given networks, which
+// are passed to the AllowOnly function. If the list is empty, only the local
+// machine is allowed to access the data.
+//
+// Example:
+//
+//	srv.EnableStatus("/_server/status")
+func (m *Middleware) EnableStatus(endpoint string, allowed ...string) {
+	handler := AllowOnly(allowed...)(http.HandlerFunc(m.statusHandler))
+
+	m.GET(endpoint, handler.ServeHTTP)
+}
+
+// statusHandler writes the status of the web server.
+func (m *Middleware) statusHandler(w http.ResponseWriter, r *http.Request) {
+	status := serverStatus{
+		Routes:      m.Routes(),
+		Middlewares: append([]string{}, m.chainNames...),
+		Build:       buildStatus{GoVersion: runtime.Version()},
+		Config: map[string]string{
+			"ReadTimeout":       m.ReadTimeout.String(),
+			"ReadHeaderTimeout": m.ReadHeaderTimeout.String(),
+			"WriteTimeout":      m.WriteTimeout.String(),
+			"IdleTimeout":       m.IdleTimeout.String(),
+			"ShutdownTimeout":   m.ShutdownTimeout.String(),
+		},
+	}
+
+	status.Hosts = append(m.Hosts(), nohost)
+
+	sort.Strings(status.Hosts)
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		status.Build.Path = info.Main.Path
+		status.Build.Version = info.Main.Version
+	}
+
+	if !m.startTime.IsZero() {
+		status.Uptime = time.Since(m.startTime).String()
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	_ = JSON(w, r, status)
+}
+
+// funcName returns the name of a function, which is used to identify the
+// middlewares attached to the router.
+func funcName(f interface{}) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(f).Pointer())
+
+	if fn == nil {
+		return "unknown"
+	}
+
+	return fn.Name()
+}
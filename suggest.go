@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// maxSuggestPath is the length of the longest URL path for which the router
+// computes suggestions, because the cost grows with the square of the length.
+const maxSuggestPath = 256
+
+// maxSuggestCandidates is the number of paths for which the router computes
+// the edit distance, so routers with thousands of routes do not turn every
+// "404 Not Found" into an expensive request.
+const maxSuggestCandidates = 1000
+
+// suggestHandler returns a request handler that replies with "404 Not Found"
+// and the paths of the router closest to the requested one, see
+// Middleware.NotFoundSuggestions, as JSON, HTML or plain text, depending on
+// the "Accept" header of the request.
+func (m *Middleware) suggestHandler(router *router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths := router.suggestions(m.requestPath(r), m.NotFoundSuggestions)
+
+		if len(paths) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch Accepts(r, "text/plain", "application/json", "text/html") {
+		case "application/json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(struct {
+				Error       string   `json:"error"`
+				Suggestions []string `json:"suggestions"`
+			}{"404 page not found", paths})
+		case "text/html":
+			var buf strings.Builder
+
+			buf.WriteString("<!DOCTYPE html>\n<title>404 page not found</title>\n<h1>404 page not found</h1>\n<p>Did you mean:</p>\n<ul>\n")
+
+			for _, p := range paths {
+				buf.WriteString("<li><a href=\"" + html.EscapeString(p) + "\">" + html.EscapeString(p) + "</a></li>\n")
+			}
+
+			buf.WriteString("</ul>\n")
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(buf.String()))
+		default:
+			http.Error(w, "404 page not found\n\nDid you mean:\n"+strings.Join(paths, "\n"), http.StatusNotFound)
+		}
+	})
+}
+
+// suggestions returns up to limit paths of the router similar to the URL path,
+// sorted by their edit distance. The named parameters and the wildcards of the
+// patterns take the values of the same segments of the URL path, so the
+// suggestions are paths that the client can request as they are.
+func (r *router) suggestions(urlPath string, limit int) []string {
+	if limit <= 0 || len(urlPath) > maxSuggestPath {
+		return nil
+	}
+
+	type candidate struct {
+		path     string
+		distance int
+	}
+
+	var found []candidate
+	var evaluated int
+
+	seen := map[string]bool{}
+
+	for _, t := range r.nodes {
+		t.root.walk(func(node *privTrieNode) {
+			p, static := fillPattern(node.pattern, urlPath)
+
+			if evaluated >= maxSuggestCandidates || p == urlPath || seen[p] {
+				return
+			}
+
+			seen[p] = true
+
+			// the values copied from the URL path always match, so only the
+			// static segments of the pattern count towards the threshold.
+			threshold := static / 3
+
+			if threshold < 2 {
+				threshold = 2
+			}
+
+			// the edit distance is at least the difference in length.
+			if diff := len(p) - len(urlPath); diff > threshold || -diff > threshold {
+				return
+			}
+
+			evaluated++
+
+			if d := editDistance(urlPath, p); d <= threshold {
+				found = append(found, candidate{path: p, distance: d})
+			}
+		})
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].distance != found[j].distance {
+			return found[i].distance < found[j].distance
+		}
+		return found[i].path < found[j].path
+	})
+
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	out := make([]string, len(found))
+
+	for i, c := range found {
+		out[i] = c.path
+	}
+
+	return out
+}
+
+// fillPattern replaces the named parameters and the wildcard of the pattern
+// with the segments of the URL path in the same position, if any, and returns
+// the resulting path and the number of bytes that come from the pattern.
+func fillPattern(pattern string, urlPath string) (string, int) {
+	segments := strings.Split(pattern, "/")
+	values := strings.Split(urlPath, "/")
+	static := len(pattern)
+
+	for i, segment := range segments {
+		if i >= len(values) || values[i] == "" {
+			continue
+		}
+
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = values[i]
+			static -= len(segment)
+		} else if strings.HasPrefix(segment, "*") {
+			segments[i] = strings.Join(values[i:], "/")
+			static -= len(segment)
+		}
+	}
+
+	return strings.Join(segments, "/"), static
+}
+
+// editDistance returns the Levenshtein distance between two strings, which is
+// the number of single-byte insertions, deletions and substitutions required
+// to change one into the other.
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
+
+// min3 returns the smallest of three integers.
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+
+	if c < a {
+		a = c
+	}
+
+	return a
+}
@@ -0,0 +1,200 @@
+// Package testlogger implements a middleware.Logger that records the access
+// logs in memory, so tests can assert what the web server logged without a
+// hand-rolled logger. The logger is safe for concurrent use, which matters
+// because the web server writes the access log after the response was sent,
+// so a client can receive the response before the entry is recorded. Use the
+// Wait method to synchronize the test with the web server.
+//
+// Example:
+//
+//	logger := testlogger.New()
+//	srv.Logger = logger
+//	[…]
+//	entries, err := logger.Wait(1, time.Second)
+//	if err != nil || entries[0].StatusCode != http.StatusOK {
+//	    t.Fatal("unexpected access log")
+//	}
+package testlogger
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cixtor/middleware"
+)
+
+// ErrTimeout is returned by the Wait functions when the timeout expires.
+var ErrTimeout = errors.New("testlogger: timeout waiting for access logs")
+
+// Logger records the access logs, the listening addresses and the shutdown
+// errors sent by the web server. The zero value is ready to use.
+type Logger struct {
+	mu        sync.Mutex
+	entries   []middleware.AccessLog
+	addrs     []net.Addr
+	shutdowns []error
+	changed   chan struct{}
+}
+
+// New returns a new recording logger.
+func New() *Logger {
+	return &Logger{}
+}
+
+// ListeningOn implements the ListeningOn method for the middleware.Logger interface.
+func (l *Logger) ListeningOn(addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.addrs = append(l.addrs, addr)
+	l.notify()
+}
+
+// Shutdown implements the Shutdown method for the middleware.Logger interface.
+func (l *Logger) Shutdown(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.shutdowns = append(l.shutdowns, err)
+	l.notify()
+}
+
+// Log implements the Log method for the middleware.Logger interface.
+func (l *Logger) Log(data middleware.AccessLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, data)
+	l.notify()
+}
+
+// notify wakes up the goroutines blocked in one of the Wait functions. The
+// caller must hold the lock.
+func (l *Logger) notify() {
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// Entries returns a copy of the recorded access logs, in the same order in
+// which the web server sent them.
+func (l *Logger) Entries() []middleware.AccessLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]middleware.AccessLog(nil), l.entries...)
+}
+
+// Last returns the most recent access log, if any.
+func (l *Logger) Last() (middleware.AccessLog, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) == 0 {
+		return middleware.AccessLog{}, false
+	}
+
+	return l.entries[len(l.entries)-1], true
+}
+
+// Len returns the number of recorded access logs.
+func (l *Logger) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.entries)
+}
+
+// Addrs returns the addresses received by ListeningOn.
+func (l *Logger) Addrs() []net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]net.Addr(nil), l.addrs...)
+}
+
+// Shutdowns returns the errors received by Shutdown, which are nil after a
+// graceful shutdown.
+func (l *Logger) Shutdowns() []error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]error(nil), l.shutdowns...)
+}
+
+// Reset removes all the recorded data.
+func (l *Logger) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = nil
+	l.addrs = nil
+	l.shutdowns = nil
+}
+
+// Wait blocks until the logger has recorded at least n access logs, and then
+// returns all of them, or returns ErrTimeout if the timeout expires first.
+func (l *Logger) Wait(n int, timeout time.Duration) ([]middleware.AccessLog, error) {
+	var out []middleware.AccessLog
+
+	err := l.waitUntil(timeout, func() bool {
+		if len(l.entries) < n {
+			return false
+		}
+
+		out = append([]middleware.AccessLog(nil), l.entries...)
+		return true
+	})
+
+	return out, err
+}
+
+// WaitFor blocks until the logger records an access log for which the
+// function returns true, including the logs recorded before the call, and then
+// returns it, or returns ErrTimeout if the timeout expires first.
+func (l *Logger) WaitFor(fn func(middleware.AccessLog) bool, timeout time.Duration) (middleware.AccessLog, error) {
+	var out middleware.AccessLog
+
+	err := l.waitUntil(timeout, func() bool {
+		for _, entry := range l.entries {
+			if fn(entry) {
+				out = entry
+				return true
+			}
+		}
+
+		return false
+	})
+
+	return out, err
+}
+
+// waitUntil calls the function, while holding the lock, every time the logger
+// records new data, until it returns true or the timeout expires.
+func (l *Logger) waitUntil(timeout time.Duration, done func() bool) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		l.mu.Lock()
+		ok := done()
+		if l.changed == nil {
+			l.changed = make(chan struct{})
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
+}
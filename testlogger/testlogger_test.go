@@ -0,0 +1,70 @@
+package testlogger_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cixtor/middleware"
+	"github.com/cixtor/middleware/testlogger"
+)
+
+func TestLogger(t *testing.T) {
+	logger := testlogger.New()
+	srv := middleware.New()
+	srv.Logger = logger
+	srv.GET("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+
+	if _, ok := logger.Last(); ok {
+		t.Fatal("unexpected access log before the first request")
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+	}()
+
+	entries, err := logger.Wait(2, time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].StatusCode != http.StatusOK || entries[1].StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected access logs: %#v", entries)
+	}
+
+	entry, err := logger.WaitFor(func(a middleware.AccessLog) bool { return a.Path == "/missing" }, time.Second)
+
+	if err != nil || entry.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected access log: %#v %v", entry, err)
+	}
+
+	if last, ok := logger.Last(); !ok || last.Path != "/missing" {
+		t.Fatalf("unexpected last access log: %#v", last)
+	}
+
+	logger.Reset()
+
+	if _, err := logger.Wait(1, time.Millisecond*10); err != testlogger.ErrTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestLoggerServer(t *testing.T) {
+	var logger testlogger.Logger
+	srv := middleware.New()
+	srv.Logger = &logger
+
+	ready := make(chan net.Addr, 1)
+	go srv.ListenAndServeReady("127.0.0.1:0", ready)
+	addr := <-ready
+	srv.Shutdown()
+
+	if addrs := logger.Addrs(); len(addrs) != 1 || addrs[0].String() != addr.String() {
+		t.Fatalf("unexpected listening addresses: %v", addrs)
+	}
+}
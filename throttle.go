@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// streamRequestHeaders is the list of request headers forwarded by StreamURL,
+// so the upstream server handles the ranges and the conditional requests.
+var streamRequestHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// streamResponseHeaders is the list of response headers copied by StreamURL.
+var streamResponseHeaders = []string{
+	"Accept-Ranges",
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+}
+
+// Throttle returns a middleware that limits the speed of the response body to
+// the number of bytes per second, which prevents a few clients downloading
+// large files from saturating the bandwidth of the server. The limit applies
+// to each response, which, over HTTP/1.1, is the same as a limit per
+// connection, because the client sends one request at a time.
+//
+// Example:
+//
+//	srv.GET("/videos/*", videos).Use(middleware.Throttle(512 << 10))
+func Throttle(bytesPerSecond int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(throttle(w, r, bytesPerSecond), r)
+		})
+	}
+}
+
+// StreamFile sends the file to the client at no more than the number of bytes
+// per second, or without limits if the number is zero. The function supports
+// range requests, so the clients can seek inside media files or resume the
+// downloads, and conditional requests with "If-Modified-Since", like
+// http.ServeFile. It responds with "404 Not Found" if the file does not exist.
+//
+// Example:
+//
+//	srv.GET("/downloads/:name", func(w http.ResponseWriter, r *http.Request) {
+//	    middleware.StreamFile(w, r, filepath.Join("/srv/downloads", filepath.Base(middleware.Param(r, "name"))), 1<<20)
+//	})
+func StreamFile(w http.ResponseWriter, r *http.Request, name string, bytesPerSecond int64) {
+	f, err := os.Open(name)
+
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+
+	if err != nil || info.IsDir() {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	http.ServeContent(throttle(w, r, bytesPerSecond), r, info.Name(), info.ModTime(), f)
+}
+
+// StreamURL sends the response of a GET request to the upstream URL to the
+// client at no more than the number of bytes per second, or without limits if
+// the number is zero. The "Range" and the conditional headers of the request
+// are forwarded to the upstream server, and its status code and the headers
+// that describe the content, like "Content-Range" or "ETag", are copied into
+// the response, so the range requests work end to end without buffering the
+// body. It responds with "502 Bad Gateway" if the upstream server fails.
+//
+// The returned error, if any, is the one that interrupted the stream, for
+// example, because the client disconnected.
+//
+// Example:
+//
+//	srv.GET("/media/*", func(w http.ResponseWriter, r *http.Request) {
+//	    _ = middleware.StreamURL(w, r, "https://storage.example.com"+r.URL.Path, 2<<20)
+//	})
+func StreamURL(w http.ResponseWriter, r *http.Request, target string, bytesPerSecond int64) error {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return err
+	}
+
+	for _, key := range streamRequestHeaders {
+		if values := r.Header.Values(key); len(values) > 0 {
+			req.Header[key] = values
+		}
+	}
+
+	res, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return err
+	}
+
+	defer res.Body.Close()
+
+	for _, key := range streamResponseHeaders {
+		if values := res.Header.Values(key); len(values) > 0 {
+			w.Header()[key] = values
+		}
+	}
+
+	w.WriteHeader(res.StatusCode)
+
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	_, err = io.Copy(throttle(w, r, bytesPerSecond), res.Body)
+
+	return err
+}
+
+// throttle wraps the writer to limit the speed of the response body, unless
+// the number of bytes per second is zero.
+func throttle(w http.ResponseWriter, r *http.Request, bytesPerSecond int64) http.ResponseWriter {
+	if bytesPerSecond <= 0 {
+		return w
+	}
+
+	chunk := int(bytesPerSecond / 10)
+
+	if chunk < 512 {
+		chunk = 512
+	}
+
+	return &throttledResponse{ResponseWriter: w, ctx: r.Context(), rate: bytesPerSecond, chunk: chunk}
+}
+
+// throttledResponse writes the response body in small chunks, and waits
+// between them as long as necessary to keep the average speed under the rate.
+type throttledResponse struct {
+	http.ResponseWriter
+	ctx   context.Context
+	rate  int64
+	chunk int
+	start time.Time
+	sent  int64
+}
+
+// Unwrap returns the original http.ResponseWriter.
+func (t *throttledResponse) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Write sends the data at the configured rate, and stops early if the client
+// disconnects.
+func (t *throttledResponse) Write(b []byte) (int, error) {
+	var total int
+
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+
+	for len(b) > 0 {
+		n := len(b)
+
+		if n > t.chunk {
+			n = t.chunk
+		}
+
+		written, err := t.ResponseWriter.Write(b[:n])
+		total += written
+		t.sent += int64(written)
+
+		if err != nil {
+			return total, err
+		}
+
+		b = b[n:]
+
+		due := t.start.Add(time.Duration(t.sent * int64(time.Second) / t.rate))
+
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return total, t.ctx.Err()
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// Flush sends the buffered data to the client.
+func (t *throttledResponse) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -1,7 +1,12 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // sep represents the endpoint folder separator.
@@ -24,19 +29,26 @@ var nps byte = ':'
 //
 // Example:
 //
-//	/lorem/ipsum/*/dolor/sit/amet
-//	              ^^^^^^^^^^^^^^^ this are not inserted in the trie.
+//	/lorem/ipsum/*
+//	             ^ matches "/lorem/ipsum/dolor/sit/amet" and similar URLs.
 var all byte = '*'
 
 type privTrie struct {
-	root *privTrieNode
+	root   *privTrieNode
+	static map[string]*privTrieNode
 }
 
 type privTrieNode struct {
-	children  map[byte]*privTrieNode
-	parameter string
-	isTheEnd  bool
-	handler   http.Handler
+	children   map[byte]*privTrieNode
+	parameter  string
+	constraint string
+	matcher    *regexp.Regexp
+	isTheEnd   bool
+	handler    http.Handler
+	pattern    string
+	audited    bool
+	route      *Route
+	composed   http.Handler
 }
 
 func newPrivTrie() *privTrie {
@@ -47,46 +59,100 @@ func newPrivTrieNode() *privTrieNode {
 	return &privTrieNode{children: make(map[byte]*privTrieNode)}
 }
 
-func (t *privTrie) Insert(endpoint string, fn http.Handler) {
+func (t *privTrie) Insert(endpoint string, fn http.Handler) *privTrieNode {
 	node := t.root
 	total := len(endpoint)
 	for i := 0; i < total; i++ {
 		char := endpoint[i]
-		param := ""
+		segment := ""
 		if char == nps && endpoint[i-1] == sep {
 			j := i + 1
 			for ; j < total && endpoint[j] != sep; j++ {
 				// Consume all characters that follow a colon until we find the
 				// next forward slash or the end of the endpoint. Then, select
-				// those characters and use them as the parameter name.
+				// those characters and use them as the parameter name and the
+				// optional constraint, like "id(int)".
 			}
-			param = endpoint[i+1 : j]
-			i += len(param)
+			segment = endpoint[i+1 : j]
+			i += len(segment)
 		}
 		if node.children[char] == nil {
 			// Initialize a trie for this specific character.
 			node.children[char] = newPrivTrieNode()
 		}
-		if param != "" {
-			// Write the parameter name, if available.
-			node.children[char].parameter = param
+		if segment != "" {
+			// Write the parameter name and the constraint, if available. The
+			// routes share the node, so the last registration wins, which is
+			// reported by Middleware.RouteConflicts.
+			child := node.children[char]
+			child.parameter, child.constraint = splitParam(segment)
+			child.matcher = nil
+			if child.constraint != "" {
+				child.matcher, _ = compileConstraint(child.constraint)
+			}
 		}
 		node = node.children[char]
 		if char == all && endpoint[i-1] == sep {
 			// If the character is an asterisk and the previous character is a
 			// URL separator, commonly a forward slash, then stop inserting new
-			// nodes and mark this character the end of the URL.
+			// nodes and mark this character the end of the URL. The rest of
+			// the endpoint, if any, is the name of the wildcard, like in
+			// "/files/*filepath".
+			node.parameter = endpoint[i+1:]
 			break
 		}
 	}
 	node.isTheEnd = true
 	node.handler = fn
+	node.pattern = endpoint
+	return node
+}
+
+// Reject reports whether the endpoint cannot match any route in the trie by
+// looking only at the first character after the leading folder separator.
+// The endpoint is the URL path before cleanup.
+//
+// Most requests sent by scanners and bots point to endpoints that do not exist
+// like "/wp-admin/" or "/.env", which means the router can reply with "404 Not
+// Found" without the need to clean the URL path or to traverse the trie. The
+// function returns false when the URL path has a double slash or a dot segment
+// anywhere, like "/x/../api", because the cleanup may change the first segment
+// and the path may point to a valid endpoint afterwards.
+func (t *privTrie) Reject(endpoint string) bool {
+	if len(endpoint) < 2 || strings.Contains(endpoint, "//") || strings.Contains(endpoint, "/.") {
+		return false
+	}
+
+	node := t.root.children[sep]
+
+	if node == nil {
+		return false
+	}
+
+	return node.children[endpoint[1]] == nil &&
+		node.children[nps] == nil &&
+		node.children[all] == nil
+}
+
+// Search reports whether the endpoint matches a route, and returns the node of
+// the route and the values of the named parameters. Endpoints with control
+// characters or invalid UTF-8 never match, because the static segments cannot
+// contain them, see ValidatePattern, and the parameters and the wildcards do
+// not capture them. A value that does not match the constraint of a parameter,
+// like "abc" for ":id(int)", falls through to the wildcard in the same
+// position, if any, or does not match. The constraint only checks the segment,
+// a value that matches it never backtracks to the wildcard.
+func (t *privTrie) Search(endpoint string) (bool, *privTrieNode, map[string]string) {
+	return t.search(endpoint, nil)
 }
 
-func (t *privTrie) Search(endpoint string) (bool, http.Handler, map[string]string) {
+// search implements Search, and reports the traversal decisions to the trace
+// function, if not nil, which is used by Middleware.Debug.
+func (t *privTrie) search(endpoint string, trace func(string, ...interface{})) (bool, *privTrieNode, map[string]string) {
 	node := t.root
 	total := len(endpoint)
 	params := map[string]string{}
+	skipped := ""
 
 	for i := 0; i < total; i++ {
 		char := endpoint[i]
@@ -115,12 +181,16 @@ func (t *privTrie) Search(endpoint string) (bool, http.Handler, map[string]strin
 		// and that is the one the algorithm selects to continue checking for
 		// the other URL segments.
 		if node.children[char] != nil {
+			if trace != nil && node.children[nps] != nil {
+				skipped = node.children[nps].parameter
+				trace("static segment preferred over :%s at %q", skipped, endpoint[:i])
+			}
 			node = node.children[char]
 			continue
 		}
 
 		// Check if there is a parameterized URL segment under this node.
-		if node.children[nps] != nil {
+		if param := node.children[nps]; param != nil {
 			j := i
 			for ; j < total && endpoint[j] != sep; j++ {
 				// Consume all characters between the colon and the next slash.
@@ -144,17 +214,55 @@ func (t *privTrie) Search(endpoint string) (bool, http.Handler, map[string]strin
 				// of characters in the parameter value.
 			}
 			value := endpoint[i:j]
-			i += len(value) - 1
-			params[node.children[nps].parameter] = value
-			node = node.children[nps]
-			continue
+			if !isPrintablePath(value) {
+				// Parameters never capture control characters or invalid
+				// UTF-8, the same way static segments never match them.
+				if trace != nil {
+					trace("rejected :%s=%q, control characters or invalid UTF-8", param.parameter, value)
+				}
+				return false, nil, nil
+			}
+			if param.matcher == nil || param.matcher.MatchString(value) {
+				i += len(value) - 1
+				params[param.parameter] = value
+				if trace != nil {
+					trace("captured :%s=%q", param.parameter, value)
+				}
+				node = param
+				continue
+			}
+			// The value does not satisfy the constraint, try the wildcard in
+			// the same position, if any, before rejecting the endpoint.
+			if trace != nil {
+				trace("rejected :%s=%q, does not match the constraint (%s)", param.parameter, value, param.constraint)
+			}
 		}
 
 		if node.children[all] != nil {
+			if !isPrintablePath(endpoint[i:]) {
+				if trace != nil {
+					trace("rejected wildcard %q, control characters or invalid UTF-8", endpoint[i:])
+				}
+				return false, nil, nil
+			}
+			if trace != nil {
+				trace("wildcard matched %q", endpoint[i:])
+			}
 			node = node.children[all]
+			if node.parameter != "" {
+				params[node.parameter] = endpoint[i:]
+			}
 			break
 		}
 
+		if trace != nil {
+			trace("rejected at %q, next character %q, candidates: %s", endpoint[:i], char, node.candidates())
+
+			if skipped != "" {
+				trace("the router does not backtrack to :%s after choosing a static segment", skipped)
+			}
+		}
+
 		return false, nil, nil
 	}
 
@@ -179,8 +287,139 @@ func (t *privTrie) Search(endpoint string) (bool, http.Handler, map[string]strin
 		// at "/", there is no character to match.
 		//
 		// This condition handles this edge case.
-		return node.children[all].isTheEnd, node.children[all].handler, params
+		if name := node.children[all].parameter; name != "" {
+			params[name] = ""
+		}
+		return node.children[all].isTheEnd, node.children[all], params
+	}
+
+	if trace != nil && !node.isTheEnd {
+		trace("%q is a prefix of other routes but not a route, candidates: %s", endpoint, node.candidates())
+	}
+
+	return node.isTheEnd, node, params
+}
+
+// candidates describes the children of the node, for debug messages.
+func (n *privTrieNode) candidates() string {
+	var out []string
+
+	for char, child := range n.children {
+		switch {
+		case char == nps:
+			out = append(out, paramLabel(child.parameter, child.constraint))
+		case char == all:
+			out = append(out, "*"+child.parameter)
+		default:
+			out = append(out, strconv.Quote(string(char)))
+		}
+	}
+
+	if len(out) == 0 {
+		return "none"
+	}
+
+	sort.Strings(out)
+
+	return strings.Join(out, ", ")
+}
+
+// ValidatePattern reports whether the endpoint is a valid route pattern. The
+// router calls it every time a route is registered, and panics if the pattern
+// is malformed, because such pattern produces a route that never matches the
+// expected requests.
+//
+// A valid pattern starts with a folder separator, uses named parameters only
+// at the beginning of a URL segment, with a non-empty name that is unique in
+// the pattern, and has nothing after a wildcard segment but its name. The
+// pattern must be valid UTF-8 without control characters, like the request
+// paths the router accepts.
+//
+// A named parameter may have a constraint between parentheses after the name,
+// either a regular expression that must match the complete value, or one of
+// the named constraints: int, alpha, alnum, hex, slug and uuid. The constraint
+// cannot contain a folder separator, because the values never do.
+//
+// A wildcard segment may have a name, like "filepath" in "/files/*filepath",
+// to receive the rest of the path as a named parameter.
+//
+// Example:
+//
+//	middleware.ValidatePattern("/users/:id/posts/:post") // nil
+//	middleware.ValidatePattern("/users/:id([0-9]+)")     // nil
+//	middleware.ValidatePattern("/posts/:slug(slug)")     // nil
+//	middleware.ValidatePattern("/files/*filepath")       // nil
+//	middleware.ValidatePattern("/users/:id/posts/:id")   // duplicate parameter
+//	middleware.ValidatePattern("/users/:id([0-9+)")      // invalid constraint
+//	middleware.ValidatePattern("/users/*/posts")         // segments after wildcard
+func ValidatePattern(endpoint string) error {
+	if endpoint == "" || endpoint[0] != sep {
+		return errors.New("middleware: pattern must start with a slash " + endpoint)
+	}
+
+	if !isPrintablePath(endpoint) {
+		return errors.New("middleware: control characters or invalid UTF-8 in pattern " + strconv.Quote(endpoint))
+	}
+
+	names := map[string]bool{}
+	total := len(endpoint)
+
+	for i := 1; i < total; i++ {
+		char := endpoint[i]
+
+		if char == nps {
+			if endpoint[i-1] != sep {
+				return errors.New("middleware: parameter not at the beginning of a segment " + endpoint)
+			}
+
+			j := i + 1
+			for ; j < total && endpoint[j] != sep; j++ {
+			}
+			name, constraint := splitParam(endpoint[i+1 : j])
+
+			if name == "" {
+				return errors.New("middleware: empty parameter name " + endpoint)
+			}
+
+			if strings.ContainsAny(name, "()") {
+				return errors.New("middleware: malformed parameter constraint " + endpoint)
+			}
+
+			if constraint != "" {
+				if _, err := compileConstraint(constraint); err != nil {
+					return errors.New(err.Error() + " " + endpoint)
+				}
+			} else if endpoint[j-1] == ')' {
+				return errors.New("middleware: empty parameter constraint " + endpoint)
+			}
+
+			if names[name] {
+				return errors.New("middleware: duplicate parameter " + name + " " + endpoint)
+			}
+
+			names[name] = true
+			i = j - 1
+			continue
+		}
+
+		if char == all && endpoint[i-1] == sep {
+			name := endpoint[i+1:]
+
+			if strings.IndexByte(name, sep) >= 0 {
+				return errors.New("middleware: segments after wildcard " + endpoint)
+			}
+
+			if strings.ContainsAny(name, "():*") {
+				return errors.New("middleware: malformed wildcard name " + endpoint)
+			}
+
+			if names[name] {
+				return errors.New("middleware: duplicate parameter " + name + " " + endpoint)
+			}
+
+			break
+		}
 	}
 
-	return node.isTheEnd, node.handler, params
+	return nil
 }
@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package middleware
+
+import (
+	"testing"
+)
+
+// FuzzTrieSearch checks that the search never panics, and never captures
+// control characters or invalid UTF-8, for arbitrary request paths. The seed
+// corpus is in testdata/fuzz/FuzzTrieSearch.
+func FuzzTrieSearch(f *testing.F) {
+	root := newPrivTrie()
+
+	root.Insert("/", nil)
+	root.Insert("/users/:id", nil)
+	root.Insert("/users/:id/posts/:post", nil)
+	root.Insert("/users/new", nil)
+	root.Insert("/files/*", nil)
+	root.Insert("/café/menu", nil)
+
+	f.Add("/users/42/posts/7")
+	f.Add("/files/a/b/c")
+
+	f.Fuzz(func(t *testing.T, endpoint string) {
+		found, node, params := root.Search(endpoint)
+
+		if !found {
+			return
+		}
+
+		if !isPrintablePath(endpoint) {
+			t.Fatalf("unexpected match for %q: %s", endpoint, node.pattern)
+		}
+
+		for name, value := range params {
+			if !isPrintablePath(value) {
+				t.Fatalf("unexpected parameter %s=%q in %q", name, value, endpoint)
+			}
+		}
+	})
+}
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -276,3 +277,225 @@ func TestTrieWithAsteriskGlobal(t *testing.T) {
 		})
 	}
 }
+
+func TestTrieStats(t *testing.T) {
+	srv := New()
+	srv.GET("/ab", nil)
+	srv.GET("/ac/:id", nil)
+	srv.POST("/a", nil)
+	srv.Host("foo.test").GET("/", nil)
+
+	stats := srv.Stats()
+
+	expected := []Stats{
+		{Host: "_", Method: "GET", Nodes: 7, Routes: 2, MaxDepth: 6},
+		{Host: "_", Method: "POST", Nodes: 3, Routes: 1, MaxDepth: 3},
+		{Host: "foo.test", Method: "GET", Nodes: 2, Routes: 1, MaxDepth: 2},
+	}
+
+	if len(stats) != len(expected) {
+		t.Fatalf("unexpected number of tries: %#v", stats)
+	}
+
+	for i, s := range stats {
+		if s.Bytes <= 0 {
+			t.Fatalf("unexpected memory estimate: %#v", s)
+		}
+
+		s.Bytes = 0
+
+		if s != expected[i] {
+			t.Fatalf("unexpected trie stats:\n- %#v\n+ %#v", expected[i], s)
+		}
+	}
+}
+
+func TestTrieReject(t *testing.T) {
+	root := newPrivTrie()
+
+	root.Insert("/", nil)
+	root.Insert("/api/v1/users/:id", nil)
+	root.Insert("/blog/:slug", nil)
+
+	testCases := []struct {
+		reject bool
+		query  string
+	}{
+		{reject: false, query: "/"},
+		{reject: false, query: "/api"},
+		{reject: false, query: "/blog/hello"},
+		{reject: false, query: "//api"},
+		{reject: false, query: "/./api"},
+		{reject: false, query: "/../blog"},
+		{reject: false, query: "/x/../api"},
+		{reject: false, query: "/x/./../blog/hello"},
+		{reject: false, query: "/x//../api"},
+		{reject: true, query: "/wp-admin/"},
+		{reject: true, query: "/xmlrpc.php"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			if rejected := root.Reject(tc.query); rejected != tc.reject {
+				t.Fatalf("rejecting %s should return %#v", tc.query, tc.reject)
+			}
+		})
+	}
+
+	root.Insert("/:page", nil)
+
+	if root.Reject("/wp-admin/") {
+		t.Fatal("parameterized routes should accept any first character")
+	}
+}
+
+func TestTrieControlCharacters(t *testing.T) {
+	root := newPrivTrie()
+
+	root.Insert("/", nil)
+	root.Insert("/users/:id", nil)
+	root.Insert("/files/*", nil)
+	root.Insert("/café", nil)
+
+	testCases := []struct {
+		found bool
+		query string
+	}{
+		{found: true, query: "/users/42"},
+		{found: true, query: "/users/josé"},
+		{found: true, query: "/files/a/b.txt"},
+		{found: true, query: "/café"},
+		{found: false, query: "/users/42\x00.txt"},
+		{found: false, query: "/users/\n42"},
+		{found: false, query: "/users/\x7f"},
+		{found: false, query: "/users/\xff"},
+		{found: false, query: "/users/caf\xc3"},
+		{found: false, query: "/files/a\x00/b.txt"},
+		{found: false, query: "/files/\xc3\x28"},
+		{found: false, query: "/caf\xc3"},
+		{found: false, query: "/\x00"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			if wasFound, _, _ := root.Search(tc.query); wasFound != tc.found {
+				t.Fatalf("searching for %q should return %#v", tc.query, tc.found)
+			}
+		})
+	}
+
+	for _, pattern := range []string{"/users\x00", "/a\nb", "/caf\xc3", "/\x7f"} {
+		if err := ValidatePattern(pattern); err == nil {
+			t.Fatalf("expecting pattern %q to be invalid", pattern)
+		}
+	}
+}
+
+func TestTrieConstraints(t *testing.T) {
+	root := newPrivTrie()
+
+	root.Insert("/users/:id([0-9]+)", nil)
+	root.Insert("/posts/:slug(slug)/comments", nil)
+	root.Insert("/files/:id(uuid)", nil)
+	root.Insert("/files/*", nil)
+
+	testCases := []struct {
+		found   bool
+		query   string
+		pattern string
+		value   string
+	}{
+		{found: true, query: "/users/42", pattern: "/users/:id([0-9]+)", value: "42"},
+		{found: false, query: "/users/abc"},
+		{found: false, query: "/users/42abc"},
+		{found: true, query: "/posts/hello-world/comments", pattern: "/posts/:slug(slug)/comments", value: "hello-world"},
+		{found: false, query: "/posts/Hello_World/comments"},
+		{found: true, query: "/files/0b5e1e4a-8d3c-4f8e-9a41-5d2b8c7e6f10", pattern: "/files/:id(uuid)", value: "0b5e1e4a-8d3c-4f8e-9a41-5d2b8c7e6f10"},
+		{found: true, query: "/files/report.pdf", pattern: "/files/*"},
+		{found: true, query: "/files/a/b.txt", pattern: "/files/*"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			wasFound, node, params := root.Search(tc.query)
+
+			if wasFound != tc.found {
+				t.Fatalf("searching for %q should return %#v", tc.query, tc.found)
+			}
+
+			if !tc.found {
+				return
+			}
+
+			if node.pattern != tc.pattern {
+				t.Fatalf("searching for %q should match %q, got %q", tc.query, tc.pattern, node.pattern)
+			}
+
+			for _, value := range params {
+				if value != tc.value {
+					t.Fatalf("searching for %q should capture %q, got %q", tc.query, tc.value, value)
+				}
+			}
+		})
+	}
+
+	for _, pattern := range []string{"/users/:id([0-9+)", "/users/:id()", "/users/:id(a)|(b)", "/users/:id(int", "/users/:(int)", "/users/:i(d)x"} {
+		if err := ValidatePattern(pattern); err == nil {
+			t.Fatalf("expecting pattern %q to be invalid", pattern)
+		}
+	}
+}
+
+func TestTrieNamedWildcard(t *testing.T) {
+	root := newPrivTrie()
+
+	root.Insert("/*page", nil)
+	root.Insert("/files/*filepath", nil)
+	root.Insert("/users/:id/*rest", nil)
+
+	testCases := []struct {
+		found   bool
+		webpage string
+		params  map[string]string
+	}{
+		{found: true, webpage: "/", params: map[string]string{"page": ""}},
+		{found: true, webpage: "/about", params: map[string]string{"page": "about"}},
+		{found: true, webpage: "/files/a.txt", params: map[string]string{"filepath": "a.txt"}},
+		{found: true, webpage: "/files/a/b/c.txt", params: map[string]string{"filepath": "a/b/c.txt"}},
+		{found: true, webpage: "/files/a/b/", params: map[string]string{"filepath": "a/b/"}},
+		{found: true, webpage: "/users/42/posts/1", params: map[string]string{"id": "42", "rest": "posts/1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.webpage, func(t *testing.T) {
+			wasFound, _, params := root.Search(tc.webpage)
+			if wasFound != tc.found {
+				t.Fatalf("searching for %q should return %#v", tc.webpage, tc.found)
+			}
+			if tc.found && !reflect.DeepEqual(params, tc.params) {
+				t.Fatalf("searching for %q\n- %#v\n+ %#v", tc.webpage, params, tc.params)
+			}
+		})
+	}
+
+	for _, pattern := range []string{"/files/*path/more", "/files/*pa:th", "/files/*p(x)", "/users/:id/*id"} {
+		if err := ValidatePattern(pattern); err == nil {
+			t.Fatalf("expecting pattern %q to be invalid", pattern)
+		}
+	}
+}
+
+func TestSuggestionsCandidates(t *testing.T) {
+	r := newRouter(nil)
+
+	for i := 0; i < 1500; i++ {
+		r.GET("/resource/"+strconv.Itoa(1000+i), nil)
+	}
+
+	r.GET("/a/much/longer/path/with/the/same/prefix", nil)
+
+	if found := r.suggestions("/resource/xxxx", 5000); len(found) != maxSuggestCandidates {
+		t.Fatalf("expecting %d suggestions, got %d", maxSuggestCandidates, len(found))
+	}
+
+	if found := r.suggestions("/a/much/longer/path/with/the/same/prefiks", 5); len(found) != 1 {
+		t.Fatalf("expecting the close path only, got %q", found)
+	}
+}
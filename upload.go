@@ -0,0 +1,293 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultUploadSize is the maximum size of each uploaded file if the
+// configuration does not set one.
+const defaultUploadSize = 32 << 20
+
+var (
+	errUploadTooLarge = errors.New("file too large")
+	errUploadExists   = errors.New("file already exists")
+	errUploadNoDir    = errors.New("directory does not exist")
+)
+
+// UploadConfig configures the endpoints registered with UPLOAD.
+type UploadConfig struct {
+	// MaxSize is the maximum size of each file, in bytes. Larger files are
+	// rejected with "413 Request Entity Too Large". Default: 32 MiB.
+	MaxSize int64
+	// Overwrite allows to replace the existing files. Otherwise, uploading a
+	// file that already exists fails with "409 Conflict".
+	Overwrite bool
+	// CreateDirs creates the missing directories in the path of the files.
+	// Otherwise, uploading a file into a missing directory fails with "409
+	// Conflict".
+	CreateDirs bool
+	// FileMode is the permission of the uploaded files. Default: 0644.
+	FileMode os.FileMode
+}
+
+// UPLOAD registers the endpoints to upload files into a folder, which is the
+// counterpart of STATIC for simple artifact servers. The files are sent either
+// in the body of a PUT or POST request to the URL of the file, or as the file
+// parts of a "multipart/form-data" POST request to the URL of the directory,
+// in which case the files keep the name sent by the client.
+//
+// The router responds with "201 Created" and the "Location" of the file if it
+// is new, or "204 No Content" if it replaced an existing file. The files are
+// written into a temporary file in the same directory, then moved into place,
+// so the clients downloading a file never receive a partial upload. Paths with
+// hidden segments, like "/.git/config", are rejected with "403 Forbidden".
+//
+// Example:
+//
+//	srv.UPLOAD("/artifacts", "/var/www/artifacts", middleware.UploadConfig{
+//	    MaxSize:    1 << 30,
+//	    CreateDirs: true,
+//	})
+//	srv.STATIC("/var/www/artifacts", "/artifacts")
+func (r *router) UPLOAD(urlPrefix string, folder string, config UploadConfig) {
+	urlPrefix = strings.TrimRight(urlPrefix, "/")
+
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultUploadSize
+	}
+
+	if config.FileMode == 0 {
+		config.FileMode = 0644
+	}
+
+	fn := uploadFiles(folder, r.prefix+urlPrefix, config)
+
+	r.POST(urlPrefix+"/", fn)
+	r.PUT(urlPrefix+"/*", fn)
+	r.POST(urlPrefix+"/*", fn)
+}
+
+// uploadFiles writes the files sent in the request into the root folder.
+func uploadFiles(root string, prefix string, config UploadConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clean := path.Clean("/" + r.URL.Path)
+
+		if clean != prefix && !strings.HasPrefix(clean, prefix+"/") {
+			// cleaned path outside the folder; return 404 Not Found
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		rel := clean[len(prefix):]
+
+		if hiddenPath(rel) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+		if r.Method == http.MethodPost && mediaType == "multipart/form-data" {
+			uploadMultipart(w, r, root, prefix, rel, config)
+			return
+		}
+
+		if rel == "" || strings.HasSuffix(r.URL.Path, "/") {
+			http.Error(w, "missing file name", http.StatusBadRequest)
+			return
+		}
+
+		if r.ContentLength > config.MaxSize {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		created, err := saveUpload(root, rel, r.Body, config)
+
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+
+		if !created {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Location", prefix+rel)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(prefix + rel + "\n"))
+	}
+}
+
+// uploadMultipart writes the file parts of a "multipart/form-data" request
+// into the directory, and lists the URL of the new files in the response.
+func uploadMultipart(w http.ResponseWriter, r *http.Request, root string, prefix string, dir string, config UploadConfig) {
+	reader, err := r.MultipartReader()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var created []string
+	var files int
+
+	for {
+		part, err := reader.NextPart()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		name := part.FileName()
+
+		if name == "" {
+			// not a file, ignore the form field.
+			continue
+		}
+
+		// some clients send the full path of the file, keep only the name.
+		name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+		if name == "/" || strings.HasPrefix(name, ".") {
+			http.Error(w, "invalid file name "+name, http.StatusBadRequest)
+			return
+		}
+
+		files++
+
+		rel := path.Join("/", dir, name)
+		isNew, err := saveUpload(root, rel, part, config)
+
+		if err != nil {
+			uploadError(w, err)
+			return
+		}
+
+		if isNew {
+			created = append(created, prefix+rel)
+		}
+	}
+
+	if files == 0 {
+		http.Error(w, "missing file", http.StatusBadRequest)
+		return
+	}
+
+	if len(created) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Location", created[0])
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(strings.Join(created, "\n") + "\n"))
+}
+
+// saveUpload writes the body into the file at the relative path inside the
+// root folder, and reports whether the file is new.
+func saveUpload(root string, rel string, body io.Reader, config UploadConfig) (bool, error) {
+	dst := filepath.Join(root, filepath.FromSlash(rel))
+	dir := filepath.Dir(dst)
+
+	if config.CreateDirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return false, err
+		}
+	}
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return false, errUploadNoDir
+	}
+
+	info, err := os.Stat(dst)
+	exists := err == nil
+
+	if exists && (info.IsDir() || !config.Overwrite) {
+		return false, errUploadExists
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+
+	if err != nil {
+		return false, err
+	}
+
+	// after the rename or the link, only the temporary name is removed.
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, io.LimitReader(body, config.MaxSize+1))
+
+	if err == nil && n > config.MaxSize {
+		err = errUploadTooLarge
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), config.FileMode)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if config.Overwrite {
+		return !exists, os.Rename(tmp.Name(), dst)
+	}
+
+	// unlike rename, link fails if another upload created the file meanwhile.
+	if err := os.Link(tmp.Name(), dst); err != nil {
+		if os.IsExist(err) {
+			return false, errUploadExists
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// uploadError responds with the status code that corresponds to the error.
+func uploadError(w http.ResponseWriter, err error) {
+	switch err {
+	case errUploadTooLarge:
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+	case errUploadExists, errUploadNoDir:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// hiddenPath reports whether any segment of the path starts with a dot.
+func hiddenPath(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// URL returns the path of the route registered with the name, see Route.Name,
+// replacing the named parameters with the values in params, which are
+// escaped. The value of the name of the wildcard, like "filepath" in
+// "/files/*filepath", or of the "*" key, if any, replaces the wildcard at the
+// end of the pattern without escaping, so it can contain slashes. The function
+// returns an error if the route does not exist or a parameter is missing.
+//
+// Example:
+//
+//	srv.GET("/users/:id", showUser).Name("users.show")
+//	path, _ := srv.URL("users.show", map[string]string{"id": "42"}) // "/users/42"
+func (m *Middleware) URL(name string, params map[string]string) (string, error) {
+	pattern := m.namedPattern(name)
+
+	if pattern == "" {
+		return "", errors.New("middleware: unknown route " + name)
+	}
+
+	var buf strings.Builder
+
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == nps && pattern[i-1] == sep:
+			j := i + 1
+
+			for j < len(pattern) && pattern[j] != sep {
+				j++
+			}
+
+			param, _ := splitParam(pattern[i+1 : j])
+			value, ok := params[param]
+
+			if !ok || value == "" {
+				return "", errors.New("middleware: missing parameter " + param + " for route " + name)
+			}
+
+			buf.WriteString(url.PathEscape(value))
+			i = j - 1
+		case pattern[i] == all && pattern[i-1] == sep:
+			value, ok := params[pattern[i+1:]]
+
+			if !ok {
+				value = params["*"]
+			}
+
+			buf.WriteString(strings.TrimPrefix(value, "/"))
+			i = len(pattern)
+		default:
+			buf.WriteByte(pattern[i])
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// AbsoluteURL acts like URL, but returns an absolute URL using the scheme and
+// host of the request, which respect the values reported by trusted proxies,
+// so the links point to the public address of the web server.
+func (m *Middleware) AbsoluteURL(r *http.Request, name string, params map[string]string) (string, error) {
+	path, err := m.URL(name, params)
+
+	if err != nil {
+		return "", err
+	}
+
+	return Scheme(r) + "://" + RequestHost(r) + path, nil
+}
+
+// namedPattern returns the pattern of the route with the name, if any.
+func (m *Middleware) namedPattern(name string) string {
+	for _, info := range m.Routes() {
+		if info.Name == name {
+			return info.Pattern
+		}
+	}
+
+	return ""
+}
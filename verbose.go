@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// responseKey is the key for the writer created by the router in the request
+// Context, which lets the functions that only receive the request modify the
+// access log entry.
+var responseKey = contextKey("MiddlewareResponse")
+
+// VerboseLog flags the request as verbose, so the access log entry sent to the
+// Logger includes extra detail about it: all the request headers, instead of
+// only the ones in Middleware.LogHeaders, the response headers, the route
+// parameters, and the notes recorded with LogNote. This is useful to debug a
+// specific client in production without increasing the size of every entry.
+//
+// The function can be called at any time before the handler returns, either by
+// a middleware or by the handler itself, and does nothing if the request was
+// not dispatched by the router.
+//
+// Example:
+//
+//	srv.Use(func(next http.Handler) http.Handler {
+//	    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//	        if middleware.ClientIP(r) == "203.0.113.7" {
+//	            middleware.VerboseLog(r)
+//	        }
+//	        next.ServeHTTP(w, r)
+//	    })
+//	})
+func VerboseLog(r *http.Request) {
+	if rw, ok := r.Context().Value(responseKey).(*response); ok {
+		rw.verbose = true
+	}
+}
+
+// LogNote records a note about the request, which is attached to the access
+// log entry in AccessLog.Notes if the request is verbose. See VerboseLog. The
+// notes are discarded otherwise, so the handlers can leave them in the code
+// with no effect on the regular entries. The arguments are formatted as in
+// fmt.Sprintf.
+//
+// Example:
+//
+//	middleware.LogNote(r, "cache miss for %s", key)
+func LogNote(r *http.Request, format string, a ...interface{}) {
+	if rw, ok := r.Context().Value(responseKey).(*response); ok {
+		rw.notes = append(rw.notes, fmt.Sprintf(format, a...))
+	}
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Watchdog periodically samples the number of goroutines, the heap size, and
+// the number of in-flight requests, and raises an alert when one of them goes
+// over the threshold, which helps to catch handlers that leak goroutines or
+// memory in long-running servers. Thresholds equal to zero are ignored.
+type Watchdog struct {
+	// Interval is the time between samples. Default: 10s
+	Interval time.Duration
+	// MaxGoroutines is the maximum number of goroutines.
+	MaxGoroutines int
+	// MaxHeapBytes is the maximum number of bytes of allocated heap objects.
+	MaxHeapBytes uint64
+	// MaxInFlight is the maximum number of requests being handled at once.
+	// Setting this threshold enables the in-flight request tracking.
+	MaxInFlight int
+	// OnAlert is called with the sample and the list of exceeded thresholds.
+	// If nil, the alert is written into the error log.
+	OnAlert func(sample WatchdogSample, exceeded []string)
+}
+
+// WatchdogSample is a snapshot of the resources used by the program.
+type WatchdogSample struct {
+	Time       time.Time
+	Goroutines int
+	HeapBytes  uint64
+	InFlight   int
+}
+
+// StartWatchdog starts sampling the resources used by the program in the
+// background and returns a function to stop it.
+//
+// Example:
+//
+//	stop := srv.StartWatchdog(middleware.Watchdog{MaxGoroutines: 10000})
+//	defer stop()
+func (m *Middleware) StartWatchdog(wd Watchdog) func() {
+	if wd.Interval <= 0 {
+		wd.Interval = time.Second * 10
+	}
+
+	if wd.MaxInFlight > 0 {
+		m.EnableInFlight()
+	}
+
+	if wd.OnAlert == nil {
+		wd.OnAlert = func(s WatchdogSample, exceeded []string) {
+			m.logf("watchdog: exceeded %s (goroutines=%d, heap=%d, inflight=%d)",
+				strings.Join(exceeded, ", "), s.Goroutines, s.HeapBytes, s.InFlight)
+		}
+	}
+
+	done := make(chan struct{})
+	ticker := time.NewTicker(wd.Interval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				m.checkWatchdog(wd)
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// checkWatchdog takes a sample and raises an alert if necessary.
+func (m *Middleware) checkWatchdog(wd Watchdog) {
+	var mem runtime.MemStats
+	var exceeded []string
+
+	runtime.ReadMemStats(&mem)
+
+	s := WatchdogSample{
+		Time:       time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  mem.HeapAlloc,
+		InFlight:   len(m.InFlight()),
+	}
+
+	if wd.MaxGoroutines > 0 && s.Goroutines > wd.MaxGoroutines {
+		exceeded = append(exceeded, "goroutines>"+strconv.Itoa(wd.MaxGoroutines))
+	}
+
+	if wd.MaxHeapBytes > 0 && s.HeapBytes > wd.MaxHeapBytes {
+		exceeded = append(exceeded, "heap>"+strconv.FormatUint(wd.MaxHeapBytes, 10))
+	}
+
+	if wd.MaxInFlight > 0 && s.InFlight > wd.MaxInFlight {
+		exceeded = append(exceeded, "inflight>"+strconv.Itoa(wd.MaxInFlight))
+	}
+
+	if len(exceeded) > 0 {
+		wd.OnAlert(s, exceeded)
+	}
+}
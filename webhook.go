@@ -0,0 +1,204 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errWebhookSignature is returned when the signature of a webhook is invalid.
+var errWebhookSignature = errors.New("middleware: invalid webhook signature")
+
+// errWebhookTimestamp is returned when the timestamp of a webhook is outside
+// the tolerance window, which protects the endpoint against replay attacks.
+var errWebhookTimestamp = errors.New("middleware: webhook timestamp outside tolerance")
+
+// Webhook verifies the HMAC signature of the requests sent by a webhook
+// provider. Use GitHubWebhook, StripeWebhook or SlackWebhook to create one.
+type Webhook struct {
+	// MaxBodySize is the maximum size of the request body. Default: 1 MiB
+	MaxBodySize int64
+	// Tolerance is the maximum age of the timestamp included in the signature
+	// by some providers, like Stripe and Slack. Default: 5 minutes
+	Tolerance time.Duration
+
+	secret []byte
+	verify func(wh *Webhook, h http.Header, body []byte) error
+}
+
+// GitHubWebhook verifies the "X-Hub-Signature-256" header sent by GitHub.
+func GitHubWebhook(secret string) *Webhook {
+	return &Webhook{secret: []byte(secret), verify: verifyGitHub}
+}
+
+// StripeWebhook verifies the "Stripe-Signature" header sent by Stripe.
+func StripeWebhook(secret string) *Webhook {
+	return &Webhook{secret: []byte(secret), verify: verifyStripe}
+}
+
+// SlackWebhook verifies the "X-Slack-Signature" header sent by Slack.
+func SlackWebhook(secret string) *Webhook {
+	return &Webhook{secret: []byte(secret), verify: verifySlack}
+}
+
+// WEBHOOK registers a webhook endpoint for the default host.
+func (m *Middleware) WEBHOOK(endpoint string, wh *Webhook, fn http.HandlerFunc) {
+	m.defaultRouter.WEBHOOK(endpoint, wh, fn)
+}
+
+// WEBHOOK registers a POST endpoint that verifies the signature of the request
+// before calling the handler. Requests with a missing or invalid signature, or
+// with an expired timestamp, receive a "401 Unauthorized" response, and those
+// with a body larger than MaxBodySize receive a "413 Request Entity Too Large"
+// response. The handler can read the original request body, byte for byte.
+//
+// Example:
+//
+//	srv.WEBHOOK("/hooks/github", middleware.GitHubWebhook(secret), func(w http.ResponseWriter, r *http.Request) {
+//	    var event PushEvent
+//	    _ = json.NewDecoder(r.Body).Decode(&event)
+//	    […]
+//	})
+func (r *router) WEBHOOK(endpoint string, wh *Webhook, fn http.HandlerFunc) {
+	r.POST(endpoint, func(w http.ResponseWriter, r *http.Request) {
+		limit := wh.MaxBodySize
+
+		if limit <= 0 {
+			limit = 1 << 20
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if int64(len(body)) > limit {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if wh.verify == nil {
+			// A webhook without a provider cannot verify anything.
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if err := wh.verify(wh, r.Header, body); err != nil {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fn(w, r)
+	})
+}
+
+// sign returns the hexadecimal HMAC-SHA256 of the parts using the secret.
+func (wh *Webhook) sign(parts ...[]byte) string {
+	mac := hmac.New(sha256.New, wh.secret)
+
+	for _, part := range parts {
+		_, _ = mac.Write(part)
+	}
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkTimestamp returns an error if the Unix timestamp is outside tolerance.
+func (wh *Webhook) checkTimestamp(value string) error {
+	sec, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil {
+		return errWebhookTimestamp
+	}
+
+	tolerance := wh.Tolerance
+
+	if tolerance <= 0 {
+		tolerance = 5 * time.Minute
+	}
+
+	age := time.Since(time.Unix(sec, 0))
+
+	if age > tolerance || age < -tolerance {
+		return errWebhookTimestamp
+	}
+
+	return nil
+}
+
+// verifyGitHub checks the header "X-Hub-Signature-256: sha256=<hex>".
+func verifyGitHub(wh *Webhook, h http.Header, body []byte) error {
+	signature := strings.TrimPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+
+	if !hmac.Equal([]byte(signature), []byte(wh.sign(body))) {
+		return errWebhookSignature
+	}
+
+	return nil
+}
+
+// verifyStripe checks the header "Stripe-Signature: t=<unix>,v1=<hex>", which
+// may include more than one v1 signature while the secret is being rolled.
+func verifyStripe(wh *Webhook, h http.Header, body []byte) error {
+	var timestamp string
+	var signatures []string
+
+	for _, item := range strings.Split(h.Get("Stripe-Signature"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	if err := wh.checkTimestamp(timestamp); err != nil {
+		return err
+	}
+
+	expected := []byte(wh.sign([]byte(timestamp), []byte("."), body))
+
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), expected) {
+			return nil
+		}
+	}
+
+	return errWebhookSignature
+}
+
+// verifySlack checks the headers "X-Slack-Request-Timestamp: <unix>" and
+// "X-Slack-Signature: v0=<hex>".
+func verifySlack(wh *Webhook, h http.Header, body []byte) error {
+	timestamp := h.Get("X-Slack-Request-Timestamp")
+
+	if err := wh.checkTimestamp(timestamp); err != nil {
+		return err
+	}
+
+	signature := strings.TrimPrefix(h.Get("X-Slack-Signature"), "v0=")
+	expected := wh.sign([]byte("v0:"), []byte(timestamp), []byte(":"), body)
+
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errWebhookSignature
+	}
+
+	return nil
+}
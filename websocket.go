@@ -0,0 +1,362 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket message types, as defined in RFC 6455, section 11.8.
+const (
+	continuationFrame = 0
+	TextMessage       = 1
+	BinaryMessage     = 2
+	closeMessage      = 8
+	pingMessage       = 9
+	pongMessage       = 10
+)
+
+// websocketGUID is concatenated with the client key to compute the handshake.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ErrMessageTooLarge is returned when a WebSocket message exceeds the limit.
+var ErrMessageTooLarge = errors.New("middleware: websocket message too large")
+
+// errUnmaskedFrame is returned when the client sends a frame without a mask,
+// which RFC 6455, section 5.1, forbids.
+var errUnmaskedFrame = errors.New("middleware: unmasked websocket frame")
+
+// errProtocol is returned when the client sends a frame that RFC 6455,
+// sections 5.2 to 5.5, forbids, like a reserved opcode or a fragmented control
+// frame.
+var errProtocol = errors.New("middleware: websocket protocol error")
+
+// closeProtocolError is the payload of the close frame with the status code
+// 1002, protocol error, as defined in RFC 6455, section 7.4.1.
+var closeProtocolError = []byte{0x03, 0xea}
+
+// closeMessageTooBig is the payload of the close frame with the status code
+// 1009, message too big, as defined in RFC 6455, section 7.4.1.
+var closeMessageTooBig = []byte{0x03, 0xf1}
+
+// shutdownKey is the key for the shutdown channel in the request Context.
+var shutdownKey = contextKey("MiddlewareShutdown")
+
+// WebSocket is a minimal implementation of a server-side WebSocket connection
+// as defined in RFC 6455. It supports text and binary messages, fragmented
+// messages, and answers ping and close control frames automatically.
+//
+// The connection is not affected by Middleware.WriteTimeout, and it is closed
+// when the server shuts down, which also cancels the connection context.
+type WebSocket struct {
+	// Request is the HTTP request that initiated the connection.
+	Request *http.Request
+	// MaxMessageSize is the maximum size of a message. Default: 16 MiB
+	MaxMessageSize int64
+
+	conn   net.Conn
+	buf    *bufio.ReadWriter
+	ctx    context.Context
+	cancel context.CancelFunc
+	mu     sync.Mutex
+}
+
+// WEBSOCKET registers an endpoint that upgrades the connection to WebSocket.
+func (m *Middleware) WEBSOCKET(endpoint string, fn func(*WebSocket)) {
+	m.defaultRouter.WEBSOCKET(endpoint, fn)
+}
+
+// WEBSOCKET registers an endpoint that upgrades the connection to WebSocket
+// and then calls the function with the connection, which is closed when the
+// function returns. Requests that are not valid WebSocket handshakes receive
+// a "400 Bad Request" response.
+//
+// Example:
+//
+//	srv.WEBSOCKET("/echo", func(ws *middleware.WebSocket) {
+//	    for {
+//	        kind, data, err := ws.ReadMessage()
+//	        if err != nil {
+//	            return
+//	        }
+//	        _ = ws.WriteMessage(kind, data)
+//	    }
+//	})
+func (r *router) WEBSOCKET(endpoint string, fn func(*WebSocket)) {
+	r.GET(endpoint, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgradeWebSocket(w, r)
+
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		defer ws.Close()
+
+		fn(ws)
+	})
+}
+
+// upgradeWebSocket validates the handshake and takes over the connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		return nil, errors.New("invalid websocket handshake")
+	}
+
+	h, ok := w.(http.Hijacker)
+
+	if !ok {
+		return nil, http.ErrNotSupported
+	}
+
+	conn, buf, err := h.Hijack()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the deadlines set by the server timeouts.
+	_ = conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+
+	buf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	buf.WriteString("Upgrade: websocket\r\n")
+	buf.WriteString("Connection: Upgrade\r\n")
+	buf.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ws := &WebSocket{
+		Request:        r,
+		MaxMessageSize: 16 << 20,
+		conn:           conn,
+		buf:            buf,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	shutdown, _ := r.Context().Value(shutdownKey).(chan struct{})
+
+	go func() {
+		select {
+		case <-shutdown:
+			ws.Close()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ws, nil
+}
+
+// headerContains reports whether a comma-separated header contains the token.
+func headerContains(h http.Header, key string, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Context returns a context that is cancelled when the connection is closed,
+// either by the handler, the client, or the server shutdown.
+func (ws *WebSocket) Context() context.Context {
+	return ws.ctx
+}
+
+// Close closes the connection and cancels its context.
+func (ws *WebSocket) Close() error {
+	ws.cancel()
+	return ws.conn.Close()
+}
+
+// ReadMessage returns the type and content of the next data message. Ping
+// frames are answered with a pong, and close frames are answered with a close
+// frame, in which case the function returns io.EOF. Frames that violate the
+// protocol close the connection with the status code 1002, and messages over
+// MaxMessageSize with the status code 1009.
+func (ws *WebSocket) ReadMessage() (int, []byte, error) {
+	var kind int
+	var message []byte
+
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+
+		if err != nil {
+			ws.cancel()
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case pingMessage:
+			if err := ws.writeFrame(pongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case pongMessage:
+			continue
+		case closeMessage:
+			_ = ws.writeFrame(closeMessage, payload)
+			ws.cancel()
+			return 0, nil, io.EOF
+		case TextMessage, BinaryMessage:
+			if kind != 0 {
+				// a new message cannot start before the previous one ends.
+				return 0, nil, ws.fail(closeProtocolError, errProtocol)
+			}
+			kind = opcode
+		case continuationFrame:
+			if kind == 0 {
+				// there is no fragmented message to continue.
+				return 0, nil, ws.fail(closeProtocolError, errProtocol)
+			}
+		}
+
+		message = append(message, payload...)
+
+		if int64(len(message)) > ws.MaxMessageSize {
+			return 0, nil, ws.fail(closeMessageTooBig, ErrMessageTooLarge)
+		}
+
+		if fin {
+			return kind, message, nil
+		}
+	}
+}
+
+// readFrame reads and unmasks a single frame sent by the client. The
+// connection is closed with a protocol error if the frame is not masked, has
+// a reserved bit or opcode, or is a fragmented or long control frame.
+func (ws *WebSocket) readFrame() (bool, int, []byte, error) {
+	var head [2]byte
+
+	if _, err := io.ReadFull(ws.buf, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	opcode := int(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	length := int64(head[1] & 0x7f)
+
+	if !masked {
+		return false, 0, nil, ws.fail(closeProtocolError, errUnmaskedFrame)
+	}
+
+	if head[0]&0x70 != 0 {
+		// no extension was negotiated, so the RSV bits must be zero.
+		return false, 0, nil, ws.fail(closeProtocolError, errProtocol)
+	}
+
+	switch opcode {
+	case continuationFrame, TextMessage, BinaryMessage:
+	case closeMessage, pingMessage, pongMessage:
+		if !fin || length > 125 {
+			return false, 0, nil, ws.fail(closeProtocolError, errProtocol)
+		}
+	default:
+		return false, 0, nil, ws.fail(closeProtocolError, errProtocol)
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.buf, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.buf, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	if length < 0 || length > ws.MaxMessageSize {
+		return false, 0, nil, ws.fail(closeMessageTooBig, ErrMessageTooLarge)
+	}
+
+	var mask [4]byte
+
+	if _, err := io.ReadFull(ws.buf, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+
+	if _, err := io.ReadFull(ws.buf, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// fail sends a close frame with the status code and closes the connection,
+// then returns the error.
+func (ws *WebSocket) fail(status []byte, err error) error {
+	_ = ws.writeFrame(closeMessage, status)
+	_ = ws.Close()
+	return err
+}
+
+// WriteMessage sends a text or binary message to the client. It is safe to
+// call the function from multiple goroutines.
+func (ws *WebSocket) WriteMessage(kind int, data []byte) error {
+	return ws.writeFrame(kind, data)
+}
+
+// writeFrame sends a single unmasked frame to the client.
+func (ws *WebSocket) writeFrame(opcode int, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	head := []byte{0x80 | byte(opcode)}
+
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xffff:
+		head = append(head, 126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		head = append(append(head, 127), ext[:]...)
+	}
+
+	if _, err := ws.buf.Write(head); err != nil {
+		return err
+	}
+
+	if _, err := ws.buf.Write(payload); err != nil {
+		return err
+	}
+
+	return ws.buf.Flush()
+}
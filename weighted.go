@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+)
+
+// Variant is one of the handlers of a route with weighted routing.
+type Variant struct {
+	// Name identifies the variant in the access logs, e.g. "stable" or "canary".
+	Name string
+	// Weight is the share of the traffic relative to the other variants.
+	Weight int
+	// Handler processes the requests assigned to the variant.
+	Handler http.HandlerFunc
+}
+
+// Weighted returns an HTTP handler that splits the traffic of a route between
+// multiple variants according to their weights, which is useful to release a
+// new version of an endpoint, a canary, to a small number of clients. The name
+// of the selected variant is recorded in AccessLog.Variant.
+//
+// If sticky is not nil, the variant is selected using the hash of the value it
+// returns, so the same client always receives the same variant. Requests with
+// an empty sticky key are assigned randomly. Use StickyCookie or StickyHeader
+// to build the function.
+//
+// The function panics if the total weight is not positive.
+//
+// Example:
+//
+//	srv.GET("/checkout", middleware.Weighted(middleware.StickyCookie("session"),
+//	    middleware.Variant{Name: "stable", Weight: 90, Handler: checkoutV1},
+//	    middleware.Variant{Name: "canary", Weight: 10, Handler: checkoutV2},
+//	))
+func Weighted(sticky func(*http.Request) string, variants ...Variant) http.HandlerFunc {
+	var total int
+
+	for _, variant := range variants {
+		if variant.Weight < 0 {
+			panic("middleware: negative weight for variant " + variant.Name)
+		}
+
+		total += variant.Weight
+	}
+
+	if total <= 0 {
+		panic("middleware: weighted route without weight")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var n int
+
+		if key := stickyKey(sticky, r); key != "" {
+			h := fnv.New32a()
+			_, _ = h.Write([]byte(key))
+			n = int(h.Sum32() % uint32(total))
+		} else {
+			n = rand.Intn(total)
+		}
+
+		for _, variant := range variants {
+			if n < variant.Weight {
+				if rw := findResponse(w); rw != nil {
+					rw.variant = variant.Name
+				}
+
+				variant.Handler(w, r)
+				return
+			}
+
+			n -= variant.Weight
+		}
+	}
+}
+
+// stickyKey returns the sticky key of the request, if any.
+func stickyKey(sticky func(*http.Request) string, r *http.Request) string {
+	if sticky == nil {
+		return ""
+	}
+
+	return sticky(r)
+}
+
+// StickyCookie returns a function that uses the value of a cookie as the key
+// to assign a variant in weighted routes.
+func StickyCookie(name string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		cookie, err := r.Cookie(name)
+
+		if err != nil {
+			return ""
+		}
+
+		return cookie.Value
+	}
+}
+
+// StickyHeader returns a function that uses the value of a request header as
+// the key to assign a variant in weighted routes.
+func StickyHeader(name string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}